@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigAllows(t *testing.T) {
+	c := Config{Groups: map[string][]string{"ops": {"bob", "erin"}}}
+	tests := []struct {
+		authorized []string
+		name       string
+		want       bool
+	}{
+		{[]string{"*"}, "anyone", true},
+		{[]string{"alice"}, "alice", true},
+		{[]string{"alice"}, "bob", false},
+		{[]string{"@ops"}, "erin", true},
+		{[]string{"@ops"}, "alice", false},
+		{[]string{"@missing"}, "bob", false},
+		// A group is not a username.
+		{[]string{"ops"}, "bob", false},
+		{nil, "alice", false},
+	}
+	for _, tt := range tests {
+		if got := c.Allows(&Target{Authorized: tt.authorized}, tt.name); got != tt.want {
+			t.Errorf("Allows(%v, %s) = %v, want %v", tt.authorized, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEffectiveAuthorized(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(keys, []byte("sigA alice\nsigB bob\nsigC carol\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		AuthorizedKeys: keys,
+		Groups:         map[string][]string{"ops": {"bob", "erin"}},
+	}
+	tests := []struct {
+		authorized []string
+		want       []string
+	}{
+		{[]string{"*"}, []string{"alice", "bob", "carol"}},
+		// Names and group members without a key are listed too.
+		{[]string{"@ops", "dave"}, []string{"bob", "dave", "erin"}},
+		{[]string{"*", "@ops"}, []string{"alice", "bob", "carol", "erin"}},
+		{[]string{"carol", "carol"}, []string{"carol"}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := c.EffectiveAuthorized(&Target{Authorized: tt.authorized})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EffectiveAuthorized(%v) = %v, want %v", tt.authorized, got, tt.want)
+		}
+	}
+}
+
+func TestWho(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Groups = map[string][]string{"ops": {"erin"}}
+		c.Targets[0].Authorized = []string{"tester", "@ops"}
+	})
+	names, err := HandleClientConnWho(d.Dial(t), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"erin", "tester"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("WHO listed %v, want %v", names, want)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(keys, []byte("sigA alice\nsigB bob\nsigC carol\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		AuthorizedKeys: keys,
+		Groups:         map[string][]string{"ops": {"bob", "erin"}},
+		Targets: []Target{
+			{Name: "web", Authorized: []string{"alice", "dave"}},
+			{Name: "api", Authorized: []string{"@ops"}},
+			// "*" references nobody in particular.
+			{Name: "docs", Authorized: []string{"*"}},
+		},
+	}
+	report, err := c.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"carol"}; !reflect.DeepEqual(report.Unreferenced, want) {
+		t.Errorf("unreferenced %v, want %v", report.Unreferenced, want)
+	}
+	if want := map[string][]string{"web": {"dave"}, "api": {"erin"}}; !reflect.DeepEqual(report.Unknown, want) {
+		t.Errorf("unknown %v, want %v", report.Unknown, want)
+	}
+	if report.Ok() {
+		t.Error("a report with mismatches is Ok")
+	}
+
+	c.Targets = []Target{{Name: "web", Authorized: []string{"alice", "@ops", "carol"}}}
+	c.Groups["ops"] = []string{"bob"}
+	if report, err := c.Audit(); err != nil || !report.Ok() {
+		t.Errorf("a matching config reported %+v: %v", report, err)
+	}
+}
+
+func TestWhoRefusals(t *testing.T) {
+	for _, generic := range []bool{false, true} {
+		d := newTestDaemon(t, func(c *Config) {
+			c.GenericAuthErrors = generic
+			c.Targets = append(c.Targets, Target{Name: "secret", Filename: filepath.Join(filepath.Dir(c.Targets[0].Filename), "secret"), Authorized: []string{"someone"}})
+		})
+		tests := []struct {
+			name, target string
+			code         int
+			msg          string
+		}{
+			{"nonexistent", "missing", StatusNotExist, "The target missing does not exist."},
+			{"not permitted", "secret", StatusBlocked, MsgNotPermitted},
+		}
+		if generic {
+			// Nothing tells a missing target from a forbidden one.
+			tests[0].code, tests[0].msg = StatusBlocked, MsgDenied
+			tests[1].msg = MsgDenied
+		}
+		for _, tt := range tests {
+			names, err := HandleClientConnWho(d.Dial(t), tt.target)
+			var rse *RemoteStatusError
+			if !errors.As(err, &rse) || rse.Code != tt.code || rse.Message != tt.msg {
+				t.Errorf("generic %v, %s: WHO gave %v, %v, want %d %q", generic, tt.name, names, err, tt.code, tt.msg)
+			}
+		}
+
+		cert, err := GenerateKeyPair("stranger", time.Hour, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.client = &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+		want := MsgNotAccepted
+		if generic {
+			want = MsgDenied
+		}
+		var rse *RemoteStatusError
+		if _, err := HandleClientConnWho(d.Dial(t), "app"); !errors.As(err, &rse) || rse.Code != StatusBlocked || rse.Message != want {
+			t.Errorf("generic %v: WHO by an unknown signature gave %v, want %q", generic, err, want)
+		}
+	}
+}
+
+func TestRunsScripts(t *testing.T) {
+	c := Config{Groups: map[string][]string{"ops": {"erin"}}}
+	tests := []struct {
+		scripts []string
+		name    string
+		want    bool
+	}{
+		// Unset leaves it to Authorized.
+		{nil, "alice", true},
+		{[]string{}, "alice", false},
+		{[]string{"alice"}, "alice", true},
+		{[]string{"alice"}, "bob", false},
+		{[]string{"@ops"}, "erin", true},
+		{[]string{"*"}, "bob", true},
+	}
+	for _, tt := range tests {
+		if got := c.RunsScripts(&Target{ScriptAuthorized: tt.scripts}, tt.name); got != tt.want {
+			t.Errorf("RunsScripts(%v, %s) = %v, want %v", tt.scripts, tt.name, got, tt.want)
+		}
+	}
+
+	target := &Target{Name: "app", Before: "b", PreBackup: "p", After: "a", Verify: "v", Cleanup: "c", Authorized: []string{"alice"}}
+	stripped := target.WithoutScripts()
+	if !target.HasScripts() || stripped.HasScripts() {
+		t.Errorf("HasScripts is %v with scripts and %v without", target.HasScripts(), stripped.HasScripts())
+	}
+	if target.After != "a" || stripped.Name != "app" || len(stripped.Authorized) != 1 {
+		t.Errorf("WithoutScripts changed more than the scripts: %+v, %+v", target, stripped)
+	}
+	if (&Target{After: " \n"}).HasScripts() {
+		t.Error("a blank After counts as a script")
+	}
+}
+
+func TestScriptAuthorized(t *testing.T) {
+	after, runs := flakyScript(t, 0)
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].After = after
+		c.Targets[0].ScriptAuthorized = []string{"someone"}
+		c.KeepBackups = 2
+	})
+	info, err := HandleClientConnPingTarget(d.Dial(t), "app")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Access != AccessAuthorized || !info.NoScripts {
+		t.Errorf("ping reported %+v, want authorized without scripts", info)
+	}
+
+	// Only the files are deployed and rolled back.
+	for _, v := range []string{"1", "2"} {
+		if err := d.Deploy(t, map[string]string{"version": v}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != v {
+			t.Errorf("version holds %q, want %s", got, v)
+		}
+	}
+	nextBackupSecond()
+	if err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: "0"}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q after the rollback", got)
+	}
+	if n := runs(); n != 0 {
+		t.Errorf("After ran %d times for a user not in ScriptAuthorized", n)
+	}
+
+	d.Target().ScriptAuthorized = []string{"tester"}
+	if info, err := HandleClientConnPingTarget(d.Dial(t), "app"); err != nil {
+		t.Fatal(err)
+	} else if info.Access != AccessAuthorized || info.NoScripts {
+		t.Errorf("ping reported %+v, want authorized with scripts", info)
+	}
+	nextBackupSecond()
+	if err := d.Deploy(t, map[string]string{"version": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("After ran %d times for a user in ScriptAuthorized, want 1", n)
+	}
+}
+
+// Backups are named by the second, waits for the next so the following backup
+// doesn't collide with the last one.
+func nextBackupSecond() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
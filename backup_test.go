@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedBackupRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "app")
+	writeFiles(t, target, map[string]string{
+		"version":      "1",
+		"conf/app.ini": "debug = false",
+	})
+	if err := os.Symlink("conf/app.ini", filepath.Join(target, "app.ini")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/nonexistent", filepath.Join(target, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := filepath.Join(dir, "app"+CompressedBackupSuffix)
+	if err := CompressBackup(target, backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup(backup, target, RenameRetry{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(target, "app.ini")); got != "debug = false" {
+		t.Errorf("app.ini reads %q through the restored link", got)
+	}
+	for name, want := range map[string]string{"app.ini": "conf/app.ini", "dangling": "/nonexistent"} {
+		if link, err := os.Readlink(filepath.Join(target, name)); err != nil || link != want {
+			t.Errorf("%s links to %q (%v), want %q", name, link, err, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(target, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("the backup was kept after restoring: %v", err)
+	}
+}
+
+// Deploys the files as the test target, asking the daemon to skip the backup.
+func (d *testDaemon) DeployNoBackup(t *testing.T, files map[string]string) error {
+	t.Helper()
+	if err := os.RemoveAll(d.Src); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, d.Src, files)
+	req := DeployRequest{Target: "app", ID: NewDeployID(), NoBackup: true}
+	_, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{})
+	return err
+}
+
+func TestDeploySkipBackup(t *testing.T) {
+	tests := []struct {
+		name       string
+		skip       bool
+		allow      bool
+		noBackup   bool
+		wantBackup bool
+	}{
+		{"backed up", false, false, false, true},
+		{"SkipBackup", true, false, false, false},
+		{"-no-backup not allowed", false, false, true, true},
+		{"-no-backup allowed", false, true, true, false},
+	}
+	for _, tt := range tests {
+		d := newTestDaemon(t, func(c *Config) {
+			c.KeepBackups = 1
+			c.Targets[0].SkipBackup = tt.skip
+			c.Targets[0].AllowNoBackup = tt.allow
+		})
+		deploy := d.Deploy
+		if tt.noBackup {
+			deploy = d.DeployNoBackup
+		}
+		for _, v := range []string{"1", "2"} {
+			if err := deploy(t, map[string]string{"version": v}); err != nil {
+				t.Fatalf("%s: deploy of version %s: %v", tt.name, v, err)
+			}
+		}
+		backups, err := ListBackups(d.Config.BackupDirectory, d.Target().Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(backups) > 0; got != tt.wantBackup {
+			t.Errorf("%s: backups %v, want a backup %v", tt.name, backups, tt.wantBackup)
+		}
+	}
+}
+
+func TestNoBackupRollback(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Targets[0].SkipBackup = true })
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = "false"
+	err := d.Deploy(t, map[string]string{"version": "2"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "No backup was taken so nothing was restored") {
+		t.Fatalf("got %v, want a reply that nothing was restored", err)
+	}
+	// Nothing to restore from, the new files stay.
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("version holds %q", got)
+	}
+
+	d.Target().After = ""
+	var out bytes.Buffer
+	err = HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: "1"}, &out)
+	if !errors.As(err, &rse) || rse.Code != StatusNotExist {
+		t.Errorf("rollback without backups: got %v, want StatusNotExist", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("after the rollback version holds %q", got)
+	}
+}
+
+func TestFailedRestoreKeepsFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the script is a shell script")
+	}
+	d := newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The backup is gone by the time it is restored.
+	script := filepath.Join(t.TempDir(), "after.sh")
+	body := fmt.Sprintf("#!/bin/sh\nrm -rf %s/*\nexit 1\n", d.Config.BackupDirectory)
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = script
+	err := d.Deploy(t, map[string]string{"version": "2"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "Restoring from backup failed") {
+		t.Fatalf("got %v, want a reply that the restore failed", err)
+	}
+	// Rather than nothing, the failed files are put back.
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("version holds %q", got)
+	}
+	xs, err := ioutil.ReadDir(filepath.Dir(d.Target().Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range xs {
+		if strings.Contains(x.Name(), ".aside-") {
+			t.Errorf("left %s behind", x.Name())
+		}
+	}
+}
+
+func TestSetAside(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "app")
+	if aside, err := SetAside(fn, RenameRetry{}); err != nil || aside != "" {
+		t.Errorf("setting aside nothing gave %q, %v", aside, err)
+	}
+	writeFiles(t, fn, map[string]string{"version": "1"})
+	aside, err := SetAside(fn, RenameRetry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(aside) != dir || !strings.HasPrefix(filepath.Base(aside), ".app.aside-") {
+		t.Errorf("set aside as %s", aside)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("the original is still there: %v", err)
+	}
+	if got := readFile(t, filepath.Join(aside, "version")); got != "1" {
+		t.Errorf("the files set aside hold %q", got)
+	}
+}
+
+func TestPreBackupFails(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.KeepBackups = 5 })
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := ListBackups(d.Config.BackupDirectory, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fails its first run only.
+	preBackup, runs := flakyScript(t, 1)
+	d.Target().PreBackup = preBackup
+
+	err = d.Deploy(t, map[string]string{"version": "2"})
+	if err == nil || !strings.Contains(err.Error(), "PreBackup") {
+		t.Fatalf("got %v, want the PreBackup failure", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q after PreBackup failed", got)
+	}
+	if after, _ := ListBackups(d.Config.BackupDirectory, "app"); len(after) != len(backups) {
+		t.Errorf("%d backups after PreBackup failed, want %d", len(after), len(backups))
+	}
+
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("version holds %q", got)
+	}
+	if after, _ := ListBackups(d.Config.BackupDirectory, "app"); len(after) != len(backups)+1 {
+		t.Errorf("%d backups, want %d", len(after), len(backups)+1)
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("PreBackup ran %d times, want 2", n)
+	}
+}
+
+func TestUnusableBackupDirectory(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	blocker := filepath.Join(t.TempDir(), "file")
+	writeFiles(t, filepath.Dir(blocker), map[string]string{"file": "not a directory"})
+	readOnly := filepath.Join(t.TempDir(), "backups")
+	if err := os.Mkdir(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	before, runs := flakyScript(t, 0)
+	d.Target().Before = before
+
+	for _, tt := range []struct {
+		name, dir string
+	}{
+		{"under a file", filepath.Join(blocker, "backups")},
+		{"read-only", readOnly},
+	} {
+		// Root writes to read-only directories all the same.
+		if tt.name == "read-only" && os.Geteuid() == 0 {
+			continue
+		}
+		d.Config.BackupDirectory = tt.dir
+		err := d.Deploy(t, map[string]string{"version": "2"})
+		var rse *RemoteStatusError
+		if !errors.As(err, &rse) || !strings.Contains(rse.Message, "not writable, the target was left untouched") {
+			t.Errorf("%s: deploy gave %v", tt.name, err)
+		}
+		if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+			t.Errorf("%s: version holds %q", tt.name, got)
+		}
+	}
+	if n := runs(); n != 0 {
+		t.Errorf("Before ran %d times", n)
+	}
+}
+
+func TestRenameRetry(t *testing.T) {
+	dir := t.TempDir()
+	// A permanent error is returned at once, not after every attempt.
+	r := RenameRetry{Attempts: 5, Delay: time.Second}
+	start := time.Now()
+	err := r.Rename(filepath.Join(dir, "missing"), filepath.Join(dir, "moved"))
+	if !os.IsNotExist(err) || errors.Is(err, ErrFileInUse) {
+		t.Errorf("renaming a missing file gave %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= r.Delay {
+		t.Errorf("a permanent error was retried, took %s", elapsed)
+	}
+
+	// Zero attempts still tries once.
+	src := filepath.Join(dir, "src")
+	writeFiles(t, src, map[string]string{"version": "1"})
+	if err := (RenameRetry{}).Rename(src, filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "moved", "version")); got != "1" {
+		t.Errorf("version holds %q after the rename", got)
+	}
+}
+
+func TestConfigRenameRetry(t *testing.T) {
+	c := &Config{}
+	if got, want := c.RenameRetry(), (RenameRetry{Attempts: InUseAttempts, Delay: InUseDelay}); got != want {
+		t.Errorf("defaults are %+v, want %+v", got, want)
+	}
+	c.RenameAttempts, c.RenameRetryDelay.Duration = 3, time.Millisecond
+	if got, want := c.RenameRetry(), (RenameRetry{Attempts: 3, Delay: time.Millisecond}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
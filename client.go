@@ -1,37 +1,306 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/tmathews/goio"
 )
 
-func HandleClientConn(conn *tls.Conn, target, filename string, ignored []string) error {
-	if err := conn.Handshake(); err != nil {
-		fmt.Println(err)
+// Where progress messages are printed. Commands producing machine readable
+// output point this at stderr to keep stdout clean.
+var MessageOutput io.Writer = os.Stdout
+
+// Summary of a send, printed by cmdSend when -json is used.
+type SendResult struct {
+	Target    string  `json:"target"`
+	Address   string  `json:"address"`
+	DeployID  string  `json:"deploy_id"`
+	BytesSent int64   `json:"bytes_sent"`
+	Duration  float64 `json:"duration_seconds"`
+	Ok        bool    `json:"ok"`
+	Error     string  `json:"error,omitempty"`
+
+	// The daemon's status code when it refused the deploy, see RemoteStatusError.
+	Status int `json:"status,omitempty"`
+
+	// The username the daemon resolved our signature to, empty when it is too old to
+	// say.
+	Username string `json:"username,omitempty"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// A non-OK status replied by the daemon.
+type RemoteStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *RemoteStatusError) Error() string {
+	return e.Message
+}
+
+// Suggests what to do about the status, or returns an empty string.
+func (e *RemoteStatusError) Guidance() string {
+	switch e.Code {
+	case StatusBlocked:
+		return "Check that your key is authorized for the target, the who command lists who is."
+	case StatusNotExist:
+		return "Check the target name, the daemon's config lists the targets."
+	case StatusUnsupported:
+		return "The daemon may be older than this client, compare versions with ping."
+	}
+	return ""
+}
+
+// The exit code commands use for the status, so scripts can tell an
+// unauthorized deploy from a failed one.
+func (e *RemoteStatusError) ExitCode() int {
+	switch e.Code {
+	case StatusBlocked:
+		return 3
+	case StatusNotExist:
+		return 4
+	case StatusUnsupported:
+		return 5
+	}
+	return 1
+}
+
+// Reads a status like goio.ReadStatus, returning a non-OK status as a
+// RemoteStatusError.
+func ReadStatus(conn io.Reader) error {
+	return remoteStatus(goio.ReadStatus(conn))
+}
+
+// Sends the command like goio.Command, returning a non-OK reply as a
+// RemoteStatusError.
+func SendCommand(conn io.ReadWriter, cmd, input string) error {
+	return remoteStatus(goio.Command(conn, cmd, input))
+}
+
+func remoteStatus(err error) error {
+	var se *goio.StatusError
+	if errors.As(err, &se) {
+		return &RemoteStatusError{Code: se.Status, Message: se.Msg}
+	}
+	return err
+}
+
+// Sends the deploy and returns the number of payload bytes written.
+func HandleClientConn(conn *tls.Conn, req DeployRequest, filename string, opts PackOptions) (int64, error) {
+	return deployPayload(conn, req, func(w io.Writer) error {
+		return packPayload(w, req, filename, opts)
+	})
+}
+
+// Deploys the payload read from r as is, a tar or, when the request says so,
+// a compressed tar. Used to replay payloads kept by the daemon.
+func HandleClientConnRaw(conn *tls.Conn, req DeployRequest, r io.Reader) (int64, error) {
+	return deployPayload(conn, req, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
 		return err
+	})
+}
+
+// Sends the DEPLOY command and streams what write writes as the payload.
+func deployPayload(conn *tls.Conn, req DeployRequest, write func(io.Writer) error) (int64, error) {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return 0, err
+	}
+
+	fmt.Fprintln(MessageOutput, "proceeding with command")
+	req.Commit = true
+	err := SendCommand(conn, CommandDEPLOY, req.Encode())
+	var rse *RemoteStatusError
+	if errors.As(err, &rse) && rse.Code == StatusUpToDate {
+		fmt.Fprintln(MessageOutput, rse.Message)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
 	}
 
-	fmt.Println("proceeding with command")
-	err := goio.Command(conn, CommandDEPLOY, target)
+	n, err := writePayload(conn, req, write)
 	if err != nil {
-		return err
+		return n, err
 	}
+	return n, ReadStatus(conn)
+}
 
+// Streams what write writes as the payload. Returns the number of payload bytes
+// written. When the request commits the stream is followed by an Ok, or a NotOk
+// if write failed, see DeployRequest.Commit.
+func writePayload(conn *tls.Conn, req DeployRequest, write func(io.Writer) error) (int64, error) {
 	sw := goio.NewStreamWriter(conn)
-	err = PackTar(filename, sw, ignored)
+	cw := &countingWriter{w: sw}
+	err := write(cw)
 	sw.Terminate()
+	if req.Commit {
+		if err != nil {
+			goio.NotOk(conn, StatusNotOK, "The client failed to pack the payload.")
+		} else if err := goio.Ok(conn); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, err
+}
+
+// Packs filename to w, compressed as the request says.
+func packPayload(w io.Writer, req DeployRequest, filename string, opts PackOptions) error {
+	if req.Compression != CompressionGzip {
+		return PackTar(filename, w, opts)
+	}
+	gz, err := gzip.NewWriterLevel(w, opts.CompressLevel)
 	if err != nil {
 		return err
 	}
-	return goio.ReadStatus(conn)
+	err = PackTar(filename, gz, opts)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// The PING input asking the daemon to follow its Ok with a PingInfo.
+const PingInfoRequest = "info"
+
+// How long to wait for PingInfo after the Ok before assuming an older daemon.
+const PingInfoTimeout = 3 * time.Second
+
+// Pings the daemon. The returned info is nil when the daemon is too old to
+// report it.
+func HandleClientConnPing(conn *tls.Conn) (*PingInfo, error) {
+	return HandleClientConnPingTarget(conn, "")
+}
+
+// Pings the daemon, asking it to also report whether we may deploy the target.
+// The returned info is nil when the daemon is too old to report it, and its
+// Access is empty when the daemon is too old to check targets.
+func HandleClientConnPingTarget(conn *tls.Conn, target string) (*PingInfo, error) {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return nil, err
+	}
+	input := PingInfoRequest
+	if target != "" {
+		input += "?" + url.Values{"target": {target}}.Encode()
+	}
+	if err := SendCommand(conn, CommandPING, input); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	prev := readDeadline(conn)
+	if d := time.Now().Add(PingInfoTimeout); prev.IsZero() || d.Before(prev) {
+		conn.SetReadDeadline(d)
+		defer conn.SetReadDeadline(prev)
+	}
+	if err := goio.ReadStream(conn, &buf); err != nil || buf.Len() == 0 {
+		return nil, nil
+	}
+	var info PingInfo
+	if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// A connection remembering its read deadline, so one shortened for a while can
+// be put back.
+type deadlineConn struct {
+	net.Conn
+	read time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.read = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.read = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// The read deadline last set on conn or a connection below it, zero when there is
+// none or it isn't known.
+func readDeadline(conn net.Conn) time.Time {
+	for {
+		switch c := conn.(type) {
+		case *deadlineConn:
+			return c.read
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return time.Time{}
+		}
+	}
 }
 
-func HandleClientConnPing(conn *tls.Conn) error {
+// Reports whether the daemon can unpack payloads compressed as named.
+func (p *PingInfo) Supports(compression string) bool {
+	if p == nil {
+		return false
+	}
+	for _, v := range p.Compression {
+		if v == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// Asks the daemon which usernames may deploy the target.
+func HandleClientConnWho(conn *tls.Conn, target string) ([]string, error) {
 	if err := conn.Handshake(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(MessageOutput, err)
+		return nil, err
+	}
+	if err := SendCommand(conn, CommandWHO, target); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := goio.ReadStream(conn, &buf); err != nil {
+		return nil, err
+	}
+	return SplitLines(buf.String()), nil
+}
+
+// Adds "did you mean" suggestions to err when the daemon replied with the
+// targets available to us.
+func SuggestTarget(err error, target string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	i := strings.Index(msg, AvailableTargetsPrefix)
+	if i < 0 {
+		return err
+	}
+	suggestions := Suggest(target, SplitList(msg[i+len(AvailableTargetsPrefix):]))
+	if len(suggestions) == 0 {
 		return err
 	}
-	return goio.Command(conn, CommandPING, "")
+	return fmt.Errorf("%w\nDid you mean %s?", err, strings.Join(suggestions, " or "))
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+func TestPingKeepsReadDeadline(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	for _, deadline := range []time.Duration{time.Minute, time.Second} {
+		conn := d.Dial(t)
+		want := time.Now().Add(deadline)
+		conn.SetDeadline(want)
+		if _, err := HandleClientConnPingTarget(conn, "app"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readDeadline(conn); !got.Equal(want) {
+			t.Errorf("read deadline %s after the ping, want %s", got, want)
+		}
+	}
+}
+
+func TestPingReportsUser(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	info, err := HandleClientConnPing(d.Dial(t))
+	if err != nil {
+		t.Fatal(err)
+	} else if info == nil || info.User != "tester" {
+		t.Fatalf("ping reported %+v, want the user tester", info)
+	}
+}
+
+func TestPingInfo(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets = append(c.Targets,
+			Target{Name: "other", Authorized: []string{"tester"}, Filename: c.Targets[0].Filename + "-other"},
+			Target{Name: "private", Authorized: []string{"someone"}, Filename: c.Targets[0].Filename + "-private"},
+		)
+	})
+	info, err := HandleClientConnPing(d.Dial(t))
+	if err != nil {
+		t.Fatal(err)
+	} else if info == nil {
+		t.Fatal("no info in the reply")
+	}
+	if info.Version != Version || info.Protocol != ProtocolVersion || info.Targets != 2 {
+		t.Errorf("ping reported %+v", info)
+	}
+	if info.Uptime <= 0 || len(info.Compression) == 0 {
+		t.Errorf("ping reported uptime %f and compression %v", info.Uptime, info.Compression)
+	}
+}
+
+func TestPingTargetAccess(t *testing.T) {
+	for _, generic := range []bool{false, true} {
+		d := newTestDaemon(t, func(c *Config) {
+			c.GenericAuthErrors = generic
+			c.Targets = append(c.Targets, Target{Name: "private", Authorized: []string{"someone"}, Filename: c.Targets[0].Filename + "-private"})
+		})
+		missing := AccessNonexistent
+		if generic {
+			missing = AccessUnauthorized
+		}
+		want := map[string]string{"app": AccessAuthorized, "private": AccessUnauthorized, "missing": missing}
+		for target, access := range want {
+			info, err := HandleClientConnPingTarget(d.Dial(t), target)
+			if err != nil {
+				t.Fatal(err)
+			} else if info == nil || info.Target != target || info.Access != access {
+				t.Errorf("generic %v: ping of %s reported %+v, want %s", generic, target, info, access)
+			}
+		}
+
+		// A stranger learns nothing about the targets.
+		cert, err := GenerateKeyPair("stranger", time.Hour, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.client = &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+		for target := range want {
+			info, err := HandleClientConnPingTarget(d.Dial(t), target)
+			if err != nil {
+				t.Fatal(err)
+			} else if info == nil || info.User != "" || info.Access != AccessUnauthorized {
+				t.Errorf("generic %v: a stranger's ping of %s reported %+v", generic, target, info)
+			}
+		}
+	}
+}
+
+func TestPingLegacyDaemon(t *testing.T) {
+	tests := []struct {
+		name  string
+		serve func(c *tls.Conn)
+	}{
+		// Closes the connection, like a daemon done with a command.
+		{"close", func(c *tls.Conn) {
+			goio.ReadCommand(c)
+			goio.Ok(c)
+		}},
+		// Waits for the next command, the client gives up on the info.
+		{"wait", func(c *tls.Conn) {
+			goio.ReadCommand(c)
+			goio.Ok(c)
+			goio.ReadCommand(c)
+		}},
+	}
+	for _, tt := range tests {
+		conn := fakeServer(t, tt.serve)
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		info, err := HandleClientConnPing(conn)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if info != nil {
+			t.Errorf("%s: reported %+v", tt.name, info)
+		}
+	}
+
+	// A daemon refusing the ping is still an error.
+	conn := fakeServer(t, func(c *tls.Conn) {
+		goio.ReadCommand(c)
+		goio.NotOk(c, StatusNotOK, "no")
+	})
+	if _, err := HandleClientConnPing(conn); err == nil {
+		t.Error("a refused ping succeeded")
+	}
+}
+
+func TestSendResultJSON(t *testing.T) {
+	buf, err := json.Marshal(SendResult{
+		Target:    "app",
+		Address:   "localhost:8080",
+		DeployID:  "0123456789abcdef",
+		BytesSent: 2048,
+		Duration:  1.5,
+		Status:    StatusBlocked,
+		Error:     "blocked",
+		Username:  "tester",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"target":           "app",
+		"address":          "localhost:8080",
+		"deploy_id":        "0123456789abcdef",
+		"bytes_sent":       2048.0,
+		"duration_seconds": 1.5,
+		"ok":               false,
+		"error":            "blocked",
+		"status":           float64(StatusBlocked),
+		"username":         "tester",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("unexpected keys in %s", buf)
+	}
+}
+
+func TestDeployCompressed(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	files := map[string]string{"big": strings.Repeat("compressible ", 8<<10), "small": "1"}
+	writeFiles(t, d.Src, files)
+	plain, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[int]int64)
+	for _, level := range []int{gzip.BestSpeed, 5, gzip.BestCompression, gzip.DefaultCompression} {
+		if err := os.RemoveAll(d.Target().Filename); err != nil {
+			t.Fatal(err)
+		}
+		req := DeployRequest{Target: "app", ID: NewDeployID(), Compression: CompressionGzip}
+		n, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{CompressLevel: level})
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		sizes[level] = n
+		if n >= plain/10 {
+			t.Errorf("level %d sent %d bytes, uncompressed is %d", level, n, plain)
+		}
+		for name, want := range files {
+			if got := readFile(t, filepath.Join(d.Target().Filename, name)); got != want {
+				t.Errorf("level %d: %s holds %d bytes, want %d", level, name, len(got), len(want))
+			}
+		}
+	}
+	if sizes[gzip.BestCompression] > sizes[gzip.BestSpeed] {
+		t.Errorf("level 9 sent %d bytes, more than level 1's %d", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+
+	if _, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{CompressLevel: 10}); err != nil {
+		t.Errorf("the level was used without compression: %v", err)
+	}
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Compression: CompressionGzip}
+	if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{CompressLevel: 10}); err == nil {
+		t.Error("packed with gzip level 10")
+	}
+}
+
+func TestDeployUnsupportedCompression(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	info, err := HandleClientConnPing(d.Dial(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Supports(CompressionGzip) || info.Supports("zstd") {
+		t.Errorf("the daemon reports compression %v", info.Compression)
+	}
+	if (*PingInfo)(nil).Supports(CompressionGzip) {
+		t.Error("a daemon without info supports gzip")
+	}
+
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Compression: "zstd"}
+	_, err = HandleClientConnRaw(d.Dial(t), req, strings.NewReader("not sent"))
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusUnsupported {
+		t.Errorf("got %v, want StatusUnsupported", err)
+	}
+}
+
+func TestSendCompressLevelFlag(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, src, map[string]string{"version": "1"})
+	for _, level := range []string{"-1", "10"} {
+		var fe *FlagError
+		err := cmdSend("send", append(clientFlags(t), "-compress-level", level, "127.0.0.1:1", "app", src))
+		if !errors.As(err, &fe) || fe.Flag != "compress-level" {
+			t.Errorf("-compress-level %s gave %v", level, err)
+		}
+	}
+}
+
+func TestRemoteStatusError(t *testing.T) {
+	tests := []struct {
+		code, exit int
+		guided     bool
+	}{
+		{StatusNotOK, 1, false},
+		{StatusBlocked, 3, true},
+		{StatusNotExist, 4, true},
+		{StatusUnsupported, 5, true},
+		{StatusUpToDate, 1, false},
+	}
+	for _, tt := range tests {
+		err := remoteStatus(&goio.StatusError{Status: tt.code, Msg: "refused"})
+		var rse *RemoteStatusError
+		if !errors.As(err, &rse) || rse.Code != tt.code || rse.Message != "refused" {
+			t.Errorf("status %d became %#v", tt.code, err)
+			continue
+		}
+		if rse.ExitCode() != tt.exit {
+			t.Errorf("status %d exits %d, want %d", tt.code, rse.ExitCode(), tt.exit)
+		}
+		if (rse.Guidance() != "") != tt.guided {
+			t.Errorf("status %d guides %q", tt.code, rse.Guidance())
+		}
+	}
+	other := errors.New("connection reset")
+	if err := remoteStatus(other); err != other {
+		t.Errorf("another error became %v", err)
+	}
+	if err := remoteStatus(nil); err != nil {
+		t.Errorf("no error became %v", err)
+	}
+}
+
+func TestDeployStatusErrors(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets = append(c.Targets, Target{Name: "private", Authorized: []string{"someone"}, Filename: c.Targets[0].Filename + "-private"})
+	})
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"missing", StatusNotExist},
+		{"private", StatusBlocked},
+	}
+	for _, tt := range tests {
+		_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: tt.target, ID: NewDeployID()}, d.Src, PackOptions{})
+		var rse *RemoteStatusError
+		if !errors.As(err, &rse) || rse.Code != tt.code {
+			t.Errorf("%s: got %v, want status %d", tt.target, err, tt.code)
+		}
+	}
+
+	// A failure after the payload is sent comes back the same way.
+	d.Config.MaxEntries = 1
+	writeFiles(t, d.Src, map[string]string{"a": "a", "b": "b"})
+	_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusNotOK || rse.ExitCode() != 1 {
+		t.Errorf("got %v, want StatusNotOK", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Describes every entry under dir by its relative path: a directory, a symlink
+// with its target or a file with its content.
+func describeTree(tb testing.TB, dir string) map[string]string {
+	tb.Helper()
+	m := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			m[rel] = "dir"
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			m[rel] = "link " + link
+		default:
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			m[rel] = string(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+func writeCopyTree(tb testing.TB, dir string, files int) {
+	tb.Helper()
+	for i := 0; i < files; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("d%d", i%7), fmt.Sprintf("e%d", i%3), fmt.Sprintf("f%d", i))
+		writeBytes(tb, name, []byte(fmt.Sprintf("file %d %0*d", i, i%4096, 0)))
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("d0/e0/f0", filepath.Join(dir, "link")); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestCopyTreeNMatchesSource(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeCopyTree(t, src, 200)
+	want := describeTree(t, src)
+	for _, workers := range []int{1, 4, 32} {
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := os.Mkdir(dst, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := CopyTreeN(src, dst, workers); err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		got := describeTree(t, dst)
+		if len(got) != len(want) {
+			t.Errorf("%d workers: copied %d entries, want %d", workers, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%d workers: %s differs", workers, k)
+			}
+		}
+	}
+}
+
+func BenchmarkCopyTreeN(b *testing.B) {
+	src := filepath.Join(b.TempDir(), "src")
+	writeCopyTree(b, src, 500)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dst := filepath.Join(b.TempDir(), "dst")
+				if err := os.Mkdir(dst, 0755); err != nil {
+					b.Fatal(err)
+				}
+				if err := CopyTreeN(src, dst, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeInto(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "site")
+	writeFiles(t, target, map[string]string{
+		"keep.txt":      "kept",
+		"app/old.txt":   "old",
+		"other/new.txt": "other",
+	})
+	tmpdir := filepath.Join(dir, "tmp")
+	writeFiles(t, tmpdir, map[string]string{"app/new.txt": "new"})
+	if err := MergeInto(tmpdir, target); err != nil {
+		t.Fatal(err)
+	}
+	// tmpdir now holds the merged directory for MoveTarget.
+	xs, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 1 {
+		t.Fatalf("tmpdir holds %d items, want the merged directory only", len(xs))
+	}
+	got := describeTree(t, filepath.Join(tmpdir, xs[0].Name()))
+	want := map[string]string{
+		"keep.txt":                        "kept",
+		"app":                             "dir",
+		filepath.Join("app", "new.txt"):   "new",
+		"other":                           "dir",
+		filepath.Join("other", "new.txt"): "other",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	if got := readFile(t, filepath.Join(target, "app", "old.txt")); got != "old" {
+		t.Errorf("the target itself was changed, old.txt holds %q", got)
+	}
+}
+
+func TestMergeIntoInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tmpdir := filepath.Join(dir, "tmp")
+	writeFiles(t, tmpdir, map[string]string{"a": "a", "b": "b"})
+	if err := MergeInto(tmpdir, filepath.Join(dir, "site")); err != ErrInvalidPayload {
+		t.Errorf("merging two items gave %v, want ErrInvalidPayload", err)
+	}
+
+	tmpdir = filepath.Join(dir, "tmp2")
+	writeFiles(t, tmpdir, map[string]string{"a": "a"})
+	writeFiles(t, dir, map[string]string{"file": "not a directory"})
+	if err := MergeInto(tmpdir, filepath.Join(dir, "file")); err == nil {
+		t.Error("merged into a file")
+	}
+
+	// A target that doesn't exist yet is created holding the item.
+	tmpdir = filepath.Join(dir, "tmp3")
+	writeFiles(t, tmpdir, map[string]string{"a": "a"})
+	if err := MergeInto(tmpdir, filepath.Join(dir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	xs, _ := ioutil.ReadDir(tmpdir)
+	if len(xs) != 1 {
+		t.Fatalf("tmpdir holds %d items", len(xs))
+	}
+	if got := describeTree(t, filepath.Join(tmpdir, xs[0].Name())); len(got) != 1 || got["a"] != "a" {
+		t.Errorf("merged %v", got)
+	}
+}
+
+func TestDeploySendInto(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Targets[0].SendInto = true })
+	writeFiles(t, d.Target().Filename, map[string]string{
+		"keep.txt":    "kept",
+		"app/old.txt": "old",
+	})
+	if err := d.Deploy(t, map[string]string{"new.txt": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	got := describeTree(t, d.Target().Filename)
+	want := map[string]string{
+		"keep.txt":                      "kept",
+		"app":                           "dir",
+		filepath.Join("app", "new.txt"): "new",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("deployed %v, want %v", got, want)
+	}
+}
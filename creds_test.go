@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generates a key pair and writes it to a certificate and a key file.
+func writeKeyPair(t *testing.T) (cert tls.Certificate, certFilename, keyFilename string) {
+	t.Helper()
+	cert, err := GenerateKeyPair("test", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFilename, keyFilename = filepath.Join(dir, "client.cert"), filepath.Join(dir, "client.key")
+	if err := WriteKeyPair(cert, certFilename, keyFilename); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFilename, keyFilename
+}
+
+func leafSignature(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return GetSignature(leaf)
+}
+
+func TestLoadKeyPairFromEnv(t *testing.T) {
+	want, certFilename, keyFilename := writeKeyPair(t)
+	t.Setenv("DCTL_TEST_CERT", readFile(t, certFilename))
+	t.Setenv("DCTL_TEST_KEY", readFile(t, keyFilename))
+	tests := []struct{ cert, key string }{
+		{"env:DCTL_TEST_CERT", "env:DCTL_TEST_KEY"},
+		{certFilename, "env:DCTL_TEST_KEY"},
+		{"env:DCTL_TEST_CERT", keyFilename},
+	}
+	for _, tt := range tests {
+		got, err := LoadKeyPair(tt.cert, tt.key)
+		if err != nil {
+			t.Errorf("LoadKeyPair(%s, %s): %v", tt.cert, tt.key, err)
+		} else if leafSignature(t, got) != leafSignature(t, want) {
+			t.Errorf("LoadKeyPair(%s, %s) loaded another certificate", tt.cert, tt.key)
+		}
+	}
+	if _, err := LoadKeyPair("env:DCTL_TEST_UNSET", "env:DCTL_TEST_KEY"); err == nil {
+		t.Error("loaded a certificate from an unset variable")
+	}
+	// A key which isn't PEM.
+	t.Setenv("DCTL_TEST_JUNK", "not pem")
+	if _, err := LoadKeyPair("env:DCTL_TEST_CERT", "env:DCTL_TEST_JUNK"); err == nil {
+		t.Error("loaded a key that isn't PEM")
+	}
+
+	cert, err := LoadCertificate("env:DCTL_TEST_CERT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetSignature(cert) != leafSignature(t, want) {
+		t.Error("LoadCertificate loaded another certificate")
+	}
+}
+
+func TestLoadKeyPairFromStdin(t *testing.T) {
+	want, certFilename, keyFilename := writeKeyPair(t)
+	// Both in one stream, read once for the cert and the key.
+	both := filepath.Join(t.TempDir(), "both.pem")
+	writeBytes(t, both, []byte(readFile(t, certFilename)+readFile(t, keyFilename)))
+	f, err := os.Open(both)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin := os.Stdin
+	os.Stdin, stdinPEM = f, nil
+	defer func() { os.Stdin, stdinPEM = stdin, nil }()
+
+	got, err := LoadKeyPair("-", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leafSignature(t, got) != leafSignature(t, want) {
+		t.Error("loaded another certificate")
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	cert, certFilename, keyFilename := writeKeyPair(t)
+	got, err := LoadCertificate(certFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetSignature(got) != leafSignature(t, cert) {
+		t.Error("loaded another certificate")
+	}
+
+	// The certificate is found after other blocks.
+	both := filepath.Join(t.TempDir(), "both.pem")
+	if err := ioutil.WriteFile(both, []byte(readFile(t, keyFilename)+readFile(t, certFilename)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LoadCertificate(both); err != nil {
+		t.Error(err)
+	} else if GetSignature(got) != leafSignature(t, cert) {
+		t.Error("loaded another certificate from the combined file")
+	}
+
+	if _, err := LoadCertificate(keyFilename); err == nil {
+		t.Error("loaded a certificate from a key file")
+	}
+	if _, err := LoadCertificate(filepath.Join(t.TempDir(), "missing.cert")); err == nil {
+		t.Error("loaded a certificate from a missing file")
+	}
+}
+
+// Handshakes with a server presenting serverCert using the client's config.
+func handshakeWith(t *testing.T, conf *tls.Config, serverCert tls.Certificate) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		tls.Server(server, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert}).Handshake()
+	}()
+	conf.ServerName = "localhost"
+	c := tls.Client(client, conf)
+	c.SetDeadline(time.Now().Add(time.Minute))
+	return c.Handshake()
+}
+
+func TestClientVerifiesServer(t *testing.T) {
+	_, certFilename, keyFilename := writeKeyPair(t)
+	server, serverCertFilename, _ := writeKeyPair(t)
+	other, _, _ := writeKeyPair(t)
+	tests := []struct {
+		name     string
+		pin      string
+		insecure bool
+		ok       bool
+	}{
+		{"unverified", "", false, false},
+		{"insecure", "", true, true},
+		{"pinned signature", leafSignature(t, server), false, true},
+		{"pinned file", serverCertFilename, false, true},
+		{"other pin", leafSignature(t, other), false, false},
+		// A pin is checked even with -insecure.
+		{"other pin insecure", leafSignature(t, other), true, false},
+	}
+	for _, tt := range tests {
+		creds := clientCreds{certFilename: certFilename, keyFilename: keyFilename, tlsMin: "1.2", pin: tt.pin, insecure: tt.insecure}
+		conf, err := creds.tlsConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := handshakeWith(t, conf, server); (err == nil) != tt.ok {
+			t.Errorf("%s: handshake gave %v", tt.name, err)
+		}
+	}
+
+	creds := clientCreds{certFilename: certFilename, keyFilename: keyFilename, tlsMin: "1.2", pin: "not a signature!"}
+	var fe *FlagError
+	if _, err := creds.tlsConfig(); !errors.As(err, &fe) || fe.Flag != "pin" {
+		t.Errorf("got %v, want a FlagError for -pin", err)
+	}
+}
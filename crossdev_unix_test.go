@@ -0,0 +1,101 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Returns a temporary directory on another filesystem than os.TempDir, skipping
+// the test when there is none.
+func otherFilesystemDir(t *testing.T) string {
+	t.Helper()
+	device := func(p string) (uint64, bool) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(p, &st); err != nil {
+			return 0, false
+		}
+		return uint64(st.Dev), true
+	}
+	tmp, ok := device(os.TempDir())
+	if !ok {
+		t.Skip("can't stat the temp directory")
+	}
+	for _, dir := range []string{"/dev/shm", "/run/user"} {
+		if dev, ok := device(dir); ok && dev != tmp {
+			other, err := ioutil.TempDir(dir, "dctl-test-")
+			if err != nil {
+				continue
+			}
+			t.Cleanup(func() { os.RemoveAll(other) })
+			return other
+		}
+	}
+	t.Skip("no other filesystem to test on")
+	return ""
+}
+
+// Fails the test when dir holds anything set aside or half restored.
+func requireNoLeftovers(t *testing.T, dir string) {
+	t.Helper()
+	xs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range xs {
+		if strings.Contains(x.Name(), ".aside-") || strings.Contains(x.Name(), ".restore-") {
+			t.Errorf("left %s behind in %s", x.Name(), dir)
+		}
+	}
+}
+
+func TestBackupRestoreCrossDevice(t *testing.T) {
+	backups := otherFilesystemDir(t)
+	dir := t.TempDir()
+	for _, compress := range []bool{false, true} {
+		target := Target{Name: "app", Filename: filepath.Join(dir, "app")}
+		writeFiles(t, target.Filename, map[string]string{"version": "1", "web/index.html": "<p>1</p>"})
+		backup, err := BackupTarget(target, backups, compress, 2, RenameRetry{})
+		if err != nil {
+			t.Fatalf("compress %v: %v", compress, err)
+		}
+		if _, err := os.Stat(target.Filename); !os.IsNotExist(err) {
+			t.Errorf("compress %v: the target is still there after the backup: %v", compress, err)
+		}
+		requireNoLeftovers(t, dir)
+
+		if err := RestoreBackup(backup, target.Filename, RenameRetry{}); err != nil {
+			t.Fatalf("compress %v: %v", compress, err)
+		}
+		if got := readFile(t, filepath.Join(target.Filename, "web", "index.html")); got != "<p>1</p>" {
+			t.Errorf("compress %v: the restored file holds %q", compress, got)
+		}
+		if _, err := os.Stat(backup); !os.IsNotExist(err) {
+			t.Errorf("compress %v: the backup is still there after the restore: %v", compress, err)
+		}
+		requireNoLeftovers(t, dir)
+		os.RemoveAll(target.Filename)
+	}
+}
+
+func TestDeployRollbackCrossDevice(t *testing.T) {
+	backups := otherFilesystemDir(t)
+	d := newTestDaemon(t, func(c *Config) { c.BackupDirectory = backups })
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = "false"
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err == nil {
+		t.Fatal("a deploy with a failing After succeeded")
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q after the rollback", got)
+	}
+	requireNoLeftovers(t, filepath.Dir(d.Target().Filename))
+}
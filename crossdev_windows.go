@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const errorNotSameDevice syscall.Errno = 17
+
+// Reports whether err is a rename failing because the names are on different
+// volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Deploys the files like Deploy, sending the digest of the payload so the daemon
+// may skip it. Reports whether it did, no payload is sent then.
+func (d *testDaemon) DeployDigest(t *testing.T, files map[string]string) (skipped bool, err error) {
+	t.Helper()
+	if err := os.RemoveAll(d.Src); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, d.Src, files)
+	digest, err := PackDigest(d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Digest: digest}
+	n, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{})
+	return n == 0 && err == nil, err
+}
+
+func TestDeploySkipsUpToDate(t *testing.T) {
+	tests := []struct {
+		name     string
+		verify   string
+		always   bool
+		skip     bool
+		failures bool
+	}{
+		{"no verify", "", true, true, false},
+		{"verify not asked for", "false", false, true, false},
+		{"verify passes", "true", true, true, false},
+		// The deploy goes ahead, to fail on the same Verify.
+		{"verify fails", "false", true, false, true},
+	}
+	for _, tt := range tests {
+		d := newTestDaemon(t, nil)
+		for _, v := range []string{"1", "2"} {
+			if skipped, err := d.DeployDigest(t, map[string]string{"version": v}); err != nil || skipped {
+				t.Fatalf("%s: deploy of version %s skipped %v: %v", tt.name, v, skipped, err)
+			}
+		}
+		d.Target().Verify, d.Target().VerifyUpToDate = tt.verify, tt.always
+		skipped, err := d.DeployDigest(t, map[string]string{"version": "2"})
+		if skipped != tt.skip || (err != nil) != tt.failures {
+			t.Errorf("%s: the same payload again skipped %v with %v, want %v", tt.name, skipped, err, tt.skip)
+		}
+		if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+			t.Errorf("%s: version holds %q", tt.name, got)
+		}
+	}
+}
+
+func TestDeployFailureForgetsDigest(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	if _, err := d.DeployDigest(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = "false"
+	if _, err := d.DeployDigest(t, map[string]string{"version": "2"}); err == nil {
+		t.Fatal("deploy with a failing After succeeded")
+	}
+	d.Target().After = ""
+	// Version 1 was restored, but a failed swap may leave the target in neither
+	// state so nothing is skipped until a deploy succeeds again.
+	for _, v := range []string{"1", "2"} {
+		if skipped, err := d.DeployDigest(t, map[string]string{"version": v}); err != nil || skipped {
+			t.Errorf("deploy of version %s skipped %v: %v", v, skipped, err)
+		}
+	}
+	if skipped, err := d.DeployDigest(t, map[string]string{"version": "2"}); err != nil || !skipped {
+		t.Errorf("deploy of version 2 again skipped %v: %v", skipped, err)
+	}
+}
+
+func TestDeployWrongDigestNotRecorded(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	claimed, err := PackDigest(d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The digest of version 1 with the files of version 2.
+	if err := os.RemoveAll(d.Src); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, d.Src, map[string]string{"version": "2"})
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Digest: claimed}
+	if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.Target().DigestFilename()); !os.IsNotExist(err) {
+		t.Errorf("the wrong digest was recorded: %v", err)
+	}
+	if skipped, err := d.DeployDigest(t, map[string]string{"version": "1"}); err != nil || skipped {
+		t.Errorf("deploy of version 1 skipped %v: %v", skipped, err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+
+	// The digest of a compressed payload is checked on the tar inside.
+	writeFiles(t, d.Src, map[string]string{"version": "3"})
+	digest, err := PackDigest(d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = DeployRequest{Target: "app", ID: NewDeployID(), Digest: digest, Compression: CompressionGzip}
+	if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !IsUpToDate(d.Target(), digest) {
+		t.Error("the digest of a compressed payload wasn't recorded")
+	}
+}
+
+func TestTarDigest(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, src, map[string]string{"version": "1", "web/index.html": "<p>hi</p>"})
+	digest, err := PackDigest(src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the daemon receives has the same digest.
+	var buf bytes.Buffer
+	if err := PackTar(src, &buf, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := TarDigest(bytes.NewReader(buf.Bytes())); err != nil || got != digest {
+		t.Errorf("the packed tar has digest %s, %v, want %s", got, err, digest)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "version"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := PackDigest(src, PackOptions{}); got != digest {
+		t.Error("touching a file changed the digest")
+	}
+	writeFiles(t, src, map[string]string{"version": "2"})
+	if got, _ := PackDigest(src, PackOptions{}); got == digest {
+		t.Error("changing a file kept the digest")
+	}
+
+	if _, err := TarDigest(strings.NewReader("not a tar at all")); err == nil {
+		t.Error("the digest of junk had no error")
+	}
+}
+
+// Writes a script failing its first fails runs and passing after. Returns the
+// command to run it and a function counting its runs.
+func flakyScript(t *testing.T, fails int) (string, func() int) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the script is a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "flaky.sh")
+	body := fmt.Sprintf("#!/bin/sh\necho run >> %[1]s/runs\n[ $(wc -l < %[1]s/runs) -gt %[2]d ]\n", dir, fails)
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, func() int {
+		buf, _ := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		return strings.Count(string(buf), "\n")
+	}
+}
+
+func TestAfterRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		ok       bool
+		runs     int
+	}{
+		{"retried", 2, true, 2},
+		{"not retried", 1, false, 2},
+		{"default", 0, false, 2},
+	}
+	for _, tt := range tests {
+		d := newTestDaemon(t, nil)
+		if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+			t.Fatal(err)
+		}
+		after, runs := flakyScript(t, 1)
+		d.Target().After, d.Target().AfterAttempts = after, tt.attempts
+		err := d.Deploy(t, map[string]string{"version": "2"})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: deploy gave %v", tt.name, err)
+		}
+		want := "2"
+		if !tt.ok {
+			want = "1"
+		}
+		if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != want {
+			t.Errorf("%s: version holds %q, want %q", tt.name, got, want)
+		}
+		// Without retries the After of the restored files is the second run.
+		if n := runs(); n != tt.runs {
+			t.Errorf("%s: After ran %d times, want %d", tt.name, n, tt.runs)
+		}
+	}
+}
+
+func TestVerifyFailureRollsBack(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scripts are shell scripts")
+	}
+	d := newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Both record the version they see, Verify after the new one's After.
+	dir := t.TempDir()
+	script := func(name, exit string) string {
+		fp := filepath.Join(dir, name+".sh")
+		body := fmt.Sprintf("#!/bin/sh\necho %s $(cat %s) >> %s/runs\nexit %s\n", name, filepath.Join(d.Target().Filename, "version"), dir, exit)
+		if err := ioutil.WriteFile(fp, []byte(body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	d.Target().After, d.Target().Verify = script("after", "0"), script("verify", "1")
+
+	err := d.Deploy(t, map[string]string{"version": "2"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "The Verify script failed.") || !strings.Contains(rse.Message, "Restore executed successfully.") {
+		t.Fatalf("deploy with a failing Verify gave %v", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q after the rollback", got)
+	}
+	// The restored files get their After again, not Verify.
+	want := []string{"after 2", "verify 2", "after 1"}
+	if got := SplitLines(readFile(t, filepath.Join(dir, "runs"))); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("the scripts ran as %q, want %q", got, want)
+	}
+}
+
+// Writes a script recording DCTL_OUTCOME and DCTL_TARGET a line per run. Returns
+// the command to run it and a function reading the lines.
+func outcomeScript(t *testing.T) (string, func() []string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the script is a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "cleanup.sh")
+	body := fmt.Sprintf("#!/bin/sh\necho \"$DCTL_OUTCOME $DCTL_TARGET\" >> %s/outcomes\n", dir)
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, func() []string {
+		buf, _ := ioutil.ReadFile(filepath.Join(dir, "outcomes"))
+		return SplitLines(string(buf))
+	}
+}
+
+// Waits up to five seconds for cond to hold, for what the daemon does after
+// replying.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCleanupRuns(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	cleanup, outcomes := outcomeScript(t)
+	d.Target().Cleanup = cleanup
+	steps := []struct {
+		name   string
+		mod    func(target *Target)
+		ok     bool
+		result string
+	}{
+		{"success", func(target *Target) {}, true, "success app"},
+		{"verify fails", func(target *Target) { target.Verify = "false" }, false, "rolled-back app"},
+		// The restored files get the same After.
+		{"after fails", func(target *Target) { target.After = "false" }, false, "rollback-failed app"},
+		{"before fails", func(target *Target) { target.Before = "false" }, false, "failure app"},
+	}
+	for i, tt := range steps {
+		target := *d.Target()
+		tt.mod(d.Target())
+		err := d.Deploy(t, map[string]string{"version": tt.name})
+		*d.Target() = target
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: deploy gave %v", tt.name, err)
+		}
+		waitFor(t, "the Cleanup of "+tt.name, func() bool { return len(outcomes()) > i })
+		if got := outcomes()[i]; got != tt.result {
+			t.Errorf("%s: Cleanup saw %q, want %q", tt.name, got, tt.result)
+		}
+	}
+}
+
+func TestCleanupFailureIgnored(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Targets[0].Cleanup = "false" })
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Errorf("a failing Cleanup failed the deploy: %v", err)
+	}
+}
+
+func TestPreSwapDelay(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scripts are shell commands")
+	}
+	const delay = 300 * time.Millisecond
+	dir := t.TempDir()
+	d := newTestDaemon(t, func(c *Config) {
+		c.KeepBackups = 2
+		c.Targets[0].PreSwapDelay = Duration{delay}
+		c.Targets[0].Before = "touch " + filepath.Join(dir, "before")
+		c.Targets[0].PreBackup = "touch " + filepath.Join(dir, "prebackup")
+	})
+	// The time between Before finishing and PreBackup starting, give or take the
+	// granularity of modification times.
+	const slack = 50 * time.Millisecond
+	gap := func() time.Duration {
+		t.Helper()
+		var times []time.Time
+		for _, name := range []string{"before", "prebackup"} {
+			stat, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			times = append(times, stat.ModTime())
+		}
+		return times[1].Sub(times[0])
+	}
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gap(); got < delay-slack {
+		t.Errorf("the deploy waited %s after Before, want %s", got, delay)
+	}
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	nextBackupSecond()
+	if err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: "0"}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := gap(); got < delay-slack {
+		t.Errorf("the rollback waited %s after Before, want %s", got, delay)
+	}
+
+	d.Target().PreSwapDelay = Duration{}
+	nextBackupSecond()
+	if err := d.Deploy(t, map[string]string{"version": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gap(); got >= delay-slack {
+		t.Errorf("without a PreSwapDelay the deploy waited %s", got)
+	}
+}
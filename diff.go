@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/tmathews/goio"
+)
+
+// A file of a target, by its slash separated path below the item deployed. A
+// target that is a single file has the path ".".
+type IndexEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Indexes the regular files at filename, sorted by path. Symlinks are left out
+// like UnpackTar leaves them out of deploys, except for filename itself, which
+// is indexed as what it links to as for a target with Generations. A filename
+// that doesn't exist has an empty index.
+func IndexDir(filename string) ([]IndexEntry, error) {
+	if fp, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = fp
+	}
+	var entries []IndexEntry
+	err := filepath.Walk(filename, func(fp string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fp == filename {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(filename, fp)
+		if err != nil {
+			return err
+		}
+		e := IndexEntry{Path: filepath.ToSlash(rel), Size: info.Size()}
+		if e.SHA256, err = hashFile(fp); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	sortIndex(entries)
+	return entries, err
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Indexes a tar as PackTar writes it, the single item at its root holding the
+// entries. Hardlinks are indexed as the file they link to.
+func IndexTar(reader *tar.Reader) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	byName := make(map[string]IndexEntry)
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := StripComponents(h.Name, 1)
+		if name == "" {
+			name = "."
+		}
+		e := IndexEntry{Path: name}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			hash := sha256.New()
+			if e.Size, err = io.Copy(hash, reader); err != nil {
+				return nil, err
+			}
+			e.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		case tar.TypeLink:
+			linked, ok := byName[path.Clean(h.Linkname)]
+			if !ok {
+				return nil, fmt.Errorf("hardlink %s to %s which isn't in the tar", h.Name, h.Linkname)
+			}
+			e.Size, e.SHA256 = linked.Size, linked.SHA256
+		default:
+			continue
+		}
+		byName[path.Clean(h.Name)] = e
+		entries = append(entries, e)
+	}
+	sortIndex(entries)
+	return entries, nil
+}
+
+func sortIndex(entries []IndexEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+}
+
+// What changed about a path going from the deployed index to the local one.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+type Change struct {
+	Kind string
+	Path string
+
+	// Sizes before and after, zero for the side the path isn't on.
+	OldSize int64
+	NewSize int64
+}
+
+// Compares the deployed index with the local one, both sorted by path, listing
+// the paths added, removed or whose contents differ.
+func DiffIndex(deployed, local []IndexEntry) []Change {
+	var changes []Change
+	i, j := 0, 0
+	for i < len(deployed) || j < len(local) {
+		switch {
+		case j == len(local) || (i < len(deployed) && deployed[i].Path < local[j].Path):
+			changes = append(changes, Change{Kind: ChangeRemoved, Path: deployed[i].Path, OldSize: deployed[i].Size})
+			i++
+		case i == len(deployed) || local[j].Path < deployed[i].Path:
+			changes = append(changes, Change{Kind: ChangeAdded, Path: local[j].Path, NewSize: local[j].Size})
+			j++
+		default:
+			if deployed[i] != local[j] {
+				changes = append(changes, Change{Kind: ChangeChanged, Path: local[j].Path, OldSize: deployed[i].Size, NewSize: local[j].Size})
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+// Prints a line per change to w followed by the totals.
+func WriteChanges(w io.Writer, changes []Change) {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Kind]++
+		switch c.Kind {
+		case ChangeAdded:
+			fmt.Fprintf(w, "+ %s (%d bytes)\n", c.Path, c.NewSize)
+		case ChangeRemoved:
+			fmt.Fprintf(w, "- %s (%d bytes)\n", c.Path, c.OldSize)
+		default:
+			fmt.Fprintf(w, "~ %s (%d -> %d bytes)\n", c.Path, c.OldSize, c.NewSize)
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed.\n", counts[ChangeAdded], counts[ChangeRemoved], counts[ChangeChanged])
+}
+
+// Replies with the index of the target, as JSON, to those who may deploy it
+// when the target has Pull. The hashes tell what the files hold, so the index
+// is guarded like the files. A target that wasn't deployed yet has an empty
+// index.
+func (ctx ServerContext) HandleList(signature, targetName string) error {
+	target, _, err := ctx.AuthorizeTarget(signature, targetName)
+	if target == nil {
+		return err
+	}
+	if !target.Pull {
+		return goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("The target %s can't be listed, it doesn't have Pull.", target.Name))
+	}
+	entries, err := IndexDir(target.Filename)
+	if err != nil {
+		ctx.Log.Printf("IndexDir error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to index the target.")
+	}
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+	sw := goio.NewStreamWriter(ctx.C)
+	err = json.NewEncoder(sw).Encode(entries)
+	sw.Terminate()
+	return err
+}
+
+// Asks the daemon for the index of what is deployed as the target.
+func HandleClientConnList(conn *tls.Conn, target string) ([]IndexEntry, error) {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return nil, err
+	}
+	if err := SendCommand(conn, CommandLIST, target); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := goio.ReadStream(conn, &buf); err != nil {
+		return nil, err
+	}
+	var entries []IndexEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		return nil, fmt.Errorf("the daemon sent a malformed index: %v", err)
+	}
+	return entries, nil
+}
+
+// Indexes what send would pack for filename.
+func IndexLocal(filename string, opts PackOptions) ([]IndexEntry, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(PackTar(filename, pw, opts))
+	}()
+	defer pr.Close()
+	return IndexTar(tar.NewReader(pr))
+}
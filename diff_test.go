@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIndexTar(t *testing.T) {
+	entries, err := IndexTar(tarOf(t,
+		tarEntry{Name: "app/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/version", Body: "1"},
+		tarEntry{Name: "app/conf/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/conf/app.ini", Body: "debug = false"},
+		tarEntry{Name: "app/again", Typeflag: tar.TypeLink, Linkname: "app/version"},
+		tarEntry{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "version"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sorted, the hardlink as the file it links to, directories and symlinks left out.
+	want := []IndexEntry{
+		{Path: "again", Size: 1, SHA256: sha256Hex("1")},
+		{Path: "conf/app.ini", Size: 13, SHA256: sha256Hex("debug = false")},
+		{Path: "version", Size: 1, SHA256: sha256Hex("1")},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+
+	entries, err = IndexTar(tarOf(t, tarEntry{Name: "app.conf", Body: "x"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []IndexEntry{{Path: ".", Size: 1, SHA256: sha256Hex("x")}}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("a single file indexed as %+v, want %+v", entries, want)
+	}
+
+	if _, err := IndexTar(tarOf(t, tarEntry{Name: "app/again", Typeflag: tar.TypeLink, Linkname: "app/missing"})); err == nil {
+		t.Error("a hardlink to a file not in the tar was indexed")
+	}
+}
+
+func TestDiffIndex(t *testing.T) {
+	a := IndexEntry{Path: "a", Size: 1, SHA256: sha256Hex("1")}
+	b := IndexEntry{Path: "b", Size: 1, SHA256: sha256Hex("1")}
+	b2 := IndexEntry{Path: "b", Size: 2, SHA256: sha256Hex("22")}
+	bSame := IndexEntry{Path: "b", Size: 1, SHA256: sha256Hex("2")}
+	c := IndexEntry{Path: "c", Size: 3, SHA256: sha256Hex("333")}
+	tests := []struct {
+		name            string
+		deployed, local []IndexEntry
+		want            []Change
+	}{
+		{"both empty", nil, nil, nil},
+		{"same", []IndexEntry{a, b}, []IndexEntry{a, b}, nil},
+		{"all added", nil, []IndexEntry{a, b}, []Change{{ChangeAdded, "a", 0, 1}, {ChangeAdded, "b", 0, 1}}},
+		{"all removed", []IndexEntry{a, b}, nil, []Change{{ChangeRemoved, "a", 1, 0}, {ChangeRemoved, "b", 1, 0}}},
+		{"resized", []IndexEntry{a, b}, []IndexEntry{a, b2}, []Change{{ChangeChanged, "b", 1, 2}}},
+		{"same size", []IndexEntry{b}, []IndexEntry{bSame}, []Change{{ChangeChanged, "b", 1, 1}}},
+		{"interleaved", []IndexEntry{a, c}, []IndexEntry{b, c}, []Change{{ChangeRemoved, "a", 1, 0}, {ChangeAdded, "b", 0, 1}}},
+	}
+	for _, tt := range tests {
+		if got := DiffIndex(tt.deployed, tt.local); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteChanges(t *testing.T) {
+	var buf bytes.Buffer
+	WriteChanges(&buf, []Change{{ChangeAdded, "a", 0, 1}, {ChangeRemoved, "b", 2, 0}, {ChangeChanged, "c", 3, 4}})
+	want := "+ a (1 bytes)\n- b (2 bytes)\n~ c (3 -> 4 bytes)\n1 added, 1 removed, 1 changed.\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestList(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	files := map[string]string{"version": "1", "conf/app.ini": "debug = false"}
+	if err := d.Deploy(t, files); err != nil {
+		t.Fatal(err)
+	}
+	var rse *RemoteStatusError
+	if _, err := HandleClientConnList(d.Dial(t), "app"); !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("listing a target without Pull gave %v", err)
+	}
+
+	d.Target().Pull = true
+	deployed, err := HandleClientConnList(d.Dial(t), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := IndexLocal(d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := DiffIndex(deployed, local); len(changes) != 0 || len(deployed) != len(files) {
+		t.Errorf("the deployed %+v differs from what was sent: %+v", deployed, changes)
+	}
+
+	writeFiles(t, d.Src, map[string]string{"version": "2"})
+	if local, err = IndexLocal(d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if changes := DiffIndex(deployed, local); len(changes) != 1 || changes[0].Path != "version" {
+		t.Errorf("after changing version got %+v", changes)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CheckPass = "PASS"
+	CheckWarn = "WARN"
+	CheckFail = "FAIL"
+)
+
+// Certificates expiring sooner than this are reported as a warning.
+const CertExpiryWarning = 30 * 24 * time.Hour
+
+// The outcome of one of the doctor's checks of the host.
+type Check struct {
+	Name   string
+	Result string
+	Detail string
+}
+
+func pass(name, format string, a ...interface{}) Check {
+	return Check{Name: name, Result: CheckPass, Detail: fmt.Sprintf(format, a...)}
+}
+
+func warn(name, format string, a ...interface{}) Check {
+	return Check{Name: name, Result: CheckWarn, Detail: fmt.Sprintf(format, a...)}
+}
+
+func fail(name, format string, a ...interface{}) Check {
+	return Check{Name: name, Result: CheckFail, Detail: fmt.Sprintf(format, a...)}
+}
+
+// Checks what the daemon needs from the host: its config, AuthorizedKeys,
+// BackupDirectory, certificate and addresses. Checks relying on the config are
+// skipped when it can't be loaded.
+func Doctor(confFilename, certSpec, keySpec string, addresses []string) []Check {
+	conf, check := CheckConfig(confFilename)
+	checks := []Check{check}
+	if conf != nil {
+		checks = append(checks, CheckAuthorizedKeys(conf), CheckBackupWritable(conf.BackupDirectory))
+	}
+	checks = append(checks, CheckCertificate(certSpec, keySpec, time.Now()))
+	for _, address := range addresses {
+		checks = append(checks, CheckListen(address))
+	}
+	return checks
+}
+
+// Prints a line per check to w and returns the number that failed.
+func WriteChecks(w io.Writer, checks []Check) int {
+	var failed int
+	for _, c := range checks {
+		fmt.Fprintf(w, "%-10s %s %s\n", c.Name, c.Result, c.Detail)
+		if c.Result == CheckFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func CheckConfig(filename string) (*Config, Check) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fail("config", "%v", err)
+	}
+	f.Close()
+	conf, err := LoadConfig(filename)
+	if err != nil {
+		return nil, fail("config", "%s is invalid: %v", filename, err)
+	}
+	return conf, pass("config", "%s has %d targets", filename, len(conf.Targets))
+}
+
+func CheckAuthorizedKeys(conf *Config) Check {
+	if conf.Signatures == nil {
+		if conf.AuthorizedKeys == "" {
+			return warn("keys", "no AuthorizedKeys file is configured, nobody can deploy")
+		}
+		f, err := os.Open(conf.AuthorizedKeys)
+		if err != nil {
+			return fail("keys", "%v", err)
+		}
+		f.Close()
+	}
+	signatures, err := conf.LoadSignatures()
+	if err != nil {
+		return fail("keys", "%v", err)
+	} else if len(signatures) == 0 {
+		return warn("keys", "no keys are authorized, nobody can deploy")
+	}
+	return pass("keys", "%d keys authorized", len(signatures))
+}
+
+// Unlike the daemon this doesn't create dir, a missing directory is only a
+// warning.
+func CheckBackupWritable(dir string) Check {
+	if dir == "" {
+		return fail("backups", "no BackupDirectory is configured")
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return warn("backups", "%s doesn't exist yet, the daemon creates it on start", dir)
+	} else if err != nil {
+		return fail("backups", "%v", err)
+	}
+	if err := CheckBackupDirectory(dir); err != nil {
+		return fail("backups", "%s: %v", dir, err)
+	}
+	return pass("backups", "%s is writable", dir)
+}
+
+// Loads the daemon's key pair and checks the certificate is valid at now. A
+// host clock that is off shows up here as a certificate not valid yet.
+func CheckCertificate(certSpec, keySpec string, now time.Time) Check {
+	pair, err := LoadKeyPair(certSpec, keySpec)
+	if err != nil {
+		return fail("cert", "%v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fail("cert", "%v", err)
+	}
+	switch {
+	case now.Before(cert.NotBefore):
+		return fail("cert", "not valid until %s, check the host's clock", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return fail("cert", "expired %s", cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < CertExpiryWarning:
+		return warn("cert", "expires soon, %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if msg := KeyModeWarning(keySpec); msg != "" {
+		return warn("cert", "%s", msg)
+	}
+	return pass("cert", "valid until %s", cert.NotAfter.Format(time.RFC3339))
+}
+
+// Binds address and lets go of it again. A daemon already running on it makes
+// this fail too.
+func CheckListen(address string) Check {
+	name := "listen"
+	network, addr := SplitNetwork(address)
+	if network == "unix" {
+		// Like ListenUnix only a stale socket is replaced.
+		if fi, err := os.Lstat(addr); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return fail(name, "%s exists and is not a socket", address)
+			}
+			if c, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+				c.Close()
+				return fail(name, "%s is in use by another process", address)
+			}
+			return warn(name, "%s is a stale socket, the daemon replaces it on start", address)
+		} else if _, err := os.Stat(filepath.Dir(addr)); err != nil {
+			return fail(name, "%v", err)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fail(name, "%v", err)
+	}
+	l.Close()
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	return pass(name, "%s is free", address)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requireCheck(t *testing.T, what string, c Check, result, detail string) {
+	t.Helper()
+	if c.Result != result || !strings.Contains(c.Detail, detail) {
+		t.Errorf("%s: %s %s %q, want %s containing %q", what, c.Name, c.Result, c.Detail, result, detail)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf, c := CheckConfig(filepath.Join(dir, "missing.toml"))
+	if conf != nil {
+		t.Error("a missing config loaded")
+	}
+	requireCheck(t, "missing", c, CheckFail, "missing.toml")
+
+	fn := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, c = CheckConfig(fn)
+	if conf == nil {
+		t.Error("an empty config didn't load")
+	}
+	requireCheck(t, "empty", c, CheckPass, "has 0 targets")
+}
+
+func TestCheckAuthorizedKeys(t *testing.T) {
+	dir := t.TempDir()
+	empty, keys := filepath.Join(dir, "empty"), filepath.Join(dir, "authorized_keys")
+	writeFiles(t, dir, map[string]string{"empty": "", "authorized_keys": "sigA alice\n"})
+	tests := []struct {
+		name, keys, result, detail string
+	}{
+		{"none", "", CheckWarn, "no AuthorizedKeys file"},
+		{"missing", filepath.Join(dir, "missing"), CheckFail, "missing"},
+		{"empty", empty, CheckWarn, "no keys are authorized"},
+		{"one", keys, CheckPass, "1 keys authorized"},
+	}
+	for _, tt := range tests {
+		requireCheck(t, tt.name, CheckAuthorizedKeys(&Config{AuthorizedKeys: tt.keys}), tt.result, tt.detail)
+	}
+}
+
+func TestCheckBackupWritable(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file": "x"})
+	tests := []struct {
+		name, dir, result, detail string
+	}{
+		{"unset", "", CheckFail, "no BackupDirectory"},
+		{"missing", filepath.Join(dir, "backups"), CheckWarn, "doesn't exist yet"},
+		{"under a file", filepath.Join(dir, "file", "backups"), CheckFail, ""},
+		{"writable", dir, CheckPass, "is writable"},
+	}
+	for _, tt := range tests {
+		requireCheck(t, tt.name, CheckBackupWritable(tt.dir), tt.result, tt.detail)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backups")); !os.IsNotExist(err) {
+		t.Errorf("the check created the missing directory: %v", err)
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	cert, err := GenerateKeyPair("test", 2*CertExpiryWarning, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFilename, keyFilename := filepath.Join(dir, "daemon.cert"), filepath.Join(dir, "daemon.key")
+	if err := WriteKeyPair(cert, certFilename, keyFilename); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		now    time.Time
+		result string
+		detail string
+	}{
+		{"valid", leaf.NotBefore.Add(time.Minute), CheckPass, "valid until"},
+		{"clock behind", leaf.NotBefore.Add(-time.Hour), CheckFail, "check the host's clock"},
+		{"expired", leaf.NotAfter.Add(time.Hour), CheckFail, "expired"},
+		{"expiring", leaf.NotAfter.Add(-CertExpiryWarning / 2), CheckWarn, "expires soon"},
+	}
+	for _, tt := range tests {
+		requireCheck(t, tt.name, CheckCertificate(certFilename, keyFilename, tt.now), tt.result, tt.detail)
+	}
+	requireCheck(t, "missing", CheckCertificate(filepath.Join(t.TempDir(), "missing"), keyFilename, time.Now()), CheckFail, "")
+
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(keyFilename, 0644); err != nil {
+			t.Fatal(err)
+		}
+		requireCheck(t, "readable key", CheckCertificate(certFilename, keyFilename, leaf.NotBefore.Add(time.Minute)), CheckWarn, "readable only by its owner")
+	}
+}
+
+func TestCheckListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireCheck(t, "taken", CheckListen(l.Addr().String()), CheckFail, "")
+	l.Close()
+	requireCheck(t, "free", CheckListen(l.Addr().String()), CheckPass, "is free")
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file": "x"})
+	requireCheck(t, "no directory", CheckListen(UnixAddressPrefix+filepath.Join(dir, "missing", "d.sock")), CheckFail, "")
+	requireCheck(t, "a file", CheckListen(UnixAddressPrefix+filepath.Join(dir, "file")), CheckFail, "not a socket")
+	sock := filepath.Join(dir, "d.sock")
+	requireCheck(t, "free socket", CheckListen(UnixAddressPrefix+sock), CheckPass, "is free")
+	l, err = ListenUnix(sock, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireCheck(t, "live socket", CheckListen(UnixAddressPrefix+sock), CheckFail, "in use")
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	requireCheck(t, "stale socket", CheckListen(UnixAddressPrefix+sock), CheckWarn, "stale socket")
+}
+
+func TestWriteChecks(t *testing.T) {
+	var buf bytes.Buffer
+	checks := []Check{pass("config", "ok"), warn("keys", "hmm"), fail("cert", "bad %d", 1), fail("listen", "taken")}
+	if n := WriteChecks(&buf, checks); n != 2 {
+		t.Errorf("WriteChecks counted %d failures, want 2", n)
+	}
+	want := fmt.Sprintf("%-10s FAIL bad 1\n", "cert")
+	if !strings.Contains(buf.String(), want) || strings.Count(buf.String(), "\n") != 4 {
+		t.Errorf("WriteChecks wrote %q", buf.String())
+	}
+}
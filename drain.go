@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Whether the daemon is draining, refusing deploys while still answering PING.
+type DrainState struct {
+	v int32
+}
+
+func (d *DrainState) Set(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&d.v, v)
+}
+
+// Safe to call on a nil state, which never drains.
+func (d *DrainState) Draining() bool {
+	return d != nil && atomic.LoadInt32(&d.v) == 1
+}
+
+func (d *DrainState) String() string {
+	if d.Draining() {
+		return "draining"
+	}
+	return "accepting"
+}
+
+// The lines understood on the control socket, each is answered with the
+// resulting state.
+const (
+	ControlDrain  = "drain"
+	ControlResume = "resume"
+	ControlStatus = "status"
+
+	// Answered with the TrafficTally instead of the state.
+	ControlTraffic = "traffic"
+)
+
+// Listens on the unix socket at filename for control lines. Only the owner may
+// connect, the socket is made 0600.
+func ListenControl(filename string) (net.Listener, error) {
+	return ListenUnix(filename, 0600)
+}
+
+func ServeControl(l net.Listener, state *DrainState, traffic *TrafficTally, log *log.Logger) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Control socket: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.TrimSpace(line) {
+			case ControlDrain:
+				state.Set(true)
+				log.Println("Draining, deploys are refused until resumed.")
+			case ControlResume:
+				state.Set(false)
+				log.Println("Resumed accepting deploys.")
+			case ControlStatus:
+			case ControlTraffic:
+				WriteTraffic(conn, traffic.List())
+				return
+			default:
+				fmt.Fprintln(conn, "unknown command")
+				return
+			}
+			fmt.Fprintln(conn, state.String())
+		}()
+	}
+}
+
+// Sends a control line to the daemon and returns its reply, the state for all
+// but ControlTraffic.
+func SendControl(filename, command string) (string, error) {
+	conn, err := net.Dial("unix", filename)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(buf))
+	if line == "unknown command" {
+		return "", errors.New("the daemon did not understand " + command)
+	}
+	return line, nil
+}
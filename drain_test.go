@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDrainState(t *testing.T) {
+	var nilState *DrainState
+	if nilState.Draining() {
+		t.Error("a nil state is draining")
+	}
+	d := &DrainState{}
+	if d.Draining() || d.String() != "accepting" {
+		t.Errorf("a new state is %s", d)
+	}
+	d.Set(true)
+	if !d.Draining() || d.String() != "draining" {
+		t.Errorf("after Set(true) the state is %s", d)
+	}
+	d.Set(false)
+	if d.Draining() {
+		t.Error("still draining after Set(false)")
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control socket is a unix socket")
+	}
+	fn := filepath.Join(t.TempDir(), "control.sock")
+	l, err := ListenControl(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	state := &DrainState{}
+	go ServeControl(l, state, &TrafficTally{}, log.New(&bytes.Buffer{}, "", 0))
+
+	for _, step := range []struct{ command, want string }{
+		{ControlStatus, "accepting"},
+		{ControlDrain, "draining"},
+		{ControlStatus, "draining"},
+		{ControlDrain, "draining"},
+		{ControlResume, "accepting"},
+		{ControlStatus, "accepting"},
+	} {
+		got, err := SendControl(fn, step.command)
+		if err != nil {
+			t.Fatalf("%s: %v", step.command, err)
+		}
+		if got != step.want {
+			t.Errorf("%s replied %s, want %s", step.command, got, step.want)
+		}
+		if state.String() != step.want {
+			t.Errorf("after %s the state is %s, want %s", step.command, state, step.want)
+		}
+	}
+	if _, err := SendControl(fn, "reboot"); err == nil {
+		t.Error("an unknown command was accepted")
+	}
+}
+
+func TestDeployWhileDraining(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	files := map[string]string{"version": "1"}
+	d.Drain.Set(true)
+	if err := d.Deploy(t, files); err == nil || !strings.Contains(err.Error(), "not accepting deploys") {
+		t.Errorf("got %v, want the deploy refused while draining", err)
+	}
+	info, err := HandleClientConnPing(d.Dial(t))
+	if err != nil || info == nil {
+		t.Errorf("PING while draining gave %+v, %v", info, err)
+	}
+	d.Drain.Set(false)
+	if err := d.Deploy(t, files); err != nil {
+		t.Errorf("the deploy was refused after resuming: %v", err)
+	}
+}
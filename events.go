@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// The kinds of Event published.
+const (
+	EventDeployStart = "deploy-start"
+	EventDeployEnd   = "deploy-end"
+	EventRollback    = "rollback"
+)
+
+// Something that happened on the daemon, streamed to TAIL subscribers as a line
+// of JSON.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"event"`
+	Target   string    `json:"target"`
+	DeployID string    `json:"deploy_id,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Outcome  string    `json:"outcome,omitempty"`
+}
+
+// How many events a subscriber may fall behind before events are dropped for it,
+// also how many recent events are kept for subscribers resuming.
+const eventBuffer = 64
+
+// Fans events out to subscribers. A nil hub drops everything.
+type EventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	recent []Event
+	closed bool
+}
+
+// The returned channel is closed by Unsubscribe or Close.
+func (h *EventHub) Subscribe() chan Event {
+	return h.SubscribeSince(time.Time{})
+}
+
+// Subscribe, first replaying the recent events published at or after since. A
+// zero since replays nothing.
+func (h *EventHub) SubscribeSince(since time.Time) chan Event {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan Event]bool)
+	}
+	h.subs[ch] = true
+	if !since.IsZero() {
+		for _, e := range h.recent {
+			if !e.Time.Before(since) {
+				ch <- e
+			}
+		}
+	}
+	return ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Sends the event to every subscriber without waiting on slow ones.
+func (h *EventHub) Publish(e Event) {
+	if h == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.recent) == eventBuffer {
+		h.recent = h.recent[1:]
+	}
+	h.recent = append(h.recent, e)
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Ends every subscription, used when the daemon shuts down.
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Streams events to an operator until they disconnect or the daemon shuts down.
+// An input of "since=<RFC 3339 time>" first replays the recent events from then
+// on, for a client resuming after a reconnect.
+func (ctx ServerContext) HandleTail(signature, input string) error {
+	name, err := ctx.LookupName(signature)
+	if name == "" {
+		return err
+	}
+	if !ctx.Config.IsOperator(name) || ctx.Events == nil {
+		return goio.NotOk(ctx.C, StatusBlocked, "You are not an operator of this server.")
+	}
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+	var since time.Time
+	if v, err := url.ParseQuery(input); err == nil && v.Get("since") != "" {
+		since, _ = time.Parse(time.RFC3339Nano, v.Get("since"))
+	}
+	ctx.Log.Printf("%s is tailing events", name)
+
+	ch := ctx.Events.SubscribeSince(since)
+	defer ctx.Events.Unsubscribe(ch)
+	sw := goio.NewStreamWriter(ctx.C)
+	defer sw.Terminate()
+	enc := json.NewEncoder(sw)
+
+	// The client sends nothing more so a read only returns once it is gone.
+	// Without watching for that a quiet daemon would keep the subscription of a
+	// client that disconnected until the next event failed to write.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ctx.C)
+		close(gone)
+	}()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		case <-gone:
+			ctx.Log.Printf("%s stopped tailing events", name)
+			return nil
+		}
+	}
+}
+
+// Subscribes to the daemon's events, writing each line of JSON to w until the
+// daemon ends the stream.
+func HandleClientConnTail(conn *tls.Conn, w io.Writer) error {
+	return HandleClientConnTailSince(conn, w, time.Time{})
+}
+
+// HandleClientConnTail asking the daemon to first replay its recent events
+// after since. Older daemons ignore it.
+func HandleClientConnTailSince(conn *tls.Conn, w io.Writer, since time.Time) error {
+	if err := subscribeTail(conn, since); err != nil {
+		return err
+	}
+	return goio.ReadStream(conn, w)
+}
+
+func subscribeTail(conn *tls.Conn, since time.Time) error {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return err
+	}
+	var input string
+	if !since.IsZero() {
+		input = url.Values{"since": {since.Format(time.RFC3339Nano)}}.Encode()
+	}
+	return SendCommand(conn, CommandTAIL, input)
+}
+
+// The bounds of the delay between attempts to reconnect a tail.
+const (
+	TailRetryMin = time.Second
+	TailRetryMax = time.Minute
+)
+
+// The delay before reconnect attempt n, counting from zero. It doubles from
+// TailRetryMin up to max, less up to half of it at random so clients cut off
+// together don't all come back at once.
+func TailBackoff(n int, max time.Duration) time.Duration {
+	d := TailRetryMin
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// Tails the daemon's events through connections from dial, reconnecting with
+// TailBackoff whenever the connection drops or the daemon restarts. Events
+// replayed on resuming that were already written are dropped. Only a failure
+// to connect the first time or a refusal by the daemon ends it.
+func FollowTail(dial func() (*tls.Conn, error), w io.Writer, max time.Duration) error {
+	dedup := NewEventDedup(w)
+	connected := false
+	for attempt := 0; ; attempt++ {
+		conn, err := dial()
+		if err == nil {
+			if err = subscribeTail(conn, dedup.Last()); err == nil {
+				// Got through to the stream, start the backoff over.
+				connected, attempt = true, 0
+				err = goio.ReadStream(conn, dedup)
+				dedup.Flush()
+			}
+			conn.Close()
+		}
+		var rse *RemoteStatusError
+		if !connected || errors.As(err, &rse) {
+			return err
+		}
+		delay := TailBackoff(attempt, max)
+		if err != nil {
+			fmt.Fprintf(MessageOutput, "Lost the daemon: %v, reconnecting in %s\n", err, delay.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(MessageOutput, "The daemon ended the stream, reconnecting in %s\n", delay.Round(time.Millisecond))
+		}
+		time.Sleep(delay)
+	}
+}
+
+// How many recent events an EventDedup remembers.
+const dedupSize = eventBuffer * 2
+
+// Passes lines of JSON events through to w, dropping events it passed before.
+// Events are told apart by their time, kind, target and deploy ID.
+type EventDedup struct {
+	w     io.Writer
+	buf   []byte
+	seen  map[string]bool
+	order []string
+	last  time.Time
+}
+
+func NewEventDedup(w io.Writer) *EventDedup {
+	return &EventDedup{w: w, seen: make(map[string]bool)}
+}
+
+func (d *EventDedup) Write(b []byte) (int, error) {
+	d.buf = append(d.buf, b...)
+	for {
+		i := bytes.IndexByte(d.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := d.buf[:i+1]
+		if err := d.line(line); err != nil {
+			return len(b), err
+		}
+		d.buf = d.buf[i+1:]
+	}
+}
+
+// Writes out a trailing partial line, the stream ended without its newline.
+func (d *EventDedup) Flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	err := d.line(d.buf)
+	d.buf = nil
+	return err
+}
+
+// The time of the latest event passed through.
+func (d *EventDedup) Last() time.Time {
+	return d.last
+}
+
+func (d *EventDedup) line(line []byte) error {
+	var e Event
+	if err := json.Unmarshal(line, &e); err == nil {
+		key := e.Time.Format(time.RFC3339Nano) + " " + e.Kind + " " + e.Target + " " + e.DeployID
+		if d.seen[key] {
+			return nil
+		}
+		d.seen[key] = true
+		d.order = append(d.order, key)
+		if len(d.order) > dedupSize {
+			delete(d.seen, d.order[0])
+			d.order = d.order[1:]
+		}
+		if e.Time.After(d.last) {
+			d.last = e.Time
+		}
+	}
+	_, err := d.w.Write(line)
+	return err
+}
+
+// Writes each line of JSON events written to it as a line of text to w. Close
+// waits for the last line to be printed.
+func NewEventPrinter(w io.Writer) io.WriteCloser {
+	pr, pw := io.Pipe()
+	p := &eventPrinter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		s := bufio.NewScanner(pr)
+		for s.Scan() {
+			var e Event
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				fmt.Fprintln(w, s.Text())
+				continue
+			}
+			fmt.Fprintf(w, "%s  %-12s %-20s %s %s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Kind, e.Target, e.DeployID, e.User, e.Outcome)
+		}
+		pr.CloseWithError(s.Err())
+	}()
+	return p
+}
+
+type eventPrinter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func (p *eventPrinter) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
+
+func (p *eventPrinter) Close() error {
+	err := p.pw.Close()
+	<-p.done
+	return err
+}
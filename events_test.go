@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+func eventLine(t *testing.T, e Event) string {
+	t.Helper()
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b) + "\n"
+}
+
+func TestEventDedup(t *testing.T) {
+	base := time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC)
+	start := eventLine(t, Event{Time: base, Kind: EventDeployStart, Target: "app", DeployID: "1"})
+	end := eventLine(t, Event{Time: base.Add(time.Second), Kind: EventDeployEnd, Target: "app", DeployID: "1", Outcome: OutcomeSuccess})
+	other := eventLine(t, Event{Time: base, Kind: EventDeployStart, Target: "other", DeployID: "2"})
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"passes through", []string{start, end}, start + end},
+		{"drops a replayed event", []string{start, end, start}, start + end},
+		{"same time other target", []string{start, other}, start + other},
+		{"split across writes", []string{start[:10], start[10:] + end[:5], end[5:]}, start + end},
+		{"resumed stream", []string{start, end, start + end + other}, start + end + other},
+		{"not an event", []string{"keepalive\n", "keepalive\n"}, "keepalive\nkeepalive\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		d := NewEventDedup(&buf)
+		for _, w := range tt.writes {
+			if _, err := d.Write([]byte(w)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrote\n%s\nwant\n%s", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestEventDedupLastAndFlush(t *testing.T) {
+	base := time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	d := NewEventDedup(&buf)
+	if !d.Last().IsZero() {
+		t.Fatal("Last of nothing isn't zero")
+	}
+	late := eventLine(t, Event{Time: base.Add(time.Minute), Kind: EventRollback, Target: "app"})
+	early := eventLine(t, Event{Time: base, Kind: EventDeployStart, Target: "app"})
+	d.Write([]byte(late + strings.TrimSuffix(early, "\n")))
+	if !d.Last().Equal(base.Add(time.Minute)) {
+		t.Errorf("Last = %s before the partial line is flushed", d.Last())
+	}
+	d.Flush()
+	if buf.String() != late+strings.TrimSuffix(early, "\n") {
+		t.Errorf("the partial line wasn't flushed: %q", buf.String())
+	}
+	// An earlier event doesn't move Last back.
+	if !d.Last().Equal(base.Add(time.Minute)) {
+		t.Errorf("Last = %s after an earlier event", d.Last())
+	}
+}
+
+func TestEventDedupForgetsOldest(t *testing.T) {
+	base := time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	d := NewEventDedup(&buf)
+	first := eventLine(t, Event{Time: base, Kind: EventDeployStart, Target: "app"})
+	d.Write([]byte(first))
+	for i := 1; i <= dedupSize; i++ {
+		d.Write([]byte(eventLine(t, Event{Time: base.Add(time.Duration(i) * time.Second), Kind: EventDeployStart, Target: "app"})))
+	}
+	buf.Reset()
+	d.Write([]byte(first))
+	if buf.String() != first {
+		t.Error("an event past dedupSize ago was still remembered")
+	}
+}
+
+// The number of subscribers of the hub.
+func subscribers(h *EventHub) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func TestTailDelivers(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Operators = []string{"tester"} })
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	conn := d.Dial(t)
+	go func() {
+		pw.CloseWithError(HandleClientConnTail(conn, pw))
+	}()
+	waitFor(t, "the subscription", func() bool { return subscribers(d.Events) == 1 })
+
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(pr)
+	for _, want := range []string{EventDeployStart, EventDeployEnd} {
+		if !lines.Scan() {
+			t.Fatalf("the stream ended before %s: %v", want, lines.Err())
+		}
+		var e Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind != want || e.Target != "app" || e.User != "tester" {
+			t.Errorf("got %+v, want a %s of app by tester", e, want)
+		}
+		if want == EventDeployEnd && e.Outcome != OutcomeSuccess {
+			t.Errorf("the deploy ended with %s", e.Outcome)
+		}
+	}
+}
+
+func TestTailUnsubscribesOnDisconnect(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Operators = []string{"tester"} })
+	conn := d.Dial(t)
+	go HandleClientConnTail(conn, ioutil.Discard)
+	waitFor(t, "the subscription", func() bool { return subscribers(d.Events) == 1 })
+	// Nothing is published, the daemon notices the client leaving anyway.
+	conn.Close()
+	waitFor(t, "the subscription to end", func() bool { return subscribers(d.Events) == 0 })
+}
+
+func TestTailNotOperator(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	err := HandleClientConnTail(d.Dial(t), ioutil.Discard)
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("got %v, want StatusBlocked", err)
+	}
+	if n := subscribers(d.Events); n != 0 {
+		t.Errorf("%d subscribers", n)
+	}
+}
+
+func TestTailBackoff(t *testing.T) {
+	tests := []struct {
+		n    int
+		max  time.Duration
+		want time.Duration
+	}{
+		{0, time.Minute, TailRetryMin},
+		{1, time.Minute, 2 * TailRetryMin},
+		{3, time.Minute, 8 * TailRetryMin},
+		{10, time.Minute, time.Minute},
+		{1000, time.Minute, time.Minute},
+		{5, 3 * time.Second, 3 * time.Second},
+		{0, 10 * time.Millisecond, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		// Up to half of the delay is jitter.
+		for i := 0; i < 100; i++ {
+			if got := TailBackoff(tt.n, tt.max); got > tt.want || got < tt.want/2 {
+				t.Fatalf("TailBackoff(%d, %s) = %s, want between %s and %s", tt.n, tt.max, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestFollowTailGivesUp(t *testing.T) {
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	MessageOutput = ioutil.Discard
+
+	refused := errors.New("connection refused")
+	dials := 0
+	err := FollowTail(func() (*tls.Conn, error) {
+		dials++
+		return nil, refused
+	}, ioutil.Discard, time.Millisecond)
+	if err != refused || dials != 1 {
+		t.Errorf("a failing first dial gave %v after %d dials", err, dials)
+	}
+
+	d := newTestDaemon(t, nil)
+	dials = 0
+	err = FollowTail(func() (*tls.Conn, error) {
+		dials++
+		return d.Dial(t), nil
+	}, ioutil.Discard, time.Millisecond)
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusBlocked || dials != 1 {
+		t.Errorf("a refused tail gave %v after %d dials", err, dials)
+	}
+}
+
+func TestFollowTailReconnects(t *testing.T) {
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	MessageOutput = ioutil.Discard
+
+	d := newTestDaemon(t, func(c *Config) { c.Operators = []string{"tester"} })
+	conns := make(chan *tls.Conn, 2)
+	dials := 0
+	dial := func() (*tls.Conn, error) {
+		dials++
+		switch dials {
+		case 1:
+		case 2:
+			// Published while disconnected, the resumed tail replays it.
+			d.Events.Publish(Event{Kind: EventDeployEnd, Target: "app"})
+		default:
+			// Ends the tail, a refusal isn't retried.
+			return fakeServer(t, func(c *tls.Conn) {
+				goio.ReadCommand(c)
+				goio.NotOk(c, StatusBlocked, "No longer an operator.")
+			}), nil
+		}
+		conn := d.Dial(t)
+		conns <- conn
+		return conn, nil
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	errc := make(chan error, 1)
+	go func() {
+		err := FollowTail(dial, pw, 10*time.Millisecond)
+		pw.Close()
+		errc <- err
+	}()
+
+	lines := bufio.NewScanner(pr)
+	next := func() Event {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("the tail ended: %v", lines.Err())
+		}
+		var e Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	conn := <-conns
+	waitFor(t, "the subscription", func() bool { return subscribers(d.Events) == 1 })
+	d.Events.Publish(Event{Kind: EventDeployStart, Target: "app"})
+	if e := next(); e.Kind != EventDeployStart {
+		t.Errorf("got %+v, want the deploy's start", e)
+	}
+	conn.Close()
+
+	// The start is replayed too, it isn't written twice.
+	if e := next(); e.Kind != EventDeployEnd {
+		t.Errorf("got %+v after reconnecting, want the deploy's end", e)
+	}
+	(<-conns).Close()
+	if lines.Scan() {
+		t.Errorf("got %s after the refusal", lines.Text())
+	}
+	var rse *RemoteStatusError
+	if err := <-errc; !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("FollowTail ended with %v, want the refusal", err)
+	}
+	if dials != 3 {
+		t.Errorf("dialed %d times, want 3", dials)
+	}
+}
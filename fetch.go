@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// How long the daemon gives a FETCH download to complete.
+const FetchTimeout = 30 * time.Minute
+
+// Asks the daemon to download the payload from URL and deploy it, instead of
+// streaming it over the connection.
+type FetchRequest struct {
+	DeployRequest
+	URL string
+
+	// Sent as the Authorization header of the download, e.g. "Bearer <token>".
+	Authorization string
+
+	// The hex SHA-256 of the file at URL. When set the daemon refuses a download that doesn't match.
+	SHA256 string
+}
+
+func (r FetchRequest) Encode() string {
+	v := r.DeployRequest.values()
+	v.Set("url", r.URL)
+	if r.Authorization != "" {
+		v.Set("auth", r.Authorization)
+	}
+	if r.SHA256 != "" {
+		v.Set("sha256", r.SHA256)
+	}
+	return r.Target + "?" + v.Encode()
+}
+
+func ParseFetchRequest(input string) (FetchRequest, error) {
+	var r FetchRequest
+	req, err := ParseDeployRequest(input)
+	if err != nil {
+		return r, err
+	}
+	r.DeployRequest = req
+	if xs := strings.SplitN(input, "?", 2); len(xs) == 2 {
+		v, err := url.ParseQuery(xs[1])
+		if err != nil {
+			return r, err
+		}
+		r.URL = v.Get("url")
+		r.Authorization = v.Get("auth")
+		r.SHA256 = strings.ToLower(v.Get("sha256"))
+	}
+	if r.URL == "" {
+		return r, errors.New("missing url")
+	}
+	return r, nil
+}
+
+// Reports whether the http or https URL is within one of the prefixes: it has the
+// prefix's scheme and host and a path under the prefix's. The path is compared by
+// whole segments, so a longer directory name doesn't match even without a
+// trailing / on the prefix.
+func IsFetchAllowed(rawurl string, prefixes []string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	// The server may resolve .. and step outside the prefix.
+	for _, v := range strings.Split(u.Path, "/") {
+		if v == ".." {
+			return false
+		}
+	}
+	for _, prefix := range prefixes {
+		p, err := url.Parse(prefix)
+		if prefix == "" || err != nil || p.Scheme != u.Scheme || !strings.EqualFold(p.Host, u.Host) {
+			continue
+		}
+		if p.Path == "" || strings.HasSuffix(p.Path, "/") {
+			if strings.HasPrefix(u.Path, p.Path) {
+				return true
+			}
+		} else if u.Path == p.Path || strings.HasPrefix(u.Path, p.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Downloads the payload from a URL allowed by FetchPrefixes and deploys it like
+// DEPLOY. The only reply is the final status.
+func (ctx ServerContext) HandleFetch(signature, input string) error {
+	if len(ctx.Config.FetchPrefixes) == 0 {
+		return goio.NotOk(ctx.C, StatusUnsupported, "Fetching payloads is not enabled on this server.")
+	}
+	fetch, err := ParseFetchRequest(input)
+	if err != nil {
+		return goio.NotOk(ctx.C, StatusNotOK, "Malformed fetch request.")
+	}
+	name, req, target, err := ctx.CheckDeploy(signature, fetch.DeployRequest.Encode())
+	if target == nil {
+		return err
+	}
+	if !IsFetchAllowed(fetch.URL, ctx.Config.FetchPrefixes) {
+		ctx.Log.Printf("Refused to fetch %s for %s", fetch.URL, name)
+		return goio.NotOk(ctx.C, StatusBlocked, "The URL is not one the server may fetch from.")
+	}
+	return ctx.Deploy(name, target, req, func(target *Target, req DeployRequest) (string, string, error) {
+		return ctx.FetchPayload(target, req, fetch)
+	})
+}
+
+// Downloads and unpacks the payload like ReceivePayload does the stream.
+func (ctx ServerContext) FetchPayload(target *Target, req DeployRequest, fetch FetchRequest) (tmpdir, payload string, err error) {
+	f, err := ioutil.TempFile(os.TempDir(), TempPattern(req.ID)+"payload-")
+	if err != nil {
+		ctx.Log.Println(err.Error())
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "There was an error creating a temporary file.")
+	}
+	defer func() {
+		f.Close()
+		if tmpdir == "" {
+			ctx.DisposePayload(f.Name(), req.ID, true)
+		}
+	}()
+
+	hreq, err := http.NewRequest(http.MethodGet, fetch.URL, nil)
+	if err != nil {
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "Malformed fetch request.")
+	}
+	if fetch.Authorization != "" {
+		hreq.Header.Set("Authorization", fetch.Authorization)
+	}
+	client := &http.Client{
+		Timeout: FetchTimeout,
+		// A redirect must stay within the allowed prefixes too.
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if !IsFetchAllowed(r.URL.String(), ctx.Config.FetchPrefixes) {
+				return fmt.Errorf("redirected to %s which is not allowed", r.URL)
+			}
+			return nil
+		},
+	}
+	ctx.Log.Printf("Fetching %s for %s", fetch.URL, target.Name)
+	resp, err := client.Do(hreq)
+	if err != nil {
+		ctx.Log.Printf("Fetch error: %s", err.Error())
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "Failed to download the payload.")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("Downloading the payload failed with %s.", resp.Status))
+	}
+
+	limit := ctx.Config.PayloadLimit(target)
+	received := &limitWriter{w: f, limit: limit}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(received, hash), resp.Body); errors.Is(err, ErrPayloadTooBig) {
+		ctx.Log.Printf("Payload for %s exceeded %d bytes", target.Name, limit)
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The payload exceeds the %d byte limit of target %s.", limit, target.Name))
+	} else if err != nil {
+		ctx.Log.Printf("Fetch error: %s", err.Error())
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "The download was broken.")
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); fetch.SHA256 != "" && sum != fetch.SHA256 {
+		ctx.Log.Printf("Fetched payload for %s has SHA-256 %s, expected %s", target.Name, sum, fetch.SHA256)
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The downloaded payload's SHA-256 is %s, not the expected %s.", sum, fetch.SHA256))
+	}
+	ctx.Log.Printf("Fetched %d bytes for %s", received.n, target.Name)
+	tmpdir, err = ctx.UnpackPayload(target, req, f, received.n)
+	return tmpdir, f.Name(), err
+}
+
+// The compression of the file at rawurl going by its extension, ".gz" or ".tgz"
+// for gzip.
+func URLCompression(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	if strings.HasSuffix(u.Path, ".gz") || strings.HasSuffix(u.Path, ".tgz") {
+		return CompressionGzip
+	}
+	return ""
+}
+
+// Asks the daemon to fetch and deploy the payload.
+func HandleClientConnFetch(conn *tls.Conn, req FetchRequest) error {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return err
+	}
+	return SendCommand(conn, CommandFETCH, req.Encode())
+}
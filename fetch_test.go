@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFetchRequest(t *testing.T) {
+	want := FetchRequest{
+		DeployRequest: DeployRequest{Target: "app", ID: "id", NoBackup: true},
+		URL:           "https://artifacts.example.com/builds/app.tar.gz?version=2&arch=amd64",
+		Authorization: "Bearer t0ken",
+		SHA256:        "ab12",
+	}
+	got, err := ParseFetchRequest(want.Encode())
+	if err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("round trip gave %+v, want %+v", got, want)
+	}
+
+	// The checksum is compared in lower case.
+	if got, err := ParseFetchRequest("app?url=https%3A%2F%2Fa%2Fb&sha256=AB12"); err != nil || got.SHA256 != "ab12" {
+		t.Errorf("upper case checksum parsed to %q, %v", got.SHA256, err)
+	}
+	for _, input := range []string{"app", "app?id=1", "app?url=", "app?url=%zz"} {
+		if _, err := ParseFetchRequest(input); err == nil {
+			t.Errorf("ParseFetchRequest(%q) succeeded", input)
+		}
+	}
+}
+
+func TestIsFetchAllowed(t *testing.T) {
+	prefixes := []string{"https://artifacts.example.com/builds/", "http://10.0.0.5:8080/", ""}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://artifacts.example.com/builds/app.tar.gz", true},
+		{"https://artifacts.example.com/builds/2020/app.tgz?sig=x", true},
+		{"http://10.0.0.5:8080/app.tar", true},
+		{"https://artifacts.example.com/builds", false},
+		{"https://artifacts.example.com/builds-old/app.tar", false},
+		{"https://artifacts.example.com.evil.com/builds/app.tar", false},
+		{"http://artifacts.example.com/builds/app.tar", false},
+		{"https://artifacts.example.com/builds/../secrets/key", false},
+		{"https://artifacts.example.com/builds/%2e%2e/secrets/key", false},
+		{"file:///etc/passwd", false},
+		{"ftp://10.0.0.5:8080/app.tar", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsFetchAllowed(tt.url, prefixes); got != tt.want {
+			t.Errorf("IsFetchAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+	if IsFetchAllowed("https://artifacts.example.com/builds/app.tar", nil) {
+		t.Error("allowed without any prefixes")
+	}
+
+	// Without a trailing / the prefix still matches whole names only.
+	prefixes = []string{"https://files.example.com/app", "https://cdn.example.com"}
+	tests = []struct {
+		url  string
+		want bool
+	}{
+		{"https://files.example.com/app", true},
+		{"https://files.example.com/app/2.tar", true},
+		{"https://FILES.example.com/app/2.tar", true},
+		{"https://files.example.com/apps/2.tar", false},
+		{"https://files.example.com/app.tar", false},
+		{"https://files.example.com.evil.com/app/2.tar", false},
+		{"https://files.example.com@evil.com/app/2.tar", false},
+		{"https://files.example.com:8443/app/2.tar", false},
+		{"https://cdn.example.com/any/app.tar", true},
+		{"https://cdn.example.com.evil.com/app.tar", false},
+	}
+	for _, tt := range tests {
+		if got := IsFetchAllowed(tt.url, prefixes); got != tt.want {
+			t.Errorf("IsFetchAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFetchPrefixes(t *testing.T) {
+	for _, prefix := range []string{"", "artifacts.example.com/builds/", "ftp://example.com/", "https:///builds/", "%zz"} {
+		conf := Config{FetchPrefixes: []string{prefix}}
+		if err := conf.Validate(); err == nil {
+			t.Errorf("FetchPrefixes %q was accepted", prefix)
+		}
+	}
+	conf := Config{FetchPrefixes: []string{"https://artifacts.example.com/builds/", "http://10.0.0.5:8080"}}
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeployFetch(t *testing.T) {
+	var payload []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/builds/moved.tar" {
+			http.Redirect(w, r, "/elsewhere/app.tar", http.StatusFound)
+			return
+		}
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	d := newTestDaemon(t, func(c *Config) { c.FetchPrefixes = []string{srv.URL + "/builds"} })
+	writeFiles(t, d.Src, map[string]string{"version": "fetched"})
+	var buf bytes.Buffer
+	if err := PackTar(d.Src, &buf, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	payload = buf.Bytes()
+
+	fetch := func(path string) error {
+		return HandleClientConnFetch(d.Dial(t), FetchRequest{DeployRequest: DeployRequest{Target: "app", ID: NewDeployID()}, URL: srv.URL + path})
+	}
+	var rse *RemoteStatusError
+	if err := fetch("/builds-old/app.tar"); !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("fetching outside the prefix gave %v", err)
+	}
+	if err := fetch("/builds/moved.tar"); !errors.As(err, &rse) || !strings.Contains(rse.Message, "Failed to download") {
+		t.Errorf("a redirect outside the prefix gave %v", err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Fatalf("a refused fetch created the target: %v", err)
+	}
+	if err := fetch("/builds/app.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "fetched" {
+		t.Errorf("version holds %q", got)
+	}
+}
+
+func TestURLCompression(t *testing.T) {
+	tests := map[string]string{
+		"https://a/app.tar.gz":         CompressionGzip,
+		"https://a/app.tgz?version=2":  CompressionGzip,
+		"https://a/app.tar":            "",
+		"https://a/app.tar?format=.gz": "",
+	}
+	for url, want := range tests {
+		if got := URLCompression(url); got != want {
+			t.Errorf("URLCompression(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
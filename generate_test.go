@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func fileContents(t *testing.T, names ...string) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	for _, v := range names {
+		if _, err := os.Stat(v); err == nil {
+			m[v] = readFile(t, v)
+		}
+	}
+	return m
+}
+
+func TestGenerateRotate(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "client")
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	first := fileContents(t, loc+".cert", loc+".key")
+
+	if err := cmdGenerate("generate", []string{"-rotate", "-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, loc+".old.cert"); got != first[loc+".cert"] {
+		t.Error("the old certificate wasn't kept as .old.cert")
+	}
+	if got := readFile(t, loc+".old.key"); got != first[loc+".key"] {
+		t.Error("the old key wasn't kept as .old.key")
+	}
+	if got := readFile(t, loc+".cert"); got == first[loc+".cert"] {
+		t.Error("no new certificate was written")
+	}
+	for _, v := range []string{loc + ".new.cert", loc + ".new.key"} {
+		if _, err := os.Stat(v); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", v, err)
+		}
+	}
+
+	// A second rotation would lose the first old key.
+	names := []string{loc + ".cert", loc + ".key", loc + ".old.cert", loc + ".old.key"}
+	before := fileContents(t, names...)
+	var fe *FlagError
+	if err := cmdGenerate("generate", []string{"-rotate", "-common-name", "test", loc}); !errors.As(err, &fe) {
+		t.Fatalf("rotating with .old files present gave %v", err)
+	}
+	if after := fileContents(t, names...); len(after) != 4 || after[loc+".cert"] != before[loc+".cert"] || after[loc+".old.key"] != before[loc+".old.key"] {
+		t.Error("a refused rotation changed the files")
+	}
+}
+
+func TestSwapKeyPairUndo(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "client")
+	writeFiles(t, filepath.Dir(loc), map[string]string{
+		"client.cert":     "cert",
+		"client.key":      "key",
+		"client.new.cert": "new cert",
+	})
+	if err := swapKeyPair(loc); err == nil {
+		t.Fatal("swapped without a new key")
+	}
+	got := fileContents(t, loc+".cert", loc+".key", loc+".new.cert", loc+".old.cert", loc+".old.key")
+	if len(got) != 3 || got[loc+".cert"] != "cert" || got[loc+".key"] != "key" || got[loc+".new.cert"] != "new cert" {
+		t.Errorf("the failed swap left %v", got)
+	}
+}
+
+func TestGenerateForce(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "client")
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{loc + ".cert", loc + ".key"}
+	first := fileContents(t, names...)
+
+	var fe *FlagError
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); !errors.As(err, &fe) || fe.Flag != "force" {
+		t.Fatalf("generating over an existing pair gave %v", err)
+	}
+	if after := fileContents(t, names...); after[loc+".cert"] != first[loc+".cert"] || after[loc+".key"] != first[loc+".key"] {
+		t.Error("a refused generate changed the files")
+	}
+
+	// Either file alone is refused too.
+	if err := os.Remove(loc + ".cert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); !errors.As(err, &fe) {
+		t.Fatalf("generating over an existing key gave %v", err)
+	}
+
+	if err := cmdGenerate("generate", []string{"-force", "-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileContents(t, names...); len(after) != 2 || after[loc+".key"] == first[loc+".key"] {
+		t.Error("-force didn't write a new pair")
+	}
+}
+
+func TestGenerateKeyMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no file modes to check")
+	}
+	requireModes := func(loc string) {
+		t.Helper()
+		for fn, want := range map[string]os.FileMode{loc + ".key": KeyFileMode, loc + ".cert": CertFileMode} {
+			if info, err := os.Stat(fn); err != nil {
+				t.Error(err)
+			} else if info.Mode().Perm() != want {
+				t.Errorf("%s has mode %04o, want %04o", fn, info.Mode().Perm(), want)
+			}
+		}
+	}
+	loc := filepath.Join(t.TempDir(), "client")
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	requireModes(loc)
+	if msg := KeyModeWarning(loc + ".key"); msg != "" {
+		t.Errorf("warned about a generated key: %s", msg)
+	}
+
+	// Writing over a readable key makes it private again.
+	if err := os.Chmod(loc+".key", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdGenerate("generate", []string{"-force", "-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	requireModes(loc)
+	if err := cmdGenerate("generate", []string{"-rotate", "-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	requireModes(loc)
+}
+
+func TestKeyModeWarning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no file modes to check")
+	}
+	fn := filepath.Join(t.TempDir(), "client.key")
+	writeFiles(t, filepath.Dir(fn), map[string]string{"client.key": "key"})
+	for _, mode := range []os.FileMode{0644, 0640, 0604} {
+		if err := os.Chmod(fn, mode); err != nil {
+			t.Fatal(err)
+		}
+		if msg := KeyModeWarning(fn); !strings.Contains(msg, fmt.Sprintf("mode %04o", mode)) {
+			t.Errorf("mode %04o warned %q", mode, msg)
+		}
+	}
+	for _, mode := range []os.FileMode{0600, 0400} {
+		if err := os.Chmod(fn, mode); err != nil {
+			t.Fatal(err)
+		}
+		if msg := KeyModeWarning(fn); msg != "" {
+			t.Errorf("mode %04o warned %q", mode, msg)
+		}
+	}
+	if msg := KeyModeWarning("env:DCTL_TEST_KEY"); msg != "" {
+		t.Errorf("warned about a PEM source: %s", msg)
+	}
+	if msg := KeyModeWarning(filepath.Join(t.TempDir(), "missing.key")); msg != "" {
+		t.Errorf("warned about a missing key: %s", msg)
+	}
+}
+
+func TestGenerateCommonNameAndSANs(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "daemon")
+	args := []string{"-common-name", "deploy.example.com", "-san", "deploy.example.com,127.0.0.1", "-san", "::1", "-san", "deploy", loc}
+	if err := cmdGenerate("generate", args); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificate(loc + ".cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "deploy.example.com" {
+		t.Errorf("common name %q", cert.Subject.CommonName)
+	}
+	if got := strings.Join(cert.DNSNames, ","); got != "deploy.example.com,deploy" {
+		t.Errorf("DNS names %s", got)
+	}
+	if len(cert.IPAddresses) != 2 || cert.IPAddresses[0].String() != "127.0.0.1" || cert.IPAddresses[1].String() != "::1" {
+		t.Errorf("IP addresses %v", cert.IPAddresses)
+	}
+	for _, host := range []string{"deploy.example.com", "deploy", "127.0.0.1", "::1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+	if err := cert.VerifyHostname("other.example.com"); err == nil {
+		t.Error("the certificate is valid for a host it doesn't name")
+	}
+	if _, err := LoadKeyPair(loc+".cert", loc+".key"); err != nil {
+		t.Errorf("the written key doesn't match: %v", err)
+	}
+
+	// Only a common name is enough to be written the same way.
+	loc = filepath.Join(t.TempDir(), "client")
+	if err := cmdGenerate("generate", []string{"-common-name", "alice", loc}); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := LoadCertificate(loc + ".cert"); err != nil {
+		t.Fatal(err)
+	} else if cert.Subject.CommonName != "alice" || len(cert.DNSNames)+len(cert.IPAddresses) != 0 {
+		t.Errorf("got common name %q and SANs %v %v", cert.Subject.CommonName, cert.DNSNames, cert.IPAddresses)
+	}
+}
+
+func TestGenerateCreatesDefaultDir(t *testing.T) {
+	home := t.TempDir()
+	conf, usr := filepath.Join(home, "conf"), filepath.Join(home, "usr")
+	t.Setenv(EnvConfigDir, conf)
+	t.Setenv(EnvUserDir, usr)
+	for _, loc := range []string{AppFilename("daemon"), UsrFilename("client")} {
+		if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+			t.Fatalf("generate %s: %v", loc, err)
+		}
+		if _, err := os.Stat(loc + ".cert"); err != nil {
+			t.Error(err)
+		}
+	}
+	// Other missing directories are still refused.
+	var fe *FlagError
+	if err := cmdGenerate("generate", []string{"-common-name", "test", filepath.Join(home, "other", "client")}); !errors.As(err, &fe) {
+		t.Errorf("generating into a missing directory gave %v", err)
+	}
+}
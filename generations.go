@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// Appended to a target's Filename for the directory its generations are kept in.
+const GenerationsSuffix = ".generations"
+
+// A deploy of a target with Generations, kept in the target's generations
+// directory as <seq>.<timestamp>.
+type Generation struct {
+	Filename string
+	Seq      int
+	Time     time.Time
+
+	// Whether the target's symlink points at it.
+	Live bool
+}
+
+func (t *Target) GenerationsDir() string {
+	return strings.TrimRight(t.Filename, `/\`) + GenerationsSuffix
+}
+
+// Lists the generations of the target, newest first. A target without any has
+// none, not an error.
+func ListGenerations(t *Target) ([]Generation, error) {
+	xs, err := ioutil.ReadDir(t.GenerationsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	link, _ := os.Readlink(strings.TrimRight(t.Filename, `/\`))
+	var gens []Generation
+	for _, v := range xs {
+		xs := strings.SplitN(v.Name(), ".", 2)
+		if len(xs) != 2 {
+			continue
+		}
+		seq, err := strconv.Atoi(xs[0])
+		if err != nil {
+			continue
+		}
+		tm, err := time.ParseInLocation(backupTimeLayout, xs[1], time.Local)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, Generation{
+			Filename: filepath.Join(t.GenerationsDir(), v.Name()),
+			Seq:      seq,
+			Time:     tm,
+			Live:     link != "" && filepath.Base(link) == v.Name(),
+		})
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].Seq > gens[j].Seq
+	})
+	return gens, nil
+}
+
+// The index of the live generation in gens, 0 for the newest when none is live.
+func liveIndex(gens []Generation) int {
+	for i, v := range gens {
+		if v.Live {
+			return i
+		}
+	}
+	return 0
+}
+
+// How the generation at index i of gens is referred to relative to the live
+// one: "current" for it, "current-N" for those before and "current+N" for
+// those after it, as left by a rollback.
+func GenerationLabel(gens []Generation, i int) string {
+	d := i - liveIndex(gens)
+	switch {
+	case d == 0:
+		return "current"
+	case d > 0:
+		return fmt.Sprintf("current-%d", d)
+	}
+	return fmt.Sprintf("current+%d", -d)
+}
+
+// Picks a generation by index, 0 being the newest, by its label, see
+// GenerationLabel, or by timestamp like SelectBackup.
+func SelectGeneration(gens []Generation, selector string) []Generation {
+	pick := func(i int) []Generation {
+		if i < 0 || i >= len(gens) {
+			return nil
+		}
+		return gens[i : i+1]
+	}
+	if selector == "current" {
+		return pick(liveIndex(gens))
+	} else if strings.HasPrefix(selector, "current-") || strings.HasPrefix(selector, "current+") {
+		n, err := strconv.Atoi(selector[len("current")+1:])
+		if err != nil || n < 0 {
+			return nil
+		}
+		// Those before the live one are further down the list.
+		if selector[len("current")] == '+' {
+			n = -n
+		}
+		return pick(liveIndex(gens) + n)
+	}
+	// Four digits or more are a timestamp, a year at least.
+	if i, err := strconv.Atoi(selector); err == nil && len(selector) < 4 {
+		return pick(i)
+	}
+	var matches []Generation
+	for _, v := range gens {
+		if strings.HasPrefix(v.Time.Format(backupTimeLayout), selector) {
+			matches = append(matches, v)
+		}
+	}
+	return matches
+}
+
+func WriteGenerationList(w io.Writer, gens []Generation) {
+	for i, v := range gens {
+		live := ""
+		if v.Live {
+			live = "  live"
+		}
+		fmt.Fprintf(w, "%3d  %-10s  %s  %s%s\n", i, GenerationLabel(gens, i), v.Time.Format(backupTimeLayout), filepath.Base(v.Filename), live)
+	}
+}
+
+// Points the symlink at filename to gen, replacing it in a single rename so the
+// target is never missing.
+func SwitchGeneration(filename, gen string) error {
+	filename = strings.TrimRight(filename, `/\`)
+	link, err := filepath.Rel(filepath.Dir(filename), gen)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".switch"
+	os.Remove(tmp)
+	if err := os.Symlink(link, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Removes all but the newest keep+1 generations of the target, the live one is
+// always kept.
+func PruneGenerations(t *Target, keep int) error {
+	gens, err := ListGenerations(t)
+	if err != nil {
+		return err
+	}
+	for i, v := range gens {
+		if i > keep && !v.Live {
+			if err := os.RemoveAll(v.Filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A deploy of a target with Generations in progress, see PrepareGeneration.
+type GenerationSwap struct {
+	target *Target
+
+	// The generation live before the deploy, empty when there was none.
+	live string
+
+	// Where the payload goes.
+	next string
+}
+
+// Picks the directory the next generation of the target is unpacked into. A
+// target deployed before it had Generations is moved into the generations
+// directory first, as the generation the deploy replaces.
+func PrepareGeneration(t *Target) (*GenerationSwap, error) {
+	dir := t.GenerationsDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	gens, err := ListGenerations(t)
+	if err != nil {
+		return nil, err
+	}
+	seq := 1
+	if len(gens) > 0 {
+		seq = gens[0].Seq + 1
+	}
+	name := func(seq int) string {
+		return filepath.Join(dir, fmt.Sprintf("%06d.%s", seq, time.Now().Format(backupTimeLayout)))
+	}
+	filename := strings.TrimRight(t.Filename, `/\`)
+	s := &GenerationSwap{target: t}
+	info, err := os.Lstat(filename)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSymlink != 0:
+		for _, v := range gens {
+			if v.Live {
+				s.live = v.Filename
+			}
+		}
+		if s.live == "" {
+			return nil, fmt.Errorf("%s is a symlink to something other than its generations", filename)
+		}
+	default:
+		s.live = name(seq)
+		seq++
+		if err := os.Rename(filename, s.live); err != nil {
+			return nil, err
+		}
+		if err := SwitchGeneration(filename, s.live); err != nil {
+			return nil, err
+		}
+	}
+	s.next = name(seq)
+	return s, nil
+}
+
+// Moves the single item in tmpdir into place as the new generation and switches
+// the target over to it.
+func (s *GenerationSwap) Move(tmpdir string) error {
+	if err := MoveTarget(tmpdir, s.next); err != nil {
+		return err
+	}
+	return SwitchGeneration(s.target.Filename, s.next)
+}
+
+// Switches the target back to the generation that was live before and removes
+// the new one. A target that had none is removed again.
+func (s *GenerationSwap) Restore() error {
+	var err error
+	if s.live != "" {
+		err = SwitchGeneration(s.target.Filename, s.live)
+	} else if err = os.Remove(strings.TrimRight(s.target.Filename, `/\`)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.next)
+}
+
+// Switches a target with Generations to the generation selected by the
+// request, listing its generations when none is. Called by HandleRollback with
+// the target locked.
+func (ctx ServerContext) RollbackGeneration(target *Target, name string, req RollbackRequest, dryRun bool) error {
+	gens, err := ListGenerations(target)
+	if err != nil {
+		ctx.Log.Printf("ListGenerations error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to list generations.")
+	}
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+
+	sw := goio.NewStreamWriter(ctx.C)
+	var matches []Generation
+	if req.Select != "" {
+		matches = SelectGeneration(gens, req.Select)
+	}
+	if len(matches) != 1 {
+		if req.Select == "" {
+			fmt.Fprintf(sw, "Generations of %s, select one by index, label or timestamp:\n", target.Name)
+		} else if len(matches) == 0 {
+			fmt.Fprintf(sw, "No generation of %s matches '%s'. Available:\n", target.Name, req.Select)
+		} else {
+			fmt.Fprintf(sw, "'%s' matches %d generations of %s:\n", req.Select, len(matches), target.Name)
+			gens = matches
+		}
+		WriteGenerationList(sw, gens)
+		sw.Terminate()
+		if req.Select == "" {
+			return goio.Ok(ctx.C)
+		}
+		return goio.NotOk(ctx.C, StatusNotExist, "No single generation was selected.")
+	}
+	selected := matches[0]
+	if selected.Live {
+		fmt.Fprintf(sw, "%s is already live.\n", filepath.Base(selected.Filename))
+		sw.Terminate()
+		return goio.Ok(ctx.C)
+	}
+	if dryRun {
+		ctx.Log.Printf("Planned rollback of %s to %s for %s", target.Name, filepath.Base(selected.Filename), name)
+		fmt.Fprintf(sw, "Would switch %s to %s, deployed %s.\n", target.Name, filepath.Base(selected.Filename), selected.Time.Format(time.RFC3339))
+		ctx.WriteScriptPlan(sw, target, name)
+		sw.Terminate()
+		return goio.Ok(ctx.C)
+	}
+	ctx.Log.Printf("Rollback of %s to %s by %s", target.Name, filepath.Base(selected.Filename), name)
+	ctx.Events.Publish(Event{Kind: EventRollback, Target: target.Name, User: name, Outcome: filepath.Base(selected.Filename)})
+	fmt.Fprintf(sw, "Switching %s to %s.\n", target.Name, filepath.Base(selected.Filename))
+	sw.Terminate()
+
+	if err := RunScript(target.Before, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Println(err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Issue running Before script.")
+	}
+	ctx.WaitPreSwap(target)
+	if err := RunScript(target.PreBackup, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Println(err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Issue running PreBackup script, the target was left untouched.")
+	}
+	ctx.RecordDigest(target, "")
+	if err := SwitchGeneration(target.Filename, selected.Filename); err != nil {
+		ctx.Log.Printf("SwitchGeneration error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to switch to the selected generation.")
+	}
+	if err := ctx.RunAfter(target); err != nil {
+		ctx.Log.Printf("After error: %s", err.Error())
+		msg := "Issue running After script."
+		// Like a failed deploy, switch back to what was live before.
+		var live string
+		for _, v := range gens {
+			if v.Live {
+				live = v.Filename
+			}
+		}
+		if live == "" {
+			msg += " No generation was live before so the selected one was left. Please attend."
+		} else if err := SwitchGeneration(target.Filename, live); err != nil {
+			ctx.Log.Printf("SwitchGeneration error: %s", err.Error())
+			msg += " Switching back failed. Please attend."
+		} else if err := ctx.RunAfter(target); err != nil {
+			ctx.Log.Printf("After error: %s", err.Error())
+			msg += fmt.Sprintf(" Switched back to %s but the After script failed again. Please attend.", filepath.Base(live))
+		} else {
+			msg += fmt.Sprintf(" Switched back to %s.", filepath.Base(live))
+		}
+		return goio.NotOk(ctx.C, StatusNotOK, msg)
+	}
+	return goio.Ok(ctx.C)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectGeneration(t *testing.T) {
+	day := time.Date(2020, 12, 31, 0, 0, 0, 0, time.Local)
+	gens := []Generation{
+		{Filename: "3", Seq: 3, Time: day.Add(3 * time.Hour)},
+		{Filename: "2", Seq: 2, Time: day.Add(2 * time.Hour), Live: true},
+		{Filename: "1", Seq: 1, Time: day.Add(-time.Hour)},
+	}
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"0", []string{"3"}},
+		{"2", []string{"1"}},
+		{"3", nil},
+		{"-1", nil},
+		// Relative to the live generation, not the newest.
+		{"current", []string{"2"}},
+		{"current-1", []string{"1"}},
+		{"current-2", nil},
+		{"current+1", []string{"3"}},
+		{"current+2", nil},
+		{"current-x", nil},
+		{"current--1", nil},
+		{"20201231", []string{"3", "2"}},
+		{"20201230", []string{"1"}},
+		{"20201231030000", []string{"3"}},
+		{"2019", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, v := range SelectGeneration(gens, tt.selector) {
+			got = append(got, v.Filename)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("SelectGeneration(%q) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+	// None live counts from the newest.
+	gens[1].Live = false
+	if got := SelectGeneration(gens, "current-1"); len(got) != 1 || got[0].Filename != "2" {
+		t.Errorf("SelectGeneration(current-1) with none live = %v", got)
+	}
+}
+
+func TestGenerationLabel(t *testing.T) {
+	gens := []Generation{{Seq: 3}, {Seq: 2, Live: true}, {Seq: 1}}
+	for i, want := range []string{"current+1", "current", "current-1"} {
+		if got := GenerationLabel(gens, i); got != want {
+			t.Errorf("GenerationLabel(%d) = %q, want %q", i, got, want)
+		}
+		// Each label selects the generation it was given for.
+		if got := SelectGeneration(gens, want); len(got) != 1 || got[0].Seq != gens[i].Seq {
+			t.Errorf("SelectGeneration(%q) = %v, want generation %d", want, got, gens[i].Seq)
+		}
+	}
+}
+
+func newGenerationsDaemon(t *testing.T, keep int) *testDaemon {
+	return newTestDaemon(t, func(c *Config) {
+		c.Targets[0].Generations = keep
+	})
+}
+
+func liveContent(t *testing.T, d *testDaemon) string {
+	t.Helper()
+	info, err := os.Lstat(d.Target().Filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("%s is not a symlink", d.Target().Filename)
+	}
+	return readFile(t, filepath.Join(d.Target().Filename, "version"))
+}
+
+func generationSeqs(t *testing.T, d *testDaemon) (seqs []int, live int) {
+	t.Helper()
+	gens, err := ListGenerations(d.Target())
+	if err != nil {
+		t.Fatal(err)
+	}
+	live = -1
+	for i, v := range gens {
+		seqs = append(seqs, v.Seq)
+		if v.Live {
+			live = i
+		}
+	}
+	return seqs, live
+}
+
+func TestGenerationsRotate(t *testing.T) {
+	d := newGenerationsDaemon(t, 2)
+	for i, v := range []string{"1", "2", "3", "4"} {
+		if err := d.Deploy(t, map[string]string{"version": v}); err != nil {
+			t.Fatalf("deploy %d: %v", i, err)
+		}
+		if got := liveContent(t, d); got != v {
+			t.Fatalf("deploy %d: live generation holds %q, want %q", i, got, v)
+		}
+	}
+	// The live generation and the 2 before it are kept.
+	seqs, live := generationSeqs(t, d)
+	if len(seqs) != 3 || seqs[0] != 4 || seqs[2] != 2 || live != 0 {
+		t.Fatalf("generations %v live at %d, want [4 3 2] live at 0", seqs, live)
+	}
+	if _, err := os.Stat(d.Config.BackupDirectory); !os.IsNotExist(err) {
+		t.Errorf("a backup directory was created: %v", err)
+	}
+}
+
+func TestGenerationsFailedDeploySwitchesBack(t *testing.T) {
+	d := newGenerationsDaemon(t, 2)
+	if err := d.Deploy(t, map[string]string{"version": "good"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = "false"
+	if err := d.Deploy(t, map[string]string{"version": "bad"}); err == nil {
+		t.Fatal("deploy with a failing After succeeded")
+	}
+	if got := liveContent(t, d); got != "good" {
+		t.Fatalf("live generation holds %q after a failed deploy", got)
+	}
+	if seqs, _ := generationSeqs(t, d); len(seqs) != 1 {
+		t.Fatalf("the failed generation was kept: %v", seqs)
+	}
+}
+
+func TestGenerationsRollback(t *testing.T) {
+	d := newGenerationsDaemon(t, 3)
+	for _, v := range []string{"1", "2", "3"} {
+		if err := d.Deploy(t, map[string]string{"version": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollback := func(selector string) (string, error) {
+		var buf bytes.Buffer
+		err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: selector}, &buf)
+		return buf.String(), err
+	}
+
+	list, err := rollback("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(list, "current-2") || strings.Count(list, "live") != 1 {
+		t.Fatalf("unexpected list:\n%s", list)
+	}
+
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{"current-2", "1"},
+		// Relative to the rolled back generation.
+		{"current+1", "2"},
+		{"current+1", "3"},
+		{"1", "2"},
+		{"current", "2"},
+	}
+	for _, tt := range tests {
+		if _, err := rollback(tt.selector); err != nil {
+			t.Fatalf("rollback %s: %v", tt.selector, err)
+		}
+		if got := liveContent(t, d); got != tt.want {
+			t.Fatalf("rollback %s: live generation holds %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+	if _, err := rollback("current-5"); err == nil {
+		t.Fatal("rollback to a missing generation succeeded")
+	}
+}
+
+func TestGenerationsRollbackAfterFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the After script is a shell script")
+	}
+	d := newGenerationsDaemon(t, 3)
+	for _, v := range []string{"1", "2"} {
+		if err := d.Deploy(t, map[string]string{"version": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Fails only while the first version is live.
+	after := filepath.Join(t.TempDir(), "after.sh")
+	body := "#!/bin/sh\n! grep -q 1 " + filepath.Join(d.Target().Filename, "version") + "\n"
+	if err := ioutil.WriteFile(after, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = after
+	var buf bytes.Buffer
+	err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: "current-1"}, &buf)
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "Switched back") {
+		t.Fatalf("a rollback whose After fails gave %v", err)
+	}
+	if got := liveContent(t, d); got != "2" {
+		t.Errorf("live generation holds %q, want the one live before the rollback", got)
+	}
+}
+
+func TestGenerationsAdoptExistingTarget(t *testing.T) {
+	d := newGenerationsDaemon(t, 1)
+	writeFiles(t, d.Target().Filename, map[string]string{"version": "plain"})
+	if err := d.Deploy(t, map[string]string{"version": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := liveContent(t, d); got != "new" {
+		t.Fatalf("live generation holds %q", got)
+	}
+	var buf bytes.Buffer
+	if err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: "current-1"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := liveContent(t, d); got != "plain" {
+		t.Fatalf("rolled back to %q, want the adopted target", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Reports whether dir is inside a git work tree and git can be run.
+func IsGitRepo(dir string) bool {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// Writes the tree of dir at ref, as git archive produces it, to w as a tar
+// holding a single directory named like dir, the same shape PackTar gives.
+// Only committed files are included, honoring export-ignore attributes. The
+// global header git adds with the commit ID is dropped, the daemon would take
+// it for a second item.
+func GitArchive(dir, ref string, w io.Writer) error {
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("'%s' is not a git ref", ref)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", abs, "archive", "--format=tar", "--prefix="+filepath.Base(abs)+"/", ref)
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	reader := tar.NewReader(out)
+	writer := tar.NewWriter(w)
+	err = func() error {
+		for {
+			h, err := reader.Next()
+			if err == io.EOF {
+				return writer.Close()
+			} else if err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			if err := writer.WriteHeader(h); err != nil {
+				return err
+			}
+			if _, err := io.Copy(writer, reader); err != nil {
+				return err
+			}
+		}
+	}()
+	if err != nil {
+		// Let git exit rather than block on a full pipe.
+		io.Copy(ioutil.Discard, out)
+	}
+	if werr := cmd.Wait(); werr != nil {
+		return fmt.Errorf("git archive %s: %v: %s", ref, werr, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
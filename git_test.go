@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Makes dir a git repository with the files committed, skipping the test when
+// git isn't installed.
+func gitRepo(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	writeFiles(t, dir, files)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "test"},
+	} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		// Keep the user's and system config out of it.
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
+func TestGitArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	gitRepo(t, dir, map[string]string{"version": "1", "conf/app.ini": "x"})
+	// Neither reaches the archive.
+	writeFiles(t, dir, map[string]string{"version": "uncommitted", "untracked": "x"})
+	if !IsGitRepo(dir) {
+		t.Fatal("IsGitRepo of a repository is false")
+	}
+	if IsGitRepo(t.TempDir()) {
+		t.Error("IsGitRepo of a plain directory is true")
+	}
+
+	var buf bytes.Buffer
+	if err := GitArchive(dir, "HEAD", &buf); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	r := tar.NewReader(&buf)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			t.Error("the global header was kept")
+		}
+		if !strings.HasPrefix(h.Name, "app/") {
+			t.Errorf("%s is outside the single item app", h.Name)
+		}
+		b, _ := ioutil.ReadAll(r)
+		got[h.Name] = string(b)
+	}
+	if got["app/version"] != "1" || got["app/conf/app.ini"] != "x" {
+		t.Errorf("got %v, want the committed files", got)
+	}
+	if _, ok := got["app/untracked"]; ok {
+		t.Error("an untracked file was archived")
+	}
+
+	for _, ref := range []string{"no-such-ref", "--output=/tmp/x"} {
+		if err := GitArchive(dir, ref, ioutil.Discard); err == nil {
+			t.Errorf("GitArchive of %q succeeded", ref)
+		}
+	}
+}
+
+func TestDeployGitRef(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	gitRepo(t, d.Src, map[string]string{"version": "1"})
+	writeFiles(t, d.Src, map[string]string{"version": "uncommitted"})
+	if _, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{GitRef: "HEAD"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q, want the committed 1", got)
+	}
+	// The repository itself isn't sent.
+	if _, err := os.Stat(filepath.Join(d.Target().Filename, ".git")); !os.IsNotExist(err) {
+		t.Errorf(".git was deployed: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A daemon serving on a random localhost port for the duration of a test, with
+// a single target "app" the user "tester" may deploy.
+type testDaemon struct {
+	Config *Config
+
+	// A directory named app to deploy from.
+	Src string
+
+	// Whether the daemon is draining.
+	Drain *DrainState
+
+	// The daemon's events, for TAIL.
+	Events *EventHub
+
+	address    string
+	client     *tls.Config
+	serverConf *tls.Config
+	serve      func(l net.Listener)
+}
+
+func newTestDaemon(t *testing.T, mod func(*Config)) *testDaemon {
+	t.Helper()
+	dir := t.TempDir()
+	serverCert, err := GenerateKeyPair("test", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := GenerateKeyPair("test", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(keys, []byte(GetSignature(clientCert.Leaf)+" tester\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &testDaemon{Src: filepath.Join(dir, "src", "app"), Drain: &DrainState{}, Events: &EventHub{}}
+	if err := os.MkdirAll(d.Src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.Config = &Config{
+		AuthorizedKeys:  keys,
+		BackupDirectory: filepath.Join(dir, "backups"),
+		Targets: []Target{{
+			Name:       "app",
+			Authorized: []string{"tester"},
+			Filename:   filepath.Join(dir, "deploy", "app"),
+		}},
+	}
+	if mod != nil {
+		mod(d.Config)
+	}
+	if err := d.Config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConf := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert}
+	if err := d.Config.ApplyTLS(serverConf); err != nil {
+		t.Fatal(err)
+	}
+	stages, results, locks := &StageStore{}, &ResultStore{}, &TargetLocks{}
+	d.serverConf = serverConf
+	d.serve = func(l net.Listener) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				HandleServerConn(ServerContext{
+					C:       tls.Server(conn, serverConf),
+					Config:  d.Config,
+					Log:     log.New(ioutil.Discard, "", 0),
+					Drain:   d.Drain,
+					Events:  d.Events,
+					Stages:  stages,
+					Results: results,
+					Locks:   locks,
+				})
+			}()
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go d.serve(l)
+	d.address = l.Addr().String()
+	d.client = &tls.Config{Certificates: []tls.Certificate{clientCert}, InsecureSkipVerify: true}
+	return d
+}
+
+// Serves the client commands, which like the daemon's listener wrap the TLS
+// connection in another. Returns the address to give them and the flags for the
+// tester's credentials.
+func (d *testDaemon) ListenCLI(t *testing.T) (address string, flags []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go d.serve(tls.NewListener(l, d.serverConf))
+	return l.Addr().String(), d.CLIFlags(t)
+}
+
+// Writes the tester's certificate & key and returns the flags for a client
+// command to use them, pinning the daemon's certificate.
+func (d *testDaemon) CLIFlags(t *testing.T) []string {
+	t.Helper()
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.cert"), filepath.Join(dir, "client.key")
+	if err := WriteKeyPair(d.client.Certificates[0], cert, key); err != nil {
+		t.Fatal(err)
+	}
+	return []string{"-cert", cert, "-key", key, "-pin", GetSignature(d.serverConf.Certificates[0].Leaf)}
+}
+
+func (d *testDaemon) Target() *Target {
+	return &d.Config.Targets[0]
+}
+
+func (d *testDaemon) Dial(t *testing.T) *tls.Conn {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", d.address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	conn := tls.Client(&deadlineConn{Conn: c}, d.client)
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn
+}
+
+// Runs serve on the daemon end of a pipe, returning the client end. For replies
+// the real daemon can't be made to send.
+func fakeServer(t *testing.T, serve func(c *tls.Conn)) *tls.Conn {
+	t.Helper()
+	cert, err := GenerateKeyPair("test", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		defer server.Close()
+		serve(tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	}()
+	conn := tls.Client(&deadlineConn{Conn: client}, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn
+}
+
+// Deploys the files, by slash separated path, as the test target.
+func (d *testDaemon) Deploy(t *testing.T, files map[string]string) error {
+	t.Helper()
+	if err := os.RemoveAll(d.Src); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, d.Src, files)
+	_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{})
+	return err
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fp := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
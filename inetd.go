@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The connection a supervisor hands the daemon with -inetd: the socket systemd
+// passes with Accept=yes, otherwise stdin. When stdin isn't a socket, e.g. a
+// pipe from ssh, stdin and stdout together make up the connection.
+func InetdConn() (net.Conn, error) {
+	if os.Getenv("LISTEN_FDS") == "1" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		return net.FileConn(os.NewFile(3, "systemd"))
+	}
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return conn, nil
+	}
+	return &stdioConn{r: os.Stdin, w: os.Stdout}, nil
+}
+
+// A net.Conn reading from r and writing to w. Deadlines aren't supported, they
+// are left to the supervisor.
+type stdioConn struct {
+	r *os.File
+	w *os.File
+}
+
+func (c *stdioConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *stdioConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *stdioConn) Close() error {
+	err := c.r.Close()
+	if werr := c.w.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
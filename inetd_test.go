@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// A listener accepting only conn, as the daemon serves a single connection
+// with -inetd.
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	return &oneConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, errors.New("listener closed")
+}
+
+func (l *oneConnListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr { return stdioAddr{} }
+
+// Points os.Stdin and os.Stdout at pipes for the test, returning the ends a
+// supervisor would hold.
+func pipeStdio(t *testing.T) (stdin, stdout *os.File) {
+	t.Helper()
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inR, outW
+	t.Cleanup(func() {
+		os.Stdin, os.Stdout = oldIn, oldOut
+		for _, f := range []*os.File{inR, inW, outR, outW} {
+			f.Close()
+		}
+	})
+	return inW, outR
+}
+
+func TestInetdPipe(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	d := newTestDaemon(t, nil)
+	stdin, stdout := pipeStdio(t)
+	conn, err := InetdConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.(*stdioConn); !ok {
+		t.Fatalf("stdin being a pipe gave a %T", conn)
+	}
+	l := newOneConnListener(conn)
+	t.Cleanup(func() { l.Close() })
+	go d.serve(tls.NewListener(l, d.serverConf))
+
+	// The client end speaks TLS over TLS as the commands do.
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	outer := tls.Client(&stdioConn{r: stdout, w: stdin}, d.client)
+	if _, err := HandleClientConn(tls.Client(outer, d.client), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
+
+func TestInetdSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a socket can't be taken as a file on windows")
+	}
+	t.Setenv("LISTEN_FDS", "")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := accepted.(*net.TCPConn).File()
+	accepted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIn := os.Stdin
+	os.Stdin = f
+	defer func() {
+		os.Stdin = oldIn
+		f.Close()
+	}()
+
+	conn, err := InetdConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*stdioConn); ok {
+		t.Fatal("stdin being a socket was served as a pipe")
+	}
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil || b[0] != 'x' {
+		t.Errorf("read %q, %v from the socket", b, err)
+	}
+}
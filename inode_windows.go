@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// Hardlinks are not detected on windows, every file is packed in full.
+func hardlinkKey(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// Renaming over a file that is in use works on unix, the old inode lives on
+// until it is closed.
+func isFileInUse(err error) bool {
+	return false
+}
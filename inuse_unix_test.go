@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsFileInUse(t *testing.T) {
+	for _, err := range []error{
+		&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EBUSY},
+		&os.PathError{Op: "remove", Path: "a", Err: syscall.EACCES},
+		nil,
+	} {
+		if isFileInUse(err) {
+			t.Errorf("isFileInUse(%v) is true on unix", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// Reports whether err is windows refusing to replace a file another process,
+// usually the running target, has open. ERROR_ACCESS_DENIED isn't counted as it
+// is just as likely to be a permissions problem.
+func isFileInUse(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == errorSharingViolation || errno == errorLockViolation
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsFileInUse(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: errorSharingViolation}, true},
+		{&os.PathError{Op: "remove", Path: "a", Err: errorLockViolation}, true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ERROR_ACCESS_DENIED}, false},
+		{&os.PathError{Op: "remove", Path: "a", Err: syscall.ERROR_FILE_NOT_FOUND}, false},
+		{errors.New("sharing violation"), false},
+		{nil, false},
+	} {
+		if got := isFileInUse(tc.err); got != tc.want {
+			t.Errorf("isFileInUse(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -2,19 +2,31 @@ package main
 
 import (
 	"archive/tar"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/tmathews/goio"
+	"github.com/BurntSushi/toml"
 )
 
 const (
@@ -27,237 +39,2165 @@ const (
 	StatusUnsupported
 	StatusNotExist
 	StatusBlocked
+	StatusUpToDate
 )
 
+// Kept out of the block above so the status codes stay what older peers expect.
+const (
+	CommandWHO      = "WHO"
+	CommandROLLBACK = "ROLLBACK"
+	CommandTAIL     = "TAIL"
+	CommandSTAGE    = "STAGE"
+	CommandAPPLY    = "APPLY"
+	CommandFETCH    = "FETCH"
+	CommandPLAN     = "PLAN"
+	CommandLIST     = "LIST"
+	CommandPULL     = "PULL"
+)
+
+const (
+	Version         = "1.1.0"
+	ProtocolVersion = 3
+)
+
+// Sent in reply to a PING asking for info. Older daemons only reply Ok.
+type PingInfo struct {
+	Version  string  `json:"version"`
+	Protocol int     `json:"protocol"`
+	Uptime   float64 `json:"uptime_seconds"`
+	Targets  int     `json:"authorized_targets"`
+
+	// The username the pinging signature resolves to, empty when it is unknown.
+	User string `json:"user,omitempty"`
+
+	// The payload compressions the daemon can unpack, see SupportedCompression.
+	Compression []string `json:"compression,omitempty"`
+
+	// Whether the pinging signature may deploy the target the PING asked about, one of the Access constants. Empty
+	// when no target was asked about.
+	Target string `json:"target,omitempty"`
+	Access string `json:"access,omitempty"`
+
+	// Set when the target's scripts are skipped for the pinging signature, see ScriptAuthorized.
+	NoScripts bool `json:"no_scripts,omitempty"`
+}
+
+// What a PING asking about a target reports. With GenericAuthErrors, or to an
+// unknown signature, a target that doesn't exist is reported as
+// AccessUnauthorized.
+const (
+	AccessAuthorized   = "authorized"
+	AccessUnauthorized = "unauthorized"
+	AccessNonexistent  = "nonexistent"
+)
+
+// The payload compressions daemons understand in a DeployRequest.
+const CompressionGzip = "gzip"
+
+var SupportedCompression = []string{CompressionGzip}
+
 type Config struct {
 	// The absolute filename that holds the signatures. Signatures are base64 encoded public keys with a space following
 	// the username associated with it. These usernames are simply lookup keys in Targets to see if they are allowed to
 	// perform deployments.
 	AuthorizedKeys string
 
-	// All the targets configured for deployment.
-	Targets []Target
+	// Looks up signatures instead of the AuthorizedKeys file when set. Only settable in code, see SignatureStore.
+	Signatures SignatureStore `toml:"-"`
+
+	// All the targets configured for deployment.
+	Targets []Target
+
+	// Target filenames that aren't absolute are resolved against this directory, so one config can serve hosts
+	// laid out alike under different roots. They may not resolve outside it.
+	BaseDirectory string
+
+	// Previous versions of targets that are deployed will be placed here.
+	BackupDirectory string
+
+	// Store backups of directory targets as a single gzipped tar instead of renaming the directory.
+	CompressBackups bool
+
+	// How many files are copied at once when a backup can't be renamed into BackupDirectory because it is on
+	// another filesystem. Zero uses DefaultBackupCopyWorkers, one copies serially.
+	BackupCopyWorkers int
+
+	// How many times renaming the target into BackupDirectory, or a backup back, is attempted when it fails with a
+	// transient error such as EBUSY, waiting RenameRetryDelay in between. They default to InUseAttempts and InUseDelay.
+	RenameAttempts   int
+	RenameRetryDelay Duration
+
+	// How many backups to keep per target after a successful deploy, for the rollback command. Zero deletes the
+	// backup once the deploy succeeds.
+	KeepBackups int
+
+	// The maximum number of entries a payload may contain before it is rejected. Zero means unlimited.
+	MaxEntries int
+
+	// Write each unpacked file under a temporary name and rename it into place once complete.
+	AtomicWrites bool
+
+	// Keep runs of zeros in unpacked files as holes rather than writing them out.
+	SparseFiles bool
+
+	// Fsync unpacked files and the target's directory after it is replaced so a deploy survives power loss. Targets
+	// may also enable it individually.
+	Durable bool
+
+	// Restore extended attributes, such as SELinux contexts or capabilities, sent by clients using -xattrs. Linux
+	// only, restoring some attributes requires the daemon to run as root.
+	PreserveXattrs bool
+
+	// The lowest TLS version accepted by the daemon, e.g. "1.2" or "1.3". Defaults to 1.2.
+	TLSMinVersion string
+
+	// Names of the cipher suites the daemon may negotiate, as listed by tls.CipherSuites. Empty allows Go's defaults.
+	TLSCipherSuites []string
+
+	// Executables that Before & After scripts may run, either absolute paths or base names. Empty allows anything.
+	AllowedCommands []string
+
+	// Paths scripts may not name, as their program or as an argument, including anything beneath them. This is a
+	// heuristic guard, a script can still reach these paths indirectly. Empty disables the check.
+	ProtectedPaths []string
+
+	// Run scripts in the directory holding the target, filepath.Dir of its Filename, so relative commands like
+	// ./restart.sh resolve next to it. Otherwise they run in the daemon's working directory. Targets may override it.
+	ScriptsInTargetDir bool
+
+	// Look up the host name of connecting clients for the logs.
+	ReverseDNS bool
+
+	// Usernames, "*" or "@group"s allowed to tail the daemon's deploy events. Empty allows nobody.
+	Operators []string
+
+	// Where every target's deploy events are posted, unless the target sets its own Webhook.
+	Webhook *Webhook
+
+	// The unix socket the drain command uses to pause and resume deploys. Empty disables it.
+	ControlSocket string
+
+	// A JSON file the bytes transferred by each signature are tallied in, so the tally survives restarts. Empty
+	// keeps it in memory only. Either way the traffic command reads it from the ControlSocket.
+	TrafficFile string
+
+	// Refuse every command from clients whose certificate has expired, even if its signature is authorized.
+	RejectExpiredCerts bool
+
+	// How long a deploy waits for another deploy of the same target to finish before giving up, e.g. "2m". Defaults
+	// to DefaultLockTimeout.
+	LockTimeout Duration
+
+	// How long a payload sent with send -stage waits to be applied before it is removed, e.g. "1h". Defaults to
+	// DefaultStageTimeout.
+	StageTimeout Duration
+
+	// How long a client has to complete the TLS handshake, e.g. "10s". Defaults to DefaultHandshakeTimeout.
+	HandshakeTimeout Duration
+
+	// The largest payload in bytes accepted for any target. Zero means unlimited.
+	MaxPayloadBytes int64
+
+	// Whether a deploy may create a target whose Filename does not exist yet. Defaults to true, targets may
+	// override it.
+	AllowNew *bool
+
+	// Named lists of usernames. A target's Authorized list may reference a group as "@name".
+	Groups map[string][]string
+
+	// When a known user asks for a target that doesn't exist, list the targets they may deploy in the reply so the
+	// client can suggest one.
+	SuggestTargets bool
+
+	// Refuse a missing target and a target the user may not deploy with the same reply, so clients can't probe
+	// which targets exist. Turns off SuggestTargets.
+	GenericAuthErrors bool
+
+	// URL prefixes, e.g. "https://artifacts.example.com/builds/", the daemon may download payloads from when a client
+	// sends FETCH instead of streaming the payload. A URL must have a prefix's scheme and host and a path under its
+	// path, see IsFetchAllowed. Empty disables FETCH.
+	FetchPrefixes []string
+
+	// Leave payloads that fail to arrive or unpack in the temp directory and log where, to inspect them. Otherwise
+	// every payload is removed once unpacked.
+	KeepFailedPayloads bool
+
+	// Move payloads of failed deploys, including those whose scripts failed, here as <time>-<deploy id>.payload
+	// instead of deleting them. Takes precedence over KeepFailedPayloads.
+	QuarantineDirectory string
+
+	// When above zero the oldest quarantined payloads are removed once they total more than this many bytes, or
+	// number more than QuarantineMaxCount. The newest is always kept.
+	QuarantineMaxBytes int64
+	QuarantineMaxCount int
+
+	// How often the daemon also prunes the quarantine to those limits, e.g. "30m". Defaults to
+	// DefaultQuarantineSweepInterval.
+	QuarantineSweepInterval Duration
+
+	// How long the outcome of a deploy sent with an idempotency key is remembered, e.g. "1h". Defaults to
+	// DefaultIdempotencyWindow.
+	IdempotencyWindow Duration
+}
+
+// The names of the targets the named signature may deploy.
+func (c *Config) AuthorizedTargets(name string) []string {
+	var names []string
+	for _, v := range c.Targets {
+		if c.Allows(&v, name) {
+			names = append(names, v.Name)
+		}
+	}
+	return names
+}
+
+// Reports whether the named signature may deploy the target, expanding groups.
+func (c *Config) Allows(t *Target, name string) bool {
+	return c.listed(t.Authorized, name)
+}
+
+// Reports whether the target's scripts run for the named signature, see
+// ScriptAuthorized.
+func (c *Config) RunsScripts(t *Target, name string) bool {
+	return t.ScriptAuthorized == nil || c.listed(t.ScriptAuthorized, name)
+}
+
+// Reports whether the named signature may tail the daemon's events.
+func (c *Config) IsOperator(name string) bool {
+	return c.listed(c.Operators, name)
+}
+
+// Reports whether name is in a list of usernames, "*" and "@group"s.
+func (c *Config) listed(list []string, name string) bool {
+	for _, v := range list {
+		if v == "*" || v == name {
+			return true
+		}
+		if strings.HasPrefix(v, "@") {
+			for _, member := range c.Groups[v[1:]] {
+				if member == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Resolves the usernames allowed to deploy the target, expanding "*" to every
+// name in AuthorizedKeys and groups to their members.
+func (c *Config) EffectiveAuthorized(t *Target) ([]string, error) {
+	signatures, err := c.LoadSignatures()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, name := range signatures {
+		name = strings.TrimSpace(name)
+		if name != "" && c.Allows(t, name) {
+			seen[name] = true
+		}
+	}
+	// Named users or group members without a key are still listed, they would
+	// be allowed once their key is added.
+	for _, v := range t.Authorized {
+		if strings.HasPrefix(v, "@") {
+			for _, member := range c.Groups[v[1:]] {
+				seen[member] = true
+			}
+		} else if v != "*" {
+			seen[v] = true
+		}
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reports whether the target may be deployed when its Filename doesn't exist.
+func (c *Config) AllowsNew(t *Target) bool {
+	if t.AllowNew != nil {
+		return *t.AllowNew
+	}
+	if c.AllowNew != nil {
+		return *c.AllowNew
+	}
+	return true
+}
+
+// The working directory for the target's scripts, empty for the daemon's own.
+func (c *Config) ScriptDir(t *Target) string {
+	enabled := c.ScriptsInTargetDir
+	if t.ScriptsInTargetDir != nil {
+		enabled = *t.ScriptsInTargetDir
+	}
+	if !enabled {
+		return ""
+	}
+	return filepath.Dir(t.Filename)
+}
+
+// The files copied at once when a backup falls back to copying, see BackupCopyWorkers.
+const DefaultBackupCopyWorkers = 4
+
+func (c *Config) CopyWorkers() int {
+	if c.BackupCopyWorkers > 0 {
+		return c.BackupCopyWorkers
+	}
+	return DefaultBackupCopyWorkers
+}
+
+func (c *Config) RenameRetry() RenameRetry {
+	r := RenameRetry{Attempts: InUseAttempts, Delay: InUseDelay}
+	if c.RenameAttempts > 0 {
+		r.Attempts = c.RenameAttempts
+	}
+	if c.RenameRetryDelay.Duration > 0 {
+		r.Delay = c.RenameRetryDelay.Duration
+	}
+	return r
+}
+
+// The effective payload size limit for the target, the smaller of the global
+// and per target limits. Zero means unlimited.
+func (c *Config) PayloadLimit(t *Target) int64 {
+	limit := c.MaxPayloadBytes
+	if t.MaxSize > 0 && (limit <= 0 || t.MaxSize < limit) {
+		limit = t.MaxSize
+	}
+	return limit
+}
+
+// Decodes the TOML config at filename and validates it.
+func LoadConfig(filename string) (*Config, error) {
+	var conf Config
+	if _, err := toml.DecodeFile(filename, &conf); err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// Normalizes the config, expanding target filenames, and reports the first
+// problem found.
+func (c *Config) Validate() error {
+	var base string
+	if c.BaseDirectory != "" {
+		v, err := ExpandPath(c.BaseDirectory)
+		if err != nil {
+			return fmt.Errorf("BaseDirectory: %v", err)
+		}
+		if !filepath.IsAbs(v) {
+			return fmt.Errorf("BaseDirectory '%s' must be an absolute path", c.BaseDirectory)
+		}
+		base = filepath.Clean(v)
+		c.BaseDirectory = base
+	}
+	if c.Webhook != nil && c.Webhook.URL != "" {
+		if err := c.Webhook.validate(); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range c.FetchPrefixes {
+		if u, err := url.Parse(prefix); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("FetchPrefixes: '%s' must be an http or https URL with a host", prefix)
+		}
+	}
+	seen := make(map[string]int)
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		// GetTargetByName returns the first match so a duplicate would shadow it.
+		if j, ok := seen[t.Name]; ok {
+			return fmt.Errorf("target '%s' is defined twice, as targets %d and %d", t.Name, j+1, i+1)
+		}
+		seen[t.Name] = i
+		fp, err := ExpandPath(t.Filename)
+		if err != nil {
+			return fmt.Errorf("target '%s': %v", t.Name, err)
+		}
+		if !filepath.IsAbs(fp) && base != "" {
+			fp = filepath.Join(base, fp)
+			if rel, err := filepath.Rel(base, fp); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("target '%s': Filename '%s' must stay within BaseDirectory '%s'", t.Name, t.Filename, base)
+			}
+		}
+		if !filepath.IsAbs(fp) {
+			return fmt.Errorf("target '%s': Filename '%s' must be an absolute path", t.Name, t.Filename)
+		}
+		t.Filename = fp
+		if _, err := t.Windows(); err != nil {
+			return fmt.Errorf("target '%s': %v", t.Name, err)
+		}
+		if t.Webhook != nil && t.Webhook.URL != "" {
+			if err := t.Webhook.validate(); err != nil {
+				return fmt.Errorf("target '%s': %v", t.Name, err)
+			}
+		}
+		if t.ReloadSignal != "" {
+			if _, err := parseSignal(t.ReloadSignal); err != nil {
+				return fmt.Errorf("target '%s': %v", t.Name, err)
+			}
+			// The pid file is only read when signalling, the process may not be running yet.
+			if t.PidFile == "" {
+				return fmt.Errorf("target '%s': ReloadSignal needs a PidFile", t.Name)
+			} else if !filepath.IsAbs(t.PidFile) {
+				return fmt.Errorf("target '%s': PidFile '%s' must be an absolute path", t.Name, t.PidFile)
+			}
+		} else if t.PidFile != "" {
+			return fmt.Errorf("target '%s': PidFile is only used with a ReloadSignal", t.Name)
+		}
+		if t.Generations < 0 {
+			return fmt.Errorf("target '%s': Generations can't be negative", t.Name)
+		} else if t.Generations > 0 && runtime.GOOS == "windows" {
+			return fmt.Errorf("target '%s': Generations needs symlinks, which aren't supported on windows", t.Name)
+		}
+		if t.StripComponents < 0 {
+			return fmt.Errorf("target '%s': StripComponents can't be negative", t.Name)
+		}
+		for _, patterns := range [][]string{t.AllowFiles, t.DenyFiles} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("target '%s': invalid file pattern '%s'", t.Name, pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the configured TLS restrictions onto conf.
+func (c *Config) ApplyTLS(conf *tls.Config) error {
+	v, err := ParseTLSVersion(c.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	suites, err := ParseCipherSuites(c.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+	conf.MinVersion = v
+	conf.CipherSuites = suites
+	return nil
+}
+
+// The store signatures are looked up in, Signatures if set otherwise the
+// AuthorizedKeys file.
+func (c *Config) SignatureStore() SignatureStore {
+	if c.Signatures != nil {
+		return c.Signatures
+	}
+	return FileSignatureStore{Filename: c.AuthorizedKeys}
+}
+
+func (c *Config) GetSignatureName(signature string) (string, error) {
+	return c.SignatureStore().GetSignatureName(signature)
+}
+
+// Adds a line for the signature & name to the AuthorizedKeys file, creating it
+// if needed. A signature already listed is an error, whoever it belongs to.
+func (c *Config) AddSignature(signature, name string) error {
+	if strings.ContainsAny(name, " \r\n") || name == "" {
+		return fmt.Errorf("'%s' is not a valid username", name)
+	}
+	existing, err := c.GetSignatureName(signature)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if existing != "" {
+		return fmt.Errorf("the signature is already authorized for %s", existing)
+	}
+	buf, err := ioutil.ReadFile(c.AuthorizedKeys)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(c.AuthorizedKeys, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line := signature + " " + name + "\n"
+	if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		line = "\n" + line
+	}
+	if _, err := f.WriteString(line); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Removes the signature's line from the AuthorizedKeys file, returning the name
+// it belonged to. The file is replaced atomically.
+func (c *Config) RemoveSignature(signature string) (string, error) {
+	buf, err := ioutil.ReadFile(c.AuthorizedKeys)
+	if err != nil {
+		return "", err
+	}
+	var name string
+	var kept []string
+	for _, line := range SplitLines(string(buf)) {
+		if xs := strings.SplitN(line, " ", 2); xs[0] == signature && name == "" {
+			name = "?"
+			if len(xs) == 2 {
+				name = strings.TrimSpace(xs[1])
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if name == "" {
+		return "", fmt.Errorf("the signature is not in %s", c.AuthorizedKeys)
+	}
+	info, err := os.Stat(c.AuthorizedKeys)
+	if err != nil {
+		return "", err
+	}
+	out := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		out += "\n"
+	}
+	if err := WriteFile(c.AuthorizedKeys, info.Mode().Perm(), strings.NewReader(out), UnpackOptions{AtomicWrites: true}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *Config) LoadSignatures() (map[string]string, error) {
+	return c.SignatureStore().ListAuthorized()
+}
+
+// Counts the targets the named signature may deploy.
+func (c *Config) CountAuthorized(name string) int {
+	var n int
+	for _, v := range c.Targets {
+		if c.Allows(&v, name) {
+			n++
+		}
+	}
+	return n
+}
+
+// Mismatches between AuthorizedKeys and the targets' Authorized lists.
+type AuditReport struct {
+	// Usernames with a key that no target authorizes, ignoring "*".
+	Unreferenced []string
+
+	// Usernames without a key per target that references them.
+	Unknown map[string][]string
+}
+
+func (r AuditReport) Ok() bool {
+	return len(r.Unreferenced) == 0 && len(r.Unknown) == 0
+}
+
+// Cross references the AuthorizedKeys usernames against every target.
+func (c *Config) Audit() (AuditReport, error) {
+	report := AuditReport{Unknown: make(map[string][]string)}
+	signatures, err := c.LoadSignatures()
+	if err != nil {
+		return report, err
+	}
+	known := make(map[string]bool)
+	for _, name := range signatures {
+		if name = strings.TrimSpace(name); name != "" {
+			known[name] = true
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, t := range c.Targets {
+		var names []string
+		for _, v := range t.Authorized {
+			if strings.HasPrefix(v, "@") {
+				names = append(names, c.Groups[v[1:]]...)
+			} else if v != "*" {
+				names = append(names, v)
+			}
+		}
+		for _, name := range names {
+			referenced[name] = true
+			if !known[name] {
+				report.Unknown[t.Name] = append(report.Unknown[t.Name], name)
+			}
+		}
+	}
+	for name := range known {
+		if !referenced[name] {
+			report.Unreferenced = append(report.Unreferenced, name)
+		}
+	}
+	sort.Strings(report.Unreferenced)
+	return report, nil
+}
+
+// Writes the report in human readable form.
+func (r AuditReport) Print(w io.Writer) {
+	for _, name := range r.Unreferenced {
+		fmt.Fprintf(w, "User '%s' has a key but is not authorized for any target.\n", name)
+	}
+	var targets []string
+	for t := range r.Unknown {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	for _, t := range targets {
+		for _, name := range r.Unknown[t] {
+			fmt.Fprintf(w, "Target '%s' authorizes '%s' who has no key.\n", t, name)
+		}
+	}
+}
+
+func (c *Config) GetTargetByName(name string) *Target {
+	for _, v := range c.Targets {
+		if v.Name == name {
+			return &v
+		}
+	}
+	return nil
+}
+
+// Converts a version such as "1.2" into its tls constant. An empty string yields TLS 1.2.
+func ParseTLSVersion(str string) (uint16, error) {
+	switch strings.TrimSpace(str) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version '%s'", str)
+}
+
+// Converts a tar format name, ustar, pax or gnu, into its constant. An empty
+// string yields tar.FormatUnknown, leaving the choice per header to the writer.
+func ParseTarFormat(str string) (tar.Format, error) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "":
+		return tar.FormatUnknown, nil
+	case "ustar":
+		return tar.FormatUSTAR, nil
+	case "pax":
+		return tar.FormatPAX, nil
+	case "gnu":
+		return tar.FormatGNU, nil
+	}
+	return 0, fmt.Errorf("unknown tar format '%s'", str)
+}
+
+// Looks up cipher suites by name. Insecure suites are accepted only when named explicitly.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, v := range tls.CipherSuites() {
+		known[v.Name] = v.ID
+	}
+	for _, v := range tls.InsecureCipherSuites() {
+		known[v.Name] = v.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type Target struct {
+	Name string
+
+	// This field determines which signatures, by name, can deploy this unit. Putting a * enables all actors.
+	Authorized []string
+
+	// The absolute path which to replace when uploading a unit's new files.
+	Filename string
+
+	// Before & After are shell commands to run during the process replacing the units files. If any shell commands
+	// results in a status of non-0 a rollback will occur. If you need more than one command, perhaps you should write
+	// a script that runs them all instead.
+	Before string
+	After  string
+
+	// Place the single item sent inside the directory at Filename, replacing only an item of the same name, instead
+	// of replacing the whole directory. The backup still holds the whole directory as it was so a rollback undoes
+	// the merge. The directory is copied to merge into it, keep that in mind for large targets.
+	SendInto bool
+
+	// Let those who may deploy the target download it with pull, or compare it with diff. Off by default as the target
+	// may hold files put there on the server, such as secrets, that deploying doesn't otherwise let them read.
+	Pull bool
+
+	// A shell command run after Before and before the target is backed up, e.g. to take an app-consistent snapshot
+	// of a database. If it fails the deploy is aborted before any backup is taken or files are replaced.
+	PreBackup string
+
+	// A shell command run after After to check the deploy worked, e.g. a CLI health check. If it fails the target
+	// is restored from the backup like a failing After.
+	Verify string
+
+	// Run Verify before skipping a deploy because the target is already up to date, see IsUpToDate. If it fails the
+	// deploy goes ahead to replace the broken target.
+	VerifyUpToDate bool
+
+	// A shell command run against the unpacked payload, e.g. a virus or secret scanner, before Before or anything
+	// else touches the live system. The temporary directory holding the payload is added as its last argument and
+	// the payload's item is in DCTL_PAYLOAD. If it fails the deploy is aborted. Unlike the other scripts it runs for
+	// every deploy, whoever sends it.
+	Scan string
+
+	// Who, among Authorized, has Before, PreBackup, After, Verify and Cleanup run when they deploy or roll back.
+	// Everyone else's deploys only replace the files, the scripts are skipped. Unset lets everyone in Authorized
+	// run them.
+	ScriptAuthorized []string
+
+	// Optional username that Before & After are executed as instead of the daemon's own user. Unix only.
+	RunAs string
+
+	// Skip backing up the previous files before replacing them. Without a backup a failed deploy cannot be rolled
+	// back. AllowNoBackup lets clients request this per deploy with -no-backup.
+	SkipBackup    bool
+	AllowNoBackup bool
+
+	// The largest payload in bytes accepted for this target, complementing Config.MaxPayloadBytes. Zero means
+	// unlimited.
+	MaxSize int64
+
+	// Overrides Config.AllowNew for this target.
+	AllowNew *bool
+
+	// Overrides Config.ScriptsInTargetDir for this target.
+	ScriptsInTargetDir *bool
+
+	// How many times to attempt the After script before declaring it failed, waiting AfterRetryDelay in between.
+	// Before is never retried.
+	AfterAttempts   int
+	AfterRetryDelay Duration
+
+	// Treat anything the After script writes to stderr as a failure, even when it exits with 0. After is then also
+	// waited on until any process it starts closes its stderr, failing when that takes over DefaultStderrWaitDelay.
+	FailOnStderr bool
+
+	// How long to wait after Before before the files are backed up and replaced, for services that need a moment to
+	// flush buffers or release ports once stopped. Zero doesn't wait.
+	PreSwapDelay Duration
+
+	// A shell command run at the end of every deploy of this target, whether it succeeded, failed or was rolled
+	// back. The outcome is passed in the DCTL_OUTCOME environment variable. Its failure does not change the result.
+	Cleanup string
+
+	// When set deploys are refused outside these windows, e.g. "Mon-Fri 09:00-17:00". A client may pass
+	// -override-window to deploy anyway if AllowWindowOverride is on.
+	DeployWindows       []string
+	AllowWindowOverride bool
+
+	// Fsync this target's files when deploying, see Config.Durable.
+	Durable bool
+
+	// Glob patterns, e.g. "*.env" or "config/*.bak", checked against every entry of a payload before it is
+	// deployed. Patterns are matched against the entry's path below the item sent and its base name. A payload with
+	// an entry matching DenyFiles, or a file or link matching none of AllowFiles when it's set, is refused.
+	// Directories only need to pass DenyFiles.
+	AllowFiles []string
+	DenyFiles  []string
+
+	// Drop this many leading path elements from every entry of a payload before unpacking it, like tar's
+	// --strip-components, for clients sending an extra wrapping directory. Entries left with nothing are skipped.
+	StripComponents int
+
+	// Where this target's deploy events are posted instead of the Config's Webhook.
+	Webhook *Webhook
+
+	// Replace a running binary without stopping it first: once the new files are renamed into place, the process
+	// whose pid is in PidFile is sent ReloadSignal, e.g. "HUP" or "USR2", to re-exec itself from the new inode.
+	// Before then doesn't need to stop it. The signal is sent ahead of After, also when restoring a backup. Unix only.
+	ReloadSignal string
+	PidFile      string
+
+	// Keep the previous Generations deploys as generations instead of taking backups. Each deploy is unpacked into
+	// a new <seq>.<timestamp> in <Filename>.generations and Filename is a symlink switched over to it in a single
+	// rename, so the target is never missing. A failed deploy switches back. The live generation and the
+	// Generations newest before it are kept, rollback switches to one by index or relative to the live one as
+	// "current-N" or "current+N". Unix only.
+	Generations int
+
+	// The slash separated path below the target's Filename a Subtree copy deploys to, empty for the target itself.
+	subpath string
+}
+
+// Reports whether the target has any scripts set.
+func (t *Target) HasScripts() bool {
+	for _, v := range []string{t.Before, t.PreBackup, t.After, t.Verify, t.Cleanup} {
+		if strings.TrimSpace(v) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// A copy of the target without its scripts, for users not in ScriptAuthorized.
+func (t *Target) WithoutScripts() *Target {
+	c := *t
+	c.Before, c.PreBackup, c.After, c.Verify, c.Cleanup = "", "", "", "", ""
+	return &c
+}
+
+// A copy of the target deploying only the subpath below its Filename, which must
+// be an existing directory. The copy keeps its backups apart from those of the
+// whole target, see BackupName, and records no digest.
+func (t *Target) Subtree(subpath string) (*Target, error) {
+	if !IsSubpath(subpath) {
+		return nil, fmt.Errorf("the subpath %s leaves the target", subpath)
+	}
+	if info, err := os.Stat(t.Filename); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", t.Filename)
+	}
+	clean := path.Clean(strings.ReplaceAll(subpath, "\\", "/"))
+
+	// A symlink on the way could lead anywhere, outside the target too.
+	fp := t.Filename
+	for _, v := range strings.Split(clean, "/") {
+		fp = filepath.Join(fp, v)
+		info, err := os.Lstat(fp)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s is a symlink", fp)
+		}
+	}
+	c := *t
+	c.Filename = filepath.Join(t.Filename, filepath.FromSlash(clean))
+	c.subpath = clean
+	return &c, nil
+}
+
+// The name the target's backups are taken under, its Name. A Subtree's have the
+// escaped subpath appended, "name@sub%2Fdir", so a rollback of the whole target
+// never restores a subtree over it.
+func (t *Target) BackupName() string {
+	if t.subpath == "" {
+		return t.Name
+	}
+	return t.Name + "@" + url.PathEscape(t.subpath)
+}
+
+// Reads the process id held by a pid file.
+func ReadPidFile(filename string) (int, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s does not hold a process id", filename)
+	}
+	return pid, nil
+}
+
+// A time.Duration that decodes from strings such as "1m30s" in the config.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// The options a client sends along with the DEPLOY command. It is encoded as
+// the target name optionally followed by a URL query, e.g. "app?no-backup=1",
+// so a bare target name remains valid for older clients.
+type DeployRequest struct {
+	Target         string
+	ID             string
+	NoBackup       bool
+	OverrideWindow bool
+
+	// How the payload is compressed, empty for a plain tar. See SupportedCompression.
+	Compression string
+
+	// Chosen by the client to identify the deploy across retries. A deploy whose key already ran for the same
+	// user and target within the IdempotencyWindow gets that outcome instead of running again.
+	Key string
+
+	// The PackDigest of the payload. When it matches the target's last successful deploy the daemon replies
+	// StatusUpToDate instead of deploying. The daemon only records it once it got the same TarDigest from the
+	// payload.
+	Digest string
+
+	// The client follows the payload stream with an Ok once it packed the whole payload, or a NotOk when packing
+	// failed part way. The daemon waits for it and only deploys after the Ok, so a stream cut short by the client
+	// never deploys as if it were complete.
+	Commit bool
+
+	// The size in bytes of the uncompressed payload as counted by the client before packing it, see PackEntryCount.
+	// The daemon refuses a Size over the target's payload limit, or more than the temporary directory has room for,
+	// before any of the payload is sent. Zero when the client doesn't know it.
+	Size int64
+
+	// Deploy the payload as this slash separated path below the target's directory, backing up and replacing only
+	// that subtree, see Target.Subtree. Daemons before protocol 3 ignore it and replace the whole target.
+	Subpath string
+}
+
+func (r DeployRequest) Encode() string {
+	v := r.values()
+	if len(v) == 0 {
+		return r.Target
+	}
+	return r.Target + "?" + v.Encode()
+}
+
+func (r DeployRequest) values() url.Values {
+	v := url.Values{}
+	if r.ID != "" {
+		v.Set("id", r.ID)
+	}
+	if r.NoBackup {
+		v.Set("no-backup", "1")
+	}
+	if r.OverrideWindow {
+		v.Set("override-window", "1")
+	}
+	if r.Compression != "" {
+		v.Set("compress", r.Compression)
+	}
+	if r.Key != "" {
+		v.Set("key", r.Key)
+	}
+	if r.Digest != "" {
+		v.Set("digest", r.Digest)
+	}
+	if r.Commit {
+		v.Set("commit", "1")
+	}
+	if r.Size > 0 {
+		v.Set("size", strconv.FormatInt(r.Size, 10))
+	}
+	if r.Subpath != "" {
+		v.Set("subpath", r.Subpath)
+	}
+	return v
+}
+
+func ParseDeployRequest(input string) (DeployRequest, error) {
+	var r DeployRequest
+	xs := strings.SplitN(input, "?", 2)
+	r.Target = xs[0]
+	if len(xs) < 2 {
+		return r, nil
+	}
+	v, err := url.ParseQuery(xs[1])
+	if err != nil {
+		return r, err
+	}
+	r.ID = v.Get("id")
+	r.NoBackup = v.Get("no-backup") == "1"
+	r.OverrideWindow = v.Get("override-window") == "1"
+	r.Compression = v.Get("compress")
+	r.Key = v.Get("key")
+	r.Digest = v.Get("digest")
+	r.Commit = v.Get("commit") == "1"
+	if str := v.Get("size"); str != "" {
+		if r.Size, err = strconv.ParseInt(str, 10, 64); err != nil || r.Size < 0 {
+			return r, fmt.Errorf("invalid size '%s'", str)
+		}
+	}
+	r.Subpath = v.Get("subpath")
+	return r, nil
+}
+
+// Addresses of this form listen on or dial a unix socket instead of TCP.
+const UnixAddressPrefix = "unix:"
+
+// Splits address into the network to use and the address on it, "unix" for
+// the unix:/path form and "tcp" otherwise.
+func SplitNetwork(address string) (network, addr string) {
+	if strings.HasPrefix(address, UnixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixAddressPrefix)
+	}
+	return "tcp", address
+}
+
+// The target name the send command infers from the filename with -target-from-dir,
+// the base name of the directory or file.
+func TargetFromFilename(filename string) (string, error) {
+	fp, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(fp)
+	if name == string(filepath.Separator) || name == "." {
+		return "", fmt.Errorf("can't infer a target name from '%s'", filename)
+	}
+	return name, nil
+}
+
+// Generates a random identifier used to correlate a deploy across client and
+// daemon logs.
+func NewDeployID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Where the digest of the target's last successful deploy is kept, next to the target. Empty for a Subtree.
+func (t *Target) DigestFilename() string {
+	if t.subpath != "" {
+		return ""
+	}
+	return strings.TrimRight(t.Filename, `/\`) + ".digest"
+}
+
+func IsIgnoredFilename(p string, ignore []string) bool {
+	for _, pattern := range ignore {
+		ok, err := filepath.Match(pattern, p)
+		if err != nil {
+			continue
+		} else if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the file should be packed given the include patterns. Patterns
+// are matched against both the full path and its base name. An empty include
+// list includes everything.
+func IsIncludedFilename(p string, include []string) bool {
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if ok, err := filepath.Match(pattern, p); err == nil && ok {
+			return true
+		}
+		if ok, err := filepath.Match(pattern, filepath.Base(p)); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a payload entry passes the AllowFiles & DenyFiles patterns.
+// The name is the entry's path in the tar, the item sent being its first
+// element.
+func IsAllowedEntry(name string, dir bool, allow, deny []string) bool {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	rel := name
+	if i := strings.Index(name, "/"); i >= 0 {
+		rel = name[i+1:]
+	}
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if match(deny) {
+		return false
+	}
+	return dir || len(allow) == 0 || match(allow)
+}
+
+// Options controlling which files PackTar includes and how it reads them.
+type PackOptions struct {
+	Ignore  []string
+	Include []string
+
+	// How many files may be read ahead concurrently while the tar is written in
+	// order, at most packChunkSize of each. Values of 1 or less read serially.
+	Parallel int
+
+	// Record extended attributes as PAX records. Linux only.
+	Xattrs bool
+
+	// The format of every header, see ParseTarFormat. PAX keeps long names and sub-second times, USTAR fails on
+	// names over 256 bytes. Headers with extended attributes are always PAX.
+	Format tar.Format
+
+	// The gzip level, 1 fastest to 9 smallest, used by HandleClientConn when the
+	// request asks for CompressionGzip.
+	CompressLevel int
+
+	// Pack the tree committed at this ref, with GitArchive, instead of the files on disk. Ignore, Include, Xattrs
+	// and Format don't apply.
+	GitRef string
+}
+
+type fileKey struct {
+	dev, ino uint64
+}
+
+type packEntry struct {
+	path   string
+	header *tar.Header
+	data   chan packResult
+}
+
+// The start of a file read ahead by PackTar.
+type packResult struct {
+	buf []byte
+	err error
+}
+
+// The most PackTar reads ahead of a single file, the rest of a larger file is
+// streamed once its turn comes.
+const packChunkSize = 1 << 20
+
+// Walks filename the way PackTar does and returns the entries it would write.
+func collectPackEntries(filename string, opts PackOptions) ([]*packEntry, error) {
+	fp, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*packEntry
+	links := make(map[fileKey]string)
+	err = filepath.Walk(fp, func(p string, info os.FileInfo, err error) error {
+		if IsIgnoredFilename(p, opts.Ignore) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !IsIncludedFilename(p, opts.Include) {
+			return nil
+		}
+
+		link := info.Name()
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(info, link)
+		if v, err := filepath.Rel(filepath.Dir(fp), p); err != nil {
+			return err
+		} else {
+			h.Name = filepath.ToSlash(v)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.Format != tar.FormatUnknown {
+			h.Format = opts.Format
+		}
+		// Reading them through a symlink would get its target's, or fail when it dangles.
+		if opts.Xattrs && info.Mode()&os.ModeSymlink == 0 {
+			records, err := readXattrs(p)
+			if err != nil {
+				return err
+			}
+			if len(records) > 0 {
+				h.PAXRecords = records
+				h.Format = tar.FormatPAX
+			}
+		}
+		e := &packEntry{path: p, header: h}
+		if info.Mode().IsRegular() {
+			// Later references to an already packed inode become hardlinks.
+			if key, ok := hardlinkKey(info); ok {
+				if first, ok := links[key]; ok {
+					h.Typeflag = tar.TypeLink
+					h.Linkname = first
+					h.Size = 0
+					entries = append(entries, e)
+					return nil
+				}
+				links[key] = h.Name
+			}
+			e.data = make(chan packResult, 1)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil || len(opts.Include) == 0 {
+		return entries, err
+	}
+	return pruneEmptyDirs(fp, entries), nil
+}
+
+// Leaves out the directories below root that have nothing included under them.
+func pruneEmptyDirs(root string, entries []*packEntry) []*packEntry {
+	used := make(map[string]bool)
+	for _, e := range entries {
+		if e.header.Typeflag == tar.TypeDir || e.path == root {
+			continue
+		}
+		for p := filepath.Dir(e.path); !used[p] && p != root; p = filepath.Dir(p) {
+			used[p] = true
+		}
+	}
+	var kept []*packEntry
+	for _, e := range entries {
+		if e.header.Typeflag != tar.TypeDir || e.path == root || used[e.path] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// The TarDigest of the tar PackTar writes for filename.
+func PackDigest(filename string, opts PackOptions) (string, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(PackTar(filename, pw, opts))
+	}()
+	return TarDigest(pr)
+}
+
+// A hex SHA-256 of the entries of the tar read from r: their names, types, modes,
+// owners, link targets, xattrs and contents. The times are left out so touching
+// files without changing them keeps the digest, and so is the encoding of the tar
+// so the daemon gets the client's digest from the payload it received.
+func TarDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		var xattrs []string
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				xattrs = append(xattrs, fmt.Sprintf("%q=%q", k, v))
+			}
+		}
+		sort.Strings(xattrs)
+		fmt.Fprintf(h, "%q %c %o %d %d %q %q %q %d %q\n", hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, hdr.Linkname, hdr.Size, xattrs)
+		if _, err := io.Copy(h, tr); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Counts the entries PackTar would write for filename, leaving out a directory at
+// its root, and the size of the tar. No entries means there is nothing to deploy,
+// a tree of empty directories is something. The size leaves out extended
+// headers, so it is never more than what PackTar writes.
+func PackEntryCount(filename string, opts PackOptions) (n int, size int64, err error) {
+	entries, err := collectPackEntries(filename, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	size = 2 * tarBlockSize
+	for i, e := range entries {
+		if i > 0 || e.header.Typeflag != tar.TypeDir {
+			n++
+		}
+		size += tarBlockSize
+		if e.header.Typeflag == tar.TypeReg {
+			size += (e.header.Size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		}
+	}
+	return n, size, nil
+}
+
+// Tar headers and file contents take up whole blocks of this size.
+const tarBlockSize = 512
+
+// Reports whether the payload unpacked in dir has nothing to deploy: no item at
+// all or only a directory with nothing in it.
+func IsEmptyPayload(dir string) (bool, error) {
+	xs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range xs {
+		if !v.IsDir() {
+			return false, nil
+		}
+		ys, err := ioutil.ReadDir(filepath.Join(dir, v.Name()))
+		if err != nil {
+			return false, err
+		} else if len(ys) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Should pack a single item, dir or file, into a tar. This is so that we can
+// assume that the 1 item inside will replace what's on the server. When include
+// is set only matching files are packed, along with the directories leading to
+// them. Ignored directories are skipped whole.
+func PackTar(filename string, w io.Writer, opts PackOptions) error {
+	if opts.GitRef != "" {
+		return GitArchive(filename, opts.GitRef, w)
+	}
+	entries, err := collectPackEntries(filename, opts)
+	if err != nil {
+		return err
+	}
+
+	writer := tar.NewWriter(w)
+	defer writer.Close()
+
+	if opts.Parallel <= 1 {
+		for _, e := range entries {
+			if err := writePackEntry(writer, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Read ahead the start of at most opts.Parallel files while the tar is written
+	// in walk order so the output matches the serial version byte for byte.
+	done := make(chan struct{})
+	defer close(done)
+	sem := make(chan struct{}, opts.Parallel)
+	go func() {
+		for _, e := range entries {
+			if e.data == nil {
+				continue
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(e *packEntry) {
+				e.data <- readPackChunk(e.path, e.header.Size)
+			}(e)
+		}
+	}()
+	for _, e := range entries {
+		if e.data == nil {
+			if err := writer.WriteHeader(e.header); err != nil {
+				return err
+			}
+			continue
+		}
+		r := <-e.data
+		<-sem
+		if r.err != nil {
+			return r.err
+		}
+		if err := writeReadAhead(writer, e, r.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPackChunk(filename string, size int64) packResult {
+	f, err := os.Open(filename)
+	if err != nil {
+		return packResult{err: err}
+	}
+	defer f.Close()
+	if size > packChunkSize {
+		size = packChunkSize
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return packResult{err: err}
+	}
+	return packResult{buf: buf}
+}
+
+// Writes an entry whose start was read ahead, reading the rest from the file.
+func writeReadAhead(writer *tar.Writer, e *packEntry, buf []byte) error {
+	if err := writer.WriteHeader(e.header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(buf); err != nil {
+		return err
+	}
+	if e.header.Size <= int64(len(buf)) {
+		return nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(int64(len(buf)), io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+func writePackEntry(writer *tar.Writer, e *packEntry) error {
+	if err := writer.WriteHeader(e.header); err != nil {
+		return err
+	}
+	if e.data == nil {
+		return nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+// Options controlling how UnpackTar writes a payload.
+type UnpackOptions struct {
+	// If above zero, any tar holding more entries than this is rejected with
+	// ErrTooManyEntries.
+	MaxEntries int
+
+	// Write each file to a sibling temporary name and rename it into place once
+	// complete, so an interrupted write never leaves a partial file behind.
+	AtomicWrites bool
+
+	// Seek over blocks of zeros instead of writing them so sparse files, whether
+	// sent as GNU sparse entries or plainly, stay sparse on disk.
+	Sparse bool
+
+	// Fsync every file written before closing it.
+	Durable bool
+
+	// Restore extended attributes recorded in PAX records. Linux only.
+	Xattrs bool
+
+	// Create symlink entries as they are instead of skipping them. Only for tars the
+	// daemon wrote itself, a payload's links could point anywhere.
+	Symlinks bool
+
+	// Put in the temporary directory's name, see TempPattern.
+	DeployID string
+
+	// Filled in with what was unpacked when not nil.
+	Stats *UnpackStats
+
+	// How the client said the payload given to PrepareTarget is compressed, see SupportedCompression. Only used
+	// when the payload is too short to tell from its first bytes.
+	Compression string
+
+	// Entries not passing these are rejected with a DisallowedEntryError, see
+	// Target.AllowFiles.
+	AllowFiles []string
+	DenyFiles  []string
+
+	// Leading path elements removed from entry names and hardlink targets, see
+	// Target.StripComponents.
+	StripComponents int
+}
+
+type UnpackStats struct {
+	// Regular files and hardlinks written.
+	Files int
+
+	// The total size of the regular files.
+	Bytes int64
+}
+
+// Reports whether the tar entry name stays within the directory it is unpacked
+// into: relative, without a volume name and not climbing out with "..".
+// Backslashes count as separators so a name can't escape on windows either.
+func IsLocalEntryName(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if len(name) >= 2 && name[1] == ':' {
+		return false
+	}
+	clean := path.Clean(name)
+	return !path.IsAbs(name) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// Reports whether subpath names something strictly below a target, see
+// IsLocalEntryName. The target itself, ".", is not a subpath.
+func IsSubpath(subpath string) bool {
+	return subpath != "" && IsLocalEntryName(subpath) && path.Clean(strings.ReplaceAll(subpath, "\\", "/")) != "."
+}
+
+// Removes the first n elements of the tar entry name, returning an empty string
+// when nothing is left.
+func StripComponents(name string, n int) string {
+	if n <= 0 {
+		return name
+	}
+	xs := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if len(xs) <= n {
+		return ""
+	}
+	return path.Join(xs[n:]...)
+}
+
+// The pattern for temporary files and directories of a deploy, so a leftover can
+// be traced back to the deploy ID in the logs. The ID comes from the client so
+// only a short run of safe characters is kept.
+func TempPattern(id string) string {
+	var b strings.Builder
+	for _, r := range id {
+		if b.Len() >= 32 {
+			break
+		}
+		if r == '-' || r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "deployctl-"
+	}
+	return "deployctl-" + b.String() + "-"
+}
+
+// Creates a temporary directory to dump the contents of the tar to and returns
+// the file path. On error the temporary directory is removed.
+func UnpackTar(reader *tar.Reader, opts UnpackOptions) (dir string, err error) {
+	dir, err = ioutil.TempDir(os.TempDir(), TempPattern(opts.DeployID))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+			dir = ""
+		}
+	}()
+
+	var entries int
+	for {
+		var h *tar.Header
+		h, err = reader.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if h == nil {
+			continue
+		}
+		entries++
+		if opts.MaxEntries > 0 && entries > opts.MaxEntries {
+			err = ErrTooManyEntries
+			return
+		}
+
+		// Names come from the client, an absolute one or one climbing out with
+		// ".." would be written outside dir.
+		if !IsLocalEntryName(h.Name) {
+			err = ErrInvalidPayload
+			return
+		}
+		if opts.StripComponents > 0 {
+			if h.Name = StripComponents(h.Name, opts.StripComponents); h.Name == "" {
+				continue
+			}
+			if h.Typeflag == tar.TypeLink {
+				if h.Linkname = StripComponents(h.Linkname, opts.StripComponents); h.Linkname == "" {
+					err = ErrInvalidPayload
+					return
+				}
+			}
+		}
+		if !IsAllowedEntry(h.Name, h.Typeflag == tar.TypeDir, opts.AllowFiles, opts.DenyFiles) {
+			err = &DisallowedEntryError{Name: h.Name}
+			return
+		}
+
+		mode := os.FileMode(h.Mode & 0x0fff)
+		fp := path.Join(dir, h.Name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(fp, mode)
+			if err != nil {
+				return
+			}
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if err = WriteFile(fp, mode, reader, opts); err != nil {
+				return
+			}
+			if opts.Stats != nil {
+				opts.Stats.Files++
+				opts.Stats.Bytes += h.Size
+			}
+		case tar.TypeLink:
+			if !IsLocalEntryName(h.Linkname) {
+				err = ErrInvalidPayload
+				return
+			}
+			if err = LinkOrCopy(path.Join(dir, path.Clean(h.Linkname)), fp); err != nil {
+				return
+			}
+			if opts.Stats != nil {
+				opts.Stats.Files++
+			}
+		case tar.TypeSymlink:
+			if !opts.Symlinks {
+				continue
+			}
+			if err = os.Symlink(h.Linkname, fp); err != nil {
+				return
+			}
+		}
+		if opts.Xattrs && (h.Typeflag == tar.TypeDir || h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeGNUSparse) {
+			if err = writeXattrs(fp, h.PAXRecords); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Writes the contents of r to filename. With AtomicWrites the data goes to a
+// sibling temporary file first which is renamed over filename after a
+// successful copy.
+func WriteFile(filename string, mode os.FileMode, r io.Reader, opts UnpackOptions) error {
+	copyFn := func(f *os.File) (n int64, err error) {
+		if opts.Sparse {
+			n, err = SparseCopy(f, r)
+		} else {
+			n, err = io.Copy(f, r)
+		}
+		if err == nil && opts.Durable {
+			err = f.Sync()
+		}
+		return
+	}
+	if !opts.AtomicWrites {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := copyFn(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
 
-	// Previous versions of targets that are deployed will be placed here.
-	BackupDirectory string
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = copyFn(f); err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
 
-func (c *Config) GetSignatureName(signature string) (name string, err error) {
-	var f *os.File
-	f, err = os.OpenFile(c.AuthorizedKeys, os.O_RDONLY, 0)
+// Fsyncs the directory so renames within it survive a crash. Directories can't
+// be synced on windows so it does nothing there.
+func SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
 	if err != nil {
-		return
+		return err
 	}
 	defer f.Close()
+	return f.Sync()
+}
 
+// The block size SparseCopy checks for zeros.
+const sparseBlockSize = 4096
+
+// Copies r into f skipping over blocks of zeros with Seek, leaving holes in the
+// file on filesystems that support them.
+func SparseCopy(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlockSize)
+	var written int64
+	var hole bool
 	for {
-		var s, n []byte
-		s, err = goio.ReadUntilByte(f, ' ')
-		if err != nil {
-			break
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return written, err
+				}
+				hole = true
+			} else {
+				if _, err := f.Write(buf[:n]); err != nil {
+					return written, err
+				}
+				hole = false
+			}
+			written += int64(n)
 		}
-		n, err = goio.ReadUntilByte(f, '\n', '\r')
-		if err != nil && err != io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
+		} else if err != nil {
+			return written, err
 		}
-		if string(s) == signature {
-			name = string(n)
-			break
-		} else if err == io.EOF {
-			break
+	}
+	// A trailing hole has to be materialized by setting the size.
+	if hole {
+		if err := f.Truncate(written); err != nil {
+			return written, err
 		}
 	}
-	if err == io.EOF {
-		err = nil
+	return written, nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
 	}
-	return strings.TrimSpace(name), err
+	return true
 }
 
-func (c *Config) LoadSignatures() (map[string]string, error) {
-	f, err := os.OpenFile(c.AuthorizedKeys, os.O_RDONLY, 0)
+// Hardlinks newname to oldname, copying the file instead when linking fails,
+// e.g. across filesystems.
+func LinkOrCopy(oldname, newname string) error {
+	if err := os.Link(oldname, newname); err == nil {
+		return nil
+	}
+	return CopyFile(oldname, newname)
+}
+
+// Copies the contents and mode of the file oldname to newname.
+func CopyFile(oldname, newname string) error {
+	src, err := os.Open(oldname)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(newname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, stat.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
 
-	m := make(map[string]string)
+// Writes a line per tar entry with its type, mode, size, name and link target
+// to w. Returns the distinct top level items found, MoveTarget expects exactly
+// one.
+func ListTar(reader *tar.Reader, w io.Writer) ([]string, error) {
+	var roots []string
+	seen := make(map[string]bool)
 	for {
-		var exit bool
-		key, err := goio.ReadUntilByte(f, ' ')
+		h, err := reader.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			return roots, err
 		}
-		name, err := goio.ReadUntilByte(f, '\n', '\r')
-		if err == io.EOF {
-			exit = true
-		} else if err != nil {
-			return nil, err
+
+		link := ""
+		if h.Linkname != "" {
+			link = " -> " + h.Linkname
 		}
-		m[string(key)] = string(name)
-		if exit {
-			break
+		fmt.Fprintf(w, "%c %s %10d %s%s\n", TarTypeChar(h.Typeflag), os.FileMode(h.Mode&0x0fff), h.Size, h.Name, link)
+
+		root := strings.SplitN(strings.TrimPrefix(path.Clean(h.Name), "/"), "/", 2)[0]
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
 		}
 	}
-	return m, nil
+	return roots, nil
 }
 
-func (c *Config) GetTargetByName(name string) *Target {
-	for _, v := range c.Targets {
-		if v.Name == name {
-			return &v
-		}
+func TarTypeChar(flag byte) byte {
+	switch flag {
+	case tar.TypeReg:
+		return '-'
+	case tar.TypeDir:
+		return 'd'
+	case tar.TypeSymlink:
+		return 'l'
+	case tar.TypeLink:
+		return 'h'
+	case tar.TypeChar:
+		return 'c'
+	case tar.TypeBlock:
+		return 'b'
+	case tar.TypeFifo:
+		return 'p'
 	}
-	return nil
+	return '?'
 }
 
-type Target struct {
-	Name string
+// Credential locations may name a file, "env:NAME" for PEM held in an
+// environment variable or "-" for PEM read from stdin.
+func IsPEMSource(spec string) bool {
+	return spec == "-" || strings.HasPrefix(spec, "env:")
+}
 
-	// This field determines which signatures, by name, can deploy this unit. Putting a * enables all actors.
-	Authorized []string
+var stdinPEM []byte
 
-	// The absolute path which to replace when uploading a unit's new files.
-	Filename string
+func ReadPEMSource(spec string) ([]byte, error) {
+	switch {
+	case spec == "-":
+		// The cert and key may both come from stdin, so it is only read once.
+		if stdinPEM == nil {
+			buf, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			stdinPEM = buf
+		}
+		return stdinPEM, nil
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(v), nil
+	}
+	return ioutil.ReadFile(spec)
+}
 
-	// Before & After are shell commands to run during the process replacing the units files. If any shell commands
-	// results in a status of non-0 a rollback will occur. If you need more than one command, perhaps you should write
-	// a script that runs them all instead.
-	Before string
-	After  string
+// Modes used when writing generated credentials.
+const (
+	KeyFileMode  os.FileMode = 0600
+	CertFileMode os.FileMode = 0644
+)
+
+// Returns a warning if the key file can be read by users other than its owner,
+// or an empty string. PEM sources and Windows, which has no such modes, are
+// never warned about.
+func KeyModeWarning(keySpec string) string {
+	if IsPEMSource(keySpec) || runtime.GOOS == "windows" {
+		return ""
+	}
+	info, err := os.Stat(keySpec)
+	if err != nil || info.Mode().Perm()&0077 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("WARNING: key file %s has mode %04o, it should be readable only by its owner (chmod %04o)", keySpec, info.Mode().Perm(), KeyFileMode)
 }
 
-func (t *Target) Allows(name string) bool {
-	for _, v := range t.Authorized {
-		if v == "*" || v == name {
-			return true
-		}
+// Loads a certificate & key from files or PEM sources, see IsPEMSource.
+func LoadKeyPair(certSpec, keySpec string) (tls.Certificate, error) {
+	if !IsPEMSource(certSpec) && !IsPEMSource(keySpec) {
+		return tls.LoadX509KeyPair(certSpec, keySpec)
 	}
-	return false
+	certPEM, err := ReadPEMSource(certSpec)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ReadPEMSource(keySpec)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
 }
 
-func IsIgnoredFilename(p string, ignore []string) bool {
-	for _, pattern := range ignore {
-		ok, err := filepath.Match(pattern, p)
-		if err != nil {
-			continue
-		} else if ok {
-			return true
+// Creates a self signed certificate & key in memory, usable by both the daemon
+// and clients. The SANs are DNS names or IP addresses.
+func GenerateKeyPair(org string, d time.Duration, commonName string, sans ...string) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{org}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(d),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	template.Subject.CommonName = commonName
+	for _, v := range sans {
+		if ip := net.ParseIP(v); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, v)
 		}
 	}
-	return false
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
 }
 
-// Should pack a single item, dir or file, into a tar. This is so that we can
-// assume that the 1 item inside will replace what's on the server.
-func PackTar(filename string, w io.Writer, ignore []string) error {
-	fp, err := filepath.Abs(filename)
-	if err != nil {
+// Writes a certificate & RSA key made by GenerateKeyPair as PEM files, the key
+// with KeyFileMode.
+func WriteKeyPair(cert tls.Certificate, certFilename, keyFilename string) error {
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("only RSA keys can be written")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certFilename, certPEM, CertFileMode); err != nil {
 		return err
 	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return ioutil.WriteFile(keyFilename, keyPEM, KeyFileMode)
+}
 
-	writer := tar.NewWriter(w)
-	defer writer.Close()
-
-	return filepath.Walk(fp, func(p string, info os.FileInfo, err error) error {
-		if IsIgnoredFilename(p, ignore) {
-			return nil
+// Reads the first certificate from a PEM source, see IsPEMSource.
+func LoadCertificate(spec string) (*x509.Certificate, error) {
+	buf, err := ReadPEMSource(spec)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", spec)
 		}
-
-		if err != nil {
-			return err
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
 		}
+	}
+}
 
-		h, err := tar.FileInfoHeader(info, info.Name())
-		if v, err := filepath.Rel(filepath.Dir(fp), p); err != nil {
-			return err
-		} else {
-			h.Name = filepath.ToSlash(v)
-		}
+// Reads a signature, such as a pinned server's as printed by server-cert, given
+// either as the signature itself or a certificate file or PEM source to take it
+// from.
+func ParseSignature(spec string) (string, error) {
+	if _, err := os.Stat(spec); err == nil || IsPEMSource(spec) {
+		cert, err := LoadCertificate(spec)
 		if err != nil {
-			return err
+			return "", err
 		}
-		if err := writer.WriteHeader(h); err != nil {
-			return err
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return "", fmt.Errorf("the certificate in %s does not hold an RSA key", spec)
 		}
-		if !info.Mode().IsRegular() {
-			return nil
+		return GetSignature(cert), nil
+	}
+	if _, err := base64.StdEncoding.DecodeString(spec); err != nil {
+		return "", fmt.Errorf("'%s' is neither a certificate file nor a signature", spec)
+	}
+	return spec, nil
+}
+
+// Returns a tls.Config VerifyPeerCertificate func accepting only a peer whose
+// certificate carries the signature.
+func VerifyPinned(signature string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("the server presented no certificate")
 		}
-		f, err := os.Open(p)
+		cert, err := x509.ParseCertificate(rawCerts[0])
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		if _, err := io.Copy(writer, f); err != nil {
-			return err
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok || GetSignature(cert) != signature {
+			return fmt.Errorf("the server's certificate does not match the pinned signature")
 		}
 		return nil
-	})
+	}
 }
 
-// Creates a temporary directory to dump the contents of the tar to and returns
-// the file path
-func UnpackTar(reader *tar.Reader) (dir string, err error) {
-	dir, err = ioutil.TempDir(os.TempDir(), "deployctl-")
+// TODO handle not ok (which should never happen...)
+func GetSignature(cert *x509.Certificate) string {
+	x, _ := cert.PublicKey.(*rsa.PublicKey)
+	buf := x509.MarshalPKCS1PublicKey(x)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// Expands environment variables and a leading ~ into the user's home directory.
+func ExpandPath(p string) (string, error) {
+	p = os.ExpandEnv(p)
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return
+		return "", err
 	}
+	return filepath.Join(home, p[1:]), nil
+}
 
-	for {
-		var h *tar.Header
-		h, err = reader.Next()
-		if err == io.EOF {
-			err = nil
-			break
-		} else if err != nil {
-			return
-		}
-		if h == nil {
-			continue
+// Precedes the list of target names in a StatusNotExist message when the
+// daemon has SuggestTargets enabled.
+const AvailableTargetsPrefix = "Available targets: "
+
+// Picks the candidates close to name by edit distance, closest first.
+func Suggest(name string, candidates []string) []string {
+	max := len(name) / 3
+	if max < 2 {
+		max = 2
+	}
+	type match struct {
+		name string
+		d    int
+	}
+	var matches []match
+	for _, v := range candidates {
+		if d := EditDistance(strings.ToLower(name), strings.ToLower(v)); d <= max {
+			matches = append(matches, match{v, d})
 		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].d < matches[j].d
+	})
+	var xs []string
+	for _, v := range matches {
+		xs = append(xs, v.name)
+	}
+	return xs
+}
 
-		mode := os.FileMode(h.Mode & 0x0fff)
-		fp := path.Join(dir, h.Name)
-		switch h.Typeflag {
-		case tar.TypeDir:
-			err = os.MkdirAll(fp, mode)
-			if err != nil {
-				return
-			}
-		case tar.TypeReg:
-			var f *os.File
-			f, err = os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
-			if err != nil {
-				return
-			}
-			_, err = io.Copy(f, reader)
-			if err != nil {
-				f.Close()
-				return
+// The Levenshtein distance between a and b.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
 			}
-			f.Close()
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
 		}
+		prev, cur = cur, prev
 	}
-	return
+	return prev[len(rb)]
 }
 
-// TODO handle not ok (which should never happen...)
-func GetSignature(cert *x509.Certificate) string {
-	x, _ := cert.PublicKey.(*rsa.PublicKey)
-	buf := x509.MarshalPKCS1PublicKey(x)
-	return base64.StdEncoding.EncodeToString(buf)
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
 }
 
+// Splits a comma separated flag value into its trimmed, non-empty parts.
+func SplitList(str string) []string {
+	var xs []string
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			xs = append(xs, v)
+		}
+	}
+	return xs
+}
+
+// Splits str into its trimmed, non-empty lines.
+func SplitLines(str string) []string {
+	var xs []string
+	for _, v := range strings.Split(str, "\n") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			xs = append(xs, v)
+		}
+	}
+	return xs
+}
+
+// Environment variables overriding AppDir and UsrDir.
+const (
+	EnvConfigDir = "DCTL_CONFIG_DIR"
+	EnvUserDir   = "DCTL_USER_DIR"
+)
+
+// The daemon's directory, holding its config, certificate and key. Clients keep
+// theirs in UsrDir. DCTL_CONFIG_DIR overrides it.
 func AppDir() string {
-	switch runtime.GOOS {
-	case "linux":
-		return "/etc/dctl"
+	if dir := os.Getenv(EnvConfigDir); dir != "" {
+		return dir
+	}
+	exists := func(dir string) bool {
+		_, err := os.Stat(dir)
+		return err == nil
+	}
+	return appDir(runtime.GOOS, os.Geteuid() == 0, os.Getenv, exists)
+}
+
+// AppDir for goos. On unix the system wide directory is used when running as
+// root or when it already exists, otherwise the user's config directory so the
+// daemon can run unprivileged.
+func appDir(goos string, root bool, getenv func(string) string, exists func(string) bool) string {
+	switch goos {
+	case "windows":
+		dir := getenv("ProgramData")
+		if dir == "" {
+			dir = `C:\ProgramData`
+		}
+		return filepath.Join(dir, appName)
+	case "darwin":
+		system := filepath.Join("/Library/Application Support", appName)
+		if root || exists(system) {
+			return system
+		}
+		return filepath.Join(getenv("HOME"), "Library/Application Support", appName)
+	}
+	system := filepath.Join("/etc", appName)
+	if root || exists(system) {
+		return system
 	}
-	return ""
+	if dir := getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, appName)
+	}
+	return filepath.Join(getenv("HOME"), ".config", appName)
 }
 
+// The client's directory, holding its certificate and key. DCTL_USER_DIR
+// overrides it.
 func UsrDir() string {
+	if dir := os.Getenv(EnvUserDir); dir != "" {
+		return dir
+	}
 	str, _ := os.UserHomeDir()
 	return filepath.Join(str, ".dctl")
 }
@@ -279,6 +2219,16 @@ func (e *FlagError) Error() string {
 	return fmt.Sprintf("Flag error '-%s': %s", e.Flag, e.Reason)
 }
 
+// Ends the program with Code without printing anything, what went wrong has
+// already been written out.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 type ArgError struct {
 	Argument string
 	Position int
@@ -288,3 +2238,20 @@ type ArgError struct {
 func (e *ArgError) Error() string {
 	return fmt.Sprintf("Argument error '%s'(%d): %s", e.Argument, e.Position, e.Reason)
 }
+
+type CommandNotAllowedError struct {
+	Program string
+}
+
+func (e *CommandNotAllowedError) Error() string {
+	return fmt.Sprintf("Command '%s' is not in AllowedCommands", e.Program)
+}
+
+type ProtectedPathError struct {
+	Path      string
+	Protected string
+}
+
+func (e *ProtectedPathError) Error() string {
+	return fmt.Sprintf("Script names '%s' which is under the protected path '%s'", e.Path, e.Protected)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeployRequestRoundTrip(t *testing.T) {
+	tests := []DeployRequest{
+		{Target: "app"},
+		{Target: "app", ID: "0123456789abcdef", NoBackup: true},
+		{Target: "app", OverrideWindow: true, Compression: CompressionGzip},
+		{Target: "app", Key: "build 42 & co", Digest: "abc123", Commit: true},
+		{Target: "app", Size: 1 << 40, Subpath: "static/css"},
+		{
+			Target: "app", ID: "id", NoBackup: true, OverrideWindow: true, Compression: CompressionGzip,
+			Key: "k?=&", Digest: "d", Commit: true, Size: 1, Subpath: "a/b",
+		},
+	}
+	for _, want := range tests {
+		input := want.Encode()
+		got, err := ParseDeployRequest(input)
+		if err != nil {
+			t.Errorf("ParseDeployRequest(%q): %v", input, err)
+		} else if got != want {
+			t.Errorf("ParseDeployRequest(%q) = %+v, want %+v", input, got, want)
+		}
+	}
+	// Older clients send the bare target name.
+	if got := (DeployRequest{Target: "app"}).Encode(); got != "app" {
+		t.Errorf("a request with nothing set encodes to %q", got)
+	}
+}
+
+func TestParseDeployRequestInvalid(t *testing.T) {
+	for _, input := range []string{
+		"app?size=-1",
+		"app?size=many",
+		"app?id=%zz",
+	} {
+		if _, err := ParseDeployRequest(input); err == nil {
+			t.Errorf("ParseDeployRequest(%q) succeeded", input)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("DCTL_TEST_ROOT", home)
+	tests := map[string]string{
+		"~":                          home,
+		"~/app":                      filepath.Join(home, "app"),
+		"$DCTL_TEST_ROOT/app":        home + "/app",
+		"${DCTL_TEST_ROOT}/a/../app": home + "/a/../app",
+		"~user/app":                  "~user/app",
+		"/srv/~/app":                 "/srv/~/app",
+		"app":                        "app",
+	}
+	for p, want := range tests {
+		if got, err := ExpandPath(p); err != nil || got != want {
+			t.Errorf("ExpandPath(%q) = %q, %v, want %q", p, got, err, want)
+		}
+	}
+}
+
+func TestValidateAbsoluteFilename(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	for _, fn := range []string{"app", "./deploy/app", ""} {
+		conf := Config{Targets: []Target{{Name: "app", Filename: fn}}}
+		if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "absolute") {
+			t.Errorf("Filename %q: got %v, want an error about an absolute path", fn, err)
+		}
+	}
+
+	conf := Config{Targets: []Target{{Name: "app", Filename: "~/deploy/app"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(home, "deploy", "app"); conf.Targets[0].Filename != want {
+		t.Errorf("Filename expanded to %s, want %s", conf.Targets[0].Filename, want)
+	}
+}
+
+func TestValidateBaseDirectory(t *testing.T) {
+	base := t.TempDir()
+	elsewhere := filepath.Join(t.TempDir(), "app")
+	tests := []struct {
+		filename, want string
+	}{
+		{"app", filepath.Join(base, "app")},
+		{filepath.Join("services", "web"), filepath.Join(base, "services", "web")},
+		{filepath.Join("services", "..", "api"), filepath.Join(base, "api")},
+		// Absolute filenames are left as they are.
+		{elsewhere, elsewhere},
+	}
+	for _, tt := range tests {
+		conf := Config{BaseDirectory: base, Targets: []Target{{Name: "app", Filename: tt.filename}}}
+		if err := conf.Validate(); err != nil {
+			t.Errorf("Filename %q: %v", tt.filename, err)
+		} else if got := conf.Targets[0].Filename; got != tt.want {
+			t.Errorf("Filename %q resolved to %s, want %s", tt.filename, got, tt.want)
+		}
+	}
+
+	for _, fn := range []string{".", "..", filepath.Join("..", "other"), filepath.Join("app", "..", "..", "other")} {
+		conf := Config{BaseDirectory: base, Targets: []Target{{Name: "app", Filename: fn}}}
+		if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "must stay within BaseDirectory") {
+			t.Errorf("Filename %q: got %v, want an error about leaving BaseDirectory", fn, err)
+		}
+	}
+
+	conf := Config{BaseDirectory: "relative", Targets: []Target{{Name: "app", Filename: "app"}}}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "BaseDirectory 'relative' must be an absolute path") {
+		t.Errorf("a relative BaseDirectory gave %v", err)
+	}
+}
+
+func TestValidateDuplicateTargets(t *testing.T) {
+	dir := t.TempDir()
+	target := func(name string) Target {
+		return Target{Name: name, Filename: filepath.Join(dir, name)}
+	}
+	conf := Config{Targets: []Target{target("app"), target("web"), target("app")}}
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "'app' is defined twice, as targets 1 and 3") {
+		t.Errorf("a duplicate target gave %v", err)
+	}
+
+	conf = Config{Targets: []Target{target("app"), target("web")}}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("distinct targets gave %v", err)
+	}
+}
+
+func TestValidateFilePatterns(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		allow, deny []string
+		ok          bool
+	}{
+		{[]string{"*.go", "config/*.ini"}, []string{"*.env"}, true},
+		{[]string{"[a-"}, nil, false},
+		{nil, []string{"*.env", "\\"}, false},
+	}
+	for _, tt := range tests {
+		conf := Config{Targets: []Target{{Name: "app", Filename: filepath.Join(dir, "app"), AllowFiles: tt.allow, DenyFiles: tt.deny}}}
+		if err := conf.Validate(); (err == nil) != tt.ok {
+			t.Errorf("AllowFiles %q, DenyFiles %q gave %v", tt.allow, tt.deny, err)
+		} else if err != nil && !strings.Contains(err.Error(), "invalid file pattern") {
+			t.Errorf("AllowFiles %q, DenyFiles %q gave %v, want an invalid pattern", tt.allow, tt.deny, err)
+		}
+	}
+}
+
+func TestValidateStripComponents(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []int{-1, 0, 2} {
+		conf := Config{Targets: []Target{{Name: "app", Filename: filepath.Join(dir, "app"), StripComponents: n}}}
+		if err := conf.Validate(); (err == nil) != (n >= 0) {
+			t.Errorf("StripComponents %d gave %v", n, err)
+		}
+	}
+}
+
+func TestAppDir(t *testing.T) {
+	env := map[string]string{"HOME": "/home/alice", "ProgramData": `D:\ProgramData`}
+	tests := []struct {
+		goos   string
+		root   bool
+		exists string
+		xdg    string
+		want   string
+	}{
+		{"linux", true, "", "", "/etc/dctl"},
+		{"linux", false, "/etc/dctl", "", "/etc/dctl"},
+		{"linux", false, "", "", "/home/alice/.config/dctl"},
+		{"linux", false, "", "/srv/config", "/srv/config/dctl"},
+		// A relative XDG_CONFIG_HOME is ignored, as the spec says.
+		{"linux", false, "", "config", "/home/alice/.config/dctl"},
+		{"freebsd", false, "", "", "/home/alice/.config/dctl"},
+		{"darwin", true, "", "", "/Library/Application Support/dctl"},
+		{"darwin", false, "/Library/Application Support/dctl", "", "/Library/Application Support/dctl"},
+		{"darwin", false, "", "/srv/config", "/home/alice/Library/Application Support/dctl"},
+		{"windows", false, "", "", filepath.Join(`D:\ProgramData`, "dctl")},
+		{"windows", true, "", "", filepath.Join(`D:\ProgramData`, "dctl")},
+	}
+	for _, tt := range tests {
+		getenv := func(k string) string {
+			if k == "XDG_CONFIG_HOME" {
+				return tt.xdg
+			}
+			return env[k]
+		}
+		exists := func(dir string) bool { return dir == filepath.FromSlash(tt.exists) }
+		if got := appDir(tt.goos, tt.root, getenv, exists); got != filepath.FromSlash(tt.want) {
+			t.Errorf("appDir(%s, root %v, exists %q, XDG %q) = %s, want %s", tt.goos, tt.root, tt.exists, tt.xdg, got, tt.want)
+		}
+	}
+	// Without ProgramData Windows falls back to its usual place.
+	if got := appDir("windows", false, func(string) string { return "" }, func(string) bool { return false }); got != filepath.Join(`C:\ProgramData`, "dctl") {
+		t.Errorf("appDir without ProgramData = %s", got)
+	}
+}
+
+func TestDirOverrides(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv(EnvConfigDir, "")
+	t.Setenv(EnvUserDir, "")
+	if got := UsrDir(); got != filepath.Join(home, ".dctl") {
+		t.Errorf("UsrDir without an override = %s", got)
+	}
+
+	conf, usr := filepath.Join(home, "conf"), filepath.Join(home, "usr")
+	t.Setenv(EnvConfigDir, conf)
+	t.Setenv(EnvUserDir, usr)
+	if got := AppDir(); got != conf {
+		t.Errorf("AppDir = %s, want %s", got, conf)
+	}
+	if got := AppFilename("conf.toml"); got != filepath.Join(conf, "conf.toml") {
+		t.Errorf("AppFilename = %s", got)
+	}
+	if got := UsrFilename("client.cert"); got != filepath.Join(usr, "client.cert") {
+		t.Errorf("UsrFilename = %s", got)
+	}
+}
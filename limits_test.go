@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPayloadLimit(t *testing.T) {
+	tests := []struct {
+		global, target, want int64
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 50, 50},
+		{100, 50, 50},
+		// The global limit still applies to a target allowing more.
+		{100, 500, 100},
+	}
+	for _, tt := range tests {
+		c := Config{MaxPayloadBytes: tt.global}
+		if got := c.PayloadLimit(&Target{MaxSize: tt.target}); got != tt.want {
+			t.Errorf("MaxPayloadBytes %d and MaxSize %d: limit %d, want %d", tt.global, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDeployPayloadLimit(t *testing.T) {
+	files := map[string]string{"big": strings.Repeat("x", 64<<10)}
+	tests := []struct {
+		global, target int64
+		ok             bool
+	}{
+		{0, 0, true},
+		{1 << 20, 1 << 20, true},
+		{16 << 10, 0, false},
+		{1 << 20, 16 << 10, false},
+		{16 << 10, 1 << 20, false},
+	}
+	for _, tt := range tests {
+		d := newTestDaemon(t, func(c *Config) {
+			c.MaxPayloadBytes = tt.global
+			c.Targets[0].MaxSize = tt.target
+		})
+		err := d.Deploy(t, files)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("MaxPayloadBytes %d and MaxSize %d: %v", tt.global, tt.target, err)
+			}
+			continue
+		}
+		var rse *RemoteStatusError
+		if want := fmt.Sprintf("exceeds the %d byte limit", 16<<10); !errors.As(err, &rse) || !strings.Contains(rse.Message, want) {
+			t.Errorf("MaxPayloadBytes %d and MaxSize %d: got %v, want a reply that it %s", tt.global, tt.target, err, want)
+		}
+	}
+}
+
+func TestAllowsNew(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		global, target *bool
+		want           bool
+	}{
+		{nil, nil, true},
+		{&no, nil, false},
+		{&no, &yes, true},
+		{&yes, &no, false},
+	}
+	for _, tt := range tests {
+		c := Config{AllowNew: tt.global}
+		if got := c.AllowsNew(&Target{AllowNew: tt.target}); got != tt.want {
+			t.Errorf("AllowNew %v and %v: got %v, want %v", tt.global, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDeployAllowNew(t *testing.T) {
+	no := false
+	d := newTestDaemon(t, func(c *Config) { c.AllowNew = &no })
+	err := d.Deploy(t, map[string]string{"version": "1"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusNotExist {
+		t.Fatalf("creating the target gave %v, want StatusNotExist", err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Errorf("the target was created: %v", err)
+	}
+
+	// It may be replaced once it exists.
+	writeFiles(t, d.Target().Filename, map[string]string{"version": "0"})
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatalf("creating the target by default: %v", err)
+	}
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestDeployAnnouncedSize(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.MaxPayloadBytes = 16 << 10 })
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	var payload, gzipped bytes.Buffer
+	if err := PackTar(d.Src, &payload, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(payload.Bytes())
+	gz.Close()
+
+	// Refused before any of it is read.
+	r := &countingReader{r: bytes.NewReader(payload.Bytes())}
+	_, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID(), Size: 64 << 10}, r)
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "exceeds the 16384 byte limit") {
+		t.Errorf("an announced size over the limit gave %v", err)
+	}
+	if r.n != 0 {
+		t.Errorf("%d bytes of the refused payload were read", r.n)
+	}
+	// More than any disk has room for.
+	r = &countingReader{r: bytes.NewReader(payload.Bytes())}
+	d.Config.MaxPayloadBytes = 0
+	_, err = HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID(), Size: 1 << 61}, r)
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "lacks the disk space") || r.n != 0 {
+		t.Errorf("an announced size over the free space gave %v after %d bytes", err, r.n)
+	}
+	d.Config.MaxPayloadBytes = 16 << 10
+
+	// A compressed payload is only held to the limit as it streams.
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Size: 64 << 10, Compression: CompressionGzip}
+	if _, err := HandleClientConnRaw(d.Dial(t), req, &gzipped); err != nil {
+		t.Errorf("a compressed payload announced over the limit: %v", err)
+	}
+	if _, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID(), Size: int64(payload.Len())}, &payload); err != nil {
+		t.Errorf("a payload announced under the limit: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	// Not a socket, left alone.
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(file, 0660); !errors.Is(err, ErrNotSocket) {
+		t.Errorf("listening over a file gave %v", err)
+	}
+	if got := readFile(t, file); got != "keep" {
+		t.Errorf("the file holds %q", got)
+	}
+
+	sock := filepath.Join(dir, "d.sock")
+	l, err := ListenUnix(sock, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("the socket has mode %v, %v", fi.Mode(), err)
+	}
+	// Still accepting, another daemon can't take it over.
+	if _, err := ListenUnix(sock, 0660); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("listening over a live socket gave %v", err)
+	}
+
+	// Left behind by a daemon that didn't shut down cleanly.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = ListenUnix(sock, 0600)
+	if err != nil {
+		t.Fatalf("replacing a stale socket: %v", err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the replaced socket has mode %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestDeployUnixSocket(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	sock := filepath.Join(t.TempDir(), "d.sock")
+	l, err := ListenUnix(sock, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go d.serve(l)
+
+	c, err := net.DialTimeout("unix", sock, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := tls.Client(&deadlineConn{Conn: c}, d.client)
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	if _, err := HandleClientConn(conn, DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Used when the config doesn't set a LockTimeout.
+const DefaultLockTimeout = 5 * time.Minute
+
+// Serializes deploys of the same target within the daemon.
+type TargetLocks struct {
+	mu sync.Mutex
+	m  map[string]chan struct{}
+}
+
+// Waits up to timeout for the named target's lock. On success the returned func
+// releases it, otherwise it is nil. A nil TargetLocks never blocks.
+func (l *TargetLocks) Acquire(name string, timeout time.Duration) func() {
+	if l == nil {
+		return func() {}
+	}
+	l.mu.Lock()
+	if l.m == nil {
+		l.m = make(map[string]chan struct{})
+	}
+	ch, ok := l.m[name]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.m[name] = ch
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTargetLocks(t *testing.T) {
+	var l TargetLocks
+	unlock := l.Acquire("app", time.Second)
+	if unlock == nil {
+		t.Fatal("the first Acquire failed")
+	}
+	if l.Acquire("app", 10*time.Millisecond) != nil {
+		t.Fatal("a held lock was acquired again")
+	}
+	other := l.Acquire("other", 10*time.Millisecond)
+	if other == nil {
+		t.Fatal("another target's lock was held up")
+	}
+	other()
+
+	// A waiter gets the lock once it is released.
+	got := make(chan func())
+	go func() { got <- l.Acquire("app", time.Minute) }()
+	time.Sleep(10 * time.Millisecond)
+	unlock()
+	select {
+	case again := <-got:
+		if again == nil {
+			t.Fatal("the waiter gave up")
+		}
+		again()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter never got the released lock")
+	}
+
+	var none *TargetLocks
+	if none.Acquire("app", 0) == nil || none.Acquire("app", 0) == nil {
+		t.Error("a nil TargetLocks blocked")
+	}
+}
+
+func TestTargetLocksExclusive(t *testing.T) {
+	var l TargetLocks
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held, most := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.Acquire("app", time.Minute)
+			if unlock == nil {
+				t.Error("Acquire gave up")
+				return
+			}
+			mu.Lock()
+			if held++; held > most {
+				most = held
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			held--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("%d deploys held the lock at once", most)
+	}
+}
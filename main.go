@@ -1,18 +1,29 @@
 package main
 
 import (
+	"archive/tar"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	cmd "github.com/tmathews/commander"
 	"github.com/tmathews/goio"
 )
@@ -25,10 +36,29 @@ func main() {
 		args = os.Args[1:]
 	}
 	err := cmd.Exec(args, cmd.Manual(fmt.Sprintf("Welcome to %s.", appName), "Send it!\n"), cmd.M{
-		"generate": cmdGenerate,
-		"daemon":   cmdDaemon,
-		"send":     cmdSend,
-		"ping":     cmdPing,
+		"generate":     cmdGenerate,
+		"daemon":       cmdDaemon,
+		"send":         cmdSend,
+		"ping":         cmdPing,
+		"inspect-tar":  cmdInspectTar,
+		"who":          cmdWho,
+		"audit":        cmdAudit,
+		"selftest":     cmdSelftest,
+		"server-cert":  cmdServerCert,
+		"rollback":     cmdRollback,
+		"apply":        cmdApply,
+		"drain":        cmdDrain,
+		"authorize":    cmdAuthorize,
+		"revoke":       cmdRevoke,
+		"tail":         cmdTail,
+		"apply-staged": cmdApplyStaged,
+		"send-url":     cmdSendURL,
+		"doctor":       cmdDoctor,
+		"replay":       cmdReplay,
+		"traffic":      cmdTraffic,
+		"diff":         cmdDiff,
+		"generations":  cmdGenerations,
+		"pull":         cmdPull,
 	})
 	if err != nil {
 		switch v := err.(type) {
@@ -36,20 +66,42 @@ func main() {
 			fmt.Print(v.Help())
 			os.Exit(2)
 		default:
+			if errors.Is(err, errPrinted) {
+				return
+			}
+			var exit *ExitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.Code)
+			}
 			fmt.Println(err.Error())
+			var rse *RemoteStatusError
+			if errors.As(err, &rse) {
+				if g := rse.Guidance(); g != "" {
+					fmt.Println(g)
+				}
+				os.Exit(rse.ExitCode())
+			}
 			os.Exit(1)
 		}
 	}
 }
 
 func cmdGenerate(name string, args []string) error {
-	var org string
+	var org, commonName string
+	var sans listFlag
 	var d time.Duration
-	var pub bool
+	var pub, force, rotate bool
+	var authorizeName, confFilename string
 	set := flag.NewFlagSet(name, flag.ExitOnError)
 	set.StringVar(&org, "organization", "", "Organization name to use for certificate.")
+	set.StringVar(&commonName, "common-name", "", "Common name to use for the certificate, e.g. the daemon's host name.")
+	set.Var(&sans, "san", "A DNS name or IP address the certificate is valid for. Repeat or comma separate for more.")
 	set.DurationVar(&d, "duration", time.Hour*24*365*5, "How long should this certificate last?")
 	set.BoolVar(&pub, "public-key", false, "Print the public key from the provided filepath instead.")
+	set.BoolVar(&force, "force", false, "Overwrite an existing certificate & key.")
+	set.BoolVar(&rotate, "rotate", false, "Generate a new certificate & key and keep the existing ones as <filename>.old.cert & .key, refused if those exist.")
+	set.StringVar(&authorizeName, "authorize", "", "Also authorize the new key for this username in the AuthorizedKeys of -config, e.g. on the daemon's host.")
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of the daemon's config file, for -authorize.")
 	set.Usage = func() {
 		fmt.Printf("\n%s %s [flags...] <filename>\n\n<filename> should be the location where credentials are read/wrote.\n\n", appName, name)
 		set.PrintDefaults()
@@ -59,6 +111,12 @@ func cmdGenerate(name string, args []string) error {
 	}
 
 	loc := set.Arg(0)
+	// The default directories are created on first use.
+	if dir := filepath.Clean(filepath.Dir(loc)); dir == filepath.Clean(AppDir()) || dir == filepath.Clean(UsrDir()) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
 	if stat, err := os.Stat(filepath.Dir(loc)); os.IsNotExist(err) {
 		return &FlagError{
 			Flag:   "filepath",
@@ -76,20 +134,87 @@ func cmdGenerate(name string, args []string) error {
 		}
 	}
 
-	var cert *x509.Certificate
-	if !pub {
-		var key *rsa.PrivateKey
-		var err error
-		cert, key, err = goio.GenerateCerts(org, d)
+	var conf *Config
+	if authorizeName != "" {
+		c, err := LoadConfig(confFilename)
 		if err != nil {
 			return err
 		}
-		if err = goio.WriteCertificate(cert, loc+".cert"); err != nil {
+		conf = c
+	}
+
+	var oldSignature string
+	out := loc
+	if rotate && !pub {
+		c, err := LoadCertificate(loc + ".cert")
+		if err != nil {
+			return fmt.Errorf("nothing to rotate: %w", err)
+		}
+		oldSignature = GetSignature(c)
+		// The key kept by an earlier rotation may still be in use by clients.
+		for _, ext := range []string{".cert", ".key"} {
+			if _, err := os.Lstat(loc + ".old" + ext); err == nil {
+				return &FlagError{
+					Flag:   "rotate",
+					Reason: fmt.Sprintf("%s already exists, revoke and remove the old key before rotating again.", loc+".old"+ext),
+				}
+			}
+		}
+		// The new pair is written aside and only swapped in once complete, a
+		// failure leaves the existing pair untouched.
+		out = loc + ".new"
+		defer os.Remove(out + ".cert")
+		defer os.Remove(out + ".key")
+	}
+
+	var cert *x509.Certificate
+	if !pub {
+		if !force && !rotate {
+			for _, fn := range []string{loc + ".cert", loc + ".key"} {
+				if _, err := os.Stat(fn); err == nil {
+					return &FlagError{
+						Flag:   "force",
+						Reason: fmt.Sprintf("%s already exists, use -force to overwrite it.", fn),
+					}
+				}
+			}
+		}
+		if commonName != "" || len(sans) > 0 {
+			c, err := GenerateKeyPair(org, d, commonName, sans...)
+			if err != nil {
+				return err
+			}
+			if err = WriteKeyPair(c, out+".cert", out+".key"); err != nil {
+				return err
+			}
+			cert = c.Leaf
+		} else {
+			var key *rsa.PrivateKey
+			var err error
+			cert, key, err = goio.GenerateCerts(org, d)
+			if err != nil {
+				return err
+			}
+			if err = goio.WriteCertificate(cert, out+".cert"); err != nil {
+				return err
+			}
+			if err = goio.WritePrivateKey(key, out+".key"); err != nil {
+				return err
+			}
+		}
+		// Don't rely on goio's modes, or those of a file being overwritten, the
+		// key must stay private.
+		if err := os.Chmod(out+".key", KeyFileMode); err != nil {
 			return err
 		}
-		if err = goio.WritePrivateKey(key, loc+".key"); err != nil {
+		if err := os.Chmod(out+".cert", CertFileMode); err != nil {
 			return err
 		}
+		if out != loc {
+			if err := swapKeyPair(loc); err != nil {
+				return err
+			}
+		}
 		fmt.Println("Certificate & key generated.")
 	} else {
 		if c, err := tls.LoadX509KeyPair(loc+".cert", loc+".key"); err != nil {
@@ -105,16 +230,140 @@ func cmdGenerate(name string, args []string) error {
 	signature := GetSignature(cert)
 	fmt.Printf("Public Key:\n%s", signature)
 
+	if conf != nil {
+		if err := conf.AddSignature(signature, authorizeName); err != nil {
+			return err
+		}
+		fmt.Printf("\n\nAuthorized for %s in %s.", authorizeName, conf.AuthorizedKeys)
+	}
+	if oldSignature != "" {
+		fmt.Printf("\n\nThe old key was kept as %s.old.key and stays authorized until revoked. Once every client uses the new key run:\n%s revoke %s\n", loc, appName, oldSignature)
+	}
+	return nil
+}
+
+// Moves the certificate & key at loc aside as loc.old and the pair written as
+// loc.new into their place. If a rename fails those done are undone.
+func swapKeyPair(loc string) error {
+	var done [][2]string
+	for _, v := range [][2]string{
+		{loc + ".cert", loc + ".old.cert"},
+		{loc + ".key", loc + ".old.key"},
+		{loc + ".new.cert", loc + ".cert"},
+		{loc + ".new.key", loc + ".key"},
+	} {
+		if err := os.Rename(v[0], v[1]); err != nil {
+			for i := len(done) - 1; i >= 0; i-- {
+				os.Rename(done[i][1], done[i][0])
+			}
+			return err
+		}
+		done = append(done, v)
+	}
+	return nil
+}
+
+func cmdAuthorize(name string, args []string) error {
+	var confFilename string
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of config file.")
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <username> <key>
+
+<username> the name targets authorize the key as
+<key>      the public key printed by generate, or the client's certificate file
+
+Adds the key to the AuthorizedKeys file. A user may have several keys, e.g. while rotating.
+
+`, appName, name)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	username := set.Arg(0)
+	if len(username) == 0 {
+		return &ArgError{Argument: "username", Position: 1, Reason: "Missing"}
+	}
+	if len(set.Arg(1)) == 0 {
+		return &ArgError{Argument: "key", Position: 2, Reason: "Missing"}
+	}
+	signature, err := ParseSignature(set.Arg(1))
+	if err != nil {
+		return &ArgError{Argument: "key", Position: 2, Reason: err.Error()}
+	}
+	conf, err := LoadConfig(confFilename)
+	if err != nil {
+		return err
+	}
+	if err := conf.AddSignature(signature, username); err != nil {
+		return err
+	}
+	fmt.Printf("Authorized the key for %s.\n", username)
+	return nil
+}
+
+func cmdRevoke(name string, args []string) error {
+	var confFilename string
+	var yes bool
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of config file.")
+	set.BoolVar(&yes, "yes", false, "Don't ask for confirmation.")
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <key>
+
+<key>  the public key to remove from the AuthorizedKeys file, or a certificate file holding it
+
+`, appName, name)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if len(set.Arg(0)) == 0 {
+		return &ArgError{Argument: "key", Position: 1, Reason: "Missing"}
+	}
+	signature, err := ParseSignature(set.Arg(0))
+	if err != nil {
+		return &ArgError{Argument: "key", Position: 1, Reason: err.Error()}
+	}
+	conf, err := LoadConfig(confFilename)
+	if err != nil {
+		return err
+	}
+	username, err := conf.GetSignatureName(signature)
+	if err != nil {
+		return err
+	} else if username == "" {
+		return fmt.Errorf("the key is not authorized")
+	}
+	if !yes {
+		fmt.Printf("Revoke this key of %s? [y/N] ", username)
+		var answer string
+		fmt.Scanln(&answer)
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("not revoked")
+		}
+	}
+	if _, err := conf.RemoveSignature(signature); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked the key of %s.\n", username)
 	return nil
 }
 
 func cmdDaemon(name string, args []string) error {
-	var address, confFilename, certFilename, keyFilename string
+	var confFilename, certFilename, keyFilename string
+	var addresses listFlag
+	var inetd bool
 	set := flag.NewFlagSet(name, flag.ExitOnError)
-	set.StringVar(&address, "address", DefaultAddress, "Address to bind to.")
+	set.BoolVar(&inetd, "inetd", false, "Serve the one connection on stdin, or the socket systemd passes with Accept=yes, then exit. Logs go to stderr. Deploys to a target are only serialized within a process, keep concurrent deploys of the same target apart.")
+	set.Var(&addresses, "address", "Address to bind to, repeat or comma separate to listen on several e.g. for IPv4 & IPv6. unix:/path listens on a unix socket. Defaults to "+DefaultAddress+".")
 	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of config file.")
-	set.StringVar(&certFilename, "cert", AppFilename("cert"), "")
-	set.StringVar(&keyFilename, "key", AppFilename("key"), "")
+	set.StringVar(&certFilename, "cert", AppFilename("cert"), "Certificate file, env:NAME or - for stdin.")
+	set.StringVar(&keyFilename, "key", AppFilename("key"), "Key file, env:NAME or - for stdin.")
 	set.Usage = func() {
 		fmt.Printf("\n%s %s [flags...]\n\n", appName, name)
 		set.PrintDefaults()
@@ -123,155 +372,1529 @@ func cmdDaemon(name string, args []string) error {
 		return err
 	}
 
-	var conf Config
-	if _, err := toml.DecodeFile(confFilename, &conf); err != nil {
+	if inetd {
+		// The supervisor listens, the daemon only serves what it is passed.
+		addresses = nil
+	} else if len(addresses) == 0 {
+		addresses = listFlag{DefaultAddress}
+	}
+
+	conf, err := LoadConfig(confFilename)
+	if err != nil {
 		return err
 	}
 	if err := os.MkdirAll(conf.BackupDirectory, 0755); err != nil {
 		return err
 	}
+	if err := CheckBackupDirectory(conf.BackupDirectory); err != nil {
+		log.Printf("WARNING: backups can't be written to %s, deploys needing one will be refused: %v", conf.BackupDirectory, err)
+	}
+	if report, err := conf.Audit(); err != nil {
+		log.Printf("Config audit failed: %v", err)
+	} else if !report.Ok() {
+		report.Print(log.Writer())
+	}
 
+	if msg := KeyModeWarning(keyFilename); msg != "" {
+		log.Println(msg)
+	}
 	server := &goio.Server{}
-	if err := server.LoadCert(certFilename, keyFilename); err != nil {
+	if !IsPEMSource(certFilename) && !IsPEMSource(keyFilename) {
+		if err := server.LoadCert(certFilename, keyFilename); err != nil {
+			return err
+		}
+	} else {
+		cert, err := LoadKeyPair(certFilename, keyFilename)
+		if err != nil {
+			return err
+		}
+		server.Conf = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}
+	}
+	if server.Conf == nil {
+		server.Conf = &tls.Config{}
+	}
+	if err := conf.ApplyTLS(server.Conf); err != nil {
 		return err
 	}
-	listener, err := server.Listen(address, true)
+	// In inetd mode stdout may be the connection.
+	logOutput := io.Writer(os.Stdout)
+	if inetd {
+		logOutput = os.Stderr
+	}
+	var listeners []net.Listener
+	for _, address := range addresses {
+		var l net.Listener
+		var err error
+		if network, path := SplitNetwork(address); network == "unix" {
+			// Still TLS, the client certificate is what identifies the user.
+			l, err = ListenUnix(path, 0660)
+		} else {
+			l, err = server.Listen(address, true)
+		}
+		if err != nil {
+			for _, v := range listeners {
+				v.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	drain := &DrainState{}
+	locks := &TargetLocks{}
+	events := &EventHub{}
+	stages := &StageStore{}
+	results := &ResultStore{}
+	traffic, err := LoadTrafficTally(conf.TrafficFile)
 	if err != nil {
 		return err
 	}
+	notified := make(chan struct{})
+	if conf.HasWebhooks() {
+		go func(ch <-chan Event) {
+			NotifyWebhooks(ch, conf, log.New(logOutput, "notify ", log.LstdFlags))
+			close(notified)
+		}(events.Subscribe())
+	} else {
+		close(notified)
+	}
+
+	serve := func(conn net.Conn, id int) {
+		defer conn.Close()
+		counted := &CountingConn{Conn: conn}
+		ctx := ServerContext{
+			C:       tls.Server(counted, server.Conf),
+			Config:  conf,
+			Log:     log.New(logOutput, fmt.Sprintf("con[%d] ", id), log.LstdFlags),
+			Drain:   drain,
+			Locks:   locks,
+			Events:  events,
+			Stages:  stages,
+			Results: results,
+		}
+		err := HandleServerConn(ctx)
+		if goio.IsClosed(err) {
+			ctx.Log.Println("Client got disconnected.")
+		} else if err != nil {
+			ctx.Log.Println(err)
+		}
+		ctx.AccountTraffic(counted, traffic)
+	}
+	if inetd {
+		conn, err := InetdConn()
+		if err != nil {
+			return err
+		}
+		// Wrapped in TLS like what the listeners accept, the clients talk TLS over TLS.
+		serve(tls.Server(conn, server.Conf), os.Getpid())
+		// Nothing can APPLY what this process staged once it exits.
+		stages.Clear()
+		// Let the webhooks hear how the deploy went before exiting.
+		events.Close()
+		<-notified
+		return nil
+	}
+
+	if conf.ControlSocket != "" {
+		l, err := ListenControl(conf.ControlSocket)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go ServeControl(l, drain, traffic, log.New(logOutput, "control ", log.LstdFlags))
+	}
+
+	done := make(chan struct{})
+	if conf.QuarantineDirectory != "" {
+		go SweepQuarantine(conf, done, log.New(logOutput, "quarantine ", log.LstdFlags))
+	}
+	for _, address := range addresses {
+		log.Printf("Server opened on %s.\n", address)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	serveListeners(listeners, stop, done, serve)
+	if n := stages.Clear(); n > 0 {
+		log.Printf("Removed %d staged payloads that were never applied.\n", n)
+	}
+	events.Close()
+	return nil
+}
 
-	log.Printf("Server opened on %s.\n", address)
+// Serves the connections of every listener until stop receives a signal. Then
+// done is closed, the listeners too and it returns once the connections in
+// progress finish.
+func serveListeners(listeners []net.Listener, stop <-chan os.Signal, done chan struct{}, serve func(conn net.Conn, id int)) {
+	conns := make(chan net.Conn)
+	for _, l := range listeners {
+		go acceptConns(l, conns, done)
+	}
 	var logId int
+	var wg sync.WaitGroup
+	for {
+		select {
+		case conn := <-conns:
+			logId++
+			wg.Add(1)
+			go func(conn net.Conn, id int) {
+				defer wg.Done()
+				serve(conn, id)
+			}(conn, logId)
+		case sig := <-stop:
+			log.Printf("Got %s, waiting for connections in progress to finish.", sig)
+			close(done)
+			for _, l := range listeners {
+				l.Close()
+			}
+			wg.Wait()
+			return
+		}
+	}
+}
 
+// Accepts connections from l until done is closed.
+func acceptConns(l net.Listener, conns chan<- net.Conn, done <-chan struct{}) {
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
 			log.Println(err)
 			continue
 		}
-		go func() {
-			logId++
-			ctx := ServerContext{
-				C:      tls.Server(conn, server.Conf),
-				Config: &conf,
-				Log:    log.New(os.Stdout, fmt.Sprintf("con[%d] ", logId), log.LstdFlags),
-			}
-			err := HandleServerConn(ctx)
-			if goio.IsClosed(err) {
-				ctx.Log.Println("Client got disconnected.")
-			} else if err != nil {
-				ctx.Log.Println(err)
-				conn.Close()
-			}
-		}()
+		select {
+		case conns <- conn:
+		case <-done:
+			conn.Close()
+			return
+		}
 	}
 }
 
-func cmdPing(name string, args []string) error {
-	var certFilename, keyFilename string
+func cmdDrain(name string, args []string) error {
+	var confFilename string
+	var resume, status bool
 	set := flag.NewFlagSet(name, flag.ExitOnError)
-	set.StringVar(&certFilename, "cert", UsrFilename("cert"), "")
-	set.StringVar(&keyFilename, "key", UsrFilename("key"), "")
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of the daemon's config file, for its ControlSocket.")
+	set.BoolVar(&resume, "resume", false, "Accept deploys again.")
+	set.BoolVar(&status, "status", false, "Only print whether the daemon is draining.")
 	set.Usage = func() {
-		fmt.Printf(`
-%s %s [flags...] <address>
-
-<address>  the server address and port to send to e.g. %s
-
-`, appName, name, DefaultAddress)
+		fmt.Printf("\n%s %s [flags...]\n\nStops the local daemon accepting deploys, PING keeps working.\n\n", appName, name)
 		set.PrintDefaults()
 	}
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	address := set.Arg(0)
-	if len(address) == 0 {
-		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
-	}
-
-	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	conf, err := LoadConfig(confFilename)
 	if err != nil {
 		return err
 	}
-	conf := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+	if conf.ControlSocket == "" {
+		return errors.New("the config has no ControlSocket set")
+	}
+	command := ControlDrain
+	if status {
+		command = ControlStatus
+	} else if resume {
+		command = ControlResume
 	}
-	fmt.Println("Dialing...")
-	c, err := tls.Dial("tcp", address, conf)
+	state, err := SendControl(conf.ControlSocket, command)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	fmt.Printf("The daemon is %s.\n", state)
+	return nil
+}
+
+func cmdTraffic(name string, args []string) error {
+	var confFilename string
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of the daemon's config file, for its ControlSocket.")
+	set.Usage = func() {
+		fmt.Printf("\n%s %s [flags...]\n\nPrints the bytes the local daemon received from and sent to each signature.\n\n", appName, name)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
 
-	err = HandleClientConnPing(tls.Client(c, conf))
+	conf, err := LoadConfig(confFilename)
 	if err != nil {
 		return err
 	}
-	fmt.Println("PING successful!")
+	if conf.ControlSocket == "" {
+		return errors.New("the config has no ControlSocket set")
+	}
+	tally, err := SendControl(conf.ControlSocket, ControlTraffic)
+	if err != nil {
+		return err
+	}
+	if tally == "" {
+		fmt.Println("No connections yet.")
+		return nil
+	}
+	fmt.Println(tally)
 	return nil
 }
 
-
-func cmdSend(name string, args []string) error {
-	var ignoreStr, certFilename, keyFilename string
+func cmdAudit(name string, args []string) error {
+	var confFilename string
 	set := flag.NewFlagSet(name, flag.ExitOnError)
-	set.StringVar(&ignoreStr, "ignore", fmt.Sprintf("%[1]c.git,%[1]c.idea", filepath.Separator), "Ignore project files")
-	set.StringVar(&certFilename, "cert", UsrFilename("cert"), "")
-	set.StringVar(&keyFilename, "key", UsrFilename("key"), "")
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of config file.")
 	set.Usage = func() {
-		fmt.Printf(`
-%s %s [flags...] <address> <target> <filename>
-
-<address>  the server address and port to send to e.g. %s
-<target>   the target name to deploy
-<filename> the filepath to a directory or file which is to be sent as the target
-
-`, appName, name, DefaultAddress)
+		fmt.Printf("\n%s %s [flags...]\n\nReports keys no target authorizes and authorized users without a key.\n\n", appName, name)
 		set.PrintDefaults()
 	}
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	address := set.Arg(0)
-	target := set.Arg(1)
-	filename := set.Arg(2)
-	if len(address) == 0 {
-		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	conf, err := LoadConfig(confFilename)
+	if err != nil {
+		return err
 	}
-	if len(target) == 0 {
-		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	report, err := conf.Audit()
+	if err != nil {
+		return err
 	}
-	if len(filename) == 0 {
-		return &ArgError{Argument: "filename", Position: 3, Reason: "Missing"}
+	if report.Ok() {
+		fmt.Println("No mismatches found.")
+		return nil
 	}
+	report.Print(os.Stdout)
+	return nil
+}
 
-	var ignore []string
-	if xs := strings.Split(ignoreStr, ","); len(xs) > 0 {
-		for _, v := range xs {
-			v = strings.TrimSpace(v)
-			if len(v) > 0 {
-				ignore = append(ignore, v)
-			}
-		}
+func cmdSelftest(name string, args []string) error {
+	var script string
+	var verbose bool
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&script, "script", "", "A command to use as the Before & After scripts of the test target.")
+	set.BoolVar(&verbose, "verbose", false, "Print the daemon's log.")
+	set.Usage = func() {
+		fmt.Printf("\n%s %s [flags...]\n\nDeploys to a temporary daemon on localhost to check everything works.\n\n", appName, name)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
 	}
 
-	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
-	if err != nil {
+	logw := ioutil.Discard
+	if verbose {
+		logw = os.Stderr
+	}
+	if err := Selftest(os.Stdout, script, logw); err != nil {
 		return err
 	}
-	conf := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+	fmt.Println("Selftest successful!")
+	return nil
+}
+
+func cmdDoctor(name string, args []string) error {
+	var confFilename, certFilename, keyFilename string
+	var addresses listFlag
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.Var(&addresses, "address", "Address the daemon binds to, repeat or comma separate for several. Defaults to "+DefaultAddress+".")
+	set.StringVar(&confFilename, "config", AppFilename("conf.toml"), "Location of config file.")
+	set.StringVar(&certFilename, "cert", AppFilename("cert"), "Certificate file, env:NAME or - for stdin.")
+	set.StringVar(&keyFilename, "key", AppFilename("key"), "Key file, env:NAME or - for stdin.")
+	set.Usage = func() {
+		fmt.Printf("\n%s %s [flags...]\n\nChecks this host has what the daemon needs, run it with the daemon's flags.\n\n", appName, name)
+		set.PrintDefaults()
 	}
-	fmt.Println("Dialing...")
-	c, err := tls.Dial("tcp", address, conf)
-	if err != nil {
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if len(addresses) == 0 {
+		addresses = listFlag{DefaultAddress}
+	}
+	if n := WriteChecks(os.Stdout, Doctor(confFilename, certFilename, keyFilename, addresses)); n > 0 {
+		return fmt.Errorf("%d checks failed", n)
+	}
+	fmt.Println("No problems found.")
+	return nil
+}
+
+func cmdServerCert(name string, args []string) error {
+	var filename string
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&filename, "file", "", "Read the certificate from this local file instead of connecting.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] [address]
+
+[address]  the server address and port to fetch the certificate from e.g. %s
+
+Prints the server's signature & certificate so clients can pin it.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
 		return err
 	}
-	defer c.Close()
 
-	return HandleClientConn(tls.Client(c, conf), target, filename, ignore)
+	var cert *x509.Certificate
+	if filename != "" {
+		c, err := LoadCertificate(filename)
+		if err != nil {
+			return err
+		}
+		cert = c
+	} else {
+		address := set.Arg(0)
+		if len(address) == 0 {
+			return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+		}
+		// There is nothing to verify against yet, the operator compares the
+		// signature printed out of band.
+		creds.pin = ""
+		creds.insecure = true
+		c, _, err := creds.dial(address, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.Handshake(); err != nil {
+			return err
+		}
+		certs := c.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return fmt.Errorf("the server presented no certificate")
+		}
+		cert = certs[0]
+	}
+
+	fmt.Printf("Signature:\n%s\n\n", GetSignature(cert))
+	return pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func cmdPing(name string, args []string) error {
+	var target string
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&target, "target", "", "Also check whether you may deploy this target, without deploying it.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address>
+
+<address>  the server address and port to send to e.g. %s
+
+With -target the exit code tells whether you may deploy it, see send.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	info, err := HandleClientConnPingTarget(tls.Client(c, conf), target)
+	if err != nil {
+		return err
+	}
+	fmt.Println("PING successful!")
+	if info != nil {
+		fmt.Printf("Server version %s (protocol %d), up for %s, %d target(s) authorized for you.\n",
+			info.Version, info.Protocol, time.Duration(info.Uptime*float64(time.Second)).Round(time.Second), info.Targets)
+		if info.User != "" {
+			fmt.Printf("You are known as %s.\n", info.User)
+		}
+	}
+	if target == "" {
+		return nil
+	}
+	switch {
+	case info == nil || info.Access == "":
+		return fmt.Errorf("the server is too old to check target %s", target)
+	case info.Access == AccessAuthorized && info.NoScripts:
+		fmt.Printf("You may deploy %s, but only its files, its scripts are skipped for you.\n", target)
+	case info.Access == AccessAuthorized:
+		fmt.Printf("You may deploy %s.\n", target)
+	case info.Access == AccessNonexistent:
+		return &RemoteStatusError{Code: StatusNotExist, Message: fmt.Sprintf("The target %s does not exist.", target)}
+	default:
+		return &RemoteStatusError{Code: StatusBlocked, Message: fmt.Sprintf("You may not deploy %s.", target)}
+	}
+	return nil
+}
+
+func cmdWho(name string, args []string) error {
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target>
+
+<address>  the server address and port to ask e.g. %s
+<target>   the target name to list authorized users of
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	names, err := HandleClientConnWho(tls.Client(c, conf), target)
+	if err != nil {
+		return err
+	}
+	for _, v := range names {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+func cmdTail(name string, args []string) error {
+	var jsonOut, noReconnect bool
+	var retryMax time.Duration
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.BoolVar(&jsonOut, "json", false, "Print each event as the JSON the daemon sends.")
+	set.BoolVar(&noReconnect, "no-reconnect", false, "Exit when the connection drops instead of reconnecting.")
+	set.DurationVar(&retryMax, "retry-max", TailRetryMax, "The longest wait between attempts to reconnect.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address>
+
+<address>  the server address and port e.g. %s
+
+Prints the daemon's deploy events as they happen. Only the daemon's Operators may tail.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	var w io.WriteCloser = os.Stdout
+	if !jsonOut {
+		w = NewEventPrinter(os.Stdout)
+		defer w.Close()
+	}
+	dial := func() (*tls.Conn, error) {
+		c, conf, err := creds.dial(address, 0)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(c, conf), nil
+	}
+	if noReconnect {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return HandleClientConnTail(c, w)
+	}
+	return FollowTail(dial, w, retryMax)
+}
+
+func cmdRollback(name string, args []string) error {
+	var dryRun bool
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.BoolVar(&dryRun, "dry-run", false, "Report the backup that would be restored, the scripts that would run and whether the backup is intact, without rolling back.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> [backup]
+
+<address>  the server address and port e.g. %s
+<target>   the target name to roll back
+[backup]   the backup to restore by index, 0 being the newest, or timestamp e.g. 20201231235959
+           leave it out to list the available backups. For a target with Generations it is the
+           generation to switch to, also by label relative to the live one e.g. current-1
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	req := RollbackRequest{Target: target, Select: set.Arg(2), DryRun: dryRun}
+	if err := HandleClientConnRollback(tls.Client(c, conf), req, os.Stdout); err != nil {
+		return err
+	}
+	if req.Select != "" && !req.DryRun {
+		fmt.Println("Rollback successful!")
+	}
+	return nil
+}
+
+func cmdGenerations(name string, args []string) error {
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target>
+
+<address>  the server address and port e.g. %s
+<target>   the target name whose generations to list
+
+Lists the generations a target with Generations keeps, newest first, for rollback to switch to.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return HandleClientConnRollback(tls.Client(c, conf), RollbackRequest{Target: target}, os.Stdout)
+}
+
+func cmdSend(name string, args []string) error {
+	var ignoreStr, includeStr, pre, tarFormat, key, gitRef, subpath string
+	var noBackup, jsonOut, overrideWindow, xattrs, targetFromDir, stage, skipUnchanged bool
+	var parallel, compressLevel int
+	var deadline time.Duration
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&ignoreStr, "ignore", fmt.Sprintf("%[1]c.git,%[1]c.idea", filepath.Separator), "Ignore project files")
+	set.StringVar(&includeStr, "include", "", "Only send files matching these comma separated globs.")
+	set.BoolVar(&noBackup, "no-backup", false, "Ask the server to skip backing up the target, if its policy allows.")
+	set.BoolVar(&overrideWindow, "override-window", false, "Deploy outside the target's deploy windows, if the server allows it.")
+	set.IntVar(&parallel, "parallel", 1, "How many files to read ahead concurrently while packing, each through a buffer of at most 1 MiB.")
+	set.BoolVar(&xattrs, "xattrs", false, "Send extended attributes of files. Linux only.")
+	set.StringVar(&tarFormat, "tar-format", "pax", "The tar format to pack with, pax, gnu or ustar. Empty lets each header pick the smallest.")
+	set.BoolVar(&jsonOut, "json", false, "Print a single JSON result object to stdout, messages go to stderr.")
+	set.DurationVar(&deadline, "deadline", 0, "Give up if the whole deploy, including the server's scripts, takes longer than this. 0 waits forever.")
+	set.StringVar(&key, "idempotency-key", os.Getenv("DCTL_IDEMPOTENCY_KEY"), "Identifies this deploy so running send again with the same key, e.g. after a timeout, reports the first outcome instead of deploying twice. Defaults to $DCTL_IDEMPOTENCY_KEY.")
+	set.BoolVar(&skipUnchanged, "skip-unchanged", false, "Send a digest of the payload first, the server skips the deploy if it matches its last one.")
+	set.BoolVar(&stage, "stage", false, "Only upload & unpack, printing a token for apply-staged to swap it in later.")
+	set.BoolVar(&targetFromDir, "target-from-dir", false, "Allow leaving out <target>, it is then the base name of <filename>.")
+	set.IntVar(&compressLevel, "compress-level", 0, "Gzip the payload, 1 fastest to 9 smallest. 0 sends it uncompressed.")
+	set.StringVar(&gitRef, "git-ref", "", "Send the tree committed at this ref with git archive instead of the files on disk, when <filename> is in a git repository. -ignore and -include don't apply.")
+	set.StringVar(&pre, "pre", "", "A command to run in the directory being sent before packing, e.g. a build. The deploy is aborted if it fails.")
+	set.StringVar(&subpath, "subpath", "", "Deploy <filename> as this path below the target's directory, e.g. static/css, backing up and replacing only that subtree.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> <filename>
+
+<address>  the server address and port to send to e.g. %s
+<target>   the target name to deploy, may be left out with -target-from-dir
+<filename> the filepath to a directory or file which is to be sent as the target
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	filename := set.Arg(2)
+	inferred := targetFromDir && set.NArg() == 2
+	if inferred {
+		filename = target
+		t, err := TargetFromFilename(filename)
+		if err != nil {
+			return &ArgError{Argument: "filename", Position: 2, Reason: err.Error()}
+		}
+		target = t
+	}
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+	if len(filename) == 0 {
+		return &ArgError{Argument: "filename", Position: 3, Reason: "Missing"}
+	}
+
+	if compressLevel < 0 || compressLevel > 9 {
+		return &FlagError{Flag: "compress-level", Reason: "Must be between 0 and 9."}
+	}
+	if subpath != "" && !IsSubpath(subpath) {
+		return &FlagError{Flag: "subpath", Reason: "Must be relative and stay within the target."}
+	}
+	format, err := ParseTarFormat(tarFormat)
+	if err != nil {
+		return &FlagError{Flag: "tar-format", Reason: err.Error()}
+	}
+	if jsonOut {
+		MessageOutput = os.Stderr
+	}
+	if err := runPre(pre, filename); err != nil {
+		return err
+	}
+
+	opts := PackOptions{
+		Ignore:        SplitList(ignoreStr),
+		Include:       SplitList(includeStr),
+		Parallel:      parallel,
+		Xattrs:        xattrs,
+		Format:        format,
+		CompressLevel: compressLevel,
+	}
+	if gitRef != "" {
+		if IsGitRepo(filename) {
+			opts.GitRef = gitRef
+		} else {
+			fmt.Fprintf(MessageOutput, "%s is not in a git repository, sending the files on disk.\n", filename)
+		}
+	}
+	req := DeployRequest{
+		Target:         target,
+		ID:             NewDeployID(),
+		NoBackup:       noBackup,
+		OverrideWindow: overrideWindow,
+		Key:            key,
+		Subpath:        subpath,
+	}
+	// The files on disk say nothing about what git archive packs.
+	if opts.GitRef == "" {
+		if n, size, err := PackEntryCount(filename, opts); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrEmptyPayload
+		} else {
+			req.Size = size
+		}
+	}
+	if inferred {
+		// Check the guess before packing, a typo'd directory shouldn't stream a
+		// whole payload only to be refused.
+		fmt.Fprintf(MessageOutput, "Inferred target %s from %s\n", target, filename)
+		if err := checkTarget(creds, address, target); err != nil {
+			return err
+		}
+	}
+	if subpath != "" {
+		if err := checkSubpath(creds, address); err != nil {
+			return err
+		}
+	}
+	if compressLevel > 0 {
+		req.Compression = negotiateCompression(creds, address, CompressionGzip)
+	}
+	if skipUnchanged && !stage {
+		digest, err := PackDigest(filename, opts)
+		if err != nil {
+			return err
+		}
+		req.Digest = digest
+	}
+
+	if stage {
+		token, err := sendStage(creds, address, req, filename, opts, deadline)
+		if err != nil {
+			return err
+		}
+		if jsonOut {
+			return json.NewEncoder(os.Stdout).Encode(map[string]string{"target": target, "deploy_id": req.ID, "token": token})
+		}
+		fmt.Printf("Staged! Apply it with:\n%s apply-staged %s %s\n", appName, address, token)
+		return nil
+	}
+	username := resolveUsername(creds, address)
+	if !jsonOut {
+		if username != "" {
+			fmt.Fprintf(MessageOutput, "Deploying as %s\n", username)
+		}
+		_, err := send(creds, address, req, filename, opts, deadline)
+		return err
+	}
+
+	result := SendResult{Target: target, Address: address, DeployID: req.ID, Username: username}
+	start := time.Now()
+	n, err := send(creds, address, req, filename, opts, deadline)
+	result.BytesSent = n
+	result.Duration = time.Since(start).Seconds()
+	result.Ok = err == nil
+	var rse *RemoteStatusError
+	if err != nil {
+		result.Error = err.Error()
+		if errors.As(err, &rse) {
+			result.Status = rse.Code
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return err
+	}
+	if !result.Ok {
+		// The error is already part of the JSON, exit without printing it again.
+		if rse != nil {
+			return &ExitError{Code: rse.ExitCode()}
+		}
+		return &ExitError{Code: 1}
+	}
+	return nil
+}
+
+func cmdApply(name string, args []string) error {
+	var failFast bool
+	var parallel int
+	var deadline time.Duration
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.BoolVar(&failFast, "fail-fast", true, "Stop at the first deploy that fails instead of trying the rest.")
+	set.IntVar(&parallel, "parallel", 1, "How many files to read ahead concurrently while packing, each through a buffer of at most 1 MiB.")
+	set.DurationVar(&deadline, "deadline", 0, "Give up on a deploy if it takes longer than this. 0 waits forever.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <manifest>
+
+<address>  the server address and port to send to e.g. %s
+<manifest> the TOML file listing the deploys, see Manifest
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	filename := set.Arg(1)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(filename) == 0 {
+		return &ArgError{Argument: "manifest", Position: 2, Reason: "Missing"}
+	}
+	m, err := LoadManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	return applyManifest(m, failFast, func(e ManifestEntry) error {
+		opts := PackOptions{Ignore: e.Ignore, Parallel: parallel}
+		req := DeployRequest{Target: e.Target, ID: NewDeployID()}
+		_, err := send(creds, address, req, e.Filename, opts, deadline)
+		return err
+	})
+}
+
+// Deploys each of the manifest's entries in order, printing a summary once done.
+func applyManifest(m *Manifest, failFast bool, deploy func(e ManifestEntry) error) error {
+	var failed int
+	results := make([]string, 0, len(m.Deploy))
+	for _, e := range m.Deploy {
+		fmt.Printf("Deploying %s from %s\n", e.Target, e.Filename)
+		err := deploy(e)
+		if err == nil {
+			results = append(results, fmt.Sprintf("ok      %s", e.Target))
+			continue
+		}
+		failed++
+		results = append(results, fmt.Sprintf("failed  %s: %v", e.Target, err))
+		if failFast {
+			break
+		}
+	}
+
+	fmt.Println()
+	for _, v := range results {
+		fmt.Println(v)
+	}
+	if skipped := len(m.Deploy) - len(results); skipped > 0 {
+		fmt.Printf("skipped %d remaining deploy(s)\n", skipped)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deploys failed", failed, len(m.Deploy))
+	}
+	return nil
+}
+
+func sendStage(creds clientCreds, address string, req DeployRequest, filename string, opts PackOptions, deadline time.Duration) (string, error) {
+	c, conf, err := creds.dial(address, deadline)
+	if err != nil {
+		return "", deadlineError(err, deadline)
+	}
+	defer c.Close()
+
+	token, err := HandleClientConnStage(tls.Client(c, conf), req, filename, opts)
+	return token, SuggestTarget(deadlineError(err, deadline), req.Target)
+}
+
+func cmdApplyStaged(name string, args []string) error {
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <token>
+
+<address>  the server address and port e.g. %s
+<token>    the token printed by send -stage
+
+Swaps a staged payload in for its target, backing up and running scripts like send.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+	address := set.Arg(0)
+	token := set.Arg(1)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(token) == 0 {
+		return &ArgError{Argument: "token", Position: 2, Reason: "Missing"}
+	}
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := HandleClientConnApply(tls.Client(c, conf), token); err != nil {
+		return err
+	}
+	fmt.Println("Applied!")
+	return nil
+}
+
+func cmdSendURL(name string, args []string) error {
+	var auth, key, sum, compression string
+	var noBackup, overrideWindow bool
+	var deadline time.Duration
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&sum, "sha256", "", "The SHA-256 of the file at <url> in hex, the server refuses a download that doesn't match.")
+	set.StringVar(&compression, "compress", "auto", "How the file at <url> is compressed, gzip, none or auto to go by its extension.")
+	set.StringVar(&auth, "auth-header", os.Getenv("DCTL_FETCH_AUTH"), "The Authorization header the server downloads with, e.g. \"Bearer <token>\". Defaults to $DCTL_FETCH_AUTH.")
+	set.StringVar(&key, "idempotency-key", os.Getenv("DCTL_IDEMPOTENCY_KEY"), "Identifies this deploy across retries, see send. Defaults to $DCTL_IDEMPOTENCY_KEY.")
+	set.BoolVar(&noBackup, "no-backup", false, "Ask the server to skip backing up the target, if its policy allows.")
+	set.BoolVar(&overrideWindow, "override-window", false, "Deploy outside the target's deploy windows, if the server allows it.")
+	set.DurationVar(&deadline, "deadline", 0, "Give up if the whole deploy, including the download, takes longer than this. 0 waits forever.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> <url>
+
+<address>  the server address and port e.g. %s
+<target>   the target name to deploy
+<url>      where the server downloads the tar from, it must be within the server's FetchPrefixes
+
+Has the server download the payload itself rather than streaming it from here.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+	address := set.Arg(0)
+	target := set.Arg(1)
+	rawurl := set.Arg(2)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+	if len(rawurl) == 0 {
+		return &ArgError{Argument: "url", Position: 3, Reason: "Missing"}
+	}
+
+	switch compression {
+	case "auto":
+		compression = URLCompression(rawurl)
+	case "none":
+		compression = ""
+	case CompressionGzip:
+	default:
+		return &FlagError{Flag: "compress", Reason: "Must be gzip, none or auto."}
+	}
+	if b, err := hex.DecodeString(sum); err != nil || (sum != "" && len(b) != sha256.Size) {
+		return &FlagError{Flag: "sha256", Reason: "Must be a hex SHA-256."}
+	}
+
+	req := FetchRequest{
+		DeployRequest: DeployRequest{
+			Target:         target,
+			ID:             NewDeployID(),
+			NoBackup:       noBackup,
+			OverrideWindow: overrideWindow,
+			Key:            key,
+			Compression:    compression,
+		},
+		URL:           rawurl,
+		Authorization: auth,
+		SHA256:        strings.ToLower(sum),
+	}
+	c, conf, err := creds.dial(address, deadline)
+	if err != nil {
+		return deadlineError(err, deadline)
+	}
+	defer c.Close()
+	if err := HandleClientConnFetch(tls.Client(c, conf), req); err != nil {
+		return SuggestTarget(deadlineError(err, deadline), target)
+	}
+	fmt.Println("Fetched & deployed!")
+	return nil
+}
+
+// Asks the daemon whether the target exists and we may deploy it.
+func checkTarget(creds clientCreds, address, target string) error {
+	c, conf, err := creds.dial(address, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var rse *RemoteStatusError
+	if _, err := HandleClientConnWho(tls.Client(c, conf), target); errors.As(err, &rse) && rse.Code == StatusNotExist {
+		return fmt.Errorf("the inferred target %s does not exist on the server, name it explicitly: %w", target, err)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Refuses to send a subpath to a daemon older than protocol 3, which would
+// ignore it and replace the whole target with the payload.
+func checkSubpath(creds clientCreds, address string) error {
+	c, conf, err := creds.dial(address, PingInfoTimeout*2)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := HandleClientConnPing(tls.Client(c, conf))
+	if err != nil {
+		return err
+	} else if info == nil || info.Protocol < 3 {
+		return errors.New("the server is too old for -subpath, it would replace the whole target")
+	}
+	return nil
+}
+
+// Asks the daemon which username our signature resolves to, empty when it is too
+// old to say or can't be reached.
+func resolveUsername(creds clientCreds, address string) string {
+	c, conf, err := creds.dial(address, PingInfoTimeout*2)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	info, err := HandleClientConnPing(tls.Client(c, conf))
+	if err != nil || info == nil {
+		return ""
+	}
+	return info.User
+}
+
+// Returns compression if the daemon reports it can unpack it, otherwise an empty
+// string to send uncompressed.
+func negotiateCompression(creds clientCreds, address, compression string) string {
+	c, conf, err := creds.dial(address, PingInfoTimeout*2)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	info, err := HandleClientConnPing(tls.Client(c, conf))
+	if err != nil || !info.Supports(compression) {
+		fmt.Fprintf(MessageOutput, "The server doesn't support %s, sending uncompressed.\n", compression)
+		return ""
+	}
+	return compression
+}
+
+// Runs the -pre command in the directory being sent, or the one holding the file.
+func runPre(command, filename string) error {
+	if command == "" {
+		return nil
+	}
+	dir := filename
+	if info, err := os.Stat(filename); err != nil {
+		return err
+	} else if !info.IsDir() {
+		dir = filepath.Dir(filename)
+	}
+	if err := RunScript(command, ScriptOptions{Dir: dir}, log.New(MessageOutput, "", 0)); err != nil {
+		return fmt.Errorf("pre command failed, nothing was sent: %w", err)
+	}
+	return nil
+}
+
+func send(creds clientCreds, address string, req DeployRequest, filename string, opts PackOptions, deadline time.Duration) (int64, error) {
+	c, conf, err := creds.dial(address, deadline)
+	if err != nil {
+		return 0, deadlineError(err, deadline)
+	}
+	defer c.Close()
+
+	n, err := HandleClientConn(tls.Client(c, conf), req, filename, opts)
+	return n, SuggestTarget(deadlineError(err, deadline), req.Target)
+}
+
+func cmdReplay(name string, args []string) error {
+	var noBackup, overrideWindow bool
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.BoolVar(&noBackup, "no-backup", false, "Ask the server to skip backing up the target, if its policy allows.")
+	set.BoolVar(&overrideWindow, "override-window", false, "Deploy outside the target's deploy windows, if the server allows it.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> <filename>
+
+<address>  the server address and port to send to e.g. %s
+<target>   the target name to deploy
+<filename> a payload to deploy again exactly as it was: a quarantined .payload, a
+           .tar.gz backup or a .tar are sent as is, a backup directory or file is
+           packed like send does
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	filename := set.Arg(2)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+	if len(filename) == 0 {
+		return &ArgError{Argument: "filename", Position: 3, Reason: "Missing"}
+	}
+
+	req := DeployRequest{
+		Target:         target,
+		ID:             NewDeployID(),
+		NoBackup:       noBackup,
+		OverrideWindow: overrideWindow,
+	}
+	if !IsRawPayload(filename) {
+		_, size, err := PackEntryCount(filename, PackOptions{})
+		if err != nil {
+			return err
+		}
+		req.Size = size
+		if _, err := send(creds, address, req, filename, PackOptions{}, 0); err != nil {
+			return err
+		}
+		fmt.Println("Replay successful!")
+		return nil
+	}
+
+	p, err := OpenPayload(filename)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	req.Compression = p.Compression
+	req.Size = p.Size
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := HandleClientConnRaw(tls.Client(c, conf), req, p); err != nil {
+		return SuggestTarget(err, target)
+	}
+	fmt.Println("Replay successful!")
+	return nil
+}
+
+func cmdDiff(name string, args []string) error {
+	var ignoreStr string
+	var creds clientCreds
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&ignoreStr, "ignore", fmt.Sprintf("%[1]c.git,%[1]c.idea", filepath.Separator), "Ignore project files")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> <filename>
+
+<address>  the server address and port e.g. %s
+<target>   the target name to compare with, it must have Pull on the server
+<filename> the directory or file send would deploy as the target
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	filename := set.Arg(2)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+	if len(filename) == 0 {
+		return &ArgError{Argument: "filename", Position: 3, Reason: "Missing"}
+	}
+
+	local, err := IndexLocal(filename, PackOptions{Ignore: SplitList(ignoreStr)})
+	if err != nil {
+		return err
+	}
+	c, conf, err := creds.dial(address, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	deployed, err := HandleClientConnList(tls.Client(c, conf), target)
+	if err != nil {
+		return SuggestTarget(err, target)
+	}
+	WriteChanges(os.Stdout, DiffIndex(deployed, local))
+	return nil
+}
+
+func cmdPull(name string, args []string) error {
+	var creds clientCreds
+	var deadline time.Duration
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.DurationVar(&deadline, "deadline", 0, "Give up if the whole download takes longer than this. 0 waits forever.")
+	creds.register(set)
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <address> <target> [filename]
+
+<address>  the server address and port e.g. %s
+<target>   the target name to download, it must have Pull on the server
+<filename> where the gzipped tar is written, - for stdout, <target>.tar.gz by default
+
+The download is checked against the SHA-256 the server sends, a mismatch leaves
+nothing behind.
+
+`, appName, name, DefaultAddress)
+		set.PrintDefaults()
+	}
+	if err := creds.parse(set, args); err != nil {
+		return err
+	}
+
+	address := set.Arg(0)
+	target := set.Arg(1)
+	filename := set.Arg(2)
+	if len(address) == 0 {
+		return &ArgError{Argument: "address", Position: 1, Reason: "Missing"}
+	}
+	if len(target) == 0 {
+		return &ArgError{Argument: "target", Position: 2, Reason: "Missing"}
+	}
+	if filename == "" {
+		filename = target + ".tar.gz"
+	}
+
+	var w io.Writer = os.Stdout
+	var tmp *os.File
+	if filename == "-" {
+		MessageOutput = os.Stderr
+	} else {
+		// Written aside and renamed once verified, a broken download never
+		// replaces an earlier one.
+		f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".part-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w, tmp = f, f
+	}
+
+	c, conf, err := creds.dial(address, deadline)
+	if err != nil {
+		return deadlineError(err, deadline)
+	}
+	defer c.Close()
+	sum, err := HandleClientConnPull(tls.Client(c, conf), target, w)
+	if err != nil {
+		return SuggestTarget(deadlineError(err, deadline), target)
+	}
+	if tmp != nil {
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), filename); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(MessageOutput, "SHA-256 %s verified.\n", sum)
+	return nil
+}
+
+func cmdInspectTar(name string, args []string) error {
+	var ignoreStr, includeStr string
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&ignoreStr, "ignore", fmt.Sprintf("%[1]c.git,%[1]c.idea", filepath.Separator), "Ignore project files when packing a directory")
+	set.StringVar(&includeStr, "include", "", "Only pack files matching these comma separated globs.")
+	set.Usage = func() {
+		fmt.Printf(`
+%s %s [flags...] <filename>
+
+<filename> a tar file to list, or a directory or file to pack the same way send would
+
+`, appName, name)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	filename := set.Arg(0)
+	if len(filename) == 0 {
+		return &ArgError{Argument: "filename", Position: 1, Reason: "Missing"}
+	}
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if stat.IsDir() || !strings.HasSuffix(filename, ".tar") {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(PackTar(filename, pw, PackOptions{
+				Ignore:  SplitList(ignoreStr),
+				Include: SplitList(includeStr),
+			}))
+		}()
+		defer pr.Close()
+		r = pr
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return inspectTar(r, os.Stdout)
+}
+
+// Lists the tar in r to w, warning when it would not deploy as a single item.
+func inspectTar(r io.Reader, w io.Writer) error {
+	roots, err := ListTar(tar.NewReader(r), w)
+	if err != nil {
+		return err
+	}
+	if len(roots) != 1 {
+		fmt.Fprintf(w, "\nWARNING: payload has %d top level items %v, a deploy expects exactly one.\n", len(roots), roots)
+	}
+	return nil
+}
+
+// Replaces network timeouts with an error explaining the -deadline was hit.
+func deadlineError(err error, deadline time.Duration) error {
+	var ne net.Error
+	if deadline > 0 && errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("deploy exceeded the %s deadline and was aborted", deadline)
+	}
+	return err
+}
+
+// A flag that may be repeated, each value may hold several comma separated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, SplitList(s)...)
+	return nil
+}
+
+// The credential flags shared by every command that connects to a daemon.
+type clientCreds struct {
+	certFilename string
+	keyFilename  string
+	tlsMin       string
+	pin          string
+	insecure     bool
+
+	printSignature bool
+}
+
+func (c *clientCreds) register(set *flag.FlagSet) {
+	set.StringVar(&c.certFilename, "cert", UsrFilename("cert"), "Certificate file, env:NAME or - for stdin.")
+	set.StringVar(&c.keyFilename, "key", UsrFilename("key"), "Key file, env:NAME or - for stdin.")
+	set.StringVar(&c.tlsMin, "tls-min", "1.2", "Lowest TLS version to offer the server.")
+	set.StringVar(&c.pin, "pin", os.Getenv("DCTL_SERVER_PIN"), "The server's signature or certificate file, see server-cert. Defaults to $DCTL_SERVER_PIN.")
+	set.BoolVar(&c.insecure, "insecure", false, "Don't verify the server at all. Anyone in the middle can read and alter the deploy.")
+	set.BoolVar(&c.printSignature, "print-signature", false, "Print the signature of -cert, to authorize it on a server, and exit.")
+}
+
+// Returned by a command that only printed what it was asked for, the program then
+// exits successfully.
+var errPrinted = errors.New("printed")
+
+// Parses args into set. With -print-signature the signature of -cert is printed
+// and errPrinted returned before the command looks at its arguments.
+func (c *clientCreds) parse(set *flag.FlagSet, args []string) error {
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if !c.printSignature {
+		return nil
+	}
+	cert, err := LoadCertificate(c.certFilename)
+	if err != nil {
+		return err
+	}
+	fmt.Println(GetSignature(cert))
+	return errPrinted
+}
+
+func (c *clientCreds) tlsConfig() (*tls.Config, error) {
+	if msg := KeyModeWarning(c.keyFilename); msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	cert, err := LoadKeyPair(c.certFilename, c.keyFilename)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ParseTLSVersion(c.tlsMin)
+	if err != nil {
+		return nil, &FlagError{Flag: "tls-min", Reason: err.Error()}
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   v,
+	}
+	// Daemon certificates are self signed so they're checked against the pin
+	// rather than a CA.
+	if c.pin != "" {
+		pin, err := ParseSignature(c.pin)
+		if err != nil {
+			return nil, &FlagError{Flag: "pin", Reason: err.Error()}
+		}
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = VerifyPinned(pin)
+	} else if c.insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: -insecure is set, the server's identity is NOT verified.")
+		conf.InsecureSkipVerify = true
+	}
+	return conf, nil
+}
+
+// Dials the daemon. A deadline above zero bounds the dial and every later read
+// and write on the connection.
+func (c *clientCreds) dial(address string, deadline time.Duration) (*tls.Conn, *tls.Config, error) {
+	conf, err := c.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	network, address := SplitNetwork(address)
+	if !conf.InsecureSkipVerify {
+		if network == "unix" {
+			conf.ServerName = "localhost"
+		} else {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, nil, err
+			}
+			conf.ServerName = host
+		}
+	}
+	dialer := &net.Dialer{}
+	if deadline > 0 {
+		dialer.Deadline = time.Now().Add(deadline)
+	}
+	fmt.Fprintln(MessageOutput, "Dialing...")
+	raw, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := tls.Client(&deadlineConn{Conn: raw}, conf)
+	if deadline > 0 {
+		if err := conn.SetDeadline(dialer.Deadline); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, conf, nil
 }
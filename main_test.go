@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Returns what fn wrote to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		done <- buf
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// Generates a key pair and returns the flags for a client command to use it.
+func clientFlags(t *testing.T) []string {
+	t.Helper()
+	loc := filepath.Join(t.TempDir(), "client")
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	return []string{"-cert", loc + ".cert", "-key", loc + ".key", "-insecure"}
+}
+
+func TestInspectTar(t *testing.T) {
+	payload := tarBytes(t,
+		tarEntry{Name: "app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/index.html", Body: "hello"},
+		tarEntry{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "index.html", Mode: 0777},
+		tarEntry{Name: "app/copy", Typeflag: tar.TypeLink, Linkname: "app/index.html"},
+	)
+	var out bytes.Buffer
+	if err := inspectTar(bytes.NewReader(payload), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"d -rwxr-xr-x          0 app",
+		"- -rw-r--r--          5 app/index.html",
+		"l -rwxrwxrwx          0 app/current -> index.html",
+		"h -rw-r--r--          0 app/copy -> app/index.html",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("listed\n%s\nwant\n%s", out.String(), strings.Join(want, "\n"))
+	}
+	if strings.Contains(out.String(), "WARNING") {
+		t.Error("warned about a single item payload")
+	}
+}
+
+func TestInspectTarMultipleItems(t *testing.T) {
+	payload := tarBytes(t,
+		tarEntry{Name: "app/a", Body: "a"},
+		tarEntry{Name: "./other", Body: "b"},
+		tarEntry{Name: "app/b", Body: "b"},
+	)
+	var out bytes.Buffer
+	if err := inspectTar(bytes.NewReader(payload), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "WARNING: payload has 2 top level items [app other]") {
+		t.Errorf("no warning in\n%s", out.String())
+	}
+}
+
+func TestSendJSONExitCode(t *testing.T) {
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	// Nothing listens at the address once closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	src := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, src, map[string]string{"version": "1"})
+
+	args := append(clientFlags(t), "-json", address, "app", src)
+	var sendErr error
+	out := captureStdout(t, func() { sendErr = cmdSend("send", args) })
+	var exit *ExitError
+	if !errors.As(sendErr, &exit) || exit.Code != 1 {
+		t.Fatalf("got %v, want an ExitError with code 1", sendErr)
+	}
+	var result SendResult
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %q", err, out)
+	}
+	if result.Ok || result.Error == "" || result.Target != "app" {
+		t.Errorf("printed %+v", result)
+	}
+}
+
+func TestServerCertFile(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "server")
+	if err := cmdGenerate("generate", []string{"-common-name", "test", loc}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadCertificate(loc + ".cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmdErr error
+	out := captureStdout(t, func() {
+		cmdErr = cmdServerCert("server-cert", []string{"-file", loc + ".cert"})
+	})
+	if cmdErr != nil {
+		t.Fatal(cmdErr)
+	}
+	if !strings.HasPrefix(out, "Signature:\n"+GetSignature(want)+"\n") {
+		t.Errorf("printed %q, want the signature first", out)
+	}
+	_, rest, _ := strings.Cut(out, "\n\n")
+	if block, _ := pem.Decode([]byte(rest)); block == nil || !bytes.Equal(block.Bytes, want.Raw) {
+		t.Errorf("printed another certificate: %q", out)
+	}
+
+	if err := cmdServerCert("server-cert", []string{"-file", loc + ".key"}); err == nil {
+		t.Error("printed a certificate from a key file")
+	}
+}
+
+func TestSendPreFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runs unix commands")
+	}
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	MessageOutput = ioutil.Discard
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+			accepted <- struct{}{}
+		}
+	}()
+	src := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, src, map[string]string{"version": "1"})
+
+	args := append(clientFlags(t), "-pre", "false", l.Addr().String(), "app", src)
+	if err := cmdSend("send", args); err == nil || !strings.Contains(err.Error(), "pre command failed") {
+		t.Errorf("got %v, want the pre command to fail", err)
+	}
+	select {
+	case <-accepted:
+		t.Error("connected to the server after the pre command failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRunPre(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runs unix commands")
+	}
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	MessageOutput = ioutil.Discard
+	src := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, src, map[string]string{"version": "1"})
+
+	if err := runPre("", src); err != nil {
+		t.Errorf("an empty command failed: %v", err)
+	}
+	// The command runs in the directory being sent, or beside a file.
+	if err := runPre("touch built", src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "built")); err != nil {
+		t.Error(err)
+	}
+	if err := runPre("touch beside", filepath.Join(src, "version")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "beside")); err != nil {
+		t.Error(err)
+	}
+	if err := runPre("true", filepath.Join(src, "missing")); err == nil {
+		t.Error("ran the command for a filename that doesn't exist")
+	}
+}
+
+func TestTargetFromFilename(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ filename, want string }{
+		{filepath.Join("build", "site"), "site"},
+		{filepath.Join("build", "site") + string(filepath.Separator), "site"},
+		{filepath.Join(wd, "app.tar"), "app.tar"},
+		{".", filepath.Base(wd)},
+	}
+	for _, tt := range tests {
+		if got, err := TargetFromFilename(tt.filename); err != nil || got != tt.want {
+			t.Errorf("TargetFromFilename(%q) = %q, %v, want %q", tt.filename, got, err, tt.want)
+		}
+	}
+	if got, err := TargetFromFilename(string(filepath.Separator)); err == nil {
+		t.Errorf("inferred %q from the root", got)
+	}
+}
+
+func TestSendTargetFromDir(t *testing.T) {
+	messages := MessageOutput
+	defer func() { MessageOutput = messages }()
+	MessageOutput = ioutil.Discard
+	d := newTestDaemon(t, nil)
+	address, flags := d.ListenCLI(t)
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+
+	if err := cmdSend("send", append(flags, "-target-from-dir", address, d.Src)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("deployed %q", got)
+	}
+
+	// A directory not named after a target is refused before packing.
+	other := filepath.Join(t.TempDir(), "typo")
+	writeFiles(t, other, map[string]string{"version": "2"})
+	err := cmdSend("send", append(flags, "-target-from-dir", address, other))
+	if err == nil || !strings.Contains(err.Error(), "inferred target typo does not exist") {
+		t.Errorf("got %v, want the inferred target refused", err)
+	}
+
+	// Naming the target still works with the flag.
+	if err := cmdSend("send", append(flags, "-target-from-dir", address, "app", other)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("deployed %q", got)
+	}
+
+	var ae *ArgError
+	if err := cmdSend("send", append(flags, address, d.Src)); !errors.As(err, &ae) {
+		t.Errorf("leaving out the target without the flag gave %v", err)
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+	lines := make(chan string)
+	release := make(chan struct{})
+	serve := func(conn net.Conn, id int) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- strings.TrimSpace(line)
+		if line == "hold\n" {
+			<-release
+		}
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		serveListeners(listeners, stop, done, serve)
+		close(returned)
+	}()
+
+	send := func(l net.Listener, line string) {
+		t.Helper()
+		c, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		fmt.Fprintln(c, line)
+	}
+	// Both listeners are served.
+	send(listeners[0], "first")
+	send(listeners[1], "second")
+	got := []string{<-lines, <-lines}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "first,second" {
+		t.Errorf("served %v", got)
+	}
+
+	// A connection in progress holds up the shutdown.
+	send(listeners[1], "hold")
+	if line := <-lines; line != "hold" {
+		t.Fatalf("served %q", line)
+	}
+	stop <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("done wasn't closed on the signal")
+	}
+	select {
+	case <-returned:
+		t.Fatal("returned before the connection in progress finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, l := range listeners {
+		if c, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+			c.Close()
+			t.Errorf("%s still accepts after the signal", l.Addr())
+		}
+	}
+	close(release)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't return once the connection finished")
+	}
+}
+
+func TestPrintSignature(t *testing.T) {
+	cert, certFilename, keyFilename := writeKeyPair(t)
+	want := leafSignature(t, cert)
+	// Nothing listens on the address, the commands stop before dialing.
+	for name, command := range map[string]func(string, []string) error{"ping": cmdPing, "send": cmdSend} {
+		var err error
+		out := captureStdout(t, func() {
+			err = command(name, []string{"-cert", certFilename, "-key", keyFilename, "-print-signature", "127.0.0.1:1", "app"})
+		})
+		if !errors.Is(err, errPrinted) {
+			t.Errorf("%s -print-signature gave %v", name, err)
+		}
+		if got := strings.TrimSpace(out); got != want {
+			t.Errorf("%s -print-signature printed %q, want %q", name, got, want)
+		}
+	}
+
+	var err error
+	captureStdout(t, func() {
+		err = cmdPing("ping", []string{"-cert", filepath.Join(t.TempDir(), "missing"), "-print-signature", "127.0.0.1:1"})
+	})
+	if err == nil || errors.Is(err, errPrinted) {
+		t.Errorf("printing the signature of a missing cert gave %v", err)
+	}
+}
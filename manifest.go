@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A list of deploys to send in one go with the apply command, e.g.
+//
+//	[[Deploy]]
+//	Target = "website"
+//	Filename = "build/site"
+//	Ignore = [".git"]
+type Manifest struct {
+	Deploy []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Target string
+
+	// The directory or file to send. Relative paths are relative to the manifest.
+	Filename string
+
+	// Filenames to leave out, like the send command's -ignore flag.
+	Ignore []string
+}
+
+func LoadManifest(filename string) (*Manifest, error) {
+	var m Manifest
+	if _, err := toml.DecodeFile(filename, &m); err != nil {
+		return nil, err
+	}
+	if err := m.Resolve(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	if len(m.Deploy) == 0 {
+		return nil, fmt.Errorf("%s lists no deploys", filename)
+	}
+	return &m, nil
+}
+
+// Checks every entry names a target and a filename, making relative filenames
+// relative to dir.
+func (m *Manifest) Resolve(dir string) error {
+	for i := range m.Deploy {
+		e := &m.Deploy[i]
+		if e.Target == "" {
+			return fmt.Errorf("deploy %d: missing Target", i+1)
+		}
+		if e.Filename == "" {
+			return fmt.Errorf("deploy %d (%s): missing Filename", i+1, e.Target)
+		}
+		fp, err := ExpandPath(e.Filename)
+		if err != nil {
+			return fmt.Errorf("deploy %d (%s): %v", i+1, e.Target, err)
+		}
+		if !filepath.IsAbs(fp) {
+			fp = filepath.Join(dir, fp)
+		}
+		e.Filename = fp
+	}
+	return nil
+}
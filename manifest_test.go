@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestResolve(t *testing.T) {
+	dir := t.TempDir()
+	abs := filepath.Join(dir, "elsewhere", "site")
+	m := Manifest{Deploy: []ManifestEntry{
+		{Target: "app", Filename: "build/app"},
+		{Target: "site", Filename: abs},
+	}}
+	if err := m.Resolve(dir); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "build", "app"); m.Deploy[0].Filename != want {
+		t.Errorf("resolved %s, want %s", m.Deploy[0].Filename, want)
+	}
+	if m.Deploy[1].Filename != abs {
+		t.Errorf("resolved %s, want %s", m.Deploy[1].Filename, abs)
+	}
+
+	for _, tc := range []struct {
+		entry ManifestEntry
+		want  string
+	}{
+		{ManifestEntry{Filename: "build/app"}, "deploy 2: missing Target"},
+		{ManifestEntry{Target: "app"}, "deploy 2 (app): missing Filename"},
+	} {
+		m := Manifest{Deploy: []ManifestEntry{{Target: "site", Filename: "site"}, tc.entry}}
+		if err := m.Resolve(dir); err == nil || err.Error() != tc.want {
+			t.Errorf("got %v, want %q", err, tc.want)
+		}
+	}
+}
+
+func TestApplyManifest(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets = append(c.Targets, Target{
+			Name:       "web",
+			Authorized: []string{"tester"},
+			Filename:   filepath.Join(filepath.Dir(c.Targets[0].Filename), "web"),
+		})
+	})
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/version":    "1",
+		"app/.git/HEAD":  "ref",
+		"web/index.html": "<html>",
+	})
+	m := Manifest{Deploy: []ManifestEntry{
+		{Target: "app", Filename: "app", Ignore: []string{filepath.Join(dir, "app", ".git")}},
+		{Target: "missing", Filename: "app"},
+		{Target: "web", Filename: "web"},
+	}}
+	if err := m.Resolve(dir); err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	deploy := func(e ManifestEntry) error {
+		sent = append(sent, e.Target)
+		_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: e.Target, ID: NewDeployID()}, e.Filename, PackOptions{Ignore: e.Ignore})
+		return err
+	}
+
+	var err error
+	out := captureStdout(t, func() { err = applyManifest(&m, true, deploy) })
+	if err == nil || err.Error() != "1 of 3 deploys failed" {
+		t.Errorf("got %v", err)
+	}
+	if strings.Join(sent, ",") != "app,missing" {
+		t.Errorf("sent %v, want to stop at the failure", sent)
+	}
+	if !strings.Contains(out, "skipped 1 remaining deploy(s)") {
+		t.Errorf("printed %q", out)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("deployed %q", got)
+	}
+
+	sent = nil
+	out = captureStdout(t, func() { err = applyManifest(&m, false, deploy) })
+	if err == nil {
+		t.Error("a failed deploy wasn't reported")
+	}
+	if strings.Join(sent, ",") != "app,missing,web" {
+		t.Errorf("sent %v, want every deploy", sent)
+	}
+	for _, want := range []string{"ok      app", "failed  missing", "ok      web"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printed %q, want %q", out, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(d.Config.Targets[1].Filename, "index.html")); got != "<html>" {
+		t.Errorf("deployed %q", got)
+	}
+	if xs, _ := ioutil.ReadDir(d.Target().Filename); len(xs) != 1 {
+		t.Errorf("deployed %d files, want the ignored ones left out", len(xs))
+	}
+
+	sent = nil
+	m.Deploy = m.Deploy[:1]
+	out = captureStdout(t, func() {
+		err = applyManifest(&m, true, func(e ManifestEntry) error { return errors.New("refused") })
+	})
+	if err == nil || !strings.Contains(out, "failed  app: refused") {
+		t.Errorf("got %v and printed %q", err, out)
+	}
+}
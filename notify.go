@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long a webhook has to accept an event.
+const WebhookTimeout = 10 * time.Second
+
+// The header carrying "sha256=<hex HMAC of the body>" when the webhook has a
+// Secret.
+const WebhookSignatureHeader = "X-Dctl-Signature"
+
+// Where deploy events are POSTed as JSON.
+type Webhook struct {
+	URL string
+
+	// Added to the body as "channel", for chat services whose webhooks pick the channel from it.
+	Channel string
+
+	// Signs each body with HMAC-SHA256 so the receiver can check it came from the daemon, see
+	// WebhookSignatureHeader.
+	Secret string
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL '%s' must be an http or https URL", w.URL)
+	}
+	return nil
+}
+
+// The webhook the target's events go to, its own if set otherwise the global
+// one. Nil when there is neither.
+func (c *Config) WebhookFor(t *Target) *Webhook {
+	if t != nil && t.Webhook != nil && t.Webhook.URL != "" {
+		return t.Webhook
+	}
+	if c.Webhook != nil && c.Webhook.URL != "" {
+		return c.Webhook
+	}
+	return nil
+}
+
+// Reports whether any webhook is configured, globally or for a target.
+func (c *Config) HasWebhooks() bool {
+	if c.WebhookFor(nil) != nil {
+		return true
+	}
+	for i := range c.Targets {
+		if c.WebhookFor(&c.Targets[i]) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type webhookBody struct {
+	Event
+	Channel string `json:"channel,omitempty"`
+}
+
+// Posts the event to the webhook.
+func (w *Webhook) Send(client *http.Client, e Event) error {
+	body, err := json.Marshal(webhookBody{Event: e, Channel: w.Channel})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+// Sends each event from ch to the webhook of its target until ch is closed.
+// Events are sent one at a time, a slow webhook makes the hub drop events for
+// it rather than hold up deploys.
+func NotifyWebhooks(ch <-chan Event, conf *Config, logger *log.Logger) {
+	client := &http.Client{Timeout: WebhookTimeout}
+	for e := range ch {
+		w := conf.WebhookFor(conf.GetTargetByName(e.Target))
+		if w == nil {
+			continue
+		}
+		if err := w.Send(client, e); err != nil {
+			logger.Printf("Failed to notify %s of %s for %s: %v", w.URL, e.Kind, e.Target, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWebhookFor(t *testing.T) {
+	global, own := &Webhook{URL: "https://hooks.example.com/all"}, &Webhook{URL: "https://hooks.example.com/app"}
+	tests := []struct {
+		name   string
+		global *Webhook
+		target *Target
+		want   *Webhook
+	}{
+		{"neither", nil, &Target{}, nil},
+		{"global", global, &Target{}, global},
+		{"own", nil, &Target{Webhook: own}, own},
+		{"own over global", global, &Target{Webhook: own}, own},
+		// An empty URL doesn't count as set.
+		{"own without URL", global, &Target{Webhook: &Webhook{Channel: "#app"}}, global},
+		{"global without URL", &Webhook{}, &Target{}, nil},
+		{"unknown target", global, nil, global},
+	}
+	for _, tt := range tests {
+		c := Config{Webhook: tt.global}
+		if got := c.WebhookFor(tt.target); got != tt.want {
+			t.Errorf("%s: WebhookFor gave %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if (&Config{Targets: []Target{{Name: "app"}}}).HasWebhooks() {
+		t.Error("HasWebhooks without any")
+	}
+	if !(&Config{Targets: []Target{{Name: "app"}, {Name: "web", Webhook: own}}}).HasWebhooks() {
+		t.Error("HasWebhooks missed a target's own")
+	}
+	if !(&Config{Webhook: global}).HasWebhooks() {
+		t.Error("HasWebhooks missed the global one")
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/x", true},
+		{"http://localhost:8080/x", true},
+		{"ftp://hooks.example.com/x", false},
+		{"hooks.example.com/x", false},
+		{"https://", false},
+	}
+	for _, tt := range tests {
+		global := Config{Webhook: &Webhook{URL: tt.url}, Targets: []Target{{Name: "app", Filename: filepath.Join(dir, "app")}}}
+		own := Config{Targets: []Target{{Name: "app", Filename: filepath.Join(dir, "app"), Webhook: &Webhook{URL: tt.url}}}}
+		for _, c := range []Config{global, own} {
+			if err := c.Validate(); (err == nil) != tt.ok {
+				t.Errorf("webhook %q gave %v", tt.url, err)
+			}
+		}
+	}
+}
+
+// A webhook receiver recording the bodies it is posted.
+type webhookReceiver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []webhookBody
+	sigs   []string
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, _ := ioutil.ReadAll(req.Body)
+		var body webhookBody
+		if err := json.Unmarshal(buf, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.bodies = append(r.bodies, body)
+		r.sigs = append(r.sigs, req.Header.Get(WebhookSignatureHeader))
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(buf)
+		if got := req.Header.Get(WebhookSignatureHeader); got != "" && got != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %s", got)
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) Received() []webhookBody {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookBody(nil), r.bodies...)
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	all, own := newWebhookReceiver(t), newWebhookReceiver(t)
+	conf := &Config{
+		Webhook: &Webhook{URL: all.URL, Channel: "#deploys"},
+		Targets: []Target{
+			{Name: "app"},
+			{Name: "web", Webhook: &Webhook{URL: own.URL, Secret: "s3cret"}},
+		},
+	}
+	ch := make(chan Event, 4)
+	done := make(chan struct{})
+	go func() {
+		NotifyWebhooks(ch, conf, log.New(ioutil.Discard, "", 0))
+		close(done)
+	}()
+	ch <- Event{Kind: EventDeployEnd, Target: "app", Outcome: OutcomeSuccess}
+	ch <- Event{Kind: EventDeployEnd, Target: "web", Outcome: OutcomeSuccess}
+	ch <- Event{Kind: EventRollback, Target: "missing"}
+	close(ch)
+	<-done
+
+	got := all.Received()
+	if len(got) != 2 || got[0].Target != "app" || got[1].Target != "missing" || got[0].Channel != "#deploys" {
+		t.Errorf("the global webhook got %+v", got)
+	}
+	if all.sigs[0] != "" {
+		t.Errorf("a webhook without a Secret was signed: %s", all.sigs[0])
+	}
+	got = own.Received()
+	if len(got) != 1 || got[0].Target != "web" || got[0].Outcome != OutcomeSuccess || got[0].Channel != "" {
+		t.Errorf("the target's webhook got %+v", got)
+	}
+	if !strings.HasPrefix(own.sigs[0], "sha256=") {
+		t.Errorf("the target's webhook wasn't signed: %q", own.sigs[0])
+	}
+}
+
+func TestWebhookSendStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	err := (&Webhook{URL: srv.URL}).Send(srv.Client(), Event{Kind: EventDeployEnd, Target: "app"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("a refusing webhook gave %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Lists the entry names of the tar PackTar writes for dir.
+func packNames(t *testing.T, dir string, opts PackOptions) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := PackTar(dir, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	r := tar.NewReader(&buf)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+}
+
+func TestPackTarIncludeIgnore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{
+		"main.go":              "",
+		"README":               "",
+		"lib/util.go":          "",
+		"lib/util.txt":         "",
+		"assets/logo.png":      "",
+		"assets/deep/more.png": "",
+		"node_modules/x/x.go":  "",
+	})
+	tests := []struct {
+		name    string
+		include []string
+		ignore  []string
+		want    string
+	}{
+		{"everything", nil, nil, "app,app/README,app/assets,app/assets/deep,app/assets/deep/more.png,app/assets/logo.png,app/lib,app/lib/util.go,app/lib/util.txt,app/main.go,app/node_modules,app/node_modules/x,app/node_modules/x/x.go"},
+		{"include only", []string{"*.go"}, nil, "app,app/lib,app/lib/util.go,app/main.go,app/node_modules,app/node_modules/x,app/node_modules/x/x.go"},
+		{"ignored directory", nil, []string{filepath.Join(dir, "node_modules")}, "app,app/README,app/assets,app/assets/deep,app/assets/deep/more.png,app/assets/logo.png,app/lib,app/lib/util.go,app/lib/util.txt,app/main.go"},
+		{"include and ignore", []string{"*.go"}, []string{filepath.Join(dir, "node_modules")}, "app,app/lib,app/lib/util.go,app/main.go"},
+		{"nested include", []string{"more.png"}, nil, "app,app/assets,app/assets/deep,app/assets/deep/more.png"},
+		{"nothing included", []string{"*.rs"}, nil, "app"},
+	}
+	for _, tt := range tests {
+		got := strings.Join(packNames(t, dir, PackOptions{Include: tt.include, Ignore: tt.ignore}), ",")
+		if got != tt.want {
+			t.Errorf("%s: packed %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A tree of small files with a few larger than packChunkSize.
+func writePackBench(tb testing.TB, dir string, small int) {
+	tb.Helper()
+	for i := 0; i < small; i++ {
+		name := filepath.Join(dir, "small", string(rune('a'+i%26)), strings.Repeat("f", 1+i/26))
+		writeBytes(tb, name, bytes.Repeat([]byte{byte(i)}, 4096+i))
+	}
+	for i := 0; i < 3; i++ {
+		writeBytes(tb, filepath.Join(dir, "large", strings.Repeat("l", i+1)), bytes.Repeat([]byte{byte(i), 1}, packChunkSize+i*1000))
+	}
+}
+
+func writeBytes(tb testing.TB, filename string, buf []byte) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestPackTarParallelMatchesSerial(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writePackBench(t, dir, 100)
+	var serial bytes.Buffer
+	if err := PackTar(dir, &serial, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{2, 4, 16} {
+		var parallel bytes.Buffer
+		if err := PackTar(dir, &parallel, PackOptions{Parallel: n}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+			t.Errorf("-parallel %d wrote %d bytes differing from the %d serial ones", n, parallel.Len(), serial.Len())
+		}
+	}
+}
+
+func BenchmarkPackTar(b *testing.B) {
+	dir := filepath.Join(b.TempDir(), "app")
+	writePackBench(b, dir, 500)
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallel=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := PackTar(dir, ioutil.Discard, PackOptions{Parallel: n}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHardlinkRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hardlinks are not detected on windows")
+	}
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{"assets/logo.png": "png", "other": "other"})
+	if err := os.Link(filepath.Join(dir, "assets", "logo.png"), filepath.Join(dir, "logo.png")); err != nil {
+		t.Skipf("no hardlinks: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := PackTar(dir, &buf, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var links int
+	r := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeLink {
+			links++
+			if h.Size != 0 {
+				t.Errorf("the link %s carries %d bytes", h.Name, h.Size)
+			}
+		}
+	}
+	if links != 1 {
+		t.Fatalf("packed %d hardlinks, want 1", links)
+	}
+
+	out, err := UnpackTar(tar.NewReader(&buf), UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	a, err := os.Stat(filepath.Join(out, "app", "assets", "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(out, "app", "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("the hardlinked files were unpacked as separate files")
+	}
+	if got := readFile(t, filepath.Join(out, "app", "logo.png")); got != "png" {
+		t.Errorf("the link holds %q", got)
+	}
+	c, err := os.Stat(filepath.Join(out, "app", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(a, c) {
+		t.Error("unrelated files were linked")
+	}
+}
+
+func TestPackEntryCountEmpty(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{
+		"node_modules/a.js":   "",
+		"node_modules/b/c.js": "",
+	})
+	ignore := []string{filepath.Join(dir, "node_modules")}
+	tests := []struct {
+		name  string
+		setup func()
+		opts  PackOptions
+		want  int
+	}{
+		{"fully ignored", func() {}, PackOptions{Ignore: ignore}, 0},
+		{"not ignored", func() {}, PackOptions{}, 4},
+		{"nothing included", func() {}, PackOptions{Include: []string{"*.go"}}, 0},
+		// Empty directories are something to deploy, see IsEmptyPayload.
+		{"empty directories", func() {
+			if err := os.MkdirAll(filepath.Join(dir, "var", "cache"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, PackOptions{Ignore: ignore}, 2},
+	}
+	for _, tt := range tests {
+		tt.setup()
+		n, _, err := PackEntryCount(dir, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("%s: counted %d entries, want %d", tt.name, n, tt.want)
+		}
+	}
+
+	fn := filepath.Join(t.TempDir(), "app.bin")
+	writeFiles(t, filepath.Dir(fn), map[string]string{"app.bin": ""})
+	if n, _, err := PackEntryCount(fn, PackOptions{}); err != nil || n != 1 {
+		t.Errorf("a single empty file counted %d entries: %v", n, err)
+	}
+}
+
+func TestDeployEmptyPayload(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "The payload is empty") {
+		t.Fatalf("deploying an empty directory gave %v", err)
+	}
+
+	// Unlike a tree of empty directories.
+	if err := os.MkdirAll(filepath.Join(d.Src, "var", "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(d.Target().Filename, "var", "cache")); err != nil || !stat.IsDir() {
+		t.Errorf("the empty directories weren't deployed: %v", err)
+	}
+}
+
+func TestParseTarFormat(t *testing.T) {
+	for str, want := range map[string]tar.Format{"": tar.FormatUnknown, "ustar": tar.FormatUSTAR, " PAX ": tar.FormatPAX, "gnu": tar.FormatGNU} {
+		if got, err := ParseTarFormat(str); err != nil || got != want {
+			t.Errorf("ParseTarFormat(%q) = %v, %v, want %v", str, got, err, want)
+		}
+	}
+	if _, err := ParseTarFormat("zip"); err == nil {
+		t.Error("ParseTarFormat accepted zip")
+	}
+}
+
+func TestPackTarLongName(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	// Over 100 bytes in one component, no split into a USTAR prefix fits it.
+	long := strings.Repeat("n", 120)
+	writeFiles(t, d.Src, map[string]string{long + "/" + long: "deep"})
+	name := filepath.Base(d.Src) + "/" + long + "/" + long
+
+	for _, tt := range []struct {
+		format tar.Format
+		want   tar.Format
+	}{
+		// The writer turns to PAX on its own.
+		{tar.FormatUnknown, tar.FormatPAX},
+		{tar.FormatPAX, tar.FormatPAX},
+		{tar.FormatGNU, tar.FormatGNU},
+	} {
+		var buf bytes.Buffer
+		if err := PackTar(d.Src, &buf, PackOptions{Format: tt.format}); err != nil {
+			t.Fatalf("%v: %v", tt.format, err)
+		}
+		found := false
+		r := tar.NewReader(&buf)
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", tt.format, err)
+			}
+			if h.Name == name {
+				found = true
+				if h.Format != tt.want {
+					t.Errorf("%v: the long name was written as %v, want %v", tt.format, h.Format, tt.want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%v: the long name didn't survive packing", tt.format)
+		}
+
+		if err := os.RemoveAll(d.Target().Filename); err != nil {
+			t.Fatal(err)
+		}
+		req := DeployRequest{Target: "app", ID: NewDeployID()}
+		if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{Format: tt.format}); err != nil {
+			t.Fatalf("%v: deploy: %v", tt.format, err)
+		}
+		if got := readFile(t, filepath.Join(d.Target().Filename, long, long)); got != "deep" {
+			t.Errorf("%v: the deployed file holds %q", tt.format, got)
+		}
+	}
+
+	if err := PackTar(d.Src, ioutil.Discard, PackOptions{Format: tar.FormatUSTAR}); err == nil {
+		t.Error("USTAR packed a name it can't hold")
+	}
+}
+
+func TestPackEntryCountSize(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{"version": "1", "empty": "", "conf/app.ini": strings.Repeat("x", 513)})
+	long := filepath.Join(dir, strings.Repeat("n", 120))
+	tests := []struct {
+		name    string
+		entries int
+		exact   bool
+	}{
+		{"ustar", 4, true},
+		// The long name takes an extended header the count leaves out.
+		{"pax", 6, false},
+	}
+	for _, tt := range tests {
+		if tt.name == "pax" {
+			writeFiles(t, long, map[string]string{"x": "x"})
+		}
+		n, size, err := PackEntryCount(dir, PackOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := PackTar(dir, &buf, PackOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.entries {
+			t.Errorf("%s: counted %d entries, want %d", tt.name, n, tt.entries)
+		}
+		if size > int64(buf.Len()) || tt.exact && size != int64(buf.Len()) {
+			t.Errorf("%s: counted %d bytes, PackTar wrote %d", tt.name, size, buf.Len())
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// How often a pull reports how much it received.
+const ProgressInterval = 2 * time.Second
+
+// Sends the target as a gzipped tar, to those who may deploy it when it has
+// Pull. The reply is an Ok, the tar as a stream, a stream holding the hex SHA-256
+// of the bytes in the first and a final status. The target is packed to a
+// temporary file while locked and sent after, so a slow client doesn't hold up
+// deploys. A failure to pack is a NotOk in place of the Ok, a failure while
+// sending ends the tar early and sends an empty checksum and a NotOk.
+func (ctx ServerContext) HandlePull(signature, targetName string) error {
+	target, name, err := ctx.AuthorizeTarget(signature, targetName)
+	if target == nil {
+		return err
+	}
+	if !target.Pull {
+		return goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("The target %s can't be pulled, it doesn't have Pull.", target.Name))
+	}
+	// Don't pack a target halfway through being swapped.
+	unlock, err := ctx.LockTarget(target)
+	if unlock == nil {
+		return err
+	}
+	var snapshot *os.File
+	var sum string
+	if _, err = os.Stat(target.Filename); err == nil {
+		snapshot, sum, err = packSnapshot(target.Filename)
+	}
+	unlock()
+	if os.IsNotExist(err) {
+		return goio.NotOk(ctx.C, StatusNotExist, fmt.Sprintf("The target %s has not been deployed.", target.Name))
+	} else if err != nil {
+		ctx.Log.Printf("Pull of %s failed: %s", target.Name, err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to pack the target.")
+	}
+	defer func() {
+		snapshot.Close()
+		os.Remove(snapshot.Name())
+	}()
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+
+	ctx.Log.Printf("Pull of %s by %s", target.Name, name)
+	sw := goio.NewStreamWriter(ctx.C)
+	cw := &countingWriter{w: sw}
+	_, err = io.Copy(cw, snapshot)
+	sw.Terminate()
+
+	sums := goio.NewStreamWriter(ctx.C)
+	if err == nil {
+		io.WriteString(sums, sum)
+	}
+	sums.Terminate()
+	if err != nil {
+		ctx.Log.Printf("Pull of %s failed: %s", target.Name, err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to send the target.")
+	}
+	ctx.Log.Printf("Sent %d bytes of %s to %s", cw.n, target.Name, name)
+	return goio.Ok(ctx.C)
+}
+
+// Packs filename as a gzipped tar into a temporary file. Returns the file rewound
+// and the hex SHA-256 of its contents, the caller closes and removes it.
+func packSnapshot(filename string) (*os.File, string, error) {
+	f, err := ioutil.TempFile(os.TempDir(), "dctl-pull-")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, hash))
+	err = PackTar(filename, gz, PackOptions{})
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	return f, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Downloads the target as a gzipped tar to w, printing progress to MessageOutput.
+// Returns the hex SHA-256 of what was written once it matched the daemon's.
+func HandleClientConnPull(conn *tls.Conn, target string, w io.Writer) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return "", err
+	}
+	if err := SendCommand(conn, CommandPULL, target); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	pw := &progressWriter{w: io.MultiWriter(w, hash), out: MessageOutput, label: "Received"}
+	if err := goio.ReadStream(conn, pw); err != nil {
+		return "", err
+	}
+	pw.Done()
+	var want sumBuffer
+	if err := goio.ReadStream(conn, &want); err != nil {
+		return "", err
+	}
+	if err := ReadStatus(conn); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if string(want) != sum {
+		return "", fmt.Errorf("%w: got %s, the daemon sent %s", ErrSumMismatch, sum, want)
+	}
+	return sum, nil
+}
+
+// Collects the short checksum stream, refusing more than a hex SHA-256.
+type sumBuffer []byte
+
+func (b *sumBuffer) Write(p []byte) (int, error) {
+	if len(*b)+len(p) > hex.EncodedLen(sha256.Size) {
+		return 0, errors.New("the daemon sent a malformed checksum")
+	}
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+// Counts what passes through and prints the count to out every
+// ProgressInterval.
+type progressWriter struct {
+	w     io.Writer
+	out   io.Writer
+	label string
+
+	n     int64
+	start time.Time
+	last  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start, p.last = now, now
+	}
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if now.Sub(p.last) >= ProgressInterval {
+		p.last = now
+		fmt.Fprintf(p.out, "%s %s...\n", p.label, FormatSize(p.n))
+	}
+	return n, err
+}
+
+// Prints the total and the average rate.
+func (p *progressWriter) Done() {
+	elapsed := time.Since(p.start)
+	if p.start.IsZero() {
+		elapsed = 0
+	}
+	rate := ""
+	if s := elapsed.Seconds(); s > 0 {
+		rate = fmt.Sprintf(", %s/s", FormatSize(int64(float64(p.n)/s)))
+	}
+	fmt.Fprintf(p.out, "%s %s in %s%s.\n", p.label, FormatSize(p.n), elapsed.Round(time.Millisecond), rate)
+}
+
+// Formats a byte count with a binary unit, e.g. 1.5 MiB.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
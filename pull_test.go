@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+func TestPullRoundTrip(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].Pull = true
+	})
+	files := map[string]string{"version": "1", "conf/app.ini": "debug = false"}
+	if err := d.Deploy(t, files); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	sum, err := HandleClientConnPull(d.Dial(t), "app", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sha256.Sum256(buf.Bytes()); hex.EncodeToString(got[:]) != sum {
+		t.Errorf("returned SHA-256 %s isn't that of the download", sum)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	r := tar.NewReader(gz)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			b, _ := ioutil.ReadAll(r)
+			got[h.Name] = string(b)
+		}
+	}
+	for name, want := range files {
+		if got["app/"+name] != want {
+			t.Errorf("app/%s holds %q, want %q", name, got["app/"+name], want)
+		}
+	}
+}
+
+func TestPullRefused(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	var rse *RemoteStatusError
+	if _, err := HandleClientConnPull(d.Dial(t), "app", ioutil.Discard); !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("pulling a target without Pull gave %v", err)
+	}
+
+	d.Target().Pull = true
+	if _, err := HandleClientConnPull(d.Dial(t), "missing", ioutil.Discard); !errors.As(err, &rse) {
+		t.Errorf("pulling a missing target gave %v", err)
+	}
+}
+
+func TestPullDoesNotHoldLock(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].Pull = true
+		c.LockTimeout = Duration{time.Second}
+	})
+	// Random content doesn't compress, the daemon blocks on a client not reading.
+	junk := make([]byte, 16<<20)
+	rand.Read(junk)
+	if err := d.Deploy(t, map[string]string{"junk": string(junk)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendCommand(d.Dial(t), CommandPULL, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Errorf("deploy during a stalled pull: %v", err)
+	}
+}
+
+// Serves a single PULL over a pipe, replying with payload and sum.
+func fakePullServer(t *testing.T, payload []byte, sum string) *tls.Conn {
+	t.Helper()
+	return fakeServer(t, func(c *tls.Conn) {
+		if _, _, err := goio.ReadCommand(c); err != nil {
+			return
+		}
+		goio.Ok(c)
+		for _, v := range []string{string(payload), sum} {
+			sw := goio.NewStreamWriter(c)
+			io.WriteString(sw, v)
+			sw.Terminate()
+		}
+		goio.Ok(c)
+	})
+}
+
+func TestPullChecksumMismatch(t *testing.T) {
+	payload := []byte("not what the daemon hashed")
+	good := sha256.Sum256(payload)
+	tests := []struct {
+		name string
+		sum  string
+		err  bool
+	}{
+		{"matching", hex.EncodeToString(good[:]), false},
+		{"mismatch", hex.EncodeToString(make([]byte, sha256.Size)), true},
+		{"empty", "", true},
+		{"too long", hex.EncodeToString(good[:]) + "00", true},
+	}
+	for _, tt := range tests {
+		_, err := HandleClientConnPull(fakePullServer(t, payload, tt.sum), "app", ioutil.Discard)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.n); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The suffix of payloads in the quarantine directory.
+const quarantineExt = ".payload"
+
+// Moves the payload file into dir, named by the time and deploy ID, then prunes
+// the quarantine to maxBytes and maxCount, see PruneQuarantine. Returns where
+// the payload went.
+func Quarantine(filename, id, dir string, maxBytes int64, maxCount int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, fmt.Sprintf("%s-%s%s", time.Now().Format(backupTimeLayout), id, quarantineExt))
+	if err := os.Rename(filename, dest); err != nil {
+		// The quarantine may be on another filesystem than the temp directory.
+		if err := CopyFile(filename, dest); err != nil {
+			return "", err
+		}
+		os.Remove(filename)
+	}
+	if err := PruneQuarantine(dir, maxBytes, maxCount); err != nil {
+		return dest, err
+	}
+	return dest, nil
+}
+
+// Removes the oldest quarantined payloads in dir until they total maxBytes or
+// less and number maxCount or fewer, always keeping the newest. A limit of zero
+// or less doesn't restrict anything.
+func PruneQuarantine(dir string, maxBytes int64, maxCount int) error {
+	if maxBytes <= 0 && maxCount <= 0 {
+		return nil
+	}
+	xs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, x := range xs {
+		if x.Mode().IsRegular() && strings.HasSuffix(x.Name(), quarantineExt) {
+			files = append(files, x)
+			total += x.Size()
+		}
+	}
+	// Names start with the time so they sort oldest first.
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	over := func() bool {
+		return (maxBytes > 0 && total > maxBytes) || (maxCount > 0 && len(files) > maxCount)
+	}
+	for len(files) > 1 && over() {
+		if err := os.Remove(filepath.Join(dir, files[0].Name())); err != nil {
+			return err
+		}
+		total -= files[0].Size()
+		files = files[1:]
+	}
+	return nil
+}
+
+// How often the daemon prunes the quarantine when the config doesn't set
+// QuarantineSweepInterval.
+const DefaultQuarantineSweepInterval = time.Hour
+
+// Prunes the QuarantineDirectory to its limits every QuarantineSweepInterval
+// until done is closed, catching payloads quarantined before the limits were
+// lowered or put there by hand.
+func SweepQuarantine(conf *Config, done <-chan struct{}, logger *log.Logger) {
+	interval := conf.QuarantineSweepInterval.Duration
+	if interval <= 0 {
+		interval = DefaultQuarantineSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := PruneQuarantine(conf.QuarantineDirectory, conf.QuarantineMaxBytes, conf.QuarantineMaxCount)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("Failed to prune the quarantine: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeployQuarantine(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	d := newTestDaemon(t, func(c *Config) {
+		c.QuarantineDirectory = dir
+		c.QuarantineMaxCount = 2
+	})
+	quarantined := func() []string {
+		xs, _ := filepath.Glob(filepath.Join(dir, "*"+quarantineExt))
+		return xs
+	}
+	deploy := func(payload []byte) string {
+		id := NewDeployID()
+		HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: id}, bytes.NewReader(payload))
+		requireNoTempDir(t, id)
+		return id
+	}
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	var buf bytes.Buffer
+	if err := PackTar(d.Src, &buf, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	payload := buf.Bytes()
+
+	deploy(payload)
+	if xs := quarantined(); len(xs) != 0 {
+		t.Fatalf("a successful deploy quarantined %v", xs)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		after   string
+	}{
+		{"scripts fail", payload, "false"},
+		{"unpack fails", payload[:700], ""},
+	} {
+		d.Target().After = tt.after
+		id := deploy(tt.payload)
+		var found string
+		for _, x := range quarantined() {
+			if strings.HasSuffix(x, "-"+id+quarantineExt) {
+				found = x
+			}
+		}
+		if found == "" {
+			t.Errorf("%s: the payload wasn't quarantined, found %v", tt.name, quarantined())
+			continue
+		}
+		if buf, err := ioutil.ReadFile(found); err != nil || !bytes.Equal(buf, tt.payload) {
+			t.Errorf("%s: the quarantined payload differs from the one sent: %v", tt.name, err)
+		}
+	}
+
+	// QuarantineMaxCount caps what is kept.
+	d.Target().After = "false"
+	deploy(payload)
+	if xs := quarantined(); len(xs) != 2 {
+		t.Errorf("quarantined %v, want QuarantineMaxCount 2", xs)
+	}
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	// Oldest first, by name, with their sizes.
+	payloads := []struct {
+		name string
+		size int
+	}{{"20201231-a", 10}, {"20201231-b", 20}, {"20210101-c", 30}, {"20210102-d", 40}}
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxCount int
+		want     string
+	}{
+		{"no limits", 0, 0, "20201231-a,20201231-b,20210101-c,20210102-d"},
+		{"under both", 100, 4, "20201231-a,20201231-b,20210101-c,20210102-d"},
+		{"bytes", 70, 0, "20210101-c,20210102-d"},
+		{"count", 0, 3, "20201231-b,20210101-c,20210102-d"},
+		// Whichever removes more wins.
+		{"both, count stricter", 1000, 1, "20210102-d"},
+		{"both, bytes stricter", 80, 3, "20210101-c,20210102-d"},
+		// The newest stays, even over the limit by itself.
+		{"newest over the limit", 5, 0, "20210102-d"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, p := range payloads {
+			if err := ioutil.WriteFile(filepath.Join(dir, p.name+quarantineExt), bytes.Repeat([]byte("x"), p.size), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Other files neither count nor are removed.
+		writeFiles(t, dir, map[string]string{"README": strings.Repeat("x", 1000)})
+		if err := PruneQuarantine(dir, tt.maxBytes, tt.maxCount); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		xs, _ := filepath.Glob(filepath.Join(dir, "*"+quarantineExt))
+		for _, x := range xs {
+			got = append(got, strings.TrimSuffix(filepath.Base(x), quarantineExt))
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: kept %v, want %s", tt.name, got, tt.want)
+		}
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "README")); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSweepQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1", "2", "3"} {
+		writeFiles(t, dir, map[string]string{name + quarantineExt: name})
+	}
+	done := make(chan struct{})
+	close(done)
+	// Sweeps once at start, then stops with done.
+	SweepQuarantine(&Config{QuarantineDirectory: dir, QuarantineMaxCount: 1}, done, log.New(ioutil.Discard, "", 0))
+	if xs, _ := filepath.Glob(filepath.Join(dir, "*"+quarantineExt)); len(xs) != 1 || filepath.Base(xs[0]) != "3"+quarantineExt {
+		t.Errorf("the sweep kept %v", xs)
+	}
+
+	// A missing directory is nothing to sweep.
+	var logged bytes.Buffer
+	SweepQuarantine(&Config{QuarantineDirectory: filepath.Join(dir, "missing"), QuarantineMaxCount: 1}, done, log.New(&logged, "", 0))
+	if logged.Len() > 0 {
+		t.Errorf("sweeping a missing quarantine logged %q", logged.String())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Returned replaying a file that is neither a tar nor a gzipped tar.
+var ErrNotPayload = errors.New("the file is not a tar or a gzipped tar payload")
+
+// Reports whether filename is a payload as the daemon received it, a
+// quarantined payload, a compressed backup or a tar, to be streamed as is.
+// Anything else, such as a backup directory, is packed like send does.
+func IsRawPayload(filename string) bool {
+	for _, ext := range []string{quarantineExt, CompressedBackupSuffix, ".tar"} {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// A payload file opened for replaying, see OpenPayload.
+type Payload struct {
+	io.Reader
+	f *os.File
+
+	// CompressionGzip when the payload is gzipped, empty for a plain tar.
+	Compression string
+
+	// The size of a plain tar, zero when compressed.
+	Size int64
+}
+
+func (p *Payload) Close() error {
+	return p.f.Close()
+}
+
+// Opens the payload file, telling a gzipped one from a tar by its first bytes.
+func OpenPayload(filename string) (*Payload, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	br := bufio.NewReaderSize(f, 512)
+	p := &Payload{Reader: br, f: f}
+	if magic, _ := br.Peek(2); IsGzip(magic) {
+		p.Compression = CompressionGzip
+	} else if block, _ := br.Peek(512); len(block) < 512 || !IsTarHeader(block) {
+		f.Close()
+		return nil, ErrNotPayload
+	} else {
+		p.Size = stat.Size()
+	}
+	return p, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The files and directories beneath dir by slash separated path, with their
+// permissions and contents.
+func treeOf(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || fp == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, fp)
+		v := info.Mode().String()
+		if info.Mode().IsRegular() {
+			v += " " + readFile(t, fp)
+		}
+		tree[filepath.ToSlash(rel)] = v
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestIsRawPayload(t *testing.T) {
+	tests := map[string]bool{
+		"20201231-abc" + quarantineExt:              true,
+		"app.20201231.bak" + CompressedBackupSuffix: true,
+		"app.tar":          true,
+		"app.20201231.bak": false,
+		"app":              false,
+		"app.tar/":         false,
+	}
+	for name, want := range tests {
+		if got := IsRawPayload(name); got != want {
+			t.Errorf("IsRawPayload(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestOpenPayload(t *testing.T) {
+	dir := t.TempDir()
+	payload := tarBytes(t, tarEntry{Name: "app/version", Body: "1"})
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(payload)
+	gz.Close()
+	files := map[string][]byte{"plain": payload, "gzipped": gzipped.Bytes(), "junk": bytes.Repeat([]byte("junk"), 256), "short": payload[:100]}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := OpenPayload(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(p)
+	p.Close()
+	if p.Compression != "" || p.Size != int64(len(payload)) || !bytes.Equal(got, payload) {
+		t.Errorf("a plain tar opened as %q of %d bytes, read %d", p.Compression, p.Size, len(got))
+	}
+	p, err = OpenPayload(filepath.Join(dir, "gzipped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadAll(p)
+	p.Close()
+	if p.Compression != CompressionGzip || p.Size != 0 || !bytes.Equal(got, gzipped.Bytes()) {
+		t.Errorf("a gzipped tar opened as %q of %d bytes", p.Compression, p.Size)
+	}
+	for _, name := range []string{"junk", "short"} {
+		if _, err := OpenPayload(filepath.Join(dir, name)); err != ErrNotPayload {
+			t.Errorf("opening %s gave %v, want ErrNotPayload", name, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	d := newTestDaemon(t, func(c *Config) {
+		c.QuarantineDirectory = quarantine
+		c.CompressBackups = true
+		c.KeepBackups = 5
+	})
+	addr, flags := d.ListenCLI(t)
+	replay := func(filename string) {
+		t.Helper()
+		args := append(append([]string(nil), flags...), addr, "app", filename)
+		if err := cmdReplay("replay", args); err != nil {
+			t.Fatalf("replay of %s: %v", filepath.Base(filename), err)
+		}
+	}
+	newestBackup := func() string {
+		t.Helper()
+		backups, err := ListBackups(d.Config.BackupDirectory, "app")
+		if err != nil || len(backups) == 0 {
+			t.Fatalf("no backups: %v", err)
+		}
+		return backups[0].Filename
+	}
+
+	if err := d.Deploy(t, map[string]string{"version": "1", "conf/app.ini": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	first := treeOf(t, d.Target().Filename)
+	// A deploy failing in After quarantines its payload and restores the first.
+	d.Target().After = "false"
+	nextBackupSecond()
+	if err := d.Deploy(t, map[string]string{"version": "2", "conf/app.ini": "b", "bin/run": "x"}); err == nil {
+		t.Fatal("the deploy with a failing After succeeded")
+	}
+	d.Target().After = ""
+	quarantined, _ := filepath.Glob(filepath.Join(quarantine, "*"+quarantineExt))
+	if len(quarantined) != 1 {
+		t.Fatalf("quarantined %v", quarantined)
+	}
+
+	// The replayed payload gives what sending the files would have.
+	nextBackupSecond()
+	replay(quarantined[0])
+	if got, want := treeOf(t, d.Target().Filename), treeOf(t, d.Src); !reflect.DeepEqual(got, want) {
+		t.Errorf("the replayed payload gave\n%v\nwant\n%v", got, want)
+	}
+
+	// As does replaying the compressed backup the replay took.
+	nextBackupSecond()
+	replay(newestBackup())
+	if got := treeOf(t, d.Target().Filename); !reflect.DeepEqual(got, first) {
+		t.Errorf("the replayed compressed backup gave\n%v\nwant\n%v", got, first)
+	}
+
+	// And a backup directory, packed like send does.
+	d.Config.CompressBackups = false
+	nextBackupSecond()
+	if err := d.Deploy(t, map[string]string{"version": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	backup := newestBackup()
+	if stat, err := os.Stat(backup); err != nil || !stat.IsDir() {
+		t.Fatalf("the backup %s isn't a directory: %v", backup, err)
+	}
+	nextBackupSecond()
+	replay(backup)
+	if got := treeOf(t, d.Target().Filename); !reflect.DeepEqual(got, first) {
+		t.Errorf("the replayed backup directory gave\n%v\nwant\n%v", got, first)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Used when the config doesn't set an IdempotencyWindow.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+type deployResult struct {
+	Outcome string
+	Expires time.Time
+}
+
+// Remembers the outcome of deploys by idempotency key so a retried deploy
+// isn't run a second time. Keys are kept per user and target.
+type ResultStore struct {
+	mu sync.Mutex
+	m  map[string]deployResult
+}
+
+func resultKey(name, target, key string) string {
+	return name + "\x00" + target + "\x00" + key
+}
+
+// Returns the outcome recorded for the key, false if there is none or it
+// expired. A nil ResultStore records nothing.
+func (s *ResultStore) Get(name, target, key string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.m[resultKey(name, target, key)]
+	if !ok || time.Now().After(r.Expires) {
+		return "", false
+	}
+	return r.Outcome, true
+}
+
+// Records the outcome for the key for window, dropping expired ones.
+func (s *ResultStore) Put(name, target, key, outcome string, window time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.m == nil {
+		s.m = make(map[string]deployResult)
+	}
+	for k, r := range s.m {
+		if now.After(r.Expires) {
+			delete(s.m, k)
+		}
+	}
+	s.m[resultKey(name, target, key)] = deployResult{Outcome: outcome, Expires: now.Add(window)}
+}
+
+func (ctx ServerContext) IdempotencyWindow() time.Duration {
+	if ctx.Config.IdempotencyWindow.Duration > 0 {
+		return ctx.Config.IdempotencyWindow.Duration
+	}
+	return DefaultIdempotencyWindow
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultStore(t *testing.T) {
+	var s ResultStore
+	s.Put("tester", "app", "k", OutcomeSuccess, time.Hour)
+	s.Put("tester", "app", "short", OutcomeFailure, 10*time.Millisecond)
+	if got, ok := s.Get("tester", "app", "k"); !ok || got != OutcomeSuccess {
+		t.Errorf("Get gave %q, %v", got, ok)
+	}
+	// Keys are per user and target.
+	if _, ok := s.Get("other", "app", "k"); ok {
+		t.Error("another user's key matched")
+	}
+	if _, ok := s.Get("tester", "web", "k"); ok {
+		t.Error("another target's key matched")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := s.Get("tester", "app", "short"); ok {
+		t.Error("an expired result was returned")
+	}
+
+	var none *ResultStore
+	none.Put("tester", "app", "k", OutcomeSuccess, time.Hour)
+	if _, ok := none.Get("tester", "app", "k"); ok {
+		t.Error("a nil store returned a result")
+	}
+}
+
+func TestDeployIdempotencyKey(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	after, runs := flakyScript(t, 0)
+	d.Target().After = after
+	deploy := func(key, version string) error {
+		writeFiles(t, d.Src, map[string]string{"version": version})
+		_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID(), Key: key}, d.Src, PackOptions{})
+		return err
+	}
+	version := func() string {
+		return readFile(t, filepath.Join(d.Target().Filename, "version"))
+	}
+
+	if err := deploy("build-1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// A retry is answered from the first run, even with other files. The
+	// client takes the StatusUpToDate as done.
+	if err := deploy("build-1", "1b"); err != nil {
+		t.Errorf("the retry of a success gave %v", err)
+	}
+	if got := version(); got != "1" {
+		t.Errorf("the retry deployed version %q", got)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("After ran %d times, want once", n)
+	}
+
+	d.Target().Verify = "false"
+	if err := deploy("build-2", "2"); err == nil {
+		t.Fatal("a deploy failing Verify succeeded")
+	}
+	d.Target().Verify = ""
+	var rse *RemoteStatusError
+	if err := deploy("build-2", "2"); !errors.As(err, &rse) || !strings.Contains(rse.Message, "ended with "+OutcomeRolledBack) {
+		t.Errorf("the retry of a rolled back deploy gave %v", err)
+	}
+	if got := version(); got != "1" {
+		t.Errorf("the retry of a failure deployed version %q", got)
+	}
+
+	// A new key runs, and an expired one runs again.
+	if err := deploy("build-3", "3"); err != nil || version() != "3" {
+		t.Errorf("a new key gave %v, version %q", err, version())
+	}
+	d.Config.IdempotencyWindow = Duration{10 * time.Millisecond}
+	if err := deploy("build-4", "4"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := deploy("build-4", "4b"); err != nil || version() != "4b" {
+		t.Errorf("an expired key gave %v, version %q", err, version())
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// The timestamp layout BackupTarget puts in backup names.
+const backupTimeLayout = "20060102150405"
+
+// A backup of a target left in the backup directory.
+type Backup struct {
+	Filename string
+	Time     time.Time
+}
+
+// Lists the backups of the named target in dir, newest first.
+func ListBackups(dir, name string) ([]Backup, error) {
+	xs, err := filepath.Glob(filepath.Join(dir, name+".*.bak*"))
+	if err != nil {
+		return nil, err
+	}
+	var backups []Backup
+	for _, v := range xs {
+		rest := strings.TrimPrefix(filepath.Base(v), name+".")
+		rest = strings.TrimSuffix(rest, CompressedBackupSuffix)
+		if !strings.HasSuffix(rest, ".bak") {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeLayout, strings.TrimSuffix(rest, ".bak"), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Filename: v, Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// Picks a backup by index, 0 being the newest, or by timestamp. A timestamp
+// prefix such as "20201231" matches every backup of that day. All matching
+// backups are returned, only a single match is a valid selection.
+func SelectBackup(backups []Backup, selector string) []Backup {
+	// Four digits or more are a timestamp, a year at least.
+	if i, err := strconv.Atoi(selector); err == nil && len(selector) < 4 {
+		if i < 0 || i >= len(backups) {
+			return nil
+		}
+		return backups[i : i+1]
+	}
+	var matches []Backup
+	for _, v := range backups {
+		if strings.HasPrefix(v.Time.Format(backupTimeLayout), selector) {
+			matches = append(matches, v)
+		}
+	}
+	return matches
+}
+
+// Removes all but the newest keep backups of the named target.
+func PruneBackups(dir, name string, keep int) error {
+	backups, err := ListBackups(dir, name)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(backups); i++ {
+		if err := os.RemoveAll(backups[i].Filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteBackupList(w io.Writer, backups []Backup) {
+	for i, v := range backups {
+		fmt.Fprintf(w, "%3d  %s  %s\n", i, v.Time.Format(backupTimeLayout), filepath.Base(v.Filename))
+	}
+}
+
+// Sent with the ROLLBACK command, encoded like DeployRequest.
+type RollbackRequest struct {
+	Target string
+
+	// A backup index or timestamp, see SelectBackup, or a generation for targets with Generations, see
+	// SelectGeneration. Empty only lists them.
+	Select string
+
+	// Only report what restoring the selected backup would do. Sent as the PLAN command rather than encoded, so a
+	// daemon too old to know it refuses instead of rolling back.
+	DryRun bool
+}
+
+func (r RollbackRequest) Encode() string {
+	v := url.Values{}
+	if r.Select != "" {
+		v.Set("select", r.Select)
+	}
+	if len(v) == 0 {
+		return r.Target
+	}
+	return r.Target + "?" + v.Encode()
+}
+
+func ParseRollbackRequest(input string) (RollbackRequest, error) {
+	var r RollbackRequest
+	xs := strings.SplitN(input, "?", 2)
+	r.Target = xs[0]
+	if len(xs) < 2 {
+		return r, nil
+	}
+	v, err := url.ParseQuery(xs[1])
+	if err != nil {
+		return r, err
+	}
+	r.Select = v.Get("select")
+	return r, nil
+}
+
+// Restores a backup of the target. The reply is an Ok, a stream of messages for
+// the operator and a final status. With dryRun the stream reports what the
+// rollback would do instead and nothing is touched.
+func (ctx ServerContext) HandleRollback(signature, input string, dryRun bool) error {
+	req, err := ParseRollbackRequest(input)
+	if err != nil {
+		return goio.NotOk(ctx.C, StatusNotOK, "Malformed rollback request.")
+	}
+	target, name, err := ctx.AuthorizeTarget(signature, req.Target)
+	if target == nil {
+		return err
+	}
+	unlock, err := ctx.LockTarget(target)
+	if unlock == nil {
+		return err
+	}
+	defer unlock()
+	if !ctx.Config.RunsScripts(target, name) && target.HasScripts() {
+		ctx.Log.Printf("Skipping the scripts of %s, %s may only roll back its files", target.Name, name)
+		target = target.WithoutScripts()
+	}
+	if target.Generations > 0 {
+		return ctx.RollbackGeneration(target, name, req, dryRun)
+	}
+	backups, err := ListBackups(ctx.Config.BackupDirectory, target.Name)
+	if err != nil {
+		ctx.Log.Printf("ListBackups error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to list backups.")
+	}
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+
+	sw := goio.NewStreamWriter(ctx.C)
+	var matches []Backup
+	if req.Select != "" {
+		matches = SelectBackup(backups, req.Select)
+	}
+	if len(matches) != 1 {
+		if req.Select == "" {
+			fmt.Fprintf(sw, "Backups of %s, select one by index or timestamp:\n", target.Name)
+		} else if len(matches) == 0 {
+			fmt.Fprintf(sw, "No backup of %s matches '%s'. Available:\n", target.Name, req.Select)
+		} else {
+			fmt.Fprintf(sw, "'%s' matches %d backups of %s:\n", req.Select, len(matches), target.Name)
+			backups = matches
+		}
+		WriteBackupList(sw, backups)
+		sw.Terminate()
+		if req.Select == "" {
+			return goio.Ok(ctx.C)
+		}
+		return goio.NotOk(ctx.C, StatusNotExist, "No single backup was selected.")
+	}
+	selected := matches[0]
+	if dryRun {
+		err := ctx.WriteRollbackPlan(sw, target, name, selected)
+		sw.Terminate()
+		if err != nil {
+			return goio.NotOk(ctx.C, StatusNotOK, "The selected backup is damaged.")
+		}
+		return goio.Ok(ctx.C)
+	}
+	ctx.Log.Printf("Rollback of %s to %s by %s", target.Name, filepath.Base(selected.Filename), name)
+	ctx.Events.Publish(Event{Kind: EventRollback, Target: target.Name, User: name, Outcome: filepath.Base(selected.Filename)})
+	fmt.Fprintf(sw, "Restoring %s from %s.\n", target.Name, filepath.Base(selected.Filename))
+	sw.Terminate()
+
+	if err := CheckBackupDirectory(ctx.Config.BackupDirectory); err != nil {
+		return ctx.BackupDirectoryError(err)
+	}
+	if err := RunScript(target.Before, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Println(err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Issue running Before script.")
+	}
+	ctx.WaitPreSwap(target)
+	if err := RunScript(target.PreBackup, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Println(err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Issue running PreBackup script, the target was left untouched.")
+	}
+	// The current files become a backup of their own so the rollback can be
+	// undone the same way.
+	current, err := BackupTarget(*target, ctx.Config.BackupDirectory, ctx.Config.CompressBackups, ctx.Config.CopyWorkers(), ctx.Config.RenameRetry())
+	if errors.Is(err, ErrLeftover) {
+		ctx.Log.Printf("BackupTarget left files behind: %s", err.Error())
+	} else if err != nil {
+		ctx.Log.Printf("BackupTarget error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to backup the current target. Please attend.")
+	}
+	ctx.RecordDigest(target, "")
+	if err := RestoreBackup(selected.Filename, target.Filename, ctx.Config.RenameRetry()); errors.Is(err, ErrLeftover) {
+		ctx.Log.Printf("RestoreBackup left files behind: %s", err.Error())
+	} else if err != nil {
+		ctx.Log.Printf("RestoreBackup error: %s", err.Error())
+		msg := "Failed to restore the selected backup."
+		if current != "" {
+			if err := RestoreBackup(current, target.Filename, ctx.Config.RenameRetry()); err != nil && !errors.Is(err, ErrLeftover) {
+				ctx.Log.Printf("Restore error: %s", err.Error())
+				msg += " Putting the current files back failed. Please attend."
+			}
+		}
+		return goio.NotOk(ctx.C, StatusNotOK, msg)
+	}
+	if err := ctx.RunAfter(target); err != nil {
+		ctx.Log.Printf("After error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "The backup was restored but the After script failed. Please attend.")
+	}
+	return goio.Ok(ctx.C)
+}
+
+// Describes restoring the backup to w: the scripts that would run, whether the
+// current files can be backed up and whether the backup reads back completely.
+// Returns the error reading the backup.
+func (ctx ServerContext) WriteRollbackPlan(w io.Writer, target *Target, name string, backup Backup) error {
+	ctx.Log.Printf("Planned rollback of %s to %s for %s", target.Name, filepath.Base(backup.Filename), name)
+	fmt.Fprintf(w, "Would restore %s from %s, taken %s.\n", target.Name, filepath.Base(backup.Filename), backup.Time.Format(time.RFC3339))
+	ctx.WriteScriptPlan(w, target, name)
+	if err := CheckBackupDirectory(ctx.Config.BackupDirectory); err != nil {
+		fmt.Fprintf(w, "The current files can't be backed up, the rollback would be refused: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "The current files would be backed up to %s first.\n", ctx.Config.BackupDirectory)
+	}
+	n, err := CheckBackup(backup.Filename)
+	if err != nil {
+		fmt.Fprintf(w, "The backup is damaged after %d entries: %v\n", n, err)
+		return err
+	}
+	fmt.Fprintf(w, "The backup is intact, %d entries.\n", n)
+	return nil
+}
+
+// Lists the scripts a rollback of the target by name would run to w.
+func (ctx ServerContext) WriteScriptPlan(w io.Writer, target *Target, name string) {
+	script := func(v string) string {
+		if strings.TrimSpace(v) == "" {
+			return "(none)"
+		}
+		return v
+	}
+	if !ctx.Config.RunsScripts(target, name) {
+		fmt.Fprintln(w, "The target's scripts are skipped for you.")
+	}
+	fmt.Fprintf(w, "Before:    %s\n", script(target.Before))
+	fmt.Fprintf(w, "PreBackup: %s\n", script(target.PreBackup))
+	fmt.Fprintf(w, "After:     %s\n", script(target.After))
+}
+
+// Reads through the backup, decompressing a compressed one, and returns the
+// number of entries found before any error.
+func CheckBackup(filename string) (int, error) {
+	if !strings.HasSuffix(filename, CompressedBackupSuffix) {
+		var n int
+		err := filepath.Walk(filename, func(fp string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		return n, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	reader := tar.NewReader(gz)
+	for {
+		if _, err := reader.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return n, err
+		}
+		n++
+	}
+	// Reading to the end of the gzip stream verifies its checksum.
+	_, err = io.Copy(ioutil.Discard, gz)
+	return n, err
+}
+
+// Asks the daemon to roll the target back, printing its messages to w.
+func HandleClientConnRollback(conn *tls.Conn, req RollbackRequest, w io.Writer) error {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return err
+	}
+	command := CommandROLLBACK
+	if req.DryRun {
+		command = CommandPLAN
+	}
+	if err := SendCommand(conn, command, req.Encode()); err != nil {
+		return err
+	}
+	if err := goio.ReadStream(conn, w); err != nil {
+		return err
+	}
+	return ReadStatus(conn)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectBackup(t *testing.T) {
+	day := time.Date(2020, 12, 31, 0, 0, 0, 0, time.Local)
+	backups := []Backup{
+		{Filename: "c", Time: day.Add(3 * time.Hour)},
+		{Filename: "b", Time: day.Add(2 * time.Hour)},
+		{Filename: "a", Time: day.Add(-time.Hour)},
+	}
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"0", []string{"c"}},
+		{"2", []string{"a"}},
+		{"3", nil},
+		{"-1", nil},
+		{"20201231", []string{"c", "b"}},
+		{"20201230", []string{"a"}},
+		{"2020123102", []string{"b"}},
+		{"20201231030000", []string{"c"}},
+		{"2020", []string{"c", "b", "a"}},
+		{"2019", nil},
+		{"latest", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, v := range SelectBackup(backups, tt.selector) {
+			got = append(got, v.Filename)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("SelectBackup(%q) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"app.20201231020000.bak",
+		"app.20201231030000.bak" + CompressedBackupSuffix,
+		"app.20201230230000.bak",
+		"app.notatime.bak",
+		"app.20201231040000.tmp",
+		"other.20201231050000.bak",
+		"app.old.20201231060000.bak",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := ListBackups(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range backups {
+		got = append(got, filepath.Base(v.Filename))
+	}
+	want := []string{"app.20201231030000.bak" + CompressedBackupSuffix, "app.20201231020000.bak", "app.20201230230000.bak"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBackups = %v, want %v", got, want)
+	}
+	if backups, err := ListBackups(filepath.Join(dir, "missing"), "app"); err != nil || len(backups) != 0 {
+		t.Errorf("ListBackups of a missing directory = %v, %v", backups, err)
+	}
+}
+
+func TestParseRollbackRequest(t *testing.T) {
+	tests := []struct {
+		input string
+		want  RollbackRequest
+	}{
+		{"app", RollbackRequest{Target: "app"}},
+		{"app?select=1", RollbackRequest{Target: "app", Select: "1"}},
+		{"app?select=20201231", RollbackRequest{Target: "app", Select: "20201231"}},
+		{"app?select=current-2&other=x", RollbackRequest{Target: "app", Select: "current-2"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRollbackRequest(tt.input)
+		if err != nil {
+			t.Errorf("ParseRollbackRequest(%q): %v", tt.input, err)
+		} else if got != tt.want {
+			t.Errorf("ParseRollbackRequest(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+		// Encoding what was parsed gives back the same request.
+		if again, err := ParseRollbackRequest(got.Encode()); err != nil || again != got {
+			t.Errorf("round trip of %+v gave %+v, %v", got, again, err)
+		}
+	}
+	if _, err := ParseRollbackRequest("app?select=%zz"); err == nil {
+		t.Error("a malformed query parsed")
+	}
+}
+
+func TestCheckBackup(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{"version": "1", "conf/app.ini": "x"})
+	// The directory itself, conf and the two files.
+	if n, err := CheckBackup(dir); err != nil || n != 4 {
+		t.Errorf("CheckBackup of a directory gave %d, %v", n, err)
+	}
+
+	compressed := filepath.Join(t.TempDir(), "app.bak"+CompressedBackupSuffix)
+	if err := CompressBackup(dir, compressed); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CheckBackup(compressed); err != nil || n != 4 {
+		t.Errorf("CheckBackup of a compressed backup gave %d, %v", n, err)
+	}
+	buf, err := ioutil.ReadFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cutting off the gzip trailer leaves every entry readable, only the checksum is missing.
+	if err := ioutil.WriteFile(compressed, buf[:len(buf)-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckBackup(compressed); err == nil {
+		t.Error("CheckBackup of a truncated backup succeeded")
+	}
+	if _, err := CheckBackup(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("CheckBackup of a missing backup succeeded")
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.KeepBackups = 5 })
+	for _, v := range []string{"1", "2"} {
+		if err := d.Deploy(t, map[string]string{"version": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only listed, planning doesn't run it.
+	d.Target().After = "/opt/app/after.sh"
+	plan := func(selector string) (string, error) {
+		var buf bytes.Buffer
+		err := HandleClientConnRollback(d.Dial(t), RollbackRequest{Target: "app", Select: selector, DryRun: true}, &buf)
+		return buf.String(), err
+	}
+	out, err := plan("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Would restore app from", "After:     /opt/app/after.sh", "would be backed up to", "The backup is intact, 2 entries."} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the plan doesn't say %q:\n%s", want, out)
+		}
+	}
+	// Nothing was touched.
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "2" {
+		t.Errorf("version holds %q after planning", got)
+	}
+	if backups, err := ListBackups(d.Config.BackupDirectory, "app"); err != nil || len(backups) != 1 {
+		t.Errorf("after planning there are %d backups: %v", len(backups), err)
+	}
+
+	var rse *RemoteStatusError
+	if _, err := plan("9"); !errors.As(err, &rse) || rse.Code != StatusNotExist {
+		t.Errorf("planning a missing backup gave %v", err)
+	}
+
+	d.Target().ScriptAuthorized = []string{"someone"}
+	if out, err := plan("0"); err != nil || !strings.Contains(out, "scripts are skipped for you") || strings.Contains(out, "after.sh") {
+		t.Errorf("the plan for a user not in ScriptAuthorized: %v\n%s", err, out)
+	}
+	d.Target().ScriptAuthorized = nil
+
+	// A damaged backup ends the plan with a NotOk.
+	d.Config.CompressBackups = true
+	d.Target().After = ""
+	nextBackupSecond()
+	if err := d.Deploy(t, map[string]string{"version": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := ListBackups(d.Config.BackupDirectory, "app")
+	if err != nil || len(backups) != 2 || !strings.HasSuffix(backups[0].Filename, CompressedBackupSuffix) {
+		t.Fatalf("got backups %+v, %v, want the newest compressed", backups, err)
+	}
+	buf, err := ioutil.ReadFile(backups[0].Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backups[0].Filename, buf[:len(buf)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = plan("0")
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "damaged") || !strings.Contains(out, "The backup is damaged") {
+		t.Errorf("planning a damaged backup gave %v:\n%s", err, out)
+	}
+}
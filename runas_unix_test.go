@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolveCredential(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	cred, err := ResolveCredential(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getuid()); strconv.FormatUint(uint64(cred.Uid), 10) != want {
+		t.Errorf("uid %d, want %s", cred.Uid, want)
+	}
+	if strconv.FormatUint(uint64(cred.Gid), 10) != u.Gid {
+		t.Errorf("gid %d, want %s", cred.Gid, u.Gid)
+	}
+	if _, err := ResolveCredential("no-such-user-for-the-test"); err == nil {
+		t.Error("resolved a user that doesn't exist")
+	}
+}
+
+func TestRunScriptRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root may run a script as another user")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no user nobody: %v", err)
+	}
+	var out bytes.Buffer
+	if err := RunScript("id -u", ScriptOptions{RunAs: "nobody"}, log.New(&out, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != nobody.Uid {
+		t.Errorf("ran as uid %s, want %s", got, nobody.Uid)
+	}
+}
+
+func TestRunScriptRunAsUnknown(t *testing.T) {
+	err := RunScript("true", ScriptOptions{RunAs: "no-such-user-for-the-test"}, log.New(&bytes.Buffer{}, "", 0))
+	if _, ok := err.(user.UnknownUserError); !ok {
+		t.Errorf("got %v, want an UnknownUserError", err)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var ErrRunAsUnsupported = errors.New("RunAs is not supported on windows")
+
+func setRunAs(cmd *exec.Cmd, name string) error {
+	if name == "" {
+		return nil
+	}
+	return ErrRunAsUnsupported
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckProtectedPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the paths are unix ones")
+	}
+	protected := []string{"/etc", "/srv/app/secrets/"}
+	dir := "/srv/app"
+	tests := []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"restart"}, ""},
+		{[]string{"cat", "/etc/passwd"}, "/etc"},
+		{[]string{"cat", "/etcetera/passwd"}, ""},
+		{[]string{"/etc/init.d/app", "restart"}, "/etc"},
+		{[]string{"cp", "--config=/etc/app.ini"}, "/etc"},
+		{[]string{"cat", "secrets/key"}, "/srv/app/secrets"},
+		{[]string{"cat", "./other/key"}, ""},
+		{[]string{"cat", "../app/secrets/key"}, "/srv/app/secrets"},
+		{[]string{"echo", "secrets"}, ""},
+	}
+	for _, tt := range tests {
+		err := CheckProtectedPaths(tt.words, dir, protected)
+		var ppe *ProtectedPathError
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%v: %v", tt.words, err)
+		case tt.want != "" && !errors.As(err, &ppe):
+			t.Errorf("%v: got %v, want a ProtectedPathError", tt.words, err)
+		case tt.want != "" && ppe.Protected != tt.want:
+			t.Errorf("%v: protected by %s, want %s", tt.words, ppe.Protected, tt.want)
+		}
+	}
+}
+
+func TestRunScriptProtectedArgs(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	protected := filepath.Join(t.TempDir(), "protected")
+	tests := []struct {
+		command string
+		args    []string
+	}{
+		{"cat " + protected, nil},
+		{"cat", []string{protected}},
+		// Not found, the command is checked as written.
+		{"missing-program-for-the-test " + protected, nil},
+		{"missing-program-for-the-test", []string{protected}},
+	}
+	for _, tt := range tests {
+		err := RunScript(tt.command, ScriptOptions{ProtectedPaths: []string{protected}, Args: tt.args}, logger)
+		var ppe *ProtectedPathError
+		if !errors.As(err, &ppe) {
+			t.Errorf("%q with args %v: got %v, want a ProtectedPathError", tt.command, tt.args, err)
+		}
+	}
+}
+
+func TestIsAllowedCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the paths are unix ones")
+	}
+	allowed := []string{"/usr/bin/systemctl", "restart.sh"}
+	tests := map[string]bool{
+		"/usr/bin/systemctl":           true,
+		"/usr/bin/../bin/systemctl":    true,
+		"/usr/local/bin/systemctl":     false,
+		"/opt/app/restart.sh":          true,
+		"/opt/app/restart.sh.disabled": false,
+		"/bin/sh":                      false,
+	}
+	for program, want := range tests {
+		if got := IsAllowedCommand(program, allowed); got != want {
+			t.Errorf("IsAllowedCommand(%s) = %v, want %v", program, got, want)
+		}
+	}
+	if !IsAllowedCommand("/bin/sh", nil) {
+		t.Error("an empty list refused a command")
+	}
+}
+
+func TestRunScriptAllowedCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell script")
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command string
+		allowed []string
+		ok      bool
+	}{
+		{hook, nil, true},
+		{hook, []string{"hook.sh"}, true},
+		{hook, []string{hook}, true},
+		{"./hook.sh", []string{hook}, true},
+		{hook, []string{"other.sh"}, false},
+		{hook, []string{filepath.Join(dir, "sub", "hook.sh")}, false},
+		{"true", []string{"hook.sh"}, false},
+	}
+	for _, tt := range tests {
+		err := RunScript(tt.command, ScriptOptions{AllowedCommands: tt.allowed, Dir: dir}, logger)
+		var cna *CommandNotAllowedError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s allowing %v: %v", tt.command, tt.allowed, err)
+		case !tt.ok && !errors.As(err, &cna):
+			t.Errorf("%s allowing %v: got %v, want a CommandNotAllowedError", tt.command, tt.allowed, err)
+		}
+	}
+}
+
+func TestScriptDir(t *testing.T) {
+	yes, no := true, false
+	target := Target{Filename: filepath.Join("srv", "app")}
+	tests := []struct {
+		global bool
+		target *bool
+		want   string
+	}{
+		{false, nil, ""},
+		{true, nil, "srv"},
+		{true, &no, ""},
+		{false, &yes, "srv"},
+	}
+	for _, tt := range tests {
+		c := Config{ScriptsInTargetDir: tt.global}
+		target.ScriptsInTargetDir = tt.target
+		if got := c.ScriptDir(&target); got != tt.want {
+			t.Errorf("ScriptsInTargetDir %v and %v: got %q, want %q", tt.global, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDeployScriptsInTargetDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the script is a shell script")
+	}
+	d := newTestDaemon(t, nil)
+	dir := filepath.Dir(d.Target().Filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	body := "#!/bin/sh\npwd -P > ran-in\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "restart.sh"), []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().After = "./restart.sh"
+	// Looked up in the daemon's working directory, where there is none.
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err == nil {
+		t.Fatal("a relative After outside the target's directory ran")
+	}
+
+	d.Config.ScriptsInTargetDir = true
+	// The allowed command is the one next to the target.
+	d.Config.AllowedCommands = []string{filepath.Join(dir, "restart.sh")}
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(readFile(t, filepath.Join(dir, "ran-in"))); got != want {
+		t.Errorf("After ran in %s, want %s", got, want)
+	}
+}
+
+func TestDeployScan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scan is a shell script")
+	}
+	dir := t.TempDir()
+	scan := filepath.Join(dir, "scan.sh")
+	// Records what it was given, failing on a payload holding EICAR.
+	body := "#!/bin/sh\necho \"$1 $DCTL_PAYLOAD\" >> " + filepath.Join(dir, "scans") + "\n! grep -rq EICAR \"$1\"\n"
+	if err := ioutil.WriteFile(scan, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	before, runs := flakyScript(t, 0)
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].Scan = scan
+		c.Targets[0].Before = before
+	})
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	scans := SplitLines(readFile(t, filepath.Join(dir, "scans")))
+	if len(scans) != 1 {
+		t.Fatalf("scanned %q", scans)
+	}
+	xs := strings.Fields(scans[0])
+	if len(xs) != 2 || xs[1] != filepath.Join(xs[0], "app") {
+		t.Errorf("the scan got %q, want the temporary directory and the item in it", scans[0])
+	}
+
+	err := d.Deploy(t, map[string]string{"version": "2", "bad": "EICAR"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "failed the Scan") {
+		t.Fatalf("deploying a payload failing the Scan gave %v", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q after a failed Scan", got)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("Before ran %d times, want only for the deploy passing the Scan", n)
+	}
+
+	// Scan runs even for those whose deploys skip the scripts.
+	d.Target().ScriptAuthorized = []string{"someone"}
+	if err := d.Deploy(t, map[string]string{"version": "3", "bad": "EICAR"}); err == nil {
+		t.Error("a user not in ScriptAuthorized skipped the Scan")
+	}
+}
+
+func TestRunScriptFailOnStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scripts are shell scripts")
+	}
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	clean := script("clean.sh", "echo fine")
+	warns := script("warns.sh", "echo careful >&2")
+	fails := script("fails.sh", "echo broken >&2\nexit 3")
+	// Leaves a child holding stderr after exiting cleanly.
+	lingers := script("lingers.sh", "sleep 3 >/dev/null &")
+	logger := log.New(ioutil.Discard, "", 0)
+	opts := ScriptOptions{FailOnStderr: true, StderrWaitDelay: 100 * time.Millisecond}
+	tests := []struct {
+		command string
+		opts    ScriptOptions
+		want    error
+	}{
+		{clean, opts, nil},
+		{warns, opts, ErrWroteStderr},
+		{warns, ScriptOptions{}, nil},
+		{lingers, opts, ErrStderrHeldOpen},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		if err := RunScript(tt.command, tt.opts, logger); err != tt.want {
+			t.Errorf("%s with FailOnStderr %v: got %v, want %v", filepath.Base(tt.command), tt.opts.FailOnStderr, err, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s took %s", filepath.Base(tt.command), elapsed)
+		}
+	}
+	// The exit status wins over what was written.
+	var ee *exec.ExitError
+	if err := RunScript(fails, opts, logger); !errors.As(err, &ee) || ee.ExitCode() != 3 {
+		t.Errorf("fails.sh gave %v, want its exit status", err)
+	}
+}
+
+func TestDeployFailOnStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the After script is a shell script")
+	}
+	after := filepath.Join(t.TempDir(), "after.sh")
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].After = after
+		c.Targets[0].FailOnStderr = true
+	})
+	// Warns only for the second version.
+	body := "#!/bin/sh\n! grep -q 2 " + filepath.Join(d.Target().Filename, "version") + " || echo careful >&2\n"
+	if err := ioutil.WriteFile(after, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err == nil {
+		t.Error("an After writing to stderr didn't fail the deploy")
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q, want the deploy rolled back", got)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Runs a complete deploy against an in process daemon on a random localhost
+// port using throwaway credentials, config and target. Each stage is reported
+// to w and the first failure stops the test.
+func Selftest(w io.Writer, script string, logw io.Writer) error {
+	stage := func(name string, err error) error {
+		if err != nil {
+			fmt.Fprintf(w, "%-10s FAIL %v\n", name, err)
+			return fmt.Errorf("selftest failed at %s: %w", name, err)
+		}
+		fmt.Fprintf(w, "%-10s PASS\n", name)
+		return nil
+	}
+	skip := func(name, reason string) {
+		fmt.Fprintf(w, "%-10s SKIP %s\n", name, reason)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "dctl-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert, err := GenerateKeyPair("selftest", time.Hour, "")
+	if err != nil {
+		return stage("certs", err)
+	}
+	clientCert, err := GenerateKeyPair("selftest", time.Hour, "")
+	if err != nil {
+		return stage("certs", err)
+	}
+
+	keys := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(keys, []byte(GetSignature(clientCert.Leaf)+" selftest\n"), 0600); err != nil {
+		return err
+	}
+	src := filepath.Join(dir, "src", "app")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return err
+	}
+	// The scripts run on a target of their own, so a failing script is reported
+	// as such rather than as a failure to stream or back up.
+	conf := &Config{
+		AuthorizedKeys:  keys,
+		BackupDirectory: filepath.Join(dir, "backups"),
+		KeepBackups:     1,
+		Targets: []Target{{
+			Name:       "selftest",
+			Authorized: []string{"selftest"},
+			Filename:   filepath.Join(dir, "deploy", "app"),
+		}, {
+			Name:       "selftest-scripts",
+			Authorized: []string{"selftest"},
+			Filename:   filepath.Join(dir, "deploy", "scripts"),
+			Before:     script,
+			After:      script,
+		}},
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	serverConf := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	if err := conf.ApplyTLS(serverConf); err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		return stage("listen", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				HandleServerConn(ServerContext{
+					C:      tls.Server(conn, serverConf),
+					Config: conf,
+					Log:    log.New(logw, "selftest ", log.LstdFlags),
+				})
+			}()
+		}
+	}()
+
+	address := listener.Addr().String()
+	clientConf := &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	dial := func() (*tls.Conn, error) {
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", address, clientConf)
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(time.Minute))
+		return tls.Client(c, clientConf), nil
+	}
+
+	// Handshake & PING
+	c, err := dial()
+	if err == nil {
+		_, err = HandleClientConnPing(c)
+		c.Close()
+	}
+	if err := stage("handshake", err); err != nil {
+		return err
+	}
+
+	// The signature must resolve to the selftest user for the target.
+	c, err = dial()
+	if err == nil {
+		var names []string
+		names, err = HandleClientConnWho(c, "selftest")
+		c.Close()
+		if err == nil && strings.Join(names, ",") != "selftest" {
+			err = fmt.Errorf("unexpected authorized users %v", names)
+		}
+	}
+	if err := stage("auth", err); err != nil {
+		return err
+	}
+
+	deploy := func(target, content string) error {
+		if err := ioutil.WriteFile(filepath.Join(src, "hello.txt"), []byte(content), 0644); err != nil {
+			return err
+		}
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = HandleClientConn(c, DeployRequest{Target: target, ID: NewDeployID()}, src, PackOptions{})
+		return err
+	}
+	check := func(target *Target, content string) error {
+		buf, err := ioutil.ReadFile(filepath.Join(target.Filename, "hello.txt"))
+		if err != nil {
+			return err
+		} else if string(buf) != content {
+			return fmt.Errorf("deployed file holds %q, expected %q", buf, content)
+		}
+		return nil
+	}
+	target := &conf.Targets[0]
+
+	// First deploy creates the target.
+	err = deploy(target.Name, "first")
+	if err := stage("stream", err); err != nil {
+		return err
+	}
+	if err := stage("move", check(target, "first")); err != nil {
+		return err
+	}
+
+	// Second deploy has to back up the first before replacing it, the backup is
+	// kept by KeepBackups.
+	err = deploy(target.Name, "second")
+	if err == nil {
+		err = check(target, "second")
+	}
+	if err == nil {
+		var backups []Backup
+		if backups, err = ListBackups(conf.BackupDirectory, target.Name); err == nil && len(backups) != 1 {
+			err = fmt.Errorf("found %d backups, expected 1", len(backups))
+		}
+	}
+	if err := stage("backup", err); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(script) == "" {
+		skip("scripts", "no -script given")
+		return nil
+	}
+	target = &conf.Targets[1]
+	err = deploy(target.Name, "scripts")
+	if err == nil {
+		err = check(target, "scripts")
+	}
+	return stage("scripts", err)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Reports the status Selftest printed for each stage.
+func selftestStages(out string) map[string]string {
+	stages := make(map[string]string)
+	for _, line := range SplitLines(out) {
+		if xs := strings.Fields(line); len(xs) >= 2 {
+			stages[xs[0]] = xs[1]
+		}
+	}
+	return stages
+}
+
+func TestSelftest(t *testing.T) {
+	tests := []struct {
+		script  string
+		ok      bool
+		scripts string
+	}{
+		{"", true, "SKIP"},
+		{"true", true, "PASS"},
+		{"false", false, "FAIL"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := Selftest(&out, tt.script, ioutil.Discard)
+		if (err == nil) != tt.ok {
+			t.Errorf("script %q: %v", tt.script, err)
+		}
+		stages := selftestStages(out.String())
+		for _, v := range []string{"handshake", "auth", "stream", "move", "backup"} {
+			if stages[v] != "PASS" {
+				t.Errorf("script %q: stage %s %s in\n%s", tt.script, v, stages[v], out.String())
+			}
+		}
+		if stages["scripts"] != tt.scripts {
+			t.Errorf("script %q: stage scripts %s, want %s", tt.script, stages["scripts"], tt.scripts)
+		}
+	}
+}
@@ -2,36 +2,247 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tmathews/goio"
 )
 
-var ErrInvalidPayload = errors.New("invalid payload")
+var (
+	ErrInvalidPayload = errors.New("invalid payload")
+	ErrTooManyEntries = fmt.Errorf("%w: too many entries", ErrInvalidPayload)
+	ErrNotArchive     = fmt.Errorf("%w: not a tar archive", ErrInvalidPayload)
+	ErrNoBackup       = errors.New("no backup was taken")
+	ErrPayloadTooBig  = errors.New("payload exceeds the size limit")
+	ErrEmptyPayload   = errors.New("payload is empty, everything was ignored or the directory is empty")
+	ErrFileInUse      = errors.New("target file is in use by another process")
+	ErrBackupDirFull  = errors.New("backup directory is out of space")
+	ErrWroteStderr    = errors.New("script wrote to stderr")
+	ErrStderrHeldOpen = errors.New("script exited but a process it started kept stderr open")
+	ErrSumMismatch    = errors.New("download doesn't match the SHA-256 the daemon sent")
+	ErrNotSocket      = errors.New("file exists and is not a socket")
+	ErrSocketInUse    = errors.New("socket is in use by another process")
+	ErrLeftover       = errors.New("files set aside could not all be removed")
+)
+
+// A payload entry the target's AllowFiles or DenyFiles refuse.
+type DisallowedEntryError struct {
+	Name string
+}
+
+func (e *DisallowedEntryError) Error() string {
+	return fmt.Sprintf("%s: %s is not allowed", ErrInvalidPayload, e.Name)
+}
+
+func (e *DisallowedEntryError) Unwrap() error {
+	return ErrInvalidPayload
+}
+
+// Backups are refused with less than this free in the backup directory.
+const MinBackupFreeSpace = 1 << 20
+
+// How often, and how far apart, a rename refused because the file is in use is
+// attempted before giving up.
+const (
+	InUseAttempts = 3
+	InUseDelay    = 500 * time.Millisecond
+)
 
 type ServerContext struct {
-	C      *tls.Conn
-	Config *Config
-	Log    *log.Logger
+	C       *tls.Conn
+	Config  *Config
+	Log     *log.Logger
+	Drain   *DrainState
+	Locks   *TargetLocks
+	Events  *EventHub
+	Stages  *StageStore
+	Results *ResultStore
+}
+
+// The outcomes of a deploy passed to the Cleanup script.
+const (
+	OutcomeSuccess        = "success"
+	OutcomeFailure        = "failure"
+	OutcomeRolledBack     = "rolled-back"
+	OutcomeRollbackFailed = "rollback-failed"
+)
+
+// Options for running a target's scripts through RunScript.
+type ScriptOptions struct {
+	RunAs           string
+	AllowedCommands []string
+	ProtectedPaths  []string
+
+	// Extra KEY=value pairs added to the script's environment.
+	Env []string
+
+	// The working directory of the script, empty uses our own.
+	Dir string
+
+	// Arguments added after those in the command.
+	Args []string
+
+	// Fail with ErrWroteStderr when the script writes anything to stderr, even if it exits with 0.
+	FailOnStderr bool
+
+	// With FailOnStderr, how long to wait for stderr to close once the script exits before failing with
+	// ErrStderrHeldOpen. Zero uses DefaultStderrWaitDelay.
+	StderrWaitDelay time.Duration
+}
+
+// How long RunScript waits with FailOnStderr for processes a script leaves running to close its stderr.
+const DefaultStderrWaitDelay = 10 * time.Second
+
+func (ctx ServerContext) ScriptOptions(target *Target) ScriptOptions {
+	return ScriptOptions{
+		RunAs:           target.RunAs,
+		AllowedCommands: ctx.Config.AllowedCommands,
+		ProtectedPaths:  ctx.Config.ProtectedPaths,
+		Dir:             ctx.Config.ScriptDir(target),
+	}
+}
+
+func (ctx ServerContext) UnpackOptions(target *Target, id string) UnpackOptions {
+	return UnpackOptions{
+		DeployID:        id,
+		MaxEntries:      ctx.Config.MaxEntries,
+		AtomicWrites:    ctx.Config.AtomicWrites,
+		Sparse:          ctx.Config.SparseFiles,
+		Durable:         ctx.Config.Durable || target.Durable,
+		Xattrs:          ctx.Config.PreserveXattrs,
+		AllowFiles:      target.AllowFiles,
+		DenyFiles:       target.DenyFiles,
+		StripComponents: target.StripComponents,
+	}
+}
+
+// Used when the config doesn't set a HandshakeTimeout.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+func (ctx ServerContext) HandshakeTimeout() time.Duration {
+	if ctx.Config.HandshakeTimeout.Duration > 0 {
+		return ctx.Config.HandshakeTimeout.Duration
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (ctx ServerContext) LockTimeout() time.Duration {
+	if ctx.Config.LockTimeout.Duration > 0 {
+		return ctx.Config.LockTimeout.Duration
+	}
+	return DefaultLockTimeout
+}
+
+// Takes the lock of the target, replying StatusBlocked when another deploy holds
+// it past the lock timeout. The returned func is nil in that case.
+func (ctx ServerContext) LockTarget(target *Target) (func(), error) {
+	unlock := ctx.Locks.Acquire(target.Name, ctx.LockTimeout())
+	if unlock == nil {
+		ctx.Log.Printf("Gave up waiting %s for the lock of %s", ctx.LockTimeout(), target.Name)
+		return nil, goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("The target %s is busy with another deploy, try again later.", target.Name))
+	}
+	return unlock, nil
+}
+
+// When the daemon started, reported by PING.
+var startTime = time.Now()
+
+// How long a reverse DNS lookup of a client may take before it is abandoned.
+const ReverseDNSTimeout = 2 * time.Second
+
+// Describes the remote end of the connection, including its host name when
+// ReverseDNS is enabled and the lookup succeeds in time.
+func (ctx ServerContext) RemoteName() string {
+	if ctx.C.RemoteAddr().Network() == "unix" {
+		return "unix socket"
+	}
+	addr := ctx.C.RemoteAddr().String()
+	if !ctx.Config.ReverseDNS {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	c, cancel := context.WithTimeout(context.Background(), ReverseDNSTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(c, host)
+	if err != nil || len(names) == 0 {
+		return addr
+	}
+	return fmt.Sprintf("%s (%s)", addr, strings.TrimSuffix(names[0], "."))
+}
+
+// Listens on the unix socket filename with the given permissions, replacing a
+// socket left behind by a daemon that didn't shut down cleanly. Anything else at
+// filename, a socket that still accepts connections included, is left alone.
+func ListenUnix(filename string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(filename); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s: %w", filename, ErrNotSocket)
+		}
+		if c, err := net.DialTimeout("unix", filename, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %w", filename, ErrSocketInUse)
+		}
+		if err := os.Remove(filename); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Created without the permissions mode denies, so no one can connect before
+	// the Chmod.
+	var l net.Listener
+	err := withUmask(^mode&os.ModePerm, func() (err error) {
+		l, err = net.Listen("unix", filename)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(filename, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 func HandleServerConn(ctx ServerContext) error {
+	ctx.Log.Printf("Connection from %s", ctx.RemoteName())
+
+	// Don't let a client that never negotiates hold the connection open.
+	if err := ctx.C.SetDeadline(time.Now().Add(ctx.HandshakeTimeout())); err != nil {
+		return err
+	}
 	if err := ctx.C.Handshake(); err != nil {
 		return err
 	}
+	if err := ctx.C.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
 
-	signature := GetSignature(ctx.C.ConnectionState().PeerCertificates[0])
+	cert := ctx.C.ConnectionState().PeerCertificates[0]
+	signature := GetSignature(cert)
 	ctx.Log.Printf("Got connection! %s", signature)
 
 	cmd, input, err := goio.ReadCommand(ctx.C)
@@ -40,121 +251,857 @@ func HandleServerConn(ctx ServerContext) error {
 	}
 	ctx.Log.Printf("Got command '%s' input len(%d)", cmd, len(input))
 
+	if ctx.Config.RejectExpiredCerts && time.Now().After(cert.NotAfter) {
+		ctx.Log.Printf("Rejected certificate %s which expired %s", signature, cert.NotAfter.Format(time.RFC3339))
+		return goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("Your certificate expired on %s. Please generate a new one.", cert.NotAfter.Format("2006-01-02")))
+	}
+
+	if ctx.Drain.Draining() && (cmd == CommandDEPLOY || cmd == CommandROLLBACK || cmd == CommandSTAGE || cmd == CommandAPPLY || cmd == CommandFETCH) {
+		return goio.NotOk(ctx.C, StatusBlocked, "The server is in maintenance and not accepting deploys.")
+	}
+
 	switch cmd {
 	case CommandDEPLOY:
-		// Just continue onto the next code.
-		break
+		return ctx.HandleDeploy(signature, string(input))
 	case CommandPING:
-		// Write the PONG by saying OK status. No need to write pong IMO...
-		return goio.Ok(ctx.C)
+		// Write the PONG by saying OK status. Newer clients ask for info which
+		// follows as a stream.
+		xs := strings.SplitN(string(input), "?", 2)
+		if err := goio.Ok(ctx.C); err != nil || xs[0] != PingInfoRequest {
+			return err
+		}
+		var target string
+		if len(xs) == 2 {
+			if v, err := url.ParseQuery(xs[1]); err == nil {
+				target = v.Get("target")
+			}
+		}
+		return ctx.WritePingInfo(signature, target)
+	case CommandWHO:
+		return ctx.HandleWho(signature, string(input))
+	case CommandROLLBACK:
+		return ctx.HandleRollback(signature, string(input), false)
+	case CommandPLAN:
+		return ctx.HandleRollback(signature, string(input), true)
+	case CommandTAIL:
+		return ctx.HandleTail(signature, string(input))
+	case CommandSTAGE:
+		return ctx.HandleStage(signature, string(input))
+	case CommandAPPLY:
+		return ctx.HandleApply(signature, string(input))
+	case CommandFETCH:
+		return ctx.HandleFetch(signature, string(input))
+	case CommandLIST:
+		return ctx.HandleList(signature, string(input))
+	case CommandPULL:
+		return ctx.HandlePull(signature, string(input))
 	default:
 		return goio.NotOk(ctx.C, StatusUnsupported, fmt.Sprintf("The command %s is unsupported.", cmd))
 	}
+}
 
-	name, err := ctx.Config.GetSignatureName(signature)
+// Receives the payload and swaps it in for the target, running its scripts and
+// restoring the backup if anything fails.
+func (ctx ServerContext) HandleDeploy(signature, input string) error {
+	name, req, target, err := ctx.CheckDeploy(signature, input)
+	if target == nil {
+		return err
+	}
+	return ctx.Deploy(name, target, req, ctx.ReceivePayload)
+}
+
+// Deploys the payload receive unpacks once the target's window and lock allow.
+// Like ReceivePayload, receive replies and returns an empty directory when the
+// payload can't be had.
+func (ctx ServerContext) Deploy(name string, target *Target, req DeployRequest, receive func(*Target, DeployRequest) (string, string, error)) error {
+	if ok, err := ctx.CheckWindow(target, req, name); !ok {
+		return err
+	}
+
+	unlock, err := ctx.LockTarget(target)
+	if unlock == nil {
+		return err
+	}
+	defer unlock()
+
+	if !ctx.Config.RunsScripts(target, name) && target.HasScripts() {
+		ctx.Log.Printf("Skipping the scripts of %s, %s may only deploy its files", target.Name, name)
+		target = target.WithoutScripts()
+	}
+
+	if req.Subpath != "" {
+		sub, err := target.Subtree(req.Subpath)
+		if err != nil {
+			ctx.Log.Printf("Subtree error: %s", err.Error())
+			return goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The subpath %s of target %s can't be deployed, the target must be an existing directory and the subpath must not pass through a symlink.", req.Subpath, target.Name))
+		}
+		// The subtree is part of the whole target, whose digest no longer holds.
+		ctx.RecordDigest(target, "")
+		ctx.Log.Printf("Deploy %s replaces only %s", req.ID, sub.Filename)
+		target, req.Digest = sub, ""
+	}
+
+	// A retry of a deploy that ran gets its outcome, it isn't run again.
+	if req.Key != "" {
+		if prev, ok := ctx.Results.Get(name, target.Name, req.Key); ok {
+			ctx.Log.Printf("Skipped %s of %s by %s, key %s already ran with outcome %s", req.ID, target.Name, name, req.Key, prev)
+			if prev == OutcomeSuccess {
+				return goio.NotOk(ctx.C, StatusUpToDate, "The deploy with this key already succeeded, it was not run again.")
+			}
+			return goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The deploy with this key already ran and ended with %s, it was not run again.", prev))
+		}
+	}
+
+	if IsUpToDate(target, req.Digest) {
+		if !target.VerifyUpToDate || target.Verify == "" {
+			ctx.Log.Printf("Skipped %s of %s by %s, already up to date", req.ID, target.Name, name)
+			return goio.NotOk(ctx.C, StatusUpToDate, fmt.Sprintf("The target %s is already up to date.", target.Name))
+		}
+		err := RunScript(target.Verify, ctx.ScriptOptions(target), ctx.Log)
+		if err == nil {
+			ctx.Log.Printf("Skipped %s of %s by %s, already up to date and verified", req.ID, target.Name, name)
+			return goio.NotOk(ctx.C, StatusUpToDate, fmt.Sprintf("The target %s is already up to date and passed Verify.", target.Name))
+		}
+		ctx.Log.Printf("Verify of up to date %s failed, deploying %s anyway: %s", target.Name, req.ID, err.Error())
+	}
+
+	// The Cleanup script runs last however the deploy turns out.
+	outcome := OutcomeFailure
+	ctx.Events.Publish(Event{Kind: EventDeployStart, Target: target.Name, DeployID: req.ID, User: name})
+	defer func() {
+		ctx.RunCleanup(target, req.ID, outcome)
+		ctx.Events.Publish(Event{Kind: EventDeployEnd, Target: target.Name, DeployID: req.ID, User: name, Outcome: outcome})
+	}()
+
+	tmpdir, payload, err := receive(target, req)
+	if tmpdir == "" {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	if payload != "" {
+		req.Digest = ctx.CheckDigest(payload, req)
+	}
+	err = ctx.SwapTarget(target, req, tmpdir, &outcome)
+	if payload != "" {
+		ctx.DisposePayload(payload, req.ID, outcome != OutcomeSuccess)
+	}
+	if req.Key != "" {
+		ctx.Results.Put(name, target.Name, req.Key, outcome, ctx.IdempotencyWindow())
+	}
+	return err
+}
+
+// Looks up who is deploying and checks the request against the target's
+// policy. When refused the reply has been sent, the returned target is nil and
+// the error is that of the reply.
+func (ctx ServerContext) CheckDeploy(signature, input string) (name string, req DeployRequest, target *Target, err error) {
+	if name, err = ctx.LookupName(signature); name == "" {
+		return "", req, nil, err
+	}
+	req, err = ParseDeployRequest(input)
 	if err != nil {
-		ctx.Log.Printf("GetSignatureName error: %s", err.Error())
-		return goio.NotOk(ctx.C, StatusNotOK, "Failed to look up signature.")
-	} else if len(name) == 0 {
-		return goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("You signature was not accepted."))
+		return "", req, nil, goio.NotOk(ctx.C, StatusNotOK, "Malformed deploy request.")
+	}
+	if req.ID == "" {
+		req.ID = NewDeployID()
 	}
-	target := ctx.Config.GetTargetByName(string(input))
+	if req.Compression != "" && req.Compression != CompressionGzip {
+		return "", req, nil, goio.NotOk(ctx.C, StatusUnsupported, fmt.Sprintf("The compression %s is unsupported.", req.Compression))
+	}
+	ctx.Log.Printf("Deploy %s of target '%s' by %s", req.ID, req.Target, name)
+	target = ctx.Config.GetTargetByName(req.Target)
 	if target == nil {
-		return goio.NotOk(ctx.C, StatusNotExist, fmt.Sprintf("The target %s does not exist.", input))
+		return "", req, nil, ctx.ReplyNoTarget(req.Target, name)
+	}
+	if !ctx.Config.Allows(target, name) {
+		return "", req, nil, ctx.ReplyNotPermitted()
+	}
+	if req.Subpath != "" && !IsSubpath(req.Subpath) {
+		return "", req, nil, goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The subpath %s must be relative and stay within the target.", req.Subpath))
+	} else if req.Subpath != "" && target.Generations > 0 {
+		return "", req, nil, goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The target %s is deployed as whole generations, a subpath can't be deployed.", target.Name))
+	}
+	if !ctx.Config.AllowsNew(target) {
+		if _, err := os.Stat(target.Filename); os.IsNotExist(err) {
+			return "", req, nil, goio.NotOk(ctx.C, StatusNotExist, fmt.Sprintf("The target %s has not been deployed before and creating it is not allowed.", target.Name))
+		}
 	}
-	if !target.Allows(name) {
-		return goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("You do not have permission to deploy this target."))
+	return name, req, target, nil
+}
+
+// Checks the target's deploy windows, replying when outside them.
+func (ctx ServerContext) CheckWindow(target *Target, req DeployRequest, name string) (bool, error) {
+	if windows, err := target.Windows(); err != nil {
+		ctx.Log.Printf("Windows error: %s", err.Error())
+		return false, goio.NotOk(ctx.C, StatusNotOK, "The target's deploy windows are misconfigured.")
+	} else if ok, next := InDeployWindow(windows, time.Now()); !ok {
+		if req.OverrideWindow && target.AllowWindowOverride {
+			ctx.Log.Printf("Deploy of %s outside its windows, overridden by %s", target.Name, name)
+		} else {
+			return false, goio.NotOk(ctx.C, StatusBlocked, fmt.Sprintf("The target %s is outside its deploy windows, the next opens %s.", target.Name, next.Format(time.RFC1123)))
+		}
 	}
+	return true, nil
+}
 
-	f, err := ioutil.TempFile(os.TempDir(), "deployctl-")
+// Streams the payload to a temporary file and unpacks it. The returned directory
+// and payload file are the caller's to remove, see DisposePayload. When the
+// directory is empty the reply has been sent and the error is that of the reply.
+func (ctx ServerContext) ReceivePayload(target *Target, req DeployRequest) (tmpdir, payload string, err error) {
+	if ok, err := ctx.CheckSize(target, req); !ok {
+		return "", "", err
+	}
+	f, err := ioutil.TempFile(os.TempDir(), TempPattern(req.ID)+"payload-")
 	if err != nil {
 		ctx.Log.Println(err.Error())
-		return goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("There was an error creating a temporary file."))
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "There was an error creating a temporary file.")
 	}
-	defer f.Close()
+	defer func() {
+		f.Close()
+		if tmpdir == "" {
+			ctx.DisposePayload(f.Name(), req.ID, true)
+		}
+	}()
 
 	if err := goio.Ok(ctx.C); err != nil {
-		return err
+		return "", "", err
 	}
 
 	// Stream the data to our temporary file
-	if err := goio.ReadStream(ctx.C, f); goio.IsClosed(err) {
-		return err
+	limit := ctx.Config.PayloadLimit(target)
+	received := &limitWriter{w: f, limit: limit}
+	if err := goio.ReadStream(ctx.C, &headerWriter{w: received}); goio.IsClosed(err) {
+		return "", "", err
+	} else if errors.Is(err, ErrPayloadTooBig) {
+		ctx.Log.Printf("Payload for %s exceeded %d bytes", target.Name, limit)
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The payload exceeds the %d byte limit of target %s.", limit, target.Name))
+	} else if err == ErrNotArchive {
+		ctx.Log.Printf("Payload for %s is not an archive", target.Name)
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "The payload is not a valid archive.")
 	} else if err != nil {
 		ctx.Log.Println(err.Error())
-		return goio.NotOk(ctx.C, StatusNotOK, "The transmission was broken.")
+		return "", "", goio.NotOk(ctx.C, StatusNotOK, "The transmission was broken.")
+	}
+	// The final reply is only written after the whole stream is in f, so the
+	// client reading it never races the transfer. Committing clients also tell
+	// us whether what they sent is all of the payload.
+	if req.Commit {
+		if err := goio.ReadStatus(ctx.C); goio.IsClosed(err) {
+			return "", "", err
+		} else if err != nil {
+			ctx.Log.Printf("Client aborted the payload for %s: %s", target.Name, err.Error())
+			return "", "", goio.NotOk(ctx.C, StatusNotOK, "The payload was aborted by the client.")
+		}
 	}
+	tmpdir, err = ctx.UnpackPayload(target, req, f, received.n)
+	return tmpdir, f.Name(), err
+}
 
-	tmpdir, err := PrepareTarget(f)
+// Checks the size the client announced against the target's payload limit and
+// the free space of the temporary directory, which holds both the payload and
+// its unpacked files. Replies when the payload wouldn't fit, before it is sent.
+// A compressed payload may well be under the limit so that is left to the
+// stream.
+func (ctx ServerContext) CheckSize(target *Target, req DeployRequest) (bool, error) {
+	if req.Size <= 0 {
+		return true, nil
+	}
+	if limit := ctx.Config.PayloadLimit(target); limit > 0 && req.Size > limit && req.Compression == "" {
+		ctx.Log.Printf("Payload for %s announced as %d bytes, over %d", target.Name, req.Size, limit)
+		return false, goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The payload exceeds the %d byte limit of target %s.", limit, target.Name))
+	}
+	if n, err := freeSpace(os.TempDir()); err == nil && n < 2*uint64(req.Size) {
+		ctx.Log.Printf("Payload for %s announced as %d bytes, %d bytes free in %s", target.Name, req.Size, n, os.TempDir())
+		return false, goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The daemon lacks the disk space to receive the %d byte payload.", req.Size))
+	}
+	return true, nil
+}
+
+// Unpacks the n byte payload in f for the target. When it can't be unpacked the
+// reply has been sent, the returned directory is empty and the error is that of
+// the reply.
+func (ctx ServerContext) UnpackPayload(target *Target, req DeployRequest, f *os.File, n int64) (string, error) {
+	var stats UnpackStats
+	opts := ctx.UnpackOptions(target, req.ID)
+	opts.Stats = &stats
+	opts.Compression = req.Compression
+	tmpdir, err := PrepareTarget(f, opts)
 	if err != nil {
-		return goio.NotOk(ctx.C, StatusNotOK, "Issue with relocating files.")
-	} else if tmpdir != "" {
-		defer os.RemoveAll(tmpdir)
+		ctx.Log.Printf("PrepareTarget error: %s", err.Error())
+	}
+	var disallowed *DisallowedEntryError
+	switch {
+	case err == nil:
+	case err == ErrTooManyEntries:
+		return "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The payload exceeds the maximum of %d entries.", ctx.Config.MaxEntries))
+	case err == ErrNotArchive:
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload is not a valid archive.")
+	case errors.As(err, &disallowed):
+		return "", goio.NotOk(ctx.C, StatusNotOK, fmt.Sprintf("The payload contains %s which target %s does not allow.", disallowed.Name, target.Name))
+	case err == ErrInvalidPayload:
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload contains an invalid entry.")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload is truncated, the archive ends part way through.")
+	case errors.Is(err, gzip.ErrChecksum):
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload failed its gzip checksum, it was corrupted on the way.")
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, tar.ErrHeader):
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload holds a corrupt archive header.")
+	default:
+		return "", goio.NotOk(ctx.C, StatusNotOK, "Issue with relocating files.")
+	}
+	if empty, err := IsEmptyPayload(tmpdir); err != nil || empty {
+		os.RemoveAll(tmpdir)
+		if err != nil {
+			ctx.Log.Printf("IsEmptyPayload error: %s", err.Error())
+			return "", goio.NotOk(ctx.C, StatusNotOK, "Issue with relocating files.")
+		}
+		return "", goio.NotOk(ctx.C, StatusNotOK, "The payload is empty, there is nothing to deploy.")
+	}
+	if req.Compression != "" && n > 0 {
+		ctx.Log.Printf("Received %s: %d bytes %s, %d files, %d bytes unpacked, ratio %.2f", target.Name, n, req.Compression, stats.Files, stats.Bytes, float64(stats.Bytes)/float64(n))
+	} else {
+		ctx.Log.Printf("Received %s: %d bytes, %d files, %d bytes unpacked", target.Name, n, stats.Files, stats.Bytes)
+	}
+	return tmpdir, nil
+}
+
+// Removes a payload file once done with it. A failed payload is moved to the
+// QuarantineDirectory if there is one, or with KeepFailedPayloads left in place
+// and its path logged.
+func (ctx ServerContext) DisposePayload(filename, id string, failed bool) {
+	if failed && ctx.Config.QuarantineDirectory != "" {
+		dest, err := Quarantine(filename, id, ctx.Config.QuarantineDirectory, ctx.Config.QuarantineMaxBytes, ctx.Config.QuarantineMaxCount)
+		if err == nil {
+			ctx.Log.Printf("Quarantined the failed payload at %s", dest)
+			return
+		}
+		ctx.Log.Printf("Failed to quarantine payload: %v", err)
+	} else if failed && ctx.Config.KeepFailedPayloads {
+		ctx.Log.Printf("Kept the failed payload at %s for inspection", filename)
+		return
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		ctx.Log.Printf("Failed to remove payload: %v", err)
+	}
+}
+
+// Replaces the target with the unpacked payload in tmpdir, backing up the old
+// files and restoring them if a script fails. Replies with the final status.
+func (ctx ServerContext) SwapTarget(target *Target, req DeployRequest, tmpdir string, outcome *string) error {
+	skipBackup := target.SkipBackup || (req.NoBackup && target.AllowNoBackup)
+	if target.Generations == 0 && !skipBackup {
+		if err := CheckBackupDirectory(ctx.Config.BackupDirectory); err != nil {
+			return ctx.BackupDirectoryError(err)
+		}
+	}
+
+	if err := ctx.RunScan(target, tmpdir); err != nil {
+		ctx.Log.Printf("Scan error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "The payload failed the Scan, the target was left untouched.")
 	}
-	f.Close()
 
 	// Run our Before commands. Should be things like killing processes, etc.
-	if err := RunScript(target.Before, ctx.Log); err != nil {
+	if err := RunScript(target.Before, ctx.ScriptOptions(target), ctx.Log); err != nil {
 		ctx.Log.Println(err.Error())
 		return goio.NotOk(ctx.C, StatusNotOK, "Issue running Before script.")
 	}
+	ctx.WaitPreSwap(target)
+	if err := RunScript(target.PreBackup, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Println(err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Issue running PreBackup script, the target was left untouched.")
+	}
 
-	backup, err := BackupTarget(*target, ctx.Config.BackupDirectory)
-	if err != nil {
-		ctx.Log.Printf("BackupTarget error: %s", err.Error())
-		return goio.NotOk(ctx.C, StatusNotOK, "Failed to backup the target. Please attend.")
+	if target.SendInto {
+		if err := MergeInto(tmpdir, target.Filename); err != nil {
+			ctx.Log.Printf("MergeInto error: %s", err.Error())
+			msg := "Failed to merge the payload into the target directory."
+			if err == ErrInvalidPayload {
+				msg = "Expected only one directory or file in the TAR payload."
+			}
+			return goio.NotOk(ctx.C, StatusNotOK, msg)
+		}
+	}
+
+	// Forget the digest before touching the target, a failed swap may leave it
+	// in neither state.
+	ctx.RecordDigest(target, "")
+
+	var backup string
+	var gen *GenerationSwap
+	var err error
+	if target.Generations > 0 {
+		// The live generation stays as it is, the new one is switched to once in place.
+		if gen, err = PrepareGeneration(target); err != nil {
+			ctx.Log.Printf("PrepareGeneration error: %s", err.Error())
+			return goio.NotOk(ctx.C, StatusNotOK, "Failed to prepare the target's next generation. Please attend.")
+		}
+	} else if skipBackup {
+		ctx.Log.Printf("WARNING: deploying %s WITHOUT A BACKUP, a failure cannot be rolled back.", target.Name)
+		// Nothing moved the old files aside for MoveTarget.
+		if err := os.RemoveAll(target.Filename); err != nil {
+			ctx.Log.Printf("RemoveAll error: %s", err.Error())
+			return goio.NotOk(ctx.C, StatusNotOK, "Failed to remove the old target files. Please attend.")
+		}
+	} else {
+		backup, err = BackupTarget(*target, ctx.Config.BackupDirectory, ctx.Config.CompressBackups, ctx.Config.CopyWorkers(), ctx.Config.RenameRetry())
+		if errors.Is(err, ErrLeftover) {
+			ctx.Log.Printf("BackupTarget left files behind: %s", err.Error())
+		} else if err != nil {
+			ctx.Log.Printf("BackupTarget error: %s", err.Error())
+			if errors.Is(err, ErrFileInUse) {
+				return goio.NotOk(ctx.C, StatusNotOK, "The target file is in use by a running process, the Before script should stop it first.")
+			}
+			return goio.NotOk(ctx.C, StatusNotOK, "Failed to backup the target. Please attend.")
+		}
 	}
 
 	restore := func() (err error) {
-		err = os.RemoveAll(target.Filename)
-		if err != nil {
-			return
+		if gen != nil {
+			if err := gen.Restore(); err != nil {
+				return err
+			}
+			return ctx.RunAfter(target)
+		}
+		if skipBackup {
+			return ErrNoBackup
 		}
-		err = os.Rename(backup, target.Filename)
+		// The failed files are only removed once the backup is back, a restore
+		// that fails puts them back rather than leaving nothing.
+		aside, err := SetAside(target.Filename, ctx.Config.RenameRetry())
 		if err != nil {
-			return
+			return err
 		}
-		return RunScript(target.After, ctx.Log)
+		err = RestoreBackup(backup, target.Filename, ctx.Config.RenameRetry())
+		if errors.Is(err, ErrLeftover) {
+			ctx.Log.Printf("RestoreBackup left files behind: %s", err.Error())
+		} else if err != nil {
+			if aside != "" {
+				os.Rename(aside, target.Filename)
+			}
+			return err
+		}
+		if aside != "" {
+			if err := os.RemoveAll(aside); err != nil {
+				ctx.Log.Printf("Failed to remove the failed files at %s: %v", aside, err)
+			}
+		}
+		return ctx.RunAfter(target)
 	}
 
-	if err := MoveTarget(tmpdir, target.Filename); err != nil {
+	if gen != nil {
+		err = gen.Move(tmpdir)
+	} else {
+		err = MoveTarget(tmpdir, target.Filename)
+	}
+	if err != nil {
 		ctx.Log.Printf("MoveTarget error: %s", err.Error())
 		msg := "Failed to move target files."
 		if err == ErrInvalidPayload {
 			msg = "Expected only one directory or file in the TAR payload."
+		} else if errors.Is(err, ErrFileInUse) {
+			msg = "The target file is in use by a running process, the Before script should stop it first."
 		}
-		if err := restore(); err != nil {
-			ctx.Log.Printf("Restore error: %s", err.Error())
-			msg += " Restoring from backup failed. Please attend."
-		} else {
-			msg += " Restore executed successfully."
-		}
+		msg += ctx.Rollback(restore, outcome)
 		return goio.NotOk(ctx.C, StatusNotOK, msg)
 	}
+	if ctx.Config.Durable || target.Durable {
+		if err := SyncDir(filepath.Dir(target.Filename)); err != nil {
+			ctx.Log.Printf("SyncDir error: %s", err.Error())
+		}
+	}
 
 	// Run our After command. i.e. Start the process up.
-	if err := RunScript(target.After, ctx.Log); err != nil {
+	if err := ctx.RunAfter(target); err != nil {
 		ctx.Log.Printf("After error: %s", err.Error())
 		msg := "Issue running After script."
-		if err := restore(); err != nil {
-			ctx.Log.Printf("Restore error: %s", err.Error())
-			msg += " Restoring from backup failed. Please attend."
-		} else {
-			msg += " Restore executed successfully."
-		}
+		msg += ctx.Rollback(restore, outcome)
+		return goio.NotOk(ctx.C, StatusNotOK, msg)
+	}
+	if err := RunScript(target.Verify, ctx.ScriptOptions(target), ctx.Log); err != nil {
+		ctx.Log.Printf("Verify error: %s", err.Error())
+		msg := "The Verify script failed."
+		msg += ctx.Rollback(restore, outcome)
 		return goio.NotOk(ctx.C, StatusNotOK, msg)
 	}
 
-	// Delete the backup we created so we save disk space.
-	if backup != "" {
+	// Delete the backup we created so we save disk space, unless we keep some
+	// around to roll back to.
+	if gen != nil {
+		if err := PruneGenerations(target, target.Generations); err != nil {
+			ctx.Log.Printf("Failed to prune generations: %v", err)
+		}
+	} else if ctx.Config.KeepBackups > 0 {
+		if err := PruneBackups(ctx.Config.BackupDirectory, target.BackupName(), ctx.Config.KeepBackups); err != nil {
+			ctx.Log.Printf("Failed to prune backups: %v", err)
+		}
+	} else if backup != "" {
 		if err := os.RemoveAll(backup); err != nil {
 			ctx.Log.Printf("Failed to delete backup: %v", err)
 		}
 	}
 
+	ctx.RecordDigest(target, req.Digest)
+	*outcome = OutcomeSuccess
 	return goio.Ok(ctx.C)
 }
 
+// Reports whether digest is the one recorded for the target's last successful
+// deploy.
+func IsUpToDate(target *Target, digest string) bool {
+	buf, err := ioutil.ReadFile(target.DigestFilename())
+	return err == nil && digest != "" && strings.TrimSpace(string(buf)) == digest
+}
+
+// Returns the digest to record for the deploy of payload once it succeeds: the
+// one the client claimed when the payload has it, none otherwise. Else a wrong
+// claim would have a later deploy of the claimed files skipped.
+func (ctx ServerContext) CheckDigest(payload string, req DeployRequest) string {
+	if req.Digest == "" {
+		return ""
+	}
+	f, err := os.Open(payload)
+	if err != nil {
+		ctx.Log.Printf("Failed to check digest: %v", err)
+		return ""
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && IsGzip(magic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			ctx.Log.Printf("Failed to check digest: %v", err)
+			return ""
+		}
+		defer gz.Close()
+		r = gz
+	}
+	digest, err := TarDigest(r)
+	if err != nil {
+		ctx.Log.Printf("Failed to check digest: %v", err)
+		return ""
+	} else if digest != req.Digest {
+		ctx.Log.Printf("Deploy %s claimed digest %s but its payload has %s, not recording it", req.ID, req.Digest, digest)
+		return ""
+	}
+	return digest
+}
+
+// Records digest for the target, removing the recorded one when empty.
+// Failures are only logged, the next deploy then isn't skipped.
+func (ctx ServerContext) RecordDigest(target *Target, digest string) {
+	filename := target.DigestFilename()
+	if filename == "" {
+		return
+	} else if digest == "" {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			ctx.Log.Printf("Failed to remove digest: %v", err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(filename, []byte(digest+"\n"), 0644); err != nil {
+		ctx.Log.Printf("Failed to record digest: %v", err)
+	}
+}
+
+// Checks a backup can be written to dir before anything destructive happens,
+// so a read-only or full filesystem doesn't fail the deploy half way.
+func CheckBackupDirectory(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".dctl-check-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(f.Name())
+	if err != nil {
+		return err
+	}
+	if n, err := freeSpace(dir); err == nil && n < MinBackupFreeSpace {
+		return ErrBackupDirFull
+	}
+	return nil
+}
+
+// Replies with why the backup directory can't be used. The target has not been
+// touched yet when this is called.
+func (ctx ServerContext) BackupDirectoryError(err error) error {
+	ctx.Log.Printf("Backup directory %s unusable: %s", ctx.Config.BackupDirectory, err.Error())
+	msg := "The backup directory is not writable, the target was left untouched. Please attend."
+	if err == ErrBackupDirFull {
+		msg = "The backup directory is out of space, the target was left untouched. Please attend."
+	}
+	return goio.NotOk(ctx.C, StatusNotOK, msg)
+}
+
+// Runs restore and describes the result for the client message, updating the
+// outcome passed to the Cleanup script.
+func (ctx ServerContext) Rollback(restore func() error, outcome *string) string {
+	if err := restore(); err == ErrNoBackup {
+		return " No backup was taken so nothing was restored. Please attend."
+	} else if err != nil {
+		ctx.Log.Printf("Restore error: %s", err.Error())
+		*outcome = OutcomeRollbackFailed
+		return " Restoring from backup failed. Please attend."
+	}
+	*outcome = OutcomeRolledBack
+	return " Restore executed successfully."
+}
+
+// Runs the target's Cleanup script with the outcome of the deploy in
+// DCTL_OUTCOME. Failures are only logged, they do not change the result.
+func (ctx ServerContext) RunCleanup(target *Target, id, outcome string) {
+	if strings.TrimSpace(target.Cleanup) == "" {
+		return
+	}
+	opts := ctx.ScriptOptions(target)
+	opts.Env = append(opts.Env,
+		"DCTL_OUTCOME="+outcome,
+		"DCTL_TARGET="+target.Name,
+		"DCTL_DEPLOY_ID="+id,
+	)
+	if err := RunScript(target.Cleanup, opts, ctx.Log); err != nil {
+		ctx.Log.Printf("Cleanup error: %s", err.Error())
+	}
+}
+
+// Fails with ErrPayloadTooBig once more than limit bytes are written. A limit of
+// zero or less does not restrict anything.
+type limitWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.limit > 0 && l.n+int64(len(b)) > l.limit {
+		return 0, ErrPayloadTooBig
+	}
+	n, err := l.w.Write(b)
+	l.n += int64(n)
+	return n, err
+}
+
+// Fails with ErrNotArchive once the first bytes written are neither the gzip
+// magic nor a tar header, so junk is refused before the rest of it is spooled.
+// A payload shorter than a header is left to PrepareTarget.
+type headerWriter struct {
+	w       io.Writer
+	head    []byte
+	checked bool
+}
+
+func (h *headerWriter) Write(b []byte) (int, error) {
+	if !h.checked {
+		n := 512 - len(h.head)
+		if n > len(b) {
+			n = len(b)
+		}
+		h.head = append(h.head, b[:n]...)
+		if len(h.head) >= 2 && IsGzip(h.head) {
+			h.checked = true
+		} else if len(h.head) == 512 {
+			if !IsTarHeader(h.head) {
+				return 0, ErrNotArchive
+			}
+			h.checked = true
+		}
+	}
+	return h.w.Write(b)
+}
+
+// Runs the target's Scan script with tmpdir, the directory holding the unpacked
+// payload, as its last argument. It doesn't run in tmpdir, a relative command
+// would then be one the payload brought along.
+func (ctx ServerContext) RunScan(target *Target, tmpdir string) error {
+	if strings.TrimSpace(target.Scan) == "" {
+		return nil
+	}
+	xs, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		return err
+	} else if len(xs) != 1 {
+		return ErrInvalidPayload
+	}
+	opts := ctx.ScriptOptions(target)
+	opts.Args = []string{tmpdir}
+	opts.Env = append(opts.Env,
+		"DCTL_PAYLOAD="+filepath.Join(tmpdir, xs[0].Name()),
+		"DCTL_TARGET="+target.Name,
+	)
+	return RunScript(target.Scan, opts, ctx.Log)
+}
+
+// Sleeps the target's PreSwapDelay, letting what Before stopped settle.
+func (ctx ServerContext) WaitPreSwap(target *Target) {
+	if target.PreSwapDelay.Duration <= 0 {
+		return
+	}
+	ctx.Log.Printf("Waiting %s before replacing %s", target.PreSwapDelay.Duration, target.Name)
+	time.Sleep(target.PreSwapDelay.Duration)
+}
+
+// Runs the After script, retrying it as configured on the target. A target with
+// a ReloadSignal has its process signalled first.
+func (ctx ServerContext) RunAfter(target *Target) error {
+	if target.ReloadSignal != "" {
+		if err := SignalPidFile(target.PidFile, target.ReloadSignal); err != nil {
+			return fmt.Errorf("reload: %w", err)
+		}
+		ctx.Log.Printf("Sent %s to the process of %s", target.ReloadSignal, target.Name)
+	}
+	opts := ctx.ScriptOptions(target)
+	opts.FailOnStderr = target.FailOnStderr
+	var err error
+	for i := 0; i < target.AfterAttempts || i == 0; i++ {
+		if i > 0 {
+			ctx.Log.Printf("After attempt %d failed: %v, retrying in %s", i, err, target.AfterRetryDelay.Duration)
+			time.Sleep(target.AfterRetryDelay.Duration)
+		}
+		if err = RunScript(target.After, opts, ctx.Log); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Sends the named signal to the process whose pid is in filename.
+func SignalPidFile(filename, name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+	pid, err := ReadPidFile(filename)
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// Replies refusing a client, shared by the handlers so they word it the same.
+const (
+	MsgLookupFailed = "Failed to look up signature."
+	MsgNotAccepted  = "Your signature was not accepted."
+	MsgNotPermitted = "You do not have permission to deploy this target."
+
+	// Replaces both of the above and a missing target with Config.GenericAuthErrors.
+	MsgDenied = "The target does not exist or you may not deploy it."
+)
+
+// Looks up the username of the signature. When unknown the reply has been sent,
+// the name is empty and the error is that of the reply.
+func (ctx ServerContext) LookupName(signature string) (string, error) {
+	name, err := ctx.Config.GetSignatureName(signature)
+	if err != nil {
+		ctx.Log.Printf("GetSignatureName error: %s", err.Error())
+		return "", goio.NotOk(ctx.C, StatusNotOK, MsgLookupFailed)
+	} else if len(name) == 0 {
+		if ctx.Config.GenericAuthErrors {
+			return "", goio.NotOk(ctx.C, StatusBlocked, MsgDenied)
+		}
+		return "", goio.NotOk(ctx.C, StatusBlocked, MsgNotAccepted)
+	}
+	return name, nil
+}
+
+// Replies that the target doesn't exist, listing those the user may deploy with
+// SuggestTargets.
+func (ctx ServerContext) ReplyNoTarget(targetName, name string) error {
+	if ctx.Config.GenericAuthErrors {
+		return goio.NotOk(ctx.C, StatusBlocked, MsgDenied)
+	}
+	msg := fmt.Sprintf("The target %s does not exist.", targetName)
+	if ctx.Config.SuggestTargets {
+		msg += " " + AvailableTargetsPrefix + strings.Join(ctx.Config.AuthorizedTargets(name), ", ")
+	}
+	return goio.NotOk(ctx.C, StatusNotExist, msg)
+}
+
+// Replies that the user may not deploy the target.
+func (ctx ServerContext) ReplyNotPermitted() error {
+	if ctx.Config.GenericAuthErrors {
+		return goio.NotOk(ctx.C, StatusBlocked, MsgDenied)
+	}
+	return goio.NotOk(ctx.C, StatusBlocked, MsgNotPermitted)
+}
+
+// Looks up who the signature belongs to and checks they may deploy the named
+// target. When refused the reply has been sent, the returned target is nil and
+// the error is that of the reply.
+func (ctx ServerContext) AuthorizeTarget(signature, targetName string) (*Target, string, error) {
+	name, err := ctx.LookupName(signature)
+	if name == "" {
+		return nil, "", err
+	}
+	target := ctx.Config.GetTargetByName(targetName)
+	if target == nil {
+		return nil, name, ctx.ReplyNoTarget(targetName, name)
+	}
+	if !ctx.Config.Allows(target, name) {
+		return nil, name, ctx.ReplyNotPermitted()
+	}
+	return target, name, nil
+}
+
+// Replies with the usernames allowed to deploy the target, one per line. Only
+// those allowed to deploy it may ask, others get the same refusal as a deploy.
+func (ctx ServerContext) HandleWho(signature, targetName string) error {
+	target, _, err := ctx.AuthorizeTarget(signature, targetName)
+	if target == nil {
+		return err
+	}
+	names, err := ctx.Config.EffectiveAuthorized(target)
+	if err != nil {
+		ctx.Log.Printf("EffectiveAuthorized error: %s", err.Error())
+		return goio.NotOk(ctx.C, StatusNotOK, "Failed to resolve the authorized users.")
+	}
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+	sw := goio.NewStreamWriter(ctx.C)
+	_, err = io.WriteString(sw, strings.Join(names, "\n"))
+	sw.Terminate()
+	return err
+}
+
+func (ctx ServerContext) WritePingInfo(signature, target string) error {
+	info := PingInfo{
+		Version:     Version,
+		Protocol:    ProtocolVersion,
+		Uptime:      time.Since(startTime).Seconds(),
+		Compression: SupportedCompression,
+	}
+	name, err := ctx.Config.GetSignatureName(signature)
+	if err == nil && name != "" {
+		info.User = name
+		info.Targets = ctx.Config.CountAuthorized(name)
+	}
+	if target != "" {
+		info.Target = target
+		info.Access = AccessUnauthorized
+		// Unknown signatures don't get to learn which targets exist.
+		if t := ctx.Config.GetTargetByName(target); t == nil && info.User != "" && !ctx.Config.GenericAuthErrors {
+			info.Access = AccessNonexistent
+		} else if t != nil && info.User != "" && ctx.Config.Allows(t, name) {
+			info.Access = AccessAuthorized
+			info.NoScripts = !ctx.Config.RunsScripts(t, name) && t.HasScripts()
+		}
+	}
+	sw := goio.NewStreamWriter(ctx.C)
+	err = json.NewEncoder(sw).Encode(info)
+	sw.Terminate()
+	return err
+}
+
 func MoveTarget(tmpdir, filename string) error {
 	// Ensure that the parent directory for our target exists
 	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
@@ -171,17 +1118,165 @@ func MoveTarget(tmpdir, filename string) error {
 
 	// Move it
 	old := filepath.Join(tmpdir, xs[0].Name())
-	return os.Rename(old, filename)
+	return RenameInUse(old, filename)
+}
+
+// Prepares tmpdir for MoveTarget when the target has SendInto, leaving it holding
+// a copy of the directory at filename with the single payload item put inside.
+func MergeInto(tmpdir, filename string) error {
+	xs, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		return err
+	} else if len(xs) != 1 {
+		return ErrInvalidPayload
+	}
+	merged, err := ioutil.TempDir(tmpdir, ".merge-")
+	if err != nil {
+		return err
+	}
+	// A target with Generations is a symlink to the live one.
+	if fp, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = fp
+	}
+	if stat, err := os.Stat(filename); err == nil {
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory to send into", filename)
+		}
+		if err := CopyTree(filename, merged); err != nil {
+			return err
+		}
+		if err := os.Chmod(merged, stat.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.Chmod(merged, 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(merged, xs[0].Name())
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(tmpdir, xs[0].Name()), dest)
+}
+
+// Copies the contents of the directory src into the existing directory dst.
+// Symlinks are recreated, anything but directories and regular files is skipped.
+func CopyTree(src, dst string) error {
+	return CopyTreeN(src, dst, 1)
 }
 
-func BackupTarget(target Target, dir string) (string, error) {
+// CopyTree copying up to workers regular files at once. Directories and
+// symlinks are still created in walk order, so a directory always exists
+// before the files copied into it.
+func CopyTreeN(src, dst string, workers int) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var copyErr error
+	files := make(chan [2]string)
+	for i := 0; i < workers && workers > 1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for x := range files {
+				// Once a copy failed drain the rest without copying.
+				mu.Lock()
+				failed := copyErr != nil
+				mu.Unlock()
+				if failed {
+					continue
+				}
+				if err := CopyFile(x[0], x[1]); err != nil {
+					mu.Lock()
+					copyErr = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	err := filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		dest := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return os.Mkdir(dest, mode.Perm())
+		case mode.IsRegular():
+			if workers <= 1 {
+				return CopyFile(fp, dest)
+			}
+			files <- [2]string{fp, dest}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(fp)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dest)
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+// How often, and how far apart, a rename failing with a transient error or
+// because the file is in use is attempted.
+type RenameRetry struct {
+	Attempts int
+	Delay    time.Duration
+}
+
+// Renames oldname to newname, retrying while newname is held open by a process
+// or the rename fails with a transient error, see isTransient. Other errors are
+// returned at once. Still in use after the last attempt it returns an error
+// wrapping ErrFileInUse.
+func (r RenameRetry) Rename(oldname, newname string) error {
+	var err error
+	for i := 0; i < r.Attempts || i == 0; i++ {
+		if i > 0 {
+			time.Sleep(r.Delay)
+		}
+		if err = os.Rename(oldname, newname); err == nil || !(isFileInUse(err) || isTransient(err)) {
+			return err
+		}
+	}
+	if isFileInUse(err) {
+		return fmt.Errorf("%w: %v", ErrFileInUse, err)
+	}
+	return err
+}
+
+// Renames oldname to newname, retrying InUseAttempts times InUseDelay apart,
+// see RenameRetry.
+func RenameInUse(oldname, newname string) error {
+	return RenameRetry{Attempts: InUseAttempts, Delay: InUseDelay}.Rename(oldname, newname)
+}
+
+// The suffix added to backups of directory targets when CompressBackups is on.
+const CompressedBackupSuffix = ".tar.gz"
+
+// Moves the target into dir as a timestamped backup, retrying the rename as
+// retry says. When dir is on another filesystem the target is copied there by
+// workers files at a time and then removed. It is renamed aside before being
+// removed so it is either whole or gone, when what was set aside can't all be
+// removed the backup is returned with an error wrapping ErrLeftover.
+func BackupTarget(target Target, dir string, compress bool, workers int, retry RenameRetry) (string, error) {
 	// Ensure the backup destination exists
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", err
 	}
 
 	// Ensure there is something to backup
-	_, err := os.Stat(target.Filename)
+	stat, err := os.Stat(target.Filename)
 	if os.IsNotExist(err) {
 		// This handles the case where the binary never existed before.
 		return "", nil
@@ -189,19 +1284,287 @@ func BackupTarget(target Target, dir string) (string, error) {
 		return "", err
 	}
 
+	str := path.Join(dir, target.BackupName()+time.Now().Format(".20060102150405.bak"))
+	if compress && stat.IsDir() {
+		str += CompressedBackupSuffix
+		if err := CompressBackup(target.Filename, str); err != nil {
+			os.Remove(str)
+			return "", err
+		}
+		return str, removeBackedUp(target.Filename, str, retry)
+	}
+
 	// Move it
-	str := path.Join(dir, target.Name+time.Now().Format(".20060102150405.bak"))
-	return str, os.Rename(target.Filename, str)
+	if err := retry.Rename(target.Filename, str); !isCrossDevice(err) {
+		return str, err
+	}
+	if stat.IsDir() {
+		err = os.Mkdir(str, stat.Mode().Perm())
+		if err == nil {
+			err = CopyTreeN(target.Filename, str, workers)
+		}
+	} else {
+		err = CopyFile(target.Filename, str)
+	}
+	if err != nil {
+		os.RemoveAll(str)
+		return "", err
+	}
+	return str, removeBackedUp(target.Filename, str, retry)
+}
+
+// Removes filename once the backup holds a copy of it. When it can't be set
+// aside the backup is removed instead, leaving things as they were.
+func removeBackedUp(filename, backup string, retry RenameRetry) error {
+	aside, err := SetAside(filename, retry)
+	if err != nil {
+		os.RemoveAll(backup)
+		return err
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		return fmt.Errorf("%w: %v", ErrLeftover, err)
+	}
+	return nil
+}
+
+// Renames filename to a hidden name next to it, retrying as retry says, and
+// returns that name. Empty when there is nothing at filename.
+func SetAside(filename string, retry RenameRetry) (string, error) {
+	if _, err := os.Lstat(filename); os.IsNotExist(err) {
+		return "", nil
+	}
+	aside := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".aside-"+NewDeployID())
+	if err := retry.Rename(filename, aside); err != nil {
+		return "", err
+	}
+	return aside, nil
+}
+
+// Packs filename into a gzipped tar at dest. Only what PackTar preserves, regular
+// files, directories, hardlinks and symlinks, survives the round trip.
+func CompressBackup(filename, dest string) error {
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if err := PackTar(filename, gz, PackOptions{}); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Puts a backup made by BackupTarget back at filename, expanding compressed
+// backups. The rename of an uncompressed backup is retried as retry says. A
+// backup on another filesystem than filename is copied, see moveInto.
+func RestoreBackup(backup, filename string, retry RenameRetry) error {
+	if !strings.HasSuffix(backup, CompressedBackupSuffix) {
+		return moveInto(backup, filename, retry)
+	}
+	f, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tmpdir, err := UnpackTar(tar.NewReader(gz), UnpackOptions{Symlinks: true})
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	xs, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		return err
+	} else if len(xs) != 1 {
+		return ErrInvalidPayload
+	}
+	if err := moveInto(filepath.Join(tmpdir, xs[0].Name()), filename, retry); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(backup)
+}
+
+// Renames src to dest, retrying as retry says. When they are on different
+// filesystems src is copied next to dest and the copy renamed into place, so
+// dest never holds part of src, and then src is removed. When src can't all be
+// removed the error wraps ErrLeftover, dest is in place all the same.
+func moveInto(src, dest string, retry RenameRetry) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	err := retry.Rename(src, dest)
+	if !isCrossDevice(err) {
+		return err
+	}
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".restore-"+NewDeployID())
+	if stat.IsDir() {
+		err = os.Mkdir(tmp, stat.Mode().Perm())
+		if err == nil {
+			err = CopyTree(src, tmp)
+		}
+	} else {
+		err = CopyFile(src, tmp)
+	}
+	if err == nil {
+		err = retry.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("%w: %v", ErrLeftover, err)
+	}
+	return nil
 }
 
-func PrepareTarget(rs io.ReadSeeker) (string, error) {
+func PrepareTarget(rs io.ReadSeeker, opts UnpackOptions) (string, error) {
 	if _, err := rs.Seek(0, 0); err != nil {
 		return "", err
 	}
-	return UnpackTar(tar.NewReader(rs))
+	// Whatever the client said, the payload's first bytes tell whether it is
+	// gzipped so clients compressing or not both work.
+	br := bufio.NewReader(rs)
+	compressed := opts.Compression == CompressionGzip
+	if magic, err := br.Peek(2); err == nil {
+		compressed = IsGzip(magic)
+	}
+	var r io.Reader = br
+	var gz *gzip.Reader
+	if compressed {
+		var err error
+		gz, err = gzip.NewReader(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == gzip.ErrHeader {
+			return "", ErrNotArchive
+		} else if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	// Check the first block before creating anything, an empty payload is left
+	// for the caller to report.
+	block := make([]byte, 512)
+	n, err := io.ReadFull(r, block)
+	if err == io.ErrUnexpectedEOF || (err == nil && !IsTarHeader(block)) {
+		return "", ErrNotArchive
+	} else if err != nil && err != io.EOF {
+		return "", err
+	}
+	dir, err := UnpackTar(tar.NewReader(io.MultiReader(bytes.NewReader(block[:n]), r)), opts)
+	if err != nil || gz == nil {
+		return dir, err
+	}
+	// The tar ends before the gzip trailer, read to it so the checksum is
+	// verified.
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Reports whether b starts with the gzip magic bytes.
+func IsGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// Reports whether block, the first 512 bytes of a payload, has a valid tar
+// header checksum. A block of zeros, the end of an empty archive, is valid too.
+func IsTarHeader(block []byte) bool {
+	if len(block) != 512 {
+		return false
+	}
+	if isZero(block) {
+		return true
+	}
+	field := strings.Trim(string(block[148:156]), " \x00")
+	want, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	// The checksum is taken with its own field as spaces, some old tars sum
+	// signed bytes.
+	var unsigned, signed int64
+	for i, b := range block {
+		if 148 <= i && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+	return want == unsigned || want == signed
+}
+
+// Reports whether program, a resolved executable path, matches one of the
+// allowed entries by absolute path or by base name. An empty list allows all.
+func IsAllowedCommand(program string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if filepath.IsAbs(v) {
+			if filepath.Clean(v) == filepath.Clean(program) {
+				return true
+			}
+		} else if v == filepath.Base(program) {
+			return true
+		}
+	}
+	return false
 }
 
-func RunScript(command string, log *log.Logger) error {
+// Returns a ProtectedPathError if any of the words, or the value of a
+// --flag=value word, is a path under one of the protected paths. Relative paths
+// are taken as relative to dir.
+func CheckProtectedPaths(words []string, dir string, protected []string) error {
+	for _, w := range words {
+		if i := strings.Index(w, "="); i >= 0 && strings.HasPrefix(w, "-") {
+			w = w[i+1:]
+		}
+		if w == "" || !strings.ContainsAny(w, "/"+string(filepath.Separator)) {
+			continue
+		}
+		fp := w
+		if !filepath.IsAbs(fp) {
+			fp = filepath.Join(dir, fp)
+		}
+		fp, err := filepath.Abs(fp)
+		if err != nil {
+			continue
+		}
+		for _, p := range protected {
+			p = filepath.Clean(p)
+			if fp == p || strings.HasPrefix(fp, p+string(filepath.Separator)) {
+				return &ProtectedPathError{Path: w, Protected: p}
+			}
+		}
+	}
+	return nil
+}
+
+// Finds the program like exec.LookPath, resolving a relative path such as
+// ./restart.sh against dir the way exec.Cmd does when Dir is set.
+func lookPath(name, dir string) (string, error) {
+	if dir != "" && !filepath.IsAbs(name) && strings.ContainsAny(name, `/\`) {
+		name = filepath.Join(dir, name)
+	}
+	return exec.LookPath(name)
+}
+
+func RunScript(command string, opts ScriptOptions, log *log.Logger) error {
 	command = strings.TrimSpace(command)
 	if command == "" {
 		return nil
@@ -214,11 +1577,58 @@ func RunScript(command string, log *log.Logger) error {
 	if len(xs) >= 2 {
 		arguments = xs[1:]
 	}
+	arguments = append(arguments, opts.Args...)
+	if len(opts.AllowedCommands) > 0 {
+		program, err := lookPath(xs[0], opts.Dir)
+		if err != nil {
+			return err
+		}
+		if !IsAllowedCommand(program, opts.AllowedCommands) {
+			return &CommandNotAllowedError{Program: program}
+		}
+	}
+	if len(opts.ProtectedPaths) > 0 {
+		// A program not found is checked as written, with the same arguments.
+		program := xs[0]
+		if v, err := lookPath(xs[0], opts.Dir); err == nil {
+			program = v
+		}
+		words := append([]string{program}, arguments...)
+		if err := CheckProtectedPaths(words, opts.Dir, opts.ProtectedPaths); err != nil {
+			log.Printf("Refused to run '%s': %v", command, err)
+			return err
+		}
+	}
 	cmd := exec.Command(xs[0], arguments...)
 	cmd.Stdout = log.Writer()
 	cmd.Stderr = log.Writer()
+	// Only counted when needed, a pipe makes Wait also wait for any process the
+	// script leaves running with stderr open, WaitDelay bounds that.
+	stderr := &countingWriter{w: log.Writer()}
+	if opts.FailOnStderr {
+		cmd.Stderr = stderr
+		cmd.WaitDelay = opts.StderrWaitDelay
+		if cmd.WaitDelay <= 0 {
+			cmd.WaitDelay = DefaultStderrWaitDelay
+		}
+	}
+	cmd.Dir = opts.Dir
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+	if err := setRunAs(cmd, opts.RunAs); err != nil {
+		return err
+	}
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return cmd.Wait()
+	if err := cmd.Wait(); errors.Is(err, exec.ErrWaitDelay) {
+		return ErrStderrHeldOpen
+	} else if err != nil {
+		return err
+	}
+	if opts.FailOnStderr && stderr.n > 0 {
+		return ErrWroteStderr
+	}
+	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+func TestHandleServerConnLogsRemoteAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The handshake fails, the connection is logged before it.
+	client.Close()
+
+	var out bytes.Buffer
+	HandleServerConn(ServerContext{
+		C:      tls.Server(conn, &tls.Config{}),
+		Config: &Config{},
+		Log:    log.New(&out, "", 0),
+	})
+	if want := "Connection from " + client.LocalAddr().String(); !strings.Contains(out.String(), want) {
+		t.Errorf("logged %q, want %q", out.String(), want)
+	}
+}
+
+func TestRemoteNameReverseDNS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Whether 127.0.0.1 resolves depends on the machine, the address is there
+	// either way.
+	name := ServerContext{C: tls.Server(conn, &tls.Config{}), Config: &Config{ReverseDNS: true}}.RemoteName()
+	if !strings.HasPrefix(name, client.LocalAddr().String()) {
+		t.Errorf("RemoteName() = %q, want it to start with %s", name, client.LocalAddr())
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// A raw client that connects and never starts the handshake.
+	client, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- HandleServerConn(ServerContext{
+			C:      tls.Server(conn, &tls.Config{}),
+			Config: &Config{HandshakeTimeout: Duration{200 * time.Millisecond}},
+			Log:    log.New(&bytes.Buffer{}, "", 0),
+		})
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("got %v, want a timeout", err)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("gave up after %s, before the timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was held open past HandshakeTimeout")
+	}
+}
+
+func TestHandshakeTimeoutDefault(t *testing.T) {
+	if got := (ServerContext{Config: &Config{}}).HandshakeTimeout(); got != DefaultHandshakeTimeout {
+		t.Errorf("HandshakeTimeout() = %s, want %s", got, DefaultHandshakeTimeout)
+	}
+	c := &Config{HandshakeTimeout: Duration{time.Second}}
+	if got := (ServerContext{Config: c}).HandshakeTimeout(); got != time.Second {
+		t.Errorf("HandshakeTimeout() = %s, want 1s", got)
+	}
+}
+
+func TestDeployAbortedPayload(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	// Cut at an entry boundary a tar unpacks cleanly, only the commit tells the
+	// daemon it isn't all of the payload.
+	payload := tarBytes(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}, tarEntry{Name: "app/a", Body: "a"}, tarEntry{Name: "app/b", Body: "b"})
+	conn := d.Dial(t)
+	_, err := HandleClientConnRaw(conn, DeployRequest{Target: "app", ID: NewDeployID()}, brokenReader(string(payload[:3*512])))
+	if err == nil {
+		t.Fatal("a broken payload was sent without an error")
+	}
+	var rse *RemoteStatusError
+	if err := ReadStatus(conn); !errors.As(err, &rse) || !strings.Contains(rse.Message, "aborted by the client") {
+		t.Errorf("the daemon replied %v to an aborted payload", err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Errorf("the aborted payload was deployed: %v", err)
+	}
+}
+
+func TestDeployWithoutCommit(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	conn := d.Dial(t)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	// Like a client from before commits, the final status follows the stream.
+	if err := SendCommand(conn, CommandDEPLOY, DeployRequest{Target: "app", ID: NewDeployID()}.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	sw := goio.NewStreamWriter(conn)
+	sw.Write(tarBytes(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}, tarEntry{Name: "app/version", Body: "1"}))
+	sw.Terminate()
+	if err := ReadStatus(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
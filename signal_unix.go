@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Parses a signal name such as "HUP" or "SIGUSR2".
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signal '%s'", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidateReloadSignal(t *testing.T) {
+	dir := t.TempDir()
+	pid := filepath.Join(dir, "app.pid")
+	tests := []struct {
+		signal, pidFile string
+		err             string
+	}{
+		{"", "", ""},
+		{"HUP", pid, ""},
+		{"sigusr2", pid, ""},
+		// Not running yet is fine, the pid file is read when signalling.
+		{"USR1", filepath.Join(dir, "missing.pid"), ""},
+		{"KILL", pid, "unsupported signal 'KILL'"},
+		{"HUP", "", "ReloadSignal needs a PidFile"},
+		{"HUP", "app.pid", "PidFile 'app.pid' must be an absolute path"},
+		{"", pid, "PidFile is only used with a ReloadSignal"},
+	}
+	for _, tt := range tests {
+		conf := Config{Targets: []Target{{Name: "app", Filename: filepath.Join(dir, "app"), ReloadSignal: tt.signal, PidFile: tt.pidFile}}}
+		err := conf.Validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("ReloadSignal %q, PidFile %q gave %v, want %q", tt.signal, tt.pidFile, err, tt.err)
+		}
+	}
+}
+
+func TestReadPidFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"ok": "1234\n", "junk": "12ab", "zero": "0", "empty": ""})
+	if pid, err := ReadPidFile(filepath.Join(dir, "ok")); err != nil || pid != 1234 {
+		t.Errorf("ReadPidFile = %d, %v", pid, err)
+	}
+	for _, name := range []string{"junk", "zero", "empty", "missing"} {
+		if pid, err := ReadPidFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("ReadPidFile of %s gave %d", name, pid)
+		}
+	}
+}
+
+// Starts a shell recording each SIGUSR1 it gets a line in the returned file,
+// with its pid written to pidFile.
+func reloadingProcess(t *testing.T, pidFile string) string {
+	t.Helper()
+	reloads := filepath.Join(t.TempDir(), "reloads")
+	script := fmt.Sprintf("trap 'echo reload >> %s' USR1; while :; do sleep 0.05; done", reloads)
+	cmd := exec.Command("/bin/sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return reloads
+}
+
+func TestSignalPidFile(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "app.pid")
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignalPidFile(pidFile, "TERM"); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGTERM {
+		t.Errorf("the process ended with %v, want SIGTERM", cmd.ProcessState)
+	}
+	if err := SignalPidFile(pidFile, "NOPE"); err == nil {
+		t.Error("an unknown signal was sent")
+	}
+	if err := SignalPidFile(filepath.Join(t.TempDir(), "missing.pid"), "HUP"); err == nil {
+		t.Error("signalling without a pid file succeeded")
+	}
+}
+
+func TestDeployReloadSignal(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "app.pid")
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].ReloadSignal = "USR1"
+		c.Targets[0].PidFile = pidFile
+	})
+	// Without the process the deploy's After step fails and the files are restored.
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err == nil {
+		t.Fatal("a deploy without the reloading process succeeded")
+	}
+
+	reloads := reloadingProcess(t, pidFile)
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reload", func() bool {
+		buf, _ := ioutil.ReadFile(reloads)
+		return strings.Count(string(buf), "\n") == 1
+	})
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows has no signals to ask a process to reload with.
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("ReloadSignal is not supported on windows")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// The bytes the filesystem allocated for the file.
+func allocated(t *testing.T, filename string) int64 {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Stat(filename, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	const size = 16 << 20
+	dir := filepath.Join(t.TempDir(), "app")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "disk.img")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if allocated(t, fn) >= size/2 {
+		t.Skip("the filesystem doesn't keep holes")
+	}
+
+	var buf bytes.Buffer
+	if err := PackTar(dir, &buf, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sparse := range []bool{true, false} {
+		out, err := UnpackTar(tar.NewReader(bytes.NewReader(buf.Bytes())), UnpackOptions{Sparse: sparse})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(out)
+		got := filepath.Join(out, "app", "disk.img")
+		b, err := ioutil.ReadFile(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, size)
+		copy(want[size/2:], "middle")
+		if !bytes.Equal(b, want) {
+			t.Errorf("sparse %v: the unpacked file differs", sparse)
+		}
+		if n := allocated(t, got); sparse && n >= size/2 {
+			t.Errorf("unpacked sparsely %d of %d bytes are allocated", n, size)
+		}
+	}
+}
+
+func TestSparseCopyTrailingHole(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "f")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := append([]byte("head"), make([]byte, 3*sparseBlockSize)...)
+	if n, err := SparseCopy(f, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(data)) {
+		t.Errorf("the file has %d bytes, want %d", stat.Size(), len(data))
+	}
+}
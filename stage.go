@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmathews/goio"
+)
+
+// Used when the config doesn't set a StageTimeout.
+const DefaultStageTimeout = 30 * time.Minute
+
+// A payload received by STAGE waiting for its APPLY.
+type stagedPayload struct {
+	Target string
+	Req    DeployRequest
+	Dir    string
+	timer  *time.Timer
+}
+
+// Holds staged payloads by token, removing those not applied in time.
+type StageStore struct {
+	mu sync.Mutex
+	m  map[string]*stagedPayload
+}
+
+func (s *StageStore) Put(p *stagedPayload, timeout time.Duration, log *log.Logger) string {
+	token := NewDeployID() + NewDeployID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*stagedPayload)
+	}
+	s.m[token] = p
+	p.timer = time.AfterFunc(timeout, func() {
+		if s.Take(token) != nil {
+			log.Printf("Staged payload %s of %s expired unapplied", p.Req.ID, p.Target)
+			os.RemoveAll(p.Dir)
+		}
+	})
+	return token
+}
+
+// Removes and returns the payload staged under token, nil if there is none.
+func (s *StageStore) Take(token string) *stagedPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.m[token]
+	if p != nil {
+		delete(s.m, token)
+		p.timer.Stop()
+	}
+	return p
+}
+
+// Returns the payload staged under token, leaving it staged.
+func (s *StageStore) Get(token string) *stagedPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[token]
+}
+
+// Removes every staged payload and its directory, for when the daemon stops.
+// Returns how many there were.
+func (s *StageStore) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.m)
+	for token, p := range s.m {
+		p.timer.Stop()
+		os.RemoveAll(p.Dir)
+		delete(s.m, token)
+	}
+	return n
+}
+
+func (ctx ServerContext) StageTimeout() time.Duration {
+	if ctx.Config.StageTimeout.Duration > 0 {
+		return ctx.Config.StageTimeout.Duration
+	}
+	return DefaultStageTimeout
+}
+
+// Receives and unpacks a payload like DEPLOY without touching the target. The
+// Ok after the stream is followed by a stream holding the token to APPLY it.
+func (ctx ServerContext) HandleStage(signature, input string) error {
+	name, req, target, err := ctx.CheckDeploy(signature, input)
+	if target == nil {
+		return err
+	}
+	if ctx.Stages == nil {
+		return goio.NotOk(ctx.C, StatusUnsupported, "Staging is not enabled on this server.")
+	}
+	tmpdir, payload, err := ctx.ReceivePayload(target, req)
+	if tmpdir == "" {
+		return err
+	}
+	// Once staged the payload file is gone, the digest is checked now.
+	req.Digest = ctx.CheckDigest(payload, req)
+	ctx.DisposePayload(payload, req.ID, false)
+	token := ctx.Stages.Put(&stagedPayload{Target: target.Name, Req: req, Dir: tmpdir}, ctx.StageTimeout(), ctx.Log)
+	ctx.Log.Printf("Staged %s of %s by %s, expires in %s", req.ID, target.Name, name, ctx.StageTimeout())
+	if err := goio.Ok(ctx.C); err != nil {
+		return err
+	}
+	sw := goio.NewStreamWriter(ctx.C)
+	_, err = io.WriteString(sw, token)
+	sw.Terminate()
+	return err
+}
+
+// Swaps a staged payload in for its target, like the second half of DEPLOY. The
+// payload is only taken once the deploy gets past its refusals, so a refused
+// APPLY can be retried with the same token.
+func (ctx ServerContext) HandleApply(signature, token string) error {
+	if ctx.Stages == nil {
+		return goio.NotOk(ctx.C, StatusUnsupported, "Staging is not enabled on this server.")
+	}
+	p := ctx.Stages.Get(token)
+	if p == nil {
+		return goio.NotOk(ctx.C, StatusNotExist, "Nothing is staged under that token, it may have expired.")
+	}
+
+	// Check again, the config or the window may have changed since staging.
+	name, req, target, err := ctx.CheckDeploy(signature, p.Req.Encode())
+	if target == nil {
+		return err
+	}
+	return ctx.Deploy(name, target, req, func(*Target, DeployRequest) (string, string, error) {
+		// Expired or applied by another connection while waiting for the lock.
+		if ctx.Stages.Take(token) == nil {
+			return "", "", goio.NotOk(ctx.C, StatusNotExist, "Nothing is staged under that token, it may have expired.")
+		}
+		return p.Dir, "", nil
+	})
+}
+
+// Sends the payload with STAGE and returns the token to APPLY it with.
+func HandleClientConnStage(conn *tls.Conn, req DeployRequest, filename string, opts PackOptions) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return "", err
+	}
+	req.Commit = true
+	if err := SendCommand(conn, CommandSTAGE, req.Encode()); err != nil {
+		return "", err
+	}
+	write := func(w io.Writer) error {
+		return packPayload(w, req, filename, opts)
+	}
+	if _, err := writePayload(conn, req, write); err != nil {
+		return "", err
+	}
+	if err := ReadStatus(conn); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := goio.ReadStream(conn, &buf); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Applies a payload staged earlier.
+func HandleClientConnApply(conn *tls.Conn, token string) error {
+	if err := conn.Handshake(); err != nil {
+		fmt.Fprintln(MessageOutput, err)
+		return err
+	}
+	return SendCommand(conn, CommandAPPLY, token)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStageStoreExpiry(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var s StageStore
+	stage := func(name string, timeout time.Duration) (string, string) {
+		dir := filepath.Join(t.TempDir(), name)
+		writeFiles(t, dir, map[string]string{"version": name})
+		return s.Put(&stagedPayload{Target: "app", Dir: dir}, timeout, logger), dir
+	}
+
+	expired, expiredDir := stage("expired", 10*time.Millisecond)
+	kept, keptDir := stage("kept", 50*time.Millisecond)
+	if expired == kept {
+		t.Fatal("two stages got the same token")
+	}
+	if p := s.Take(kept); p == nil || p.Dir != keptDir {
+		t.Fatalf("Take of a fresh stage gave %+v", p)
+	}
+	if s.Take(kept) != nil {
+		t.Error("a stage was taken twice")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if s.Take(expired) != nil {
+		t.Error("an expired stage was taken")
+	}
+	if _, err := os.Stat(expiredDir); !os.IsNotExist(err) {
+		t.Errorf("the expired stage's directory was kept: %v", err)
+	}
+	// Taken before it expired, its directory is the caller's.
+	if _, err := os.Stat(keptDir); err != nil {
+		t.Errorf("the taken stage's directory was removed: %v", err)
+	}
+	if s.Take("unknown") != nil {
+		t.Error("an unknown token was taken")
+	}
+}
+
+func TestStageStoreClear(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var s StageStore
+	var tokens, dirs []string
+	for _, name := range []string{"one", "two"} {
+		dir := filepath.Join(t.TempDir(), name)
+		writeFiles(t, dir, map[string]string{"version": name})
+		tokens = append(tokens, s.Put(&stagedPayload{Target: "app", Dir: dir}, time.Hour, logger))
+		dirs = append(dirs, dir)
+	}
+	if p := s.Get(tokens[0]); p == nil || p.Dir != dirs[0] {
+		t.Fatalf("Get gave %+v", p)
+	}
+	if s.Get(tokens[0]) == nil {
+		t.Fatal("Get removed the stage")
+	}
+
+	if n := s.Clear(); n != 2 {
+		t.Errorf("Clear removed %d stages, want 2", n)
+	}
+	for i, token := range tokens {
+		if s.Get(token) != nil {
+			t.Errorf("stage %s survived Clear", token)
+		}
+		if _, err := os.Stat(dirs[i]); !os.IsNotExist(err) {
+			t.Errorf("the directory of a cleared stage was kept: %v", err)
+		}
+	}
+	if n := s.Clear(); n != 0 {
+		t.Errorf("Clearing an empty store removed %d", n)
+	}
+}
+
+func TestStageThenApply(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	writeFiles(t, d.Src, map[string]string{"version": "staged"})
+	token, err := HandleClientConnStage(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, d.Src, PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Fatalf("staging touched the target: %v", err)
+	}
+
+	// Refused, the payload stays staged for a later APPLY.
+	tomorrow := strings.ToLower(time.Now().AddDate(0, 0, 1).Weekday().String()[:3])
+	d.Target().DeployWindows = []string{tomorrow + " 00:00-23:59"}
+	var rse *RemoteStatusError
+	if err := HandleClientConnApply(d.Dial(t), token); !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Fatalf("an apply outside the window gave %v", err)
+	}
+	d.Target().DeployWindows = nil
+
+	if err := HandleClientConnApply(d.Dial(t), token); err != nil {
+		t.Fatalf("applying after a refusal: %v", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "staged" {
+		t.Errorf("the target holds %q after the apply", got)
+	}
+	if err := HandleClientConnApply(d.Dial(t), token); !errors.As(err, &rse) || rse.Code != StatusNotExist {
+		t.Errorf("applying a token twice gave %v", err)
+	}
+	if err := HandleClientConnApply(d.Dial(t), "unknown"); !errors.As(err, &rse) || rse.Code != StatusNotExist {
+		t.Errorf("applying an unknown token gave %v", err)
+	}
+}
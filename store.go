@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tmathews/goio"
+)
+
+// Maps client signatures to the usernames targets authorize. The daemon looks
+// every signature up through Config.SignatureStore so other backends, such as a
+// directory of keys or a service, can stand in for the AuthorizedKeys file.
+type SignatureStore interface {
+	// Returns the username of the signature, or an empty string if it is unknown.
+	GetSignatureName(signature string) (string, error)
+
+	// Returns every known signature mapped to its username.
+	ListAuthorized() (map[string]string, error)
+}
+
+// The default store, a file with a signature, a space and a username per line.
+type FileSignatureStore struct {
+	Filename string
+}
+
+func (s FileSignatureStore) GetSignatureName(signature string) (name string, err error) {
+	var f *os.File
+	f, err = os.OpenFile(s.Filename, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	for {
+		var sig, n []byte
+		sig, err = goio.ReadUntilByte(f, ' ')
+		if err != nil {
+			break
+		}
+		n, err = goio.ReadUntilByte(f, '\n', '\r')
+		if err != nil && err != io.EOF {
+			break
+		}
+		if string(sig) == signature {
+			name = string(n)
+			break
+		} else if err == io.EOF {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return strings.TrimSpace(name), err
+}
+
+func (s FileSignatureStore) ListAuthorized() (map[string]string, error) {
+	f, err := os.OpenFile(s.Filename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	for {
+		var exit bool
+		key, err := goio.ReadUntilByte(f, ' ')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name, err := goio.ReadUntilByte(f, '\n', '\r')
+		if err == io.EOF {
+			exit = true
+		} else if err != nil {
+			return nil, err
+		}
+		m[string(key)] = string(name)
+		if exit {
+			break
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A SignatureStore held in memory, failing every lookup when err is set.
+type mapStore struct {
+	names map[string]string
+	err   error
+}
+
+func (s *mapStore) GetSignatureName(signature string) (string, error) {
+	return s.names[signature], s.err
+}
+
+func (s *mapStore) ListAuthorized() (map[string]string, error) {
+	return s.names, s.err
+}
+
+func TestFileSignatureStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "authorized_keys")
+	// The last line has no newline.
+	if err := ioutil.WriteFile(fn, []byte("AAA alice\nBBB bob\nCCC carol"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := FileSignatureStore{Filename: fn}
+	for sig, want := range map[string]string{"AAA": "alice", "BBB": "bob", "CCC": "carol", "DDD": ""} {
+		if got, err := s.GetSignatureName(sig); err != nil || got != want {
+			t.Errorf("GetSignatureName(%s) = %q, %v, want %q", sig, got, err, want)
+		}
+	}
+	m, err := s.ListAuthorized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 || m["CCC"] != "carol" || m["BBB"] != "bob" {
+		t.Errorf("ListAuthorized() = %q", m)
+	}
+	if _, err := (FileSignatureStore{Filename: fn + ".missing"}).GetSignatureName("AAA"); err == nil {
+		t.Error("looked up a signature in a missing file")
+	}
+}
+
+func TestConfigSignatureStore(t *testing.T) {
+	store := &mapStore{names: map[string]string{"AAA": "alice"}}
+	c := &Config{AuthorizedKeys: "/nonexistent", Signatures: store}
+	if c.SignatureStore() != store {
+		t.Error("the configured store isn't used")
+	}
+	if name, err := c.GetSignatureName("AAA"); err != nil || name != "alice" {
+		t.Errorf("GetSignatureName = %q, %v", name, err)
+	}
+	if m, err := c.LoadSignatures(); err != nil || !reflect.DeepEqual(m, store.names) {
+		t.Errorf("LoadSignatures = %v, %v", m, err)
+	}
+	c.Signatures = nil
+	if fs, ok := c.SignatureStore().(FileSignatureStore); !ok || fs.Filename != "/nonexistent" {
+		t.Errorf("without a store got %#v, want the AuthorizedKeys file", c.SignatureStore())
+	}
+}
+
+func TestDeploySignatureStore(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	// Only the store knows the client.
+	if err := ioutil.WriteFile(d.Config.AuthorizedKeys, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err == nil {
+		t.Fatal("deployed with an empty AuthorizedKeys file")
+	}
+	store := &mapStore{names: map[string]string{GetSignature(d.client.Certificates[0].Leaf): "tester"}}
+	d.Config.Signatures = store
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.err = errors.New("the directory is down")
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err == nil {
+		t.Error("deployed while the store fails")
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestIsSubpath(t *testing.T) {
+	tests := []struct {
+		subpath string
+		want    bool
+	}{
+		{"static", true},
+		{"static/css", true},
+		{`static\css`, true},
+		{"static/../js", true},
+		{"", false},
+		{".", false},
+		{"static/..", false},
+		{"..", false},
+		{"../other", false},
+		{"static/../../other", false},
+		{`..\other`, false},
+		{"/etc", false},
+	}
+	for _, tt := range tests {
+		if got := IsSubpath(tt.subpath); got != tt.want {
+			t.Errorf("IsSubpath(%q) = %v, want %v", tt.subpath, got, tt.want)
+		}
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	dir := t.TempDir()
+	target := &Target{Name: "app", Filename: filepath.Join(dir, "app")}
+	if _, err := target.Subtree("static"); !os.IsNotExist(err) {
+		t.Errorf("a target not deployed gave %v", err)
+	}
+	writeFiles(t, target.Filename, map[string]string{"static/css/a.css": "a"})
+
+	sub, err := target.Subtree(`static\css`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(target.Filename, "static", "css"); sub.Filename != want {
+		t.Errorf("Filename is %s, want %s", sub.Filename, want)
+	}
+	if got := sub.BackupName(); got != "app@static%2Fcss" {
+		t.Errorf("BackupName is %s", got)
+	}
+	if sub.DigestFilename() != "" || target.DigestFilename() == "" || target.BackupName() != "app" {
+		t.Error("the subtree changed the whole target")
+	}
+	// Not there yet is fine, it is created by the deploy.
+	if _, err := target.Subtree("static/new/dir"); err != nil {
+		t.Errorf("a new subpath gave %v", err)
+	}
+	if _, err := target.Subtree("../app"); err == nil {
+		t.Error("a subpath leaving the target was allowed")
+	}
+
+	file := &Target{Name: "conf", Filename: filepath.Join(dir, "app", "static", "css", "a.css")}
+	if _, err := file.Subtree("x"); err == nil {
+		t.Error("a subpath of a file target was allowed")
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(dir, filepath.Join(target.Filename, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := target.Subtree("link/app"); err == nil {
+			t.Error("a subpath through a symlink was allowed")
+		}
+	}
+}
+
+func TestDeploySubpath(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.KeepBackups = 5 })
+	files := map[string]string{"version": "1", "static/css/a.css": "a", "static/js/b.js": "b"}
+	if err := d.Deploy(t, files); err != nil {
+		t.Fatal(err)
+	}
+	// As left by a deploy sending its digest.
+	if err := ioutil.WriteFile(d.Target().DigestFilename(), []byte("digest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(t.TempDir(), "css")
+	writeFiles(t, src, map[string]string{"c.css": "c"})
+	req := DeployRequest{Target: "app", ID: NewDeployID(), Subpath: "static/css"}
+	if _, err := HandleClientConn(d.Dial(t), req, src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the subtree is replaced.
+	want := map[string]string{"version": "1", "static/css/c.css": "c", "static/js/b.js": "b"}
+	for name, body := range want {
+		if got := readFile(t, filepath.Join(d.Target().Filename, filepath.FromSlash(name))); got != body {
+			t.Errorf("%s holds %q, want %q", name, got, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(d.Target().Filename, "static", "css", "a.css")); !os.IsNotExist(err) {
+		t.Errorf("the replaced subtree kept a.css: %v", err)
+	}
+	if _, err := os.Stat(d.Target().DigestFilename()); !os.IsNotExist(err) {
+		t.Errorf("the digest of the whole target was kept: %v", err)
+	}
+	subtree, err := ListBackups(d.Config.BackupDirectory, "app@static%2Fcss")
+	if err != nil || len(subtree) != 1 {
+		t.Errorf("backups of the subtree are %v, %v", subtree, err)
+	}
+	whole, err := ListBackups(d.Config.BackupDirectory, "app")
+	if err != nil || len(whole) != 0 {
+		t.Errorf("backups of the whole target are %v, %v, want the subtree's left out", whole, err)
+	}
+}
+
+func TestDeploySubpathEscape(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	if err := d.Deploy(t, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "keep"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	subpaths := []string{"..", "../other", "static/../../other", "/" + strings.TrimLeft(filepath.ToSlash(outside), "/"), "."}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(outside, filepath.Join(d.Target().Filename, "link")); err != nil {
+			t.Fatal(err)
+		}
+		subpaths = append(subpaths, "link", "link/sub")
+	}
+	src := filepath.Join(t.TempDir(), "evil")
+	writeFiles(t, src, map[string]string{"keep": "replaced"})
+	for _, subpath := range subpaths {
+		req := DeployRequest{Target: "app", ID: NewDeployID(), Subpath: subpath}
+		var rse *RemoteStatusError
+		if _, err := HandleClientConn(d.Dial(t), req, src, PackOptions{}); !errors.As(err, &rse) {
+			t.Errorf("the subpath %q gave %v, want it refused", subpath, err)
+		}
+	}
+	if got := readFile(t, filepath.Join(outside, "keep")); got != "keep" {
+		t.Errorf("a file outside the target holds %q", got)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
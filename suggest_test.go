@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"app", "", 3},
+		{"app", "app", 0},
+		{"app", "apps", 1},
+		{"kitten", "sitting", 3},
+		{"wbe", "web", 2},
+		{"naïve", "naive", 1},
+	}
+	for _, tt := range tests {
+		if got := EditDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("EditDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := EditDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("EditDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"web", "web-staging", "api", "API-v2", "worker"}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"wbe", []string{"web"}},
+		{"apo", []string{"api"}},
+		// Case is ignored.
+		{"Api-V2", []string{"API-v2"}},
+		{"web-stagin", []string{"web-staging"}},
+		{"database", nil},
+	}
+	for _, tt := range tests {
+		if got := Suggest(tt.name, candidates); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Suggest(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got, want := Suggest("ap", []string{"apps", "app"}), []string{"app", "apps"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Suggest(ap) = %v, want the closest first %v", got, want)
+	}
+}
+
+func TestSuggestTarget(t *testing.T) {
+	plain := errors.New("The target wbe does not exist.")
+	if got := SuggestTarget(plain, "wbe"); got != plain {
+		t.Errorf("a message without targets became %v", got)
+	}
+	if SuggestTarget(nil, "wbe") != nil {
+		t.Error("no error became one")
+	}
+	listed := &RemoteStatusError{Code: StatusNotExist, Message: "The target wbe does not exist. " + AvailableTargetsPrefix + "web, worker"}
+	got := SuggestTarget(listed, "wbe")
+	if !strings.HasSuffix(got.Error(), "\nDid you mean web?") {
+		t.Errorf("suggested %q", got)
+	}
+	var rse *RemoteStatusError
+	if !errors.As(got, &rse) || rse.Code != StatusNotExist {
+		t.Error("the suggestion lost the status")
+	}
+	if got := SuggestTarget(listed, "database"); got != listed {
+		t.Errorf("nothing close became %v", got)
+	}
+}
+
+func TestDeployUnknownTargetSuggests(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.SuggestTargets = true })
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	_, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "apo", ID: NewDeployID()}, d.Src, PackOptions{})
+	if err = SuggestTarget(err, "apo"); err == nil || !strings.HasSuffix(err.Error(), "Did you mean app?") {
+		t.Errorf("got %v, want a suggestion of app", err)
+	}
+}
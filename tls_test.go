@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handshakes with the daemon offering only the versions from min to max.
+func handshakeVersions(t *testing.T, d *testDaemon, min, max uint16) error {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", d.address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conf := d.client.Clone()
+	conf.MinVersion, conf.MaxVersion = min, max
+	conn := tls.Client(c, conf)
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn.Handshake()
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	if err := handshakeVersions(t, d, tls.VersionTLS10, tls.VersionTLS11); err == nil {
+		t.Error("a client offering only TLS 1.0 and 1.1 was accepted by default")
+	}
+	if err := handshakeVersions(t, d, tls.VersionTLS12, tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2: %v", err)
+	}
+
+	d = newTestDaemon(t, func(c *Config) { c.TLSMinVersion = "1.3" })
+	if err := handshakeVersions(t, d, tls.VersionTLS12, tls.VersionTLS12); err == nil {
+		t.Error("a client offering only TLS 1.2 was accepted with TLSMinVersion 1.3")
+	}
+	if err := handshakeVersions(t, d, tls.VersionTLS13, tls.VersionTLS13); err != nil {
+		t.Errorf("TLS 1.3: %v", err)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, " 1.3 ": tls.VersionTLS13, "1.0": tls.VersionTLS10}
+	for str, want := range tests {
+		if got, err := ParseTLSVersion(str); err != nil || got != want {
+			t.Errorf("ParseTLSVersion(%q) = %x, %v, want %x", str, got, err, want)
+		}
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Error("parsed TLS 2.0")
+	}
+}
+
+// Authorizes a new client certificate valid for d as tester and switches the
+// daemon's client to it.
+func (d *testDaemon) UseClientCert(t *testing.T, valid time.Duration) {
+	t.Helper()
+	cert, err := GenerateKeyPair("test", valid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(d.Config.AuthorizedKeys, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s tester\n", GetSignature(cert.Leaf)); err != nil {
+		t.Fatal(err)
+	}
+	d.client = &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+}
+
+func TestRejectExpiredCerts(t *testing.T) {
+	files := map[string]string{"version": "1"}
+	d := newTestDaemon(t, func(c *Config) { c.RejectExpiredCerts = true })
+	if err := d.Deploy(t, files); err != nil {
+		t.Errorf("a valid certificate was refused: %v", err)
+	}
+	d.UseClientCert(t, -time.Second)
+	if err := d.Deploy(t, files); err == nil || !strings.Contains(err.Error(), "certificate expired") {
+		t.Errorf("got %v, want the expired certificate refused", err)
+	}
+
+	d = newTestDaemon(t, nil)
+	d.UseClientCert(t, -time.Second)
+	if err := d.Deploy(t, files); err != nil {
+		t.Errorf("an expired certificate was refused without RejectExpiredCerts: %v", err)
+	}
+}
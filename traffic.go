@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counts the bytes read from and written to the connection, TLS included.
+type CountingConn struct {
+	net.Conn
+	received int64
+	sent     int64
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Received() int64 {
+	return atomic.LoadInt64(&c.received)
+}
+
+func (c *CountingConn) Sent() int64 {
+	return atomic.LoadInt64(&c.sent)
+}
+
+// What the connections of one signature transferred in total.
+type Traffic struct {
+	Signature   string `json:"signature"`
+	Name        string `json:"name,omitempty"`
+	Connections int64  `json:"connections"`
+	Received    int64  `json:"received"`
+	Sent        int64  `json:"sent"`
+}
+
+// Tallies the traffic of each signature, kept in filename across restarts
+// when it is set.
+type TrafficTally struct {
+	mu       sync.Mutex
+	m        map[string]*Traffic
+	filename string
+}
+
+// Loads the tally kept in filename, starting an empty one when it doesn't
+// exist yet. An empty filename keeps the tally in memory only.
+func LoadTrafficTally(filename string) (*TrafficTally, error) {
+	t := &TrafficTally{m: make(map[string]*Traffic), filename: filename}
+	if filename == "" {
+		return t, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var xs []Traffic
+	if err := json.Unmarshal(buf, &xs); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i := range xs {
+		t.m[xs[i].Signature] = &xs[i]
+	}
+	return t, nil
+}
+
+// Adds a connection of the signature, known as name, to the tally and saves
+// it. A nil tally records nothing.
+func (t *TrafficTally) Add(signature, name string, received, sent int64) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.m[signature]
+	if !ok {
+		v = &Traffic{Signature: signature}
+		t.m[signature] = v
+	}
+	if name != "" {
+		v.Name = name
+	}
+	v.Connections++
+	v.Received += received
+	v.Sent += sent
+	if t.filename == "" {
+		return nil
+	}
+	return t.save()
+}
+
+// Writes the tally to a temporary file renamed over filename so a crash never
+// leaves it half written.
+func (t *TrafficTally) save() error {
+	buf, err := json.MarshalIndent(t.list(), "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(t.filename), ".traffic-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), t.filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// The traffic of every signature, most received first.
+func (t *TrafficTally) List() []Traffic {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.list()
+}
+
+func (t *TrafficTally) list() []Traffic {
+	xs := make([]Traffic, 0, len(t.m))
+	for _, v := range t.m {
+		xs = append(xs, *v)
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		if xs[i].Received != xs[j].Received {
+			return xs[i].Received > xs[j].Received
+		}
+		return xs[i].Signature < xs[j].Signature
+	})
+	return xs
+}
+
+// Prints a line per signature to w.
+func WriteTraffic(w io.Writer, xs []Traffic) {
+	for _, v := range xs {
+		name := v.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%-16s %6d connections %12d bytes received %12d bytes sent %s\n", name, v.Connections, v.Received, v.Sent, v.Signature)
+	}
+}
+
+// Logs what the finished connection transferred and adds it to the tally under
+// the client's signature. Connections failing the handshake are tallied under
+// an empty signature.
+func (ctx ServerContext) AccountTraffic(c *CountingConn, tally *TrafficTally) {
+	var signature, name string
+	if certs := ctx.C.ConnectionState().PeerCertificates; len(certs) > 0 {
+		signature = GetSignature(certs[0])
+		name, _ = ctx.Config.GetSignatureName(signature)
+	}
+	ctx.Log.Printf("Transferred %d bytes received, %d bytes sent", c.Received(), c.Sent())
+	if err := tally.Add(signature, name, c.Received(), c.Sent()); err != nil {
+		ctx.Log.Printf("Failed to save the traffic tally: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCountingConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	counted := &CountingConn{Conn: a}
+	go func() {
+		b.Write([]byte("hello"))
+		io.Copy(ioutil.Discard, b)
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(counted, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := counted.Write([]byte("hi there")); err != nil {
+		t.Fatal(err)
+	}
+	if counted.Received() != 5 || counted.Sent() != 8 {
+		t.Errorf("counted %d received and %d sent, want 5 and 8", counted.Received(), counted.Sent())
+	}
+}
+
+func TestTrafficTally(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "traffic.json")
+	tally, err := LoadTrafficTally(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tally.Add("sigA", "alice", 100, 10)
+	tally.Add("sigB", "", 500, 50)
+	tally.Add("sigA", "", 200, 20)
+	// Most received first.
+	want := []Traffic{
+		{Signature: "sigB", Connections: 1, Received: 500, Sent: 50},
+		{Signature: "sigA", Name: "alice", Connections: 2, Received: 300, Sent: 30},
+	}
+	if got := tally.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %+v, want %+v", got, want)
+	}
+
+	// Kept across restarts.
+	again, err := LoadTrafficTally(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := again.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reloading List = %+v, want %+v", got, want)
+	}
+
+	var nothing *TrafficTally
+	if err := nothing.Add("sigA", "alice", 1, 1); err != nil || nothing.List() != nil {
+		t.Error("a nil tally recorded something")
+	}
+	writeFiles(t, filepath.Dir(fn), map[string]string{"traffic.json": "{"})
+	if _, err := LoadTrafficTally(fn); err == nil {
+		t.Error("a corrupt tally loaded")
+	}
+}
+
+func TestAccountTraffic(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	tally, _ := LoadTrafficTally("")
+	client, server := net.Pipe()
+	defer client.Close()
+	counted, clientCounted := &CountingConn{Conn: server}, &CountingConn{Conn: client}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		ctx := ServerContext{C: tls.Server(counted, d.serverConf), Config: d.Config, Log: log.New(ioutil.Discard, "", 0)}
+		HandleServerConn(ctx)
+		ctx.AccountTraffic(counted, tally)
+	}()
+	if _, err := HandleClientConnPing(tls.Client(clientCounted, d.client)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	xs := tally.List()
+	if len(xs) != 1 || xs[0].Name != "tester" || xs[0].Connections != 1 {
+		t.Fatalf("tallied %+v, want a connection of tester", xs)
+	}
+	// TLS included, what one end sent the other received.
+	if xs[0].Received != clientCounted.Sent() || xs[0].Sent != clientCounted.Received() || xs[0].Received == 0 {
+		t.Errorf("tallied %d received and %d sent, the client sent %d and received %d", xs[0].Received, xs[0].Sent, clientCounted.Sent(), clientCounted.Received())
+	}
+}
+
+func TestControlTraffic(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control socket is a unix socket")
+	}
+	fn := filepath.Join(t.TempDir(), "control.sock")
+	l, err := ListenControl(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tally, _ := LoadTrafficTally("")
+	tally.Add("sigA", "alice", 100, 10)
+	go ServeControl(l, &DrainState{}, tally, log.New(&bytes.Buffer{}, "", 0))
+	got, err := SendControl(fn, ControlTraffic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	WriteTraffic(&want, tally.List())
+	if got != strings.TrimSpace(want.String()) || !strings.Contains(got, "alice") {
+		t.Errorf("the traffic reply is %q, want %q", got, want.String())
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Reports whether a rename failing with err may succeed when tried again, such
+// as one refused because the filesystem is busy. Errors like ENOSPC or EACCES
+// are permanent.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
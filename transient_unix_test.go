@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EBUSY}, true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EAGAIN}, true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EINTR}, true},
+		{fmt.Errorf("backup: %w", syscall.EBUSY), true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOSPC}, false},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EACCES}, false},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV}, false},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOENT}, false},
+		{errors.New("device or resource busy"), false},
+		{nil, false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
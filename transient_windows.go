@@ -0,0 +1,7 @@
+package main
+
+// Windows reports a busy file as in use, see isFileInUse, nothing else is
+// worth retrying.
+func isTransient(err error) bool {
+	return false
+}
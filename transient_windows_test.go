@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, err := range []error{
+		&os.LinkError{Op: "rename", Old: "a", New: "b", Err: errorSharingViolation},
+		&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ERROR_ACCESS_DENIED},
+		nil,
+	} {
+		if isTransient(err) {
+			t.Errorf("isTransient(%v) is true on windows", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The umask is the process's, this keeps two callers from restoring each other's.
+var umaskMu sync.Mutex
+
+// Runs f with the umask set to mask, restoring the previous one after.
+func withUmask(mask os.FileMode, f func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(mask))
+	defer syscall.Umask(old)
+	return f()
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// Windows has no umask, the permissions of a unix socket are set after.
+func withUmask(mask os.FileMode, f func() error) error {
+	return f()
+}
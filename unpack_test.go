@@ -0,0 +1,726 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// An entry for tarOf, a regular file unless Typeflag says otherwise.
+type tarEntry struct {
+	Name     string
+	Body     string
+	Typeflag byte
+	Linkname string
+	Mode     int64
+}
+
+// Writes the entries to a tar and returns a reader over it.
+func tarOf(t *testing.T, entries ...tarEntry) *tar.Reader {
+	t.Helper()
+	return tar.NewReader(bytes.NewReader(tarBytes(t, entries...)))
+}
+
+// Writes the entries to a tar.
+func tarBytes(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.Name, Typeflag: e.Typeflag, Linkname: e.Linkname, Mode: e.Mode}
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+			if h.Typeflag == tar.TypeDir {
+				h.Mode = 0755
+			}
+		}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(e.Body))
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Fails the test when a temporary directory of the deploy ID is left behind.
+func requireNoTempDir(t *testing.T, id string) {
+	t.Helper()
+	leftover, err := filepath.Glob(filepath.Join(os.TempDir(), TempPattern(id)+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftover) > 0 {
+		t.Errorf("left behind %v", leftover)
+	}
+}
+
+func TestUnpackTarMaxEntries(t *testing.T) {
+	entries := []tarEntry{
+		{Name: "app", Typeflag: tar.TypeDir},
+		{Name: "app/a", Body: "a"},
+		{Name: "app/b", Body: "b"},
+		{Name: "app/c", Body: "c"},
+	}
+	id := NewDeployID()
+	dir, err := UnpackTar(tarOf(t, entries...), UnpackOptions{MaxEntries: 3, DeployID: id})
+	if err != ErrTooManyEntries {
+		t.Errorf("got %v, want ErrTooManyEntries", err)
+	}
+	if dir != "" {
+		t.Errorf("returned the directory %s", dir)
+	}
+	requireNoTempDir(t, id)
+
+	dir, err = UnpackTar(tarOf(t, entries...), UnpackOptions{MaxEntries: len(entries)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+}
+
+func TestIsAllowedEntry(t *testing.T) {
+	allow, deny := []string{"*.go", "config/*.ini"}, []string{"*.env", "secret"}
+	tests := []struct {
+		name string
+		dir  bool
+		want bool
+	}{
+		{"app/main.go", false, true},
+		{"app/pkg/lib.go", false, true},
+		{"app/config/app.ini", false, true},
+		// The path is below the item sent, the pattern isn't rooted there.
+		{"app/other/app.ini", false, false},
+		{"app/README", false, false},
+		// Directories only need to pass DenyFiles.
+		{"app/pkg", true, true},
+		{"app/secret", true, false},
+		{"app/.env", false, false},
+		{"app/config/prod.env", false, false},
+		{"./app/../app/main.go", false, true},
+	}
+	for _, tt := range tests {
+		if got := IsAllowedEntry(tt.name, tt.dir, allow, deny); got != tt.want {
+			t.Errorf("IsAllowedEntry(%s, %v) = %v, want %v", tt.name, tt.dir, got, tt.want)
+		}
+	}
+	if !IsAllowedEntry("app/anything", false, nil, nil) {
+		t.Error("without patterns an entry was refused")
+	}
+	if !IsAllowedEntry("app/README", false, nil, deny) || IsAllowedEntry("app/.env", false, nil, deny) {
+		t.Error("DenyFiles alone refuses the wrong entries")
+	}
+}
+
+func TestUnpackTarDisallowedEntry(t *testing.T) {
+	id := NewDeployID()
+	_, err := UnpackTar(tarOf(t,
+		tarEntry{Name: "app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/main.go", Body: "package main"},
+		tarEntry{Name: "app/.env", Body: "TOKEN=x"},
+	), UnpackOptions{DeployID: id, DenyFiles: []string{"*.env"}})
+	var disallowed *DisallowedEntryError
+	if !errors.As(err, &disallowed) || disallowed.Name != "app/.env" || !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got %v, want app/.env disallowed", err)
+	}
+	requireNoTempDir(t, id)
+}
+
+func TestDeployDisallowedEntry(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].AllowFiles = []string{"*.go"}
+		c.Targets[0].DenyFiles = []string{"*_test.go"}
+	})
+	files := map[string]string{"main.go": "package main", "pkg/lib.go": "package pkg"}
+	if err := d.Deploy(t, files); err != nil {
+		t.Fatal(err)
+	}
+	for _, extra := range []string{"README", "pkg/lib_test.go"} {
+		files[extra] = "x"
+		err := d.Deploy(t, files)
+		delete(files, extra)
+		var rse *RemoteStatusError
+		if !errors.As(err, &rse) || !strings.Contains(rse.Message, "app/"+extra+" which target app does not allow") {
+			t.Errorf("deploying %s gave %v", extra, err)
+		}
+		if _, err := os.Stat(filepath.Join(d.Target().Filename, extra)); !os.IsNotExist(err) {
+			t.Errorf("%s was deployed: %v", extra, err)
+		}
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"wrap/app/version", 0, "wrap/app/version"},
+		{"wrap/app/version", 1, "app/version"},
+		{"a/b/wrap/app/version", 3, "app/version"},
+		{"./wrap/app/", 1, "app"},
+		{"wrap//app/version", 1, "app/version"},
+		// Nothing left.
+		{"wrap", 1, ""},
+		{"wrap/", 1, ""},
+		{"wrap/app", 2, ""},
+		{"wrap/app", 5, ""},
+		// Can't climb out.
+		{"wrap/../../etc/passwd", 1, "passwd"},
+	}
+	for _, tt := range tests {
+		if got := StripComponents(tt.name, tt.n); got != tt.want {
+			t.Errorf("StripComponents(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestUnpackTarStripComponents(t *testing.T) {
+	dir, err := UnpackTar(tarOf(t,
+		tarEntry{Name: "wrap", Typeflag: tar.TypeDir},
+		tarEntry{Name: "wrap/app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "wrap/app/version", Body: "1"},
+		tarEntry{Name: "wrap/app/copy", Typeflag: tar.TypeLink, Linkname: "wrap/app/version"},
+	), UnpackOptions{StripComponents: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"version", "copy"} {
+		if got := readFile(t, filepath.Join(dir, "app", name)); got != "1" {
+			t.Errorf("app/%s holds %q", name, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wrap")); !os.IsNotExist(err) {
+		t.Errorf("the wrapping directory was unpacked: %v", err)
+	}
+
+	// The stripped name is what AllowFiles & DenyFiles see.
+	dir, err = UnpackTar(tarOf(t,
+		tarEntry{Name: "wrap/app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "wrap/app/.env", Body: "x"},
+	), UnpackOptions{StripComponents: 1, DenyFiles: []string{"wrap"}})
+	if err != nil {
+		t.Errorf("DenyFiles matched the stripped directory: %v", err)
+	}
+	os.RemoveAll(dir)
+
+	id := NewDeployID()
+	_, err = UnpackTar(tarOf(t,
+		tarEntry{Name: "wrap/version", Body: "1"},
+		tarEntry{Name: "wrap/app/copy", Typeflag: tar.TypeLink, Linkname: "wrap"},
+	), UnpackOptions{StripComponents: 1, DeployID: id})
+	if err != ErrInvalidPayload {
+		t.Errorf("a hardlink to a stripped entry gave %v, want ErrInvalidPayload", err)
+	}
+	requireNoTempDir(t, id)
+}
+
+func TestDeployStripComponents(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.Targets[0].StripComponents = 1 })
+	if err := d.Deploy(t, map[string]string{"app/version": "1", "app/conf/app.ini": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "conf", "app.ini")); got != "x" {
+		t.Errorf("conf/app.ini holds %q", got)
+	}
+}
+
+func TestIsLocalEntryName(t *testing.T) {
+	tests := map[string]bool{
+		"app":                true,
+		"app/conf/app.ini":   true,
+		"./app":              true,
+		"app/../app/version": true,
+		"app/..version":      true,
+		"/etc/passwd":        false,
+		"..":                 false,
+		"../app":             false,
+		"app/../../etc":      false,
+		"C:/Windows":         false,
+		"c:app":              false,
+		`..\app`:             false,
+		`app\..\..\etc`:      false,
+		`\\server\share`:     false,
+	}
+	for name, want := range tests {
+		if got := IsLocalEntryName(name); got != want {
+			t.Errorf("IsLocalEntryName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestUnpackTarEscapingNames(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "escaped")
+	names := []string{outside, "../escaped", "app/../../escaped", `..\escaped`, "C:/escaped"}
+	for _, name := range names {
+		for _, link := range []bool{false, true} {
+			entries := []tarEntry{{Name: "app", Typeflag: tar.TypeDir}, {Name: name, Body: "x"}}
+			if link {
+				// A hardlink pointing outside is refused the same way.
+				entries[1] = tarEntry{Name: "app/link", Typeflag: tar.TypeLink, Linkname: name}
+			}
+			id := NewDeployID()
+			if dir, err := UnpackTar(tarOf(t, entries...), UnpackOptions{DeployID: id}); err != ErrInvalidPayload {
+				os.RemoveAll(dir)
+				t.Errorf("unpacking %q, link %v, gave %v, want ErrInvalidPayload", name, link, err)
+			}
+			requireNoTempDir(t, id)
+		}
+	}
+	for _, fp := range []string{outside, filepath.Join(os.TempDir(), "escaped")} {
+		if _, err := os.Stat(fp); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", fp, err)
+		}
+	}
+}
+
+func TestDeployEscapingName(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	payload := tarBytes(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}, tarEntry{Name: "app/../../escaped", Body: "x"})
+	_, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, bytes.NewReader(payload))
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "invalid entry") {
+		t.Errorf("deploying an escaping name gave %v", err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Errorf("the target was created: %v", err)
+	}
+}
+
+func TestPrepareTargetCompression(t *testing.T) {
+	payload := tarBytes(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}, tarEntry{Name: "app/version", Body: "1"})
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(payload)
+	gz.Close()
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+	}{{"plain", payload}, {"gzipped", gzipped.Bytes()}} {
+		// Either unpacks whatever the client claimed.
+		for _, claim := range []string{"", CompressionGzip} {
+			dir, err := PrepareTarget(bytes.NewReader(tt.payload), UnpackOptions{Compression: claim})
+			if err != nil {
+				t.Errorf("%s claimed %q: %v", tt.name, claim, err)
+				continue
+			}
+			if got := readFile(t, filepath.Join(dir, "app", "version")); got != "1" {
+				t.Errorf("%s claimed %q: version holds %q", tt.name, claim, got)
+			}
+			os.RemoveAll(dir)
+		}
+	}
+	// Too short to tell, the claim decides and neither is an archive.
+	for _, claim := range []string{"", CompressionGzip} {
+		if dir, err := PrepareTarget(bytes.NewReader([]byte{0x1f}), UnpackOptions{Compression: claim}); err != ErrNotArchive {
+			os.RemoveAll(dir)
+			t.Errorf("a single byte claimed %q gave %v, want ErrNotArchive", claim, err)
+		}
+	}
+}
+
+func TestIsGzip(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want bool
+	}{
+		{[]byte{0x1f, 0x8b, 0x08}, true},
+		{[]byte{0x1f, 0x8b}, true},
+		{[]byte{0x1f}, false},
+		{[]byte("app/"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsGzip(tt.b); got != tt.want {
+			t.Errorf("IsGzip(%x) = %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDeployUndeclaredCompression(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+	var payload, gzipped bytes.Buffer
+	if err := PackTar(d.Src, &payload, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(payload.Bytes())
+	gz.Close()
+	// Gzipped without saying so, then claimed gzipped but plain.
+	if _, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID()}, &gzipped); err != nil {
+		t.Errorf("an undeclared gzipped payload: %v", err)
+	}
+	if _, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: NewDeployID(), Compression: CompressionGzip}, &payload); err != nil {
+		t.Errorf("a plain payload claimed gzipped: %v", err)
+	}
+	if got := readFile(t, filepath.Join(d.Target().Filename, "version")); got != "1" {
+		t.Errorf("version holds %q", got)
+	}
+}
+
+func TestDeployMaxEntries(t *testing.T) {
+	d := newTestDaemon(t, func(c *Config) { c.MaxEntries = 2 })
+	err := d.Deploy(t, map[string]string{"a": "a", "b": "b", "c": "c"})
+	if err == nil {
+		t.Fatal("deployed a payload over MaxEntries")
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Errorf("the target was created: %v", err)
+	}
+	if err := d.Deploy(t, map[string]string{"a": "a"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the string then fails, like a connection dropping part way.
+func brokenReader(s string) io.Reader {
+	return io.MultiReader(strings.NewReader(s), iotest.ErrReader(errors.New("connection reset")))
+}
+
+func TestWriteFileAtomicInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "app.ini")
+	writeFiles(t, dir, map[string]string{"app.ini": "original"})
+
+	err := WriteFile(fn, 0644, brokenReader("partial"), UnpackOptions{AtomicWrites: true})
+	if err == nil {
+		t.Fatal("an interrupted write succeeded")
+	}
+	if got := readFile(t, fn); got != "original" {
+		t.Errorf("the file holds %q after an interrupted atomic write", got)
+	}
+	if xs, _ := ioutil.ReadDir(dir); len(xs) != 1 {
+		t.Errorf("left %d files behind", len(xs))
+	}
+
+	// Without AtomicWrites the file is cut short.
+	if err := WriteFile(fn, 0644, brokenReader("partial"), UnpackOptions{}); err == nil {
+		t.Fatal("an interrupted write succeeded")
+	}
+	if got := readFile(t, fn); got != "partial" {
+		t.Errorf("the file holds %q after an interrupted write", got)
+	}
+
+	if err := WriteFile(fn, 0600, strings.NewReader("complete"), UnpackOptions{AtomicWrites: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fn); got != "complete" {
+		t.Errorf("the file holds %q", got)
+	}
+	if stat, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && stat.Mode().Perm() != 0600 {
+		t.Errorf("the file has mode %s", stat.Mode())
+	}
+}
+
+func TestWriteFileDurable(t *testing.T) {
+	dir := t.TempDir()
+	for _, atomic := range []bool{false, true} {
+		fn := filepath.Join(dir, "app.ini")
+		opts := UnpackOptions{AtomicWrites: atomic, Durable: true}
+		if err := WriteFile(fn, 0644, strings.NewReader("synced"), opts); err != nil {
+			t.Fatalf("atomic %v: %v", atomic, err)
+		}
+		if got := readFile(t, fn); got != "synced" {
+			t.Errorf("atomic %v: the file holds %q", atomic, got)
+		}
+		if err := WriteFile(fn, 0644, brokenReader("partial"), opts); err == nil {
+			t.Errorf("atomic %v: an interrupted write succeeded", atomic)
+		}
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := SyncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncDir(filepath.Join(dir, "missing")); runtime.GOOS != "windows" && err == nil {
+		t.Error("synced a directory that doesn't exist")
+	}
+}
+
+func TestDeployDurable(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		config, target bool
+	}{
+		{"off", false, false},
+		{"config", true, false},
+		{"target", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDaemon(t, func(c *Config) {
+				c.Durable = tc.config
+				c.Targets[0].Durable = tc.target
+			})
+			ctx := ServerContext{Config: d.Config}
+			if got, want := ctx.UnpackOptions(d.Target(), "").Durable, tc.config || tc.target; got != want {
+				t.Errorf("Durable is %v, want %v", got, want)
+			}
+			if err := d.Deploy(t, map[string]string{"app.ini": "durable"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, filepath.Join(d.Target().Filename, "app.ini")); got != "durable" {
+				t.Errorf("deployed %q", got)
+			}
+		})
+	}
+}
+
+func TestTempPattern(t *testing.T) {
+	tests := []struct{ id, want string }{
+		{"", "deployctl-"},
+		{"20260101-abc_DEF", "deployctl-20260101-abc_DEF-"},
+		{"../../etc/passwd", "deployctl-etcpasswd-"},
+		{"../..", "deployctl-"},
+		{strings.Repeat("a", 40), "deployctl-" + strings.Repeat("a", 32) + "-"},
+	}
+	for _, tt := range tests {
+		if got := TempPattern(tt.id); got != tt.want {
+			t.Errorf("TempPattern(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	id := NewDeployID()
+	dir, err := UnpackTar(tarOf(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}), UnpackOptions{DeployID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if !strings.HasPrefix(filepath.Base(dir), TempPattern(id)) {
+		t.Errorf("unpacked into %s, want the deploy ID %s in its name", dir, id)
+	}
+}
+
+func TestDeployTempNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the script is a shell script")
+	}
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	d := newTestDaemon(t, nil)
+	listing := filepath.Join(t.TempDir(), "listing")
+	script := filepath.Join(t.TempDir(), "before.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nls \"$TMPDIR\" > "+listing+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.Target().Before = script
+	writeFiles(t, d.Src, map[string]string{"version": "1"})
+
+	id := NewDeployID()
+	if _, err := HandleClientConn(d.Dial(t), DeployRequest{Target: "app", ID: id}, d.Src, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// While Before runs both the payload and the unpacked directory exist.
+	names := SplitLines(readFile(t, listing))
+	var payload bool
+	for _, name := range names {
+		if !strings.HasPrefix(name, TempPattern(id)) {
+			t.Errorf("the temporary %s doesn't name the deploy %s", name, id)
+		}
+		payload = payload || strings.HasPrefix(name, TempPattern(id)+"payload-")
+	}
+	if len(names) < 2 || !payload {
+		t.Errorf("found %v in the temporary directory, want the payload and unpacked files", names)
+	}
+}
+
+func TestHeaderWriter(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(tarBytes(t, tarEntry{Name: "app", Typeflag: tar.TypeDir}))
+	zw.Close()
+	tests := []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"tar", tarBytes(t, tarEntry{Name: "app/version", Body: "1"}), true},
+		{"gzip", gz.Bytes(), true},
+		{"empty tar", tarBytes(t), true},
+		{"short", []byte("junk"), true},
+		{"junk", bytes.Repeat([]byte("junk"), 1024), false},
+	}
+	for _, tt := range tests {
+		// Written a few bytes at a time like a slow stream.
+		var out bytes.Buffer
+		w := &headerWriter{w: &out}
+		var err error
+		for b := tt.payload; len(b) > 0 && err == nil; {
+			n := 100
+			if n > len(b) {
+				n = len(b)
+			}
+			_, err = w.Write(b[:n])
+			b = b[n:]
+		}
+		if tt.ok && (err != nil || !bytes.Equal(out.Bytes(), tt.payload)) {
+			t.Errorf("%s: wrote %d of %d bytes: %v", tt.name, out.Len(), len(tt.payload), err)
+		} else if !tt.ok && (err != ErrNotArchive || out.Len() >= 512) {
+			t.Errorf("%s: got %v after %d bytes, want ErrNotArchive within the first block", tt.name, err, out.Len())
+		}
+	}
+}
+
+func TestDeployJunk(t *testing.T) {
+	d := newTestDaemon(t, nil)
+	id := NewDeployID()
+	junk := bytes.NewReader(bytes.Repeat([]byte("junk"), 16<<10))
+	_, err := HandleClientConnRaw(d.Dial(t), DeployRequest{Target: "app", ID: id}, junk)
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || !strings.Contains(rse.Message, "not a valid archive") {
+		t.Errorf("got %v, want the payload refused as not an archive", err)
+	}
+	if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+		t.Errorf("the target was created: %v", err)
+	}
+	requireNoTempDir(t, id)
+}
+
+func TestDeployDamagedPayloads(t *testing.T) {
+	payload := tarBytes(t,
+		tarEntry{Name: "app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/a", Body: strings.Repeat("a", 2048)},
+		tarEntry{Name: "app/b", Body: "b"},
+	)
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return buf.Bytes()
+	}
+	// The header of app/b follows those of app and app/a and the four blocks of a.
+	corrupt := append([]byte(nil), payload...)
+	corrupt[6*512+10] ^= 0xff
+	badSum := gzipped(payload)
+	badSum[len(badSum)-8] ^= 0xff
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		compression string
+		want        string
+	}{
+		{"truncated tar", payload[:1500], "", "The payload is truncated"},
+		{"truncated gzip", gzipped(payload)[:100], CompressionGzip, "The payload is truncated"},
+		{"bad checksum", badSum, CompressionGzip, "failed its gzip checksum"},
+		{"corrupt header", corrupt, "", "corrupt archive header"},
+	}
+	for _, keep := range []bool{false, true} {
+		d := newTestDaemon(t, func(c *Config) { c.KeepFailedPayloads = keep })
+		for _, tt := range tests {
+			id := NewDeployID()
+			req := DeployRequest{Target: "app", ID: id, Compression: tt.compression}
+			_, err := HandleClientConnRaw(d.Dial(t), req, bytes.NewReader(tt.payload))
+			var rse *RemoteStatusError
+			if !errors.As(err, &rse) || !strings.Contains(rse.Message, tt.want) {
+				t.Errorf("%s: got %v, want a reply containing %q", tt.name, err, tt.want)
+			}
+			if _, err := os.Stat(d.Target().Filename); !os.IsNotExist(err) {
+				t.Errorf("%s: the target was created: %v", tt.name, err)
+			}
+			kept, err := filepath.Glob(filepath.Join(os.TempDir(), TempPattern(id)+"payload-*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep && len(kept) != 1 {
+				t.Errorf("%s: KeepFailedPayloads kept %v", tt.name, kept)
+			} else if !keep {
+				requireNoTempDir(t, id)
+			}
+			for _, v := range kept {
+				os.Remove(v)
+			}
+		}
+	}
+}
+
+func TestUnpackStats(t *testing.T) {
+	payload := tarBytes(t,
+		tarEntry{Name: "app", Typeflag: tar.TypeDir},
+		tarEntry{Name: "app/a", Body: "hello"},
+		tarEntry{Name: "app/b", Body: "world!"},
+		tarEntry{Name: "app/c", Typeflag: tar.TypeLink, Linkname: "app/a"},
+		tarEntry{Name: "app/d", Typeflag: tar.TypeSymlink, Linkname: "a"},
+	)
+	var stats UnpackStats
+	dir, err := UnpackTar(tar.NewReader(bytes.NewReader(payload)), UnpackOptions{Stats: &stats})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	// The hardlink counts as a file but its bytes are those of app/a.
+	if stats.Files != 3 || stats.Bytes != 11 {
+		t.Errorf("got %+v, want 3 files and 11 bytes", stats)
+	}
+
+	f, err := ioutil.TempFile(t.TempDir(), "payload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ctx := ServerContext{Config: &Config{}, Log: log.New(&out, "", 0)}
+	dir, err = ctx.UnpackPayload(&Target{Name: "app"}, DeployRequest{ID: NewDeployID()}, f, int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	if want := fmt.Sprintf("Received app: %d bytes, 3 files, 11 bytes unpacked", len(payload)); !strings.Contains(out.String(), want) {
+		t.Errorf("logged %q, want %q", out.String(), want)
+	}
+
+	// Compressed payloads also log the ratio.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(payload)
+	zw.Close()
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(gz.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	req := DeployRequest{ID: NewDeployID(), Compression: CompressionGzip}
+	dir, err = ctx.UnpackPayload(&Target{Name: "app"}, req, f, int64(gz.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	if want := fmt.Sprintf("Received app: %d bytes %s, 3 files, 11 bytes unpacked, ratio", gz.Len(), CompressionGzip); !strings.Contains(out.String(), want) {
+		t.Errorf("logged %q, want %q", out.String(), want)
+	}
+}
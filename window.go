@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A recurring period of the week during which a target may be deployed, parsed
+// from strings such as "Mon-Fri 09:00-17:00", "Sat,Sun 10:00-12:00" or
+// "22:00-02:00" for every day. Ranges ending before they start cross midnight.
+// Times are in the daemon's local time zone.
+type Window struct {
+	Days       [7]bool
+	Start, End time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func ParseWindow(str string) (Window, error) {
+	var w Window
+	fields := strings.Fields(str)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		hours = fields[0]
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("invalid deploy window '%s'", str)
+	}
+
+	for _, part := range strings.Split(days, ",") {
+		if part == "" {
+			continue
+		}
+		xs := strings.SplitN(strings.ToLower(part), "-", 2)
+		from, ok := weekdays[xs[0]]
+		if !ok {
+			return w, fmt.Errorf("invalid day '%s' in deploy window '%s'", xs[0], str)
+		}
+		to := from
+		if len(xs) == 2 {
+			if to, ok = weekdays[xs[1]]; !ok {
+				return w, fmt.Errorf("invalid day '%s' in deploy window '%s'", xs[1], str)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	xs := strings.SplitN(hours, "-", 2)
+	if len(xs) != 2 {
+		return w, fmt.Errorf("invalid time range '%s' in deploy window '%s'", hours, str)
+	}
+	var err error
+	if w.Start, err = parseClock(xs[0]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(xs[1]); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func parseClock(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", str)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Reports whether t falls inside the window. A window crossing midnight belongs
+// to the day it starts on.
+func (w Window) Contains(t time.Time) bool {
+	day := midnight(t)
+	offset := t.Sub(day)
+	if w.Start <= w.End {
+		return w.Days[t.Weekday()] && offset >= w.Start && offset < w.End
+	}
+	if w.Days[t.Weekday()] && offset >= w.Start {
+		return true
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return w.Days[yesterday] && offset < w.End
+}
+
+// Reports whether t is inside any window and, when it is not, when the next
+// window opens. No windows means always open.
+func InDeployWindow(windows []Window, t time.Time) (bool, time.Time) {
+	if len(windows) == 0 {
+		return true, t
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true, t
+		}
+	}
+	var next time.Time
+	for i := 0; i <= 7; i++ {
+		day := midnight(t).AddDate(0, 0, i)
+		for _, w := range windows {
+			start := day.Add(w.Start)
+			if w.Days[day.Weekday()] && start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			break
+		}
+	}
+	return false, next
+}
+
+// Parses all the deploy windows of the target.
+func (t *Target) Windows() ([]Window, error) {
+	var windows []Window
+	for _, v := range t.DeployWindows {
+		w, err := ParseWindow(v)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustWindow(t *testing.T, str string) Window {
+	t.Helper()
+	w, err := ParseWindow(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestParseWindowInvalid(t *testing.T) {
+	for _, str := range []string{"", "Mon", "Mon 09:00", "Funday 09:00-17:00", "Mon-Fri 9am-5pm", "Mon 25:00-26:00", "a b c"} {
+		if _, err := ParseWindow(str); err == nil {
+			t.Errorf("parsed %q", str)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2026-10-12 is a Monday.
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 10, 12+day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"Mon-Fri 09:00-17:00", at(0, "09:00"), true},
+		{"Mon-Fri 09:00-17:00", at(4, "16:59"), true},
+		{"Mon-Fri 09:00-17:00", at(0, "17:00"), false},
+		{"Mon-Fri 09:00-17:00", at(0, "08:59"), false},
+		{"Mon-Fri 09:00-17:00", at(5, "12:00"), false},
+		{"Sat,Sun 10:00-12:00", at(6, "11:00"), true},
+		{"Sat,Sun 10:00-12:00", at(2, "11:00"), false},
+		// Wrapping around the week.
+		{"Fri-Mon 10:00-12:00", at(0, "11:00"), true},
+		{"Fri-Mon 10:00-12:00", at(1, "11:00"), false},
+		// Crossing midnight belongs to the day it starts.
+		{"Fri 22:00-02:00", at(4, "23:00"), true},
+		{"Fri 22:00-02:00", at(5, "01:59"), true},
+		{"Fri 22:00-02:00", at(5, "02:00"), false},
+		{"Fri 22:00-02:00", at(4, "01:00"), false},
+		{"22:00-02:00", at(2, "00:30"), true},
+	}
+	for _, tt := range tests {
+		if got := mustWindow(t, tt.window).Contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.window, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestInDeployWindow(t *testing.T) {
+	// A Saturday noon.
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	if ok, _ := InDeployWindow(nil, now); !ok {
+		t.Error("no windows is closed")
+	}
+	windows := []Window{mustWindow(t, "Mon-Fri 09:00-17:00"), mustWindow(t, "Sun 20:00-21:00")}
+	ok, next := InDeployWindow(windows, now)
+	if ok {
+		t.Fatal("open on a Saturday")
+	}
+	if want := time.Date(2026, 10, 18, 20, 0, 0, 0, time.Local); !next.Equal(want) {
+		t.Errorf("next window opens %s, want %s", next, want)
+	}
+	if ok, _ := InDeployWindow(windows, now.AddDate(0, 0, 2)); !ok {
+		t.Error("closed on a Monday noon")
+	}
+}
+
+func TestDeployOutsideWindow(t *testing.T) {
+	// Only tomorrow, so not now.
+	tomorrow := strings.ToLower(time.Now().AddDate(0, 0, 1).Weekday().String()[:3])
+	d := newTestDaemon(t, func(c *Config) {
+		c.Targets[0].DeployWindows = []string{tomorrow + " 00:00-23:59"}
+	})
+	err := d.Deploy(t, map[string]string{"version": "1"})
+	var rse *RemoteStatusError
+	if !errors.As(err, &rse) || rse.Code != StatusBlocked || !strings.Contains(rse.Message, "the next opens") {
+		t.Fatalf("deploying outside the window gave %v", err)
+	}
+
+	req := DeployRequest{Target: "app", ID: NewDeployID(), OverrideWindow: true}
+	if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{}); !errors.As(err, &rse) || rse.Code != StatusBlocked {
+		t.Errorf("an override without AllowWindowOverride gave %v", err)
+	}
+	d.Target().AllowWindowOverride = true
+	if _, err := HandleClientConn(d.Dial(t), req, d.Src, PackOptions{}); err != nil {
+		t.Errorf("an allowed override: %v", err)
+	}
+
+	// Both halves of every day.
+	d.Target().DeployWindows = []string{"00:00-12:00", "12:00-00:00"}
+	if err := d.Deploy(t, map[string]string{"version": "2"}); err != nil {
+		t.Errorf("deploying inside the window: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// The PAX record prefix used for extended attributes, as written by GNU tar.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Reads the extended attributes of p as PAX records. Filesystems without
+// xattr support yield none.
+func readXattrs(p string) (map[string]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Listxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name == "" {
+			continue
+		}
+		size, err := syscall.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, size)
+		n, err := syscall.Getxattr(p, name, val)
+		if err != nil {
+			return nil, err
+		}
+		records[paxXattrPrefix+name] = string(val[:n])
+	}
+	return records, nil
+}
+
+// Applies the extended attributes found in the PAX records to p.
+func writeXattrs(p string, records map[string]string) error {
+	for k, v := range records {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		if err := syscall.Setxattr(p, strings.TrimPrefix(k, paxXattrPrefix), []byte(v), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Skips the test when the filesystem holding dir has no user xattrs.
+func requireXattrs(t *testing.T, dir string) {
+	t.Helper()
+	if err := syscall.Setxattr(dir, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("no user xattrs in %s: %v", dir, err)
+	}
+}
+
+func TestXattrsRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	writeFiles(t, dir, map[string]string{"file": "content"})
+	requireXattrs(t, dir)
+	if err := syscall.Setxattr(filepath.Join(dir, "file"), "user.label", []byte("kept"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := PackTar(dir, &buf, PackOptions{Xattrs: true}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := UnpackTar(tar.NewReader(&buf), UnpackOptions{Xattrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	records, err := readXattrs(filepath.Join(out, "app", "file"))
+	if err != nil {
+		t.Fatal(err)
+	} else if records[paxXattrPrefix+"user.label"] != "kept" {
+		t.Fatalf("unpacked file has xattrs %v", records)
+	}
+}
+
+// A tar holding a single old GNU sparse entry named name, with data at its start,
+// preceded by PAX records. Go's tar writer doesn't write sparse entries, so the
+// header is patched in place.
+func gnuSparseTar(t *testing.T, name string, data []byte, size int64, records map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg, PAXRecords: records, Format: tar.FormatPAX}
+	if err := w.WriteHeader(h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// The PAX header and its records come first, the entry's header follows.
+	var off int
+	for off = tarBlockSize; off < len(b); off += tarBlockSize {
+		if string(b[off:off+len(name)]) == name {
+			break
+		}
+	}
+	hb := b[off : off+tarBlockSize]
+	hb[156] = tar.TypeGNUSparse
+	copy(hb[257:265], "ustar  \x00")
+	copy(hb[386:398], fmt.Sprintf("%011o\x00", 0))
+	copy(hb[398:410], fmt.Sprintf("%011o\x00", len(data)))
+	copy(hb[483:495], fmt.Sprintf("%011o\x00", size))
+	copy(hb[148:156], "        ")
+	var sum int64
+	for _, c := range hb {
+		sum += int64(c)
+	}
+	copy(hb[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+func TestXattrsGNUSparse(t *testing.T) {
+	dir := t.TempDir()
+	requireXattrs(t, dir)
+	b := gnuSparseTar(t, "sparse", []byte("head"), 64<<10, map[string]string{paxXattrPrefix + "user.label": "sparse"})
+	for _, sparse := range []bool{false, true} {
+		out, err := UnpackTar(tar.NewReader(bytes.NewReader(b)), UnpackOptions{Xattrs: true, Sparse: sparse})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(out)
+		fp := filepath.Join(out, "sparse")
+		if got := readFile(t, fp); len(got) != 64<<10 || got[:4] != "head" {
+			t.Fatalf("sparse file unpacked to %d bytes", len(got))
+		}
+		records, err := readXattrs(fp)
+		if err != nil {
+			t.Fatal(err)
+		} else if records[paxXattrPrefix+"user.label"] != "sparse" {
+			t.Errorf("sparse %v: unpacked file has xattrs %v", sparse, records)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Extended attributes are only preserved on linux.
+func readXattrs(p string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattrs(p string, records map[string]string) error {
+	return nil
+}